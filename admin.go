@@ -0,0 +1,110 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// buildAdminRouter creates the router for the admin API of srv, wrapped in
+// the admin binding's middleware.
+func buildAdminRouter(srv *Server, conf *Config) http.Handler {
+	rt := conf.Admin.newRouter(conf.StrictRouting)
+	rt.GET("/standby", adminGetStandby(srv))
+	rt.POST("/standby/promote", adminPromote(srv))
+	rt.GET("/log/level", adminGetLogLevel)
+	rt.PUT("/log/level", adminSetLogLevel)
+	rt.GET("/slo", adminGetSLOs(conf))
+	rt.GET("/slo/metrics", adminGetSLOMetrics(conf))
+	rt.GET("/databases/drains", adminGetDrains)
+	rt.GET("/databases/drains/metrics", adminGetDrainMetrics)
+	rt.GET("/deprecations", adminGetDeprecations(conf))
+	rt.GET("/deprecations/metrics", adminGetDeprecationMetrics(conf))
+	rt.GET("/datasets", adminGetDatasets(conf))
+	rt.GET("/sizes", adminGetSizes(conf))
+	rt.GET("/sizes/metrics", adminGetSizeMetrics(conf))
+	rt.GET("/config", adminGetConfig(conf))
+	rt.GET("/config/versions", adminGetConfigVersions(srv))
+	rt.GET("/config/versions/:id", adminGetConfigVersion(srv))
+	rt.POST("/config/versions/:id/rollback", adminRollbackConfig(srv))
+	rt.GET("/errors", adminGetRecentErrors)
+	rt.GET("/tap", adminTap)
+	rt.POST("/diagnostics", adminWriteDiagnostics(conf))
+	return conf.Admin.Middleware.Wrap(conf.Middleware, rt)
+}
+
+// adminGetConfig returns the loaded config with its secrets redacted.
+func adminGetConfig(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		data, err := redactJSON(conf, conf.StrictSecrets)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to encode config.")
+			writeError(log, w, http.StatusInternalServerError, &errorResponse{Error: "config cannot be returned"})
+			return
+		}
+		writeJSON(log, w, http.StatusOK, json.RawMessage(data))
+	}
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func adminGetLogLevel(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log := *zerolog.Ctx(req.Context())
+	writeJSON(log, w, http.StatusOK, &logLevelBody{
+		Level: zerolog.GlobalLevel().String(),
+	})
+}
+
+func adminSetLogLevel(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log := *zerolog.Ctx(req.Context())
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "error reading request body"})
+		return
+	}
+
+	var body logLevelBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "error parsing request body"})
+		return
+	}
+
+	level, err := zerolog.ParseLevel(body.Level)
+	if err != nil || body.Level == "" {
+		writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "invalid log level"})
+		return
+	}
+
+	prev := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(level)
+	log.Info().
+		Stringer("from", prev).
+		Stringer("to", level).
+		Msg("Log level changed.")
+
+	writeJSON(log, w, http.StatusOK, &logLevelBody{
+		Level: level.String(),
+	})
+}
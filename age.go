@@ -0,0 +1,132 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ageExt is the extension of age-encrypted config files, such as
+// config.yaml.age. The extension before it selects the config's format.
+const ageExt = ".age"
+
+// ageKeyEnv and ageKeyFileEnv hold the age identities used to decrypt
+// config files and age secrets, one AGE-SECRET-KEY-1 per line. Lines
+// beginning with # are ignored, as in files written by age-keygen.
+const (
+	ageKeyEnv     = "CHISEL_AGE_KEY"
+	ageKeyFileEnv = "CHISEL_AGE_KEY_FILE"
+)
+
+var errNoAgeIdentity = errors.New("no age identity matches the file's recipients")
+
+// configExt returns the extension selecting the format of the config file
+// at path, ignoring age and template extensions.
+func configExt(path string) string {
+	base, _ := splitConfigSuffix(path)
+	return filepath.Ext(base)
+}
+
+// readConfigData reads the file at path, decrypting it if it has an age
+// extension and then rendering it if it is a template.
+func readConfigData(path, profile string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfigData(path, profile, data)
+}
+
+// decodeConfigData decrypts and renders the data of the config file at path
+// as its extensions require.
+func decodeConfigData(path, profile string, data []byte) ([]byte, error) {
+	var err error
+	name := path
+	if strings.HasSuffix(name, ageExt) {
+		name = strings.TrimSuffix(name, ageExt)
+		if data, err = decryptAge(data); err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasSuffix(name, tmplExt) {
+		return renderConfigTemplate(name, profile, data)
+	}
+	return data, nil
+}
+
+// ageIdentities returns the age identities in the environment.
+func ageIdentities() ([]age.Identity, error) {
+	keys := os.Getenv(ageKeyEnv)
+	if file := os.Getenv(ageKeyFileEnv); file != "" {
+		p, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading age key file: %w", err)
+		}
+		keys += "\n" + string(p)
+	}
+	var ids []age.Identity
+	for _, line := range strings.Split(keys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := age.ParseX25519Identity(line)
+		if err != nil {
+			// Never include the error, since it may quote the key.
+			return nil, errors.New("malformed age identity")
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no age identities in $%s or $%s", ageKeyEnv, ageKeyFileEnv)
+	}
+	return ids, nil
+}
+
+// decryptAge decrypts an age file, armored or not, encrypted to one of the
+// X25519 identities in the environment. Passphrase and SSH recipients are
+// not supported.
+func decryptAge(data []byte) ([]byte, error) {
+	ids, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = bytes.NewReader(data)
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	r, err := age.Decrypt(src, ids...)
+	var nme *age.NoIdentityMatchError
+	if errors.As(err, &nme) {
+		return nil, errNoAgeIdentity
+	} else if err != nil {
+		return nil, fmt.Errorf("error decrypting age file: %w", err)
+	}
+	p, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting age file: %w", err)
+	}
+	return p, nil
+}
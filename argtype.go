@@ -0,0 +1,333 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgType is a SQL type hint for a query argument. Arguments with a type are
+// converted to a matching Go value before being bound to a query.
+type ArgType int
+
+const (
+	TextArgType      ArgType = iota // text
+	IntArgType                      // int
+	FloatArgType                    // float
+	NumericArgType                  // numeric
+	BoolArgType                     // bool
+	UUIDArgType                     // uuid
+	BytesArgType                    // bytea
+	TimestampArgType                // timestamptz
+	DateArgType                     // date
+	JSONArgType                     // json
+)
+
+var argTypeNames = map[string]ArgType{
+	"text":        TextArgType,
+	"string":      TextArgType,
+	"varchar":     TextArgType,
+	"int":         IntArgType,
+	"integer":     IntArgType,
+	"bigint":      IntArgType,
+	"smallint":    IntArgType,
+	"float":       FloatArgType,
+	"double":      FloatArgType,
+	"real":        FloatArgType,
+	"numeric":     NumericArgType,
+	"decimal":     NumericArgType,
+	"bool":        BoolArgType,
+	"boolean":     BoolArgType,
+	"uuid":        UUIDArgType,
+	"bytea":       BytesArgType,
+	"bytes":       BytesArgType,
+	"blob":        BytesArgType,
+	"timestamp":   TimestampArgType,
+	"timestamptz": TimestampArgType,
+	"datetime":    TimestampArgType,
+	"date":        DateArgType,
+	"json":        JSONArgType,
+	"jsonb":       JSONArgType,
+}
+
+func (t ArgType) String() string {
+	switch t {
+	case TextArgType:
+		return "text"
+	case IntArgType:
+		return "int"
+	case FloatArgType:
+		return "float"
+	case NumericArgType:
+		return "numeric"
+	case BoolArgType:
+		return "bool"
+	case UUIDArgType:
+		return "uuid"
+	case BytesArgType:
+		return "bytea"
+	case TimestampArgType:
+		return "timestamptz"
+	case DateArgType:
+		return "date"
+	case JSONArgType:
+		return "json"
+	default:
+		return "ArgType(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+func (t ArgType) MarshalText() ([]byte, error) {
+	if t < TextArgType || t > JSONArgType {
+		return nil, fmt.Errorf("unrecognized arg type %d", t)
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *ArgType) UnmarshalText(src []byte) error {
+	name := strings.ToLower(strings.TrimPrefix(string(src), "::"))
+	typ, ok := argTypeNames[name]
+	if !ok {
+		return fmt.Errorf("unrecognized arg type %q", src)
+	}
+	*t = typ
+	return nil
+}
+
+// Convert converts v to a value suitable for binding as t. Nil values are
+// always passed through as NULL, and lists are converted element-wise so
+// that they can still be expanded by IN (?) clauses.
+func (t ArgType) Convert(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if list, ok := v.([]interface{}); ok && t != JSONArgType {
+		conv := make([]interface{}, len(list))
+		for i, e := range list {
+			ce, err := t.Convert(e)
+			if err != nil {
+				return nil, fmt.Errorf("error converting element %d: %w", i, err)
+			}
+			conv[i] = ce
+		}
+		return conv, nil
+	}
+
+	switch t {
+	case TextArgType:
+		if s, ok := opaqueString(v); ok {
+			return s, nil
+		}
+	case IntArgType:
+		return convertInt(v)
+	case FloatArgType:
+		return convertFloat(v)
+	case NumericArgType:
+		return convertNumeric(v)
+	case BoolArgType:
+		return convertBool(v)
+	case UUIDArgType:
+		if s, ok := v.(string); ok {
+			return parseUUID(s)
+		}
+	case BytesArgType:
+		if s, ok := v.(string); ok {
+			p, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("bytea values must be base64-encoded: %w", err)
+			}
+			return p, nil
+		}
+	case TimestampArgType:
+		return convertTime(v, time.RFC3339Nano)
+	case DateArgType:
+		return convertTime(v, "2006-01-02")
+	case JSONArgType:
+		p, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding json arg: %w", err)
+		}
+		return string(p), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to %v", v, t)
+}
+
+func convertInt(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(v), nil
+	case *big.Int:
+		if !v.IsInt64() {
+			return nil, fmt.Errorf("%v overflows int64", v)
+		}
+		return v.Int64(), nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		return i, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to int", v)
+}
+
+func convertFloat(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to float", v)
+}
+
+// convertNumeric converts v to a decimal string so that arbitrary precision
+// numerics aren't rounded by float conversion.
+func convertNumeric(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64, *big.Int, int, int64:
+		s, _ := opaqueString(v)
+		return s, nil
+	case string:
+		if _, ok := new(big.Float).SetString(v); !ok {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to numeric", v)
+}
+
+func convertBool(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to bool", v)
+}
+
+// convertTime parses a time from a string in the given layout (or RFC 3339)
+// or from a number of seconds since the Unix epoch.
+func convertTime(v interface{}, layout string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(layout, v)
+		if err != nil && layout != time.RFC3339Nano {
+			t, err = time.Parse(time.RFC3339Nano, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid time", v)
+		}
+		return t, nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case int:
+		return time.Unix(int64(v), 0).UTC(), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to a time", v)
+}
+
+// parseUUID parses a UUID in its canonical, braced, URN, or unhyphenated
+// forms and returns it in canonical form.
+func parseUUID(s string) (string, error) {
+	in := strings.TrimPrefix(strings.ToLower(s), "urn:uuid:")
+	in = strings.TrimSuffix(strings.TrimPrefix(in, "{"), "}")
+	in = strings.ReplaceAll(in, "-", "")
+	if len(in) != 32 {
+		return "", fmt.Errorf("%q is not a valid uuid", s)
+	}
+	if _, err := hex.DecodeString(in); err != nil {
+		return "", fmt.Errorf("%q is not a valid uuid", s)
+	}
+	return in[:8] + "-" + in[8:12] + "-" + in[12:16] + "-" + in[16:20] + "-" + in[20:], nil
+}
+
+// TypedArg is an argument with a type hint.
+type TypedArg struct {
+	Arg  ArgDef
+	Type ArgType
+}
+
+func (TypedArg) param() {}
+
+// paramSource returns where the arg's value comes from in the request, if
+// it's bound to a request param.
+func (a TypedArg) paramSource() (in, name string, ok bool) {
+	switch arg := a.Arg.(type) {
+	case PathParamRef:
+		return "path", arg.Name, true
+	case QueryParamRef:
+		return "query", arg.Name, true
+	case HeaderParamRef:
+		return "header", arg.Name, true
+	case CookieParamRef:
+		return "cookie", arg.Name, true
+	case FileRef:
+		return "file", arg.Name, true
+	case FilePathRef:
+		return "file", arg.Name, true
+	}
+	return "", "", false
+}
+
+func (a TypedArg) MarshalJSON() ([]byte, error) {
+	blob, err := json.Marshal(a.Arg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		return nil, err
+	}
+	fields["type"] = a.Type
+	return json.Marshal(fields)
+}
@@ -0,0 +1,369 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const arrowStreamContentType = "application/vnd.apache.arrow.stream"
+
+// arrowBatchRows is the maximum number of rows in each Arrow record batch.
+const arrowBatchRows = 64 * 1024
+
+// Arrow flatbuffer enum values used by encodeArrowStream.
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeBinary        = 4
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble = 2
+	arrowUnitMicrosecond = 2
+)
+
+// encodeArrowStream encodes out as an Arrow IPC stream: a schema message
+// followed by record batches of at most arrowBatchRows rows each.
+func encodeArrowStream(out interface{}) ([]byte, error) {
+	rows, err := tableRows(out)
+	if err != nil {
+		return nil, err
+	}
+	columns := tableColumns(rows)
+
+	var buf bytes.Buffer
+	fields := make(fbTables, len(columns))
+	for i, col := range columns {
+		typeType, typ := arrowType(col.Type)
+		fields[i] = fbTable{
+			fbString(col.Name),
+			fbBool(true),      // nullable
+			fbUint8(typeType), // type_type
+			typ,               // type
+			nil,               // dictionary
+			fbTables{},        // children
+		}
+	}
+	if err := writeArrowMessage(&buf, arrowHeaderSchema, fbTable{fbInt16(0), fields}, nil); err != nil {
+		return nil, err
+	}
+
+	for lo := 0; lo < len(rows); lo += arrowBatchRows {
+		hi := lo + arrowBatchRows
+		if hi > len(rows) {
+			hi = len(rows)
+		}
+		header, body := arrowRecordBatch(columns, lo, hi)
+		if err := writeArrowMessage(&buf, arrowHeaderRecordBatch, header, body); err != nil {
+			return nil, err
+		}
+	}
+
+	// End of stream.
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	return buf.Bytes(), nil
+}
+
+func arrowType(typ ColumnType) (uint8, fbTable) {
+	switch typ {
+	case BoolColumn:
+		return arrowTypeBool, fbTable{}
+	case Int64Column:
+		return arrowTypeInt, fbTable{fbInt32(64), fbBool(true)}
+	case Float64Column:
+		return arrowTypeFloatingPoint, fbTable{fbInt16(arrowPrecisionDouble)}
+	case BinaryColumn:
+		return arrowTypeBinary, fbTable{}
+	case TimestampColumn:
+		return arrowTypeTimestamp, fbTable{fbInt16(arrowUnitMicrosecond), fbString("UTC")}
+	default:
+		return arrowTypeUtf8, fbTable{}
+	}
+}
+
+// writeArrowMessage writes an encapsulated IPC message: a continuation
+// marker, the length of the message's metadata, the metadata, and the body.
+func writeArrowMessage(buf *bytes.Buffer, headerType uint8, header fbTable, body []byte) error {
+	meta, err := fbFinish(fbTable{
+		fbInt16(arrowMetadataV5),
+		fbUint8(headerType),
+		header,
+		fbInt64(int64(len(body))),
+	})
+	if err != nil {
+		return err
+	}
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:], 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	buf.Write(prefix[:])
+	buf.Write(meta)
+	buf.Write(body)
+	return nil
+}
+
+// arrowRecordBatch returns the metadata and body of a record batch holding
+// rows lo through hi of columns.
+func arrowRecordBatch(columns []*column, lo, hi int) (fbTable, []byte) {
+	n := hi - lo
+	var body bytes.Buffer
+	var nodes, buffers []byte
+	addBuffer := func(p []byte) {
+		buffers = appendInt64s(buffers, int64(body.Len()), int64(len(p)))
+		body.Write(p)
+		for body.Len()%8 != 0 {
+			body.WriteByte(0)
+		}
+	}
+
+	for _, col := range columns {
+		values := col.Values[lo:hi]
+		validity := make([]byte, (n+7)/8)
+		nulls := 0
+		for i, v := range values {
+			if v == nil {
+				nulls++
+				continue
+			}
+			validity[i/8] |= 1 << (i % 8)
+		}
+		nodes = appendInt64s(nodes, int64(n), int64(nulls))
+		addBuffer(validity)
+
+		switch col.Type {
+		case BoolColumn:
+			bits := make([]byte, (n+7)/8)
+			for i, v := range values {
+				if v == true {
+					bits[i/8] |= 1 << (i % 8)
+				}
+			}
+			addBuffer(bits)
+		case Int64Column, TimestampColumn, Float64Column:
+			data := make([]byte, 8*n)
+			for i, v := range values {
+				switch v := v.(type) {
+				case int64:
+					binary.LittleEndian.PutUint64(data[8*i:], uint64(v))
+				case float64:
+					binary.LittleEndian.PutUint64(data[8*i:], math.Float64bits(v))
+				}
+			}
+			addBuffer(data)
+		default:
+			offsets := make([]byte, 4*(n+1))
+			var data []byte
+			for i, v := range values {
+				data = append(data, columnBytes(v)...)
+				binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+			}
+			addBuffer(offsets)
+			addBuffer(data)
+		}
+	}
+
+	header := fbTable{
+		fbInt64(int64(n)),
+		fbStructs{align: 8, data: nodes, n: len(nodes) / 16},
+		fbStructs{align: 8, data: buffers, n: len(buffers) / 16},
+	}
+	return header, body.Bytes()
+}
+
+func appendInt64s(p []byte, vs ...int64) []byte {
+	var b [8]byte
+	for _, v := range vs {
+		binary.LittleEndian.PutUint64(b[:], uint64(v))
+		p = append(p, b[:]...)
+	}
+	return p
+}
+
+// columnBytes returns the bytes of a string or binary column value.
+func columnBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	}
+	return nil
+}
+
+// Flatbuffer values. An fbTable holds its fields in slot order, with nil for
+// absent fields. Objects referenced by a table are written after it, so that
+// all offsets point forward.
+type (
+	fbTable  []interface{}
+	fbTables []fbTable
+	fbString string
+	fbScalar struct {
+		size int
+		bits uint64
+	}
+	fbStructs struct {
+		align int
+		data  []byte
+		n     int
+	}
+)
+
+func fbBool(b bool) fbScalar {
+	if b {
+		return fbScalar{1, 1}
+	}
+	return fbScalar{1, 0}
+}
+
+func fbUint8(v uint8) fbScalar { return fbScalar{1, uint64(v)} }
+func fbInt16(v int16) fbScalar { return fbScalar{2, uint64(uint16(v))} }
+func fbInt32(v int32) fbScalar { return fbScalar{4, uint64(uint32(v))} }
+func fbInt64(v int64) fbScalar { return fbScalar{8, uint64(v)} }
+
+// fbFinish encodes root as a flatbuffer, padded to a multiple of 8 bytes.
+func fbFinish(root fbTable) ([]byte, error) {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	binary.LittleEndian.PutUint32(b.buf, uint32(b.table(root)))
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.align(8)
+	return b.buf, nil
+}
+
+type fbBuilder struct {
+	buf []byte
+	err error // The first value that couldn't be encoded.
+}
+
+func (b *fbBuilder) align(n int) {
+	for len(b.buf)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) appendUint16(v uint16) {
+	b.buf = append(b.buf, byte(v), byte(v>>8))
+}
+
+func (b *fbBuilder) appendUint32(v uint32) {
+	b.buf = append(b.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// offset writes the offset from at to pos at at.
+func (b *fbBuilder) offset(at, pos int) {
+	binary.LittleEndian.PutUint32(b.buf[at:], uint32(pos-at))
+}
+
+// table writes a vtable followed by the table it describes and the objects
+// the table references, and returns the position of the table.
+func (b *fbBuilder) table(t fbTable) int {
+	// Lay out fields after the vtable offset, each aligned to its size.
+	offs := make([]int, len(t))
+	size := 4
+	for i, v := range t {
+		if v == nil {
+			continue
+		}
+		n := 4
+		if s, ok := v.(fbScalar); ok {
+			n = s.size
+		}
+		size = (size + n - 1) / n * n
+		offs[i] = size
+		size += n
+	}
+
+	b.align(2)
+	vt := len(b.buf)
+	b.appendUint16(uint16(4 + 2*len(t)))
+	b.appendUint16(uint16(size))
+	for _, off := range offs {
+		b.appendUint16(uint16(off))
+	}
+
+	b.align(8)
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(pos-vt)))
+	for i, v := range t {
+		at := pos + offs[i]
+		switch v := v.(type) {
+		case nil:
+		case fbScalar:
+			switch v.size {
+			case 1:
+				b.buf[at] = byte(v.bits)
+			case 2:
+				binary.LittleEndian.PutUint16(b.buf[at:], uint16(v.bits))
+			case 4:
+				binary.LittleEndian.PutUint32(b.buf[at:], uint32(v.bits))
+			case 8:
+				binary.LittleEndian.PutUint64(b.buf[at:], v.bits)
+			}
+		default:
+			b.offset(at, b.object(v))
+		}
+	}
+	return pos
+}
+
+// object writes a string, vector, or table and returns its position. Other
+// values are recorded as the builder's error.
+func (b *fbBuilder) object(v interface{}) int {
+	switch v := v.(type) {
+	case fbTable:
+		return b.table(v)
+	case fbString:
+		b.align(4)
+		pos := len(b.buf)
+		b.appendUint32(uint32(len(v)))
+		b.buf = append(append(b.buf, v...), 0)
+		return pos
+	case fbTables:
+		b.align(4)
+		pos := len(b.buf)
+		b.appendUint32(uint32(len(v)))
+		b.buf = append(b.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			b.offset(pos+4+4*i, b.table(t))
+		}
+		return pos
+	case fbStructs:
+		// The length precedes the first struct, which must be aligned.
+		for (len(b.buf)+4)%v.align != 0 {
+			b.buf = append(b.buf, 0)
+		}
+		pos := len(b.buf)
+		b.appendUint32(uint32(v.n))
+		b.buf = append(b.buf, v.data...)
+		return pos
+	}
+	if b.err == nil {
+		b.err = fmt.Errorf("unsupported flatbuffer value of type %T", v)
+	}
+	return len(b.buf)
+}
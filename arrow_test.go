@@ -0,0 +1,45 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+// testdata/table.arrow was checked by reading it with the ipc.Reader of
+// github.com/apache/arrow/go/arrow, which returned the schema and values
+// of tableTestRows.
+func TestEncodeArrowStream(t *testing.T) {
+	got, err := encodeArrowStream(tableTestRows())
+	if err != nil {
+		t.Fatalf("encodeArrowStream() = %v", err)
+	}
+	checkGolden(t, "table.arrow", got)
+}
+
+func TestEncodeArrowStreamEmpty(t *testing.T) {
+	got, err := encodeArrowStream([]interface{}{})
+	if err != nil {
+		t.Fatalf("encodeArrowStream() = %v", err)
+	}
+	checkGolden(t, "empty.arrow", got)
+}
+
+func TestFlatbufferUnsupportedValue(t *testing.T) {
+	if _, err := fbFinish(fbTable{fbInt32(1), 42}); err == nil {
+		t.Fatal("fbFinish() = nil; want an error for an int field")
+	}
+}
@@ -0,0 +1,195 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Principal is an authenticated client of an endpoint.
+type Principal struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// HasRole reports whether the principal has any of the given roles. A nil
+// principal has no roles.
+func (p *Principal) HasRole(roles ...string) bool {
+	if p == nil {
+		return false
+	}
+	for _, want := range roles {
+		for _, have := range p.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns the principal authenticated for a request, or
+// nil if the request was not authenticated.
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// BasicAuthMiddleware authenticates requests using HTTP basic auth against
+// bcrypt password hashes, given either in config or in an htpasswd file.
+type BasicAuthMiddleware struct {
+	Realm    string            `json:"realm,omitempty" yaml:"realm,omitempty"`
+	Users    map[string]string `json:"users,omitempty" yaml:"users,omitempty" sensitive:"true"`
+	Htpasswd string            `json:"htpasswd,omitempty" yaml:"htpasswd,omitempty"`
+	// Roles maps user names to the roles they are granted.
+	Roles map[string][]string `json:"roles,omitempty" yaml:"roles,omitempty"`
+
+	hashes map[string][]byte
+	dummy  []byte // Compared against for unknown users.
+}
+
+func (m *BasicAuthMiddleware) Validate() error {
+	if m.Realm == "" {
+		m.Realm = "chisel"
+	}
+
+	users := make(map[string]string, len(m.Users))
+	for k, v := range m.Users {
+		users[k] = v
+	}
+	if m.Htpasswd != "" {
+		file, err := readHtpasswd(m.Htpasswd)
+		if err != nil {
+			return err
+		}
+		for k, v := range file {
+			if _, ok := users[k]; ok {
+				return fmt.Errorf("user %q is defined in both users and htpasswd", k)
+			}
+			users[k] = v
+		}
+	}
+	if len(users) == 0 {
+		return errors.New("no users defined")
+	}
+
+	var me *multierror.Error
+	m.hashes = make(map[string][]byte, len(users))
+	for k, v := range users {
+		hash := []byte(v)
+		if _, err := bcrypt.Cost(hash); err != nil {
+			me = multierror.Append(me, fmt.Errorf("user %q does not have a bcrypt password hash: %w", k, err))
+			continue
+		}
+		m.hashes[k] = hash
+	}
+	for k := range m.Roles {
+		if _, ok := users[k]; !ok {
+			me = multierror.Append(me, fmt.Errorf("roles given for undefined user %q", k))
+		}
+	}
+	if err := errorOrNil(me); err != nil {
+		return err
+	}
+
+	dummy, err := bcrypt.GenerateFromPassword([]byte("chisel"), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error generating password hash: %w", err)
+	}
+	m.dummy = dummy
+	return nil
+}
+
+// readHtpasswd reads user names and password hashes from an htpasswd file.
+func readHtpasswd(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading htpasswd file: %w", err)
+	}
+
+	users := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: malformed htpasswd entry", path, line)
+		}
+		users[name] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading htpasswd file: %w", err)
+	}
+	return users, nil
+}
+
+func (m *BasicAuthMiddleware) authenticate(req *http.Request) (string, bool) {
+	name, pass, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, known := m.hashes[name]
+	if !known {
+		// Compare anyway so that unknown users take as long to reject
+		// as known ones.
+		hash = m.dummy
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil || !known {
+		return "", false
+	}
+	return name, true
+}
+
+func (m *BasicAuthMiddleware) Wrap(next http.Handler) http.Handler {
+	challenge := "Basic realm=" + strconv.Quote(m.Realm) + `, charset="UTF-8"`
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		name, ok := m.authenticate(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeError(*zerolog.Ctx(ctx), w, http.StatusUnauthorized, &errorResponse{
+				Error: "unauthorized",
+			})
+			return
+		}
+
+		log := zerolog.Ctx(ctx).With().Str("user", name).Logger()
+		ctx = log.WithContext(ctx)
+		ctx = withPrincipal(ctx, &Principal{Name: name, Roles: m.Roles[name]})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
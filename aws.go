@@ -0,0 +1,86 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// awsCredentials are the credentials used to sign AWS API requests.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// sign signs a JSON request for the target action of an AWS service with
+// AWS Signature Version 4.
+func (c *awsCredentials) sign(req *http.Request, service, region, target string, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signed := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+		signed = []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	}
+	var headers strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(h + ":" + v + "\n")
+	}
+	payload := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := req.Method + "\n" + path + "\n" + req.URL.RawQuery + "\n" + headers.String() + "\n" +
+		strings.Join(signed, ";") + "\n" + hex.EncodeToString(payload[:])
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+
+		", Signature="+awsSignature(c.secretKey, region, service, amzDate, canonical))
+}
+
+// awsSignature returns the Signature Version 4 signature of a canonical
+// request made at amzDate.
+func awsSignature(secretKey, region, service, amzDate, canonical string) string {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := mac([]byte("AWS4"+secretKey), amzDate[:8])
+	key = mac(key, region)
+	key = mac(key, service)
+	key = mac(key, "aws4_request")
+	return hex.EncodeToString(mac(key, toSign))
+}
@@ -0,0 +1,96 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The credentials and time of the AWS Signature Version 4 test suite.
+var (
+	sigV4TestCredentials = awsCredentials{
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	sigV4TestTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+func TestAWSSignatureTestSuite(t *testing.T) {
+	// The canonical requests and signatures of the get-vanilla and
+	// post-vanilla cases of the AWS Signature Version 4 test suite.
+	cases := []struct {
+		name      string
+		canonical string
+		signature string
+	}{
+		{
+			"get-vanilla",
+			"GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			"5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"post-vanilla",
+			"POST\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			"5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, c := range cases {
+		got := awsSignature(sigV4TestCredentials.secretKey, "us-east-1", "service", "20150830T123600Z", c.canonical)
+		if got != c.signature {
+			t.Errorf("%s: signature = %s; want %s", c.name, got, c.signature)
+		}
+	}
+}
+
+func TestAWSSign(t *testing.T) {
+	// The expected headers were produced by signing the same requests with
+	// the signer of aws-sdk-go-v2.
+	cases := []struct {
+		name  string
+		token string
+		auth  string
+	}{
+		{
+			"no session token", "",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/athena/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date;x-amz-target, " +
+				"Signature=380165a1ff492da0f3f19f75f0a75a8e1cad631d086db58de77845ad0f008ef5",
+		},
+		{
+			"session token", "TOKEN",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/athena/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, " +
+				"Signature=2002c9d009bbbc333f01da3348cb8089cb2aff4e4e0ecc0f212c997e48c2f6d7",
+		},
+	}
+	for _, c := range cases {
+		creds := sigV4TestCredentials
+		creds.sessionToken = c.token
+		req := httptest.NewRequest("POST", "https://athena.us-east-1.amazonaws.com/", nil)
+		creds.sign(req, "athena", "us-east-1", "AmazonAthena.GetQueryExecution",
+			[]byte(`{"QueryExecutionId":"abc"}`), sigV4TestTime)
+		if got := req.Header.Get("Authorization"); got != c.auth {
+			t.Errorf("%s: Authorization = %s; want %s", c.name, got, c.auth)
+		}
+		if got := req.Header.Get("X-Amz-Security-Token"); got != c.token {
+			t.Errorf("%s: X-Amz-Security-Token = %q; want %q", c.name, got, c.token)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+type BinaryEncoding int
+
+const (
+	Base64BinaryEncoding BinaryEncoding = iota // base64 - Default
+	HexBinaryEncoding                          // hex
+	OmitBinaryEncoding                         // omit
+	RawBinaryEncoding                          // raw
+)
+
+func (b BinaryEncoding) MarshalText() ([]byte, error) {
+	enc := "base64"
+	switch b {
+	case Base64BinaryEncoding:
+	case HexBinaryEncoding:
+		enc = "hex"
+	case OmitBinaryEncoding:
+		enc = "omit"
+	case RawBinaryEncoding:
+		enc = "raw"
+	default:
+		return nil, fmt.Errorf("unrecognized binary encoding %d", b)
+	}
+	return []byte(enc), nil
+}
+
+func (b *BinaryEncoding) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "base64":
+		*b = Base64BinaryEncoding
+	case "hex":
+		*b = HexBinaryEncoding
+	case "omit":
+		*b = OmitBinaryEncoding
+	case "raw":
+		*b = RawBinaryEncoding
+	default:
+		return fmt.Errorf("unrecognized binary encoding %q", src)
+	}
+	return nil
+}
+
+// BinaryDef controls how binary column values in a step's results are
+// emitted. Byte values in any column use Encoding unless the column has its
+// own encoding in Columns. Columns listed in Columns are treated as binary
+// even if the driver scans them as strings.
+//
+// With the raw encoding, the value of Column in the step's only row is
+// written as the response body instead of JSON.
+type BinaryDef struct {
+	Encoding    BinaryEncoding            `json:"encoding" yaml:"encoding"`
+	Columns     map[string]BinaryEncoding `json:"columns,omitempty" yaml:"columns,omitempty"`
+	Column      string                    `json:"column,omitempty" yaml:"column,omitempty"`
+	ContentType string                    `json:"content_type,omitempty" yaml:"content_type,omitempty"`
+}
+
+func (bd *BinaryDef) Validate() error {
+	for k, enc := range bd.Columns {
+		if enc == RawBinaryEncoding {
+			return fmt.Errorf("column %q cannot use the raw encoding, set column instead", k)
+		}
+	}
+	if bd.Encoding != RawBinaryEncoding {
+		if bd.Column != "" || bd.ContentType != "" {
+			return errors.New("column and content_type are only used by the raw encoding")
+		}
+		return nil
+	}
+	if bd.Column == "" {
+		return errors.New("raw encoding requires a column")
+	}
+	if bd.ContentType == "" {
+		bd.ContentType = "application/octet-stream"
+	}
+	return nil
+}
+
+// Encode encodes binary values in the rows of res in place.
+func (bd *BinaryDef) Encode(res interface{}) interface{} {
+	rows, ok := res.([]interface{})
+	if !ok {
+		return res
+	}
+	for _, row := range rows {
+		cols, ok := row.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range cols {
+			enc, explicit := bd.Columns[k]
+			if !explicit {
+				enc = bd.Encoding
+			}
+			var p []byte
+			switch v := v.(type) {
+			case []byte:
+				p = v
+			case string:
+				if !explicit {
+					continue
+				}
+				p = []byte(v)
+			default:
+				continue
+			}
+			switch enc {
+			case OmitBinaryEncoding:
+				delete(cols, k)
+			case HexBinaryEncoding:
+				cols[k] = hex.EncodeToString(p)
+			case Base64BinaryEncoding:
+				cols[k] = base64.StdEncoding.EncodeToString(p)
+			}
+		}
+	}
+	return res
+}
+
+// rawBody is a response body written as-is instead of being encoded as JSON.
+type rawBody struct {
+	ContentType string
+	Data        []byte
+}
+
+// Raw returns the value of the raw column from the only row of res. If res
+// has no rows, it returns nil.
+func (bd *BinaryDef) Raw(res interface{}) (*rawBody, error) {
+	rows, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot take a raw body from %T", res)
+	}
+	switch len(rows) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("raw body requires at most one row, got %d", len(rows))
+	}
+	cols, ok := rows[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot take a raw body from row of type %T", rows[0])
+	}
+	var data []byte
+	switch v := cols[bd.Column].(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+	default:
+		return nil, fmt.Errorf("column %q is a %T, not binary", bd.Column, v)
+	}
+	return &rawBody{ContentType: bd.ContentType, Data: data}, nil
+}
@@ -0,0 +1,86 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StepBudget determines how a query's remaining time is divided among its
+// remaining steps. Each step may use its share of the time left when it
+// starts, so time a step doesn't use is passed on to the steps after it.
+type StepBudget int
+
+const (
+	NoStepBudget       StepBudget = iota // none - Default. Steps may use all remaining time.
+	EqualStepBudget                      // equal
+	WeightedStepBudget                   // weighted
+)
+
+func (b StepBudget) MarshalText() ([]byte, error) {
+	typ := "none"
+	switch b {
+	case NoStepBudget:
+	case EqualStepBudget:
+		typ = "equal"
+	case WeightedStepBudget:
+		typ = "weighted"
+	default:
+		return nil, fmt.Errorf("unrecognized step budget %d", b)
+	}
+	return []byte(typ), nil
+}
+
+func (b *StepBudget) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "none":
+		*b = NoStepBudget
+	case "equal":
+		*b = EqualStepBudget
+	case "weighted":
+		*b = WeightedStepBudget
+	default:
+		return fmt.Errorf("unrecognized step budget %q", src)
+	}
+	return nil
+}
+
+// stepWeight returns the weight of step sd under the budget b.
+func (b StepBudget) stepWeight(sd *StepDef) float64 {
+	if b == WeightedStepBudget && sd.Weight > 0 {
+		return sd.Weight
+	}
+	return 1
+}
+
+// stepContext returns a context for step si of steps, limited to its share
+// of the time remaining before ctx's deadline. If the budget is
+// NoStepBudget or ctx has no deadline, it returns ctx.
+func (b StepBudget) stepContext(ctx context.Context, steps []*StepDef, si int) (context.Context, time.Duration, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if b == NoStepBudget || !ok {
+		return ctx, 0, func() {}
+	}
+	var total float64
+	for _, sd := range steps[si:] {
+		total += b.stepWeight(sd)
+	}
+	share := time.Duration(float64(time.Until(deadline)) * b.stepWeight(steps[si]) / total)
+	ctx, cancel := context.WithTimeout(ctx, share)
+	return ctx, share, cancel
+}
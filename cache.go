@@ -0,0 +1,442 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// recordedResponse is a response saved by the cache and idempotency
+// middleware so that it can be replayed.
+type recordedResponse struct {
+	Pending     bool        `json:"pending,omitempty"`
+	Fingerprint string      `json:"fingerprint,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	SHA256      string      `json:"sha256,omitempty"` // Hex digest of Body, checked when the response is loaded.
+}
+
+var errStoredResponseDigest = errors.New("stored response does not match its digest")
+
+// checkDigest returns an error if the response's body doesn't match its
+// digest. Responses recorded without a digest are assumed to be intact.
+func (rr *recordedResponse) checkDigest() error {
+	if rr.SHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256(rr.Body)
+	if hex.EncodeToString(sum[:]) != rr.SHA256 {
+		return errStoredResponseDigest
+	}
+	return nil
+}
+
+// replay writes the recorded response to w. Successful responses are served
+// with http.ServeContent so that conditional and Range requests work, and
+// with the digest of the full body so that clients fetching it in ranges
+// can check what they reassemble.
+func (rr *recordedResponse) replay(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	for k, vs := range rr.Header {
+		h[k] = append([]string(nil), vs...)
+	}
+	if rr.Status == http.StatusOK {
+		h.Del("Content-Length")
+		if sum, err := hex.DecodeString(rr.SHA256); err == nil && len(sum) == sha256.Size {
+			setDigestHeaders(h, sum)
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(rr.Body))
+		return
+	}
+	w.WriteHeader(rr.Status)
+	_, _ = w.Write(rr.Body)
+}
+
+// recordingWriter passes a response through to the client while recording
+// it.
+type recordingWriter struct {
+	http.ResponseWriter
+	resp recordedResponse
+	body bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.resp.Status == 0 {
+		rw.resp.Status = status
+		rw.resp.Header = rw.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.resp.Status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recordingWriter) recorded() *recordedResponse {
+	if rw.resp.Status == 0 {
+		rw.resp.Status = http.StatusOK
+		rw.resp.Header = rw.Header().Clone()
+	}
+	rw.resp.Body = rw.body.Bytes()
+	sum := sha256.Sum256(rw.resp.Body)
+	rw.resp.SHA256 = hex.EncodeToString(sum[:])
+	return &rw.resp
+}
+
+func loadResponse(ctx context.Context, store *StoreDef, key string) (*recordedResponse, bool, error) {
+	p, ok, err := store.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	var rr recordedResponse
+	if err := json.Unmarshal(p, &rr); err != nil {
+		return nil, false, fmt.Errorf("error decoding stored response: %w", err)
+	}
+	if err := rr.checkDigest(); err != nil {
+		return nil, false, err
+	}
+	return &rr, true, nil
+}
+
+// CacheMiddleware caches successful responses to GET requests.
+type CacheMiddleware struct {
+	Store StoreDef `json:"store" yaml:"store"`
+	TTL   Duration `json:"ttl" yaml:"ttl"` // Defaults to 1m.
+	// Vary lists request headers whose values are part of the cache key.
+	Vary []string `json:"vary,omitempty" yaml:"vary,omitempty"`
+}
+
+func (m *CacheMiddleware) Validate() error {
+	if m.TTL.Duration <= 0 {
+		m.TTL.Duration = time.Minute
+	}
+	if err := m.Store.Validate(); err != nil {
+		return fmt.Errorf("store failed validation: %w", err)
+	}
+	return nil
+}
+
+func (m *CacheMiddleware) Close() error {
+	return m.Store.Close()
+}
+
+// key returns the base cache key of req, which identifies its principal, its
+// URI, and the values of the headers in Vary. Responses are stored under
+// variantKey, since they may also vary by headers of their own.
+func (m *CacheMiddleware) key(req *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString("cache:")
+	if p := principalFromContext(req.Context()); p != nil {
+		sb.WriteString(p.Name)
+	}
+	sb.WriteByte(0)
+	sb.WriteString(req.URL.RequestURI())
+	writeHeaderValues(&sb, req, m.Vary)
+	return sb.String()
+}
+
+// variantKey returns the key of the response to req under the base key
+// base, given the request headers vary named in the response's Vary header.
+func variantKey(base string, vary []string, req *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(base)
+	sb.WriteString("\x00vary")
+	writeHeaderValues(&sb, req, vary)
+	return sb.String()
+}
+
+func writeHeaderValues(sb *strings.Builder, req *http.Request, names []string) {
+	for _, h := range names {
+		sb.WriteByte(0)
+		sb.WriteString(strings.Join(req.Header.Values(h), ","))
+	}
+}
+
+// responseVary returns the request headers named by h's Vary header. It
+// returns false if the response varies by something other than headers
+// ("*"), and so can't be cached.
+func responseVary(h http.Header) ([]string, bool) {
+	seen := map[string]bool{}
+	vary := []string{}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch {
+			case name == "":
+				continue
+			case name == "*":
+				return nil, false
+			case !seen[name]:
+				seen[name] = true
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// loadVary returns the headers that responses stored under the base key
+// vary by, and whether any are stored.
+func (m *CacheMiddleware) loadVary(ctx context.Context, base string) ([]string, bool, error) {
+	p, ok, err := m.Store.Get(ctx, base)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	var vary []string
+	if err := json.Unmarshal(p, &vary); err != nil {
+		return nil, false, fmt.Errorf("error decoding stored vary headers: %w", err)
+	}
+	return vary, true, nil
+}
+
+// lookup returns the cached response to req and the key it's stored under,
+// if there is one.
+func (m *CacheMiddleware) lookup(ctx context.Context, req *http.Request) (*recordedResponse, string, bool, error) {
+	base := m.key(req)
+	vary, ok, err := m.loadVary(ctx, base)
+	if err != nil || !ok {
+		return nil, "", false, err
+	}
+	key := variantKey(base, vary, req)
+	rr, ok, err := loadResponse(ctx, &m.Store, key)
+	return rr, key, ok, err
+}
+
+// store caches rr, the response to req. The headers it varies by are
+// stored under the base key, and the response under its variant key.
+func (m *CacheMiddleware) store(ctx context.Context, req *http.Request, rr *recordedResponse) error {
+	vary, ok := responseVary(rr.Header)
+	if !ok {
+		return nil
+	}
+	base := m.key(req)
+	p, err := json.Marshal(vary)
+	if err != nil {
+		return err
+	}
+	if err := m.Store.Set(ctx, base, p, m.TTL.Duration); err != nil {
+		return err
+	}
+	p, err = json.Marshal(rr)
+	if err != nil {
+		return err
+	}
+	return m.Store.Set(ctx, variantKey(base, vary, req), p, m.TTL.Duration)
+}
+
+// credentialHeaders are response headers that carry credentials for a
+// single client. Responses with any of them are never cached, so that they
+// aren't replayed to other requests.
+var credentialHeaders = []string{
+	"Set-Cookie",
+	"Authentication-Info",
+	"Proxy-Authentication-Info",
+}
+
+// cacheable reports whether a recorded response may be cached.
+func cacheable(rr *recordedResponse) bool {
+	if rr.Status != http.StatusOK {
+		return false
+	}
+	for _, name := range credentialHeaders {
+		if _, ok := rr.Header[name]; ok {
+			return false
+		}
+	}
+	cc := strings.ToLower(rr.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+func (m *CacheMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-cache") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		log := *zerolog.Ctx(ctx)
+		rr, key, ok, err := m.lookup(ctx, req)
+		if errors.Is(err, errStoredResponseDigest) {
+			// Drop the corrupt entry so that this response replaces it.
+			log.Warn().Err(err).Msg("Cached response failed integrity check.")
+			if err := m.Store.Del(ctx, key); err != nil {
+				log.Warn().Err(err).Msg("Unable to remove cached response.")
+			}
+		} else if err != nil {
+			log.Warn().Err(err).Msg("Unable to read response cache.")
+		}
+		if ok {
+			w.Header().Set("X-Cache", "HIT")
+			rr.replay(w, req)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rw := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, req)
+
+		rr = rw.recorded()
+		if !cacheable(rr) {
+			return
+		}
+		rr.Header.Del("X-Cache")
+		if err := m.store(ctx, req, rr); err != nil {
+			log.Warn().Err(err).Msg("Unable to write response cache.")
+		}
+	})
+}
+
+// IdempotencyMiddleware deduplicates requests that carry an idempotency key.
+// The first request with a key runs normally and its response is saved;
+// later requests with the same key receive the saved response instead of
+// running again.
+type IdempotencyMiddleware struct {
+	Store  StoreDef `json:"store" yaml:"store"`
+	TTL    Duration `json:"ttl" yaml:"ttl"`       // Defaults to 24h.
+	Header string   `json:"header" yaml:"header"` // Defaults to Idempotency-Key.
+}
+
+func (m *IdempotencyMiddleware) Validate() error {
+	if m.TTL.Duration <= 0 {
+		m.TTL.Duration = 24 * time.Hour
+	}
+	if m.Header == "" {
+		m.Header = "Idempotency-Key"
+	}
+	if err := m.Store.Validate(); err != nil {
+		return fmt.Errorf("store failed validation: %w", err)
+	}
+	return nil
+}
+
+func (m *IdempotencyMiddleware) Close() error {
+	return m.Store.Close()
+}
+
+var errIdempotencyBody = errors.New("error reading request body")
+
+// fingerprint reads the request body and returns a hash of the request,
+// restoring the body so that it can be read again.
+func fingerprint(req *http.Request) (string, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", errIdempotencyBody
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (m *IdempotencyMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		idem := req.Header.Get(m.Header)
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			idem = ""
+		}
+		if idem == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		log := *zerolog.Ctx(ctx)
+
+		fp, err := fingerprint(req)
+		if err != nil {
+			writeError(log, w, http.StatusBadRequest, &errorResponse{Error: err.Error()})
+			return
+		}
+
+		key := "idempotency:"
+		if p := principalFromContext(ctx); p != nil {
+			key += p.Name
+		}
+		key += ":" + idem
+
+		pending, _ := json.Marshal(&recordedResponse{Pending: true, Fingerprint: fp})
+		claimed, err := m.Store.SetNX(ctx, key, pending, m.TTL.Duration)
+		if err != nil {
+			// Fail open, as with quotas.
+			log.Warn().Err(err).Msg("Unable to check idempotency key.")
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if !claimed {
+			rr, ok, err := loadResponse(ctx, &m.Store, key)
+			switch {
+			case err != nil:
+				log.Warn().Err(err).Msg("Unable to read idempotent response.")
+				writeError(log, w, http.StatusServiceUnavailable, &errorResponse{Error: "unable to check idempotency key"})
+			case !ok:
+				// Expired between SetNX and Get; ask the client
+				// to retry rather than risk running twice.
+				writeError(log, w, http.StatusConflict, &errorResponse{Error: "request with this idempotency key is in progress"})
+			case rr.Fingerprint != fp:
+				writeError(log, w, http.StatusUnprocessableEntity, &errorResponse{Error: "idempotency key was used for a different request"})
+			case rr.Pending:
+				writeError(log, w, http.StatusConflict, &errorResponse{Error: "request with this idempotency key is in progress"})
+			default:
+				w.Header().Set("Idempotent-Replayed", "true")
+				rr.replay(w, req)
+			}
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, req)
+
+		rr := rw.recorded()
+		if rr.Status >= 500 {
+			// Let the client retry failed requests.
+			if err := m.Store.Del(ctx, key); err != nil {
+				log.Warn().Err(err).Msg("Unable to release idempotency key.")
+			}
+			return
+		}
+		rr.Fingerprint = fp
+		p, err := json.Marshal(rr)
+		if err == nil {
+			err = m.Store.Set(ctx, key, p, m.TTL.Duration)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to save idempotent response.")
+		}
+	})
+}
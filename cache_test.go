@@ -0,0 +1,79 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newTestCache returns a handler that caches the responses of a handler
+// counting its calls in the response body. If cookie is true, responses
+// set a cookie.
+func newTestCache(t *testing.T, cookie bool) http.Handler {
+	t.Helper()
+	m := &CacheMiddleware{}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	calls := 0
+	return m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if cookie {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.Itoa(calls)})
+		}
+		w.Write([]byte(strconv.Itoa(calls)))
+	}))
+}
+
+// getCached sends a GET request for / to h with the given Cache-Control
+// header, if any, and returns the response's X-Cache header and body.
+func getCached(h http.Handler, cacheControl string) (string, string) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if cacheControl != "" {
+		req.Header.Set("Cache-Control", cacheControl)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Header().Get("X-Cache"), w.Body.String()
+}
+
+func TestCacheHit(t *testing.T) {
+	h := newTestCache(t, false)
+	getCached(h, "")
+	if xc, body := getCached(h, ""); xc != "HIT" || body != "1" {
+		t.Errorf("response = %s %q; want HIT %q", xc, body, "1")
+	}
+}
+
+func TestCacheSetCookie(t *testing.T) {
+	h := newTestCache(t, true)
+	getCached(h, "")
+	if xc, body := getCached(h, ""); xc != "MISS" || body != "2" {
+		t.Errorf("response = %s %q; want MISS %q", xc, body, "2")
+	}
+}
+
+func TestCacheNoCache(t *testing.T) {
+	h := newTestCache(t, false)
+	getCached(h, "")
+	if xc, body := getCached(h, "No-Cache"); xc != "" || body != "2" {
+		t.Errorf("response = %q %q; want no X-Cache and %q", xc, body, "2")
+	}
+}
@@ -0,0 +1,131 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// CallDef makes a query step call a stored procedure. Every result set the
+// call returns is kept, so the step's result is a list of result sets, each
+// a list of rows, instead of a single list of rows.
+//
+// OUT parameters are bound by name after the step's args using sql.Out, and
+// their values are returned as a final result set with a single row. Only
+// drivers that support sql.Out (such as SQL Server and Oracle) accept OUT
+// parameters; PostgreSQL and MySQL return OUT parameters as a result set.
+type CallDef struct {
+	Out []*OutParamDef `json:"out,omitempty" yaml:"out,omitempty"`
+}
+
+// OutParamDef is an OUT parameter of a stored procedure call. Its type
+// determines the Go type its value is scanned into.
+type OutParamDef struct {
+	Name string  `json:"name" yaml:"name"`
+	Type ArgType `json:"type" yaml:"type"`
+}
+
+func (cd *CallDef) Validate() error {
+	var me *multierror.Error
+	seen := map[string]bool{}
+	for i, od := range cd.Out {
+		switch {
+		case od == nil:
+			me = multierror.Append(me, fmt.Errorf("out param %d is nil", i))
+		case od.Name == "":
+			me = multierror.Append(me, fmt.Errorf("out param %d has no name", i))
+		case seen[od.Name]:
+			me = multierror.Append(me, fmt.Errorf("out param %q is defined more than once", od.Name))
+		default:
+			seen[od.Name] = true
+		}
+	}
+	return errorOrNil(me)
+}
+
+// outArgs returns the named sql.Out args for the call's OUT parameters along
+// with the destinations they're scanned into.
+func (cd *CallDef) outArgs() (args, dests []interface{}) {
+	args = make([]interface{}, len(cd.Out))
+	dests = make([]interface{}, len(cd.Out))
+	for i, od := range cd.Out {
+		dests[i] = od.Type.outDest()
+		args[i] = sql.Named(od.Name, sql.Out{Dest: dests[i]})
+	}
+	return args, dests
+}
+
+// outRow returns the values of the call's OUT parameters as a row.
+func (cd *CallDef) outRow(dests []interface{}) map[string]interface{} {
+	row := make(map[string]interface{}, len(dests))
+	for i, od := range cd.Out {
+		row[od.Name] = outValue(dests[i])
+	}
+	return row
+}
+
+// outDest returns a pointer to a value of the Go type that OUT parameters of
+// type t are scanned into.
+func (t ArgType) outDest() interface{} {
+	switch t {
+	case IntArgType:
+		return new(sql.NullInt64)
+	case FloatArgType:
+		return new(sql.NullFloat64)
+	case BoolArgType:
+		return new(sql.NullBool)
+	case BytesArgType:
+		return new([]byte)
+	case TimestampArgType, DateArgType:
+		return new(sql.NullTime)
+	default:
+		return new(sql.NullString)
+	}
+}
+
+func outValue(dest interface{}) interface{} {
+	switch d := dest.(type) {
+	case *sql.NullInt64:
+		if d.Valid {
+			return d.Int64
+		}
+	case *sql.NullFloat64:
+		if d.Valid {
+			return d.Float64
+		}
+	case *sql.NullBool:
+		if d.Valid {
+			return d.Bool
+		}
+	case *sql.NullTime:
+		if d.Valid {
+			return d.Time.Format(time.RFC3339Nano)
+		}
+	case *sql.NullString:
+		if d.Valid {
+			return d.String
+		}
+	case *[]byte:
+		if *d != nil {
+			return *d
+		}
+	}
+	return nil
+}
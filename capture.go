@@ -0,0 +1,253 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+)
+
+// CaptureDef records a sampled fraction of an endpoint's requests and
+// responses for debugging intermittent data issues offline. Captures are
+// appended to a file as JSON lines. Headers, query parameters, and JSON
+// body fields with names that look like secrets or that are listed in
+// Redact are redacted.
+type CaptureDef struct {
+	Rate    float64  `json:"rate" yaml:"rate"`                             // Fraction of requests captured.
+	Path    string   `json:"path" yaml:"path"`                             // File to append captures to.
+	MaxBody int      `json:"max_body,omitempty" yaml:"max_body,omitempty"` // Defaults to 64KiB.
+	Redact  []string `json:"redact,omitempty" yaml:"redact,omitempty"`
+
+	mu sync.Mutex // Serializes writes to Path.
+}
+
+func (cd *CaptureDef) Validate() error {
+	var me *multierror.Error
+	if cd.Rate <= 0 || cd.Rate > 1 {
+		me = multierror.Append(me, errors.New("rate must be greater than 0 and at most 1"))
+	}
+	if cd.Path == "" {
+		me = multierror.Append(me, errors.New("path is empty"))
+	}
+	if cd.MaxBody < 0 {
+		me = multierror.Append(me, errors.New("max_body must not be negative"))
+	} else if cd.MaxBody == 0 {
+		cd.MaxBody = 64 << 10
+	}
+	return errorOrNil(me)
+}
+
+// capture is a single captured request and its response.
+type capture struct {
+	Time      time.Time       `json:"time"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"` // The path template of the endpoint.
+	URL       string          `json:"url"`
+	RequestID string          `json:"request_id,omitempty"`
+	Elapsed   Duration        `json:"elapsed"`
+	Request   capturedMessage `json:"request"`
+	Response  capturedMessage `json:"response"`
+}
+
+type capturedMessage struct {
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"header"`
+	Body      interface{} `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// Wrap captures a sample of the requests to next, made to the endpoint at
+// path.
+func (cd *CaptureDef) Wrap(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rand.Float64() >= cd.Rate {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		reqBody := &captureBuffer{max: cd.MaxBody}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, reqBody), req.Body}
+		}
+		cw := &captureWriter{ResponseWriter: w, body: captureBuffer{max: cd.MaxBody}}
+		next.ServeHTTP(cw, req)
+
+		c := &capture{
+			Time:      start.UTC(),
+			Method:    req.Method,
+			Path:      path,
+			URL:       redactRequestURL(req.URL, cd.sensitive),
+			RequestID: req.Header.Get(requestIDHeader),
+			Elapsed:   Duration{time.Since(start)},
+			Request:   cd.message(0, req.Header, reqBody),
+			Response:  cd.message(cw.Status(), cw.Header(), &cw.body),
+		}
+		if err := cd.write(c); err != nil {
+			zerolog.Ctx(req.Context()).Warn().Err(err).Str("capture", cd.Path).Msg("Failed to write request capture.")
+		}
+	})
+}
+
+func (cd *CaptureDef) write(c *capture) error {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	f, err := os.OpenFile(cd.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sensitive returns whether values named name are redacted.
+func (cd *CaptureDef) sensitive(name string) bool {
+	for _, r := range cd.Redact {
+		if strings.EqualFold(r, name) {
+			return true
+		}
+	}
+	return sensitiveName(name)
+}
+
+// message returns a captured message for a header and body. JSON bodies are
+// decoded so that their fields can be redacted, and are left out if they
+// were truncated.
+func (cd *CaptureDef) message(status int, header http.Header, body *captureBuffer) capturedMessage {
+	msg := capturedMessage{
+		Status:    status,
+		Header:    header.Clone(),
+		Truncated: body.truncated,
+	}
+	for k, vs := range msg.Header {
+		if !cd.sensitive(k) {
+			continue
+		}
+		for i := range vs {
+			vs[i] = redactedSecret
+		}
+	}
+
+	if len(body.buf) == 0 {
+		return msg
+	}
+	mt, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mt == "application/json" || strings.HasSuffix(mt, "+json") {
+		var tree interface{}
+		if body.truncated || json.Unmarshal(body.buf, &tree) != nil {
+			return msg
+		}
+		msg.Body = cd.redactTree(tree)
+		return msg
+	}
+	if utf8.Valid(body.buf) {
+		msg.Body = string(body.buf)
+	} else {
+		msg.Body = body.buf // Encoded as base64.
+	}
+	return msg
+}
+
+// redactTree redacts the values of fields in tree with sensitive names.
+func (cd *CaptureDef) redactTree(tree interface{}) interface{} {
+	switch tree := tree.(type) {
+	case map[string]interface{}:
+		for k, e := range tree {
+			if cd.sensitive(k) {
+				tree[k] = redactAll(e)
+				continue
+			}
+			tree[k] = cd.redactTree(e)
+		}
+	case []interface{}:
+		for i, e := range tree {
+			tree[i] = cd.redactTree(e)
+		}
+	}
+	return tree
+}
+
+// captureBuffer keeps up to max bytes written to it and discards the rest.
+type captureBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (cb *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := cb.max - len(cb.buf); len(p) > room {
+		p = p[:room]
+		cb.truncated = true
+	}
+	cb.buf = append(cb.buf, p...)
+	return n, nil
+}
+
+// captureWriter passes a response through to the client while capturing
+// its status and body.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   captureBuffer
+}
+
+func (cw *captureWriter) Status() int {
+	if cw.status == 0 {
+		return http.StatusOK
+	}
+	return cw.status
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	_, _ = cw.body.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,207 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/julienschmidt/httprouter"
+)
+
+// CatalogQueryDef is a named query in the catalog. Catalog queries are run
+// by catalog endpoints on request, with parameters bound from the request
+// body in the order they're listed.
+type CatalogQueryDef struct {
+	DB        string             `json:"db" yaml:"db"`
+	Isolation IsolationLevel     `json:"isolation" yaml:"isolation"`
+	Query     string             `json:"query" yaml:"query"`
+	Params    []*CatalogParamDef `json:"params,omitempty" yaml:"params,omitempty"`
+	// Roles, if set, restricts the query to principals with one of the
+	// roles.
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+
+	def *QueryDef
+}
+
+// CatalogParamDef is a parameter of a catalog query. Parameters without a
+// default are required.
+type CatalogParamDef struct {
+	Name    string      `json:"name" yaml:"name"`
+	Type    ArgType     `json:"type" yaml:"type"`
+	Default interface{} `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+func (cq *CatalogQueryDef) Validate() error {
+	var me *multierror.Error
+	if cq.DB == "" {
+		me = multierror.Append(me, errors.New("db is empty"))
+	}
+	if cq.Query == "" {
+		me = multierror.Append(me, errors.New("query is empty"))
+	}
+
+	args := make(ArgDefs, len(cq.Params))
+	seen := map[string]bool{}
+	for i, pd := range cq.Params {
+		switch {
+		case pd == nil:
+			me = multierror.Append(me, fmt.Errorf("param %d is nil", i))
+			continue
+		case pd.Name == "":
+			me = multierror.Append(me, fmt.Errorf("param %d has no name", i))
+		case seen[pd.Name]:
+			me = multierror.Append(me, fmt.Errorf("param %q is defined more than once", pd.Name))
+		}
+		seen[pd.Name] = true
+		if pd.Default != nil {
+			if _, err := pd.Type.Convert(pd.Default); err != nil {
+				me = multierror.Append(me, fmt.Errorf("param %q has an invalid default: %w", pd.Name, err))
+			}
+		}
+		args[i] = QueryParamRef{Name: pd.Name}
+	}
+
+	cq.def = &QueryDef{
+		Transactions: []*TransactionDef{{DB: cq.DB, Isolation: cq.Isolation}},
+		Steps:        []*StepDef{{Query: cq.Query, Args: args}},
+	}
+	return errorOrNil(me)
+}
+
+// Bind returns the values of the query's parameters from the request's
+// params. Every parameter of the request must be defined by the query.
+func (cq *CatalogQueryDef) Bind(params map[string]interface{}) (map[string]interface{}, error) {
+	var perrs ParamErrors
+	defined := make(map[string]bool, len(cq.Params))
+	bound := make(map[string]interface{}, len(cq.Params))
+	for _, pd := range cq.Params {
+		defined[pd.Name] = true
+		v, ok := params[pd.Name]
+		if !ok {
+			if pd.Default == nil {
+				perrs = append(perrs, &ParamError{In: "body", Name: pd.Name, Err: errors.New("required parameter is missing")})
+				continue
+			}
+			v = pd.Default
+		}
+		v, err := pd.Type.Convert(v)
+		if err != nil {
+			perrs = append(perrs, &ParamError{In: "body", Name: pd.Name, Err: err})
+			continue
+		}
+		bound[pd.Name] = v
+	}
+
+	names := make([]string, 0, len(params))
+	for k := range params {
+		if !defined[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		perrs = append(perrs, &ParamError{In: "body", Name: k, Err: errors.New("unknown parameter")})
+	}
+
+	if len(perrs) > 0 {
+		return nil, perrs
+	}
+	return bound, nil
+}
+
+// CatalogDef makes an endpoint run queries from the catalog. Queries lists
+// the names of the queries the endpoint may run; if empty, it may run any.
+type CatalogDef struct {
+	Queries []string `json:"queries,omitempty" yaml:"queries,omitempty"`
+}
+
+// Allows reports whether the endpoint may run the named query.
+func (cd *CatalogDef) Allows(name string) bool {
+	if len(cd.Queries) == 0 {
+		return true
+	}
+	for _, q := range cd.Queries {
+		if q == name {
+			return true
+		}
+	}
+	return false
+}
+
+// catalogRequest is the body of a request to a catalog endpoint.
+type catalogRequest struct {
+	Query  string                 `json:"query"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// ServeCatalog handles requests to catalog endpoints. The request names a query
+// in the catalog and gives its parameters; SQL is never accepted from the
+// request.
+func (h *Handler) ServeCatalog(w http.ResponseWriter, req *http.Request, pathParams httprouter.Params) {
+	req, ctx, log := h.WithLogger(req)
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "error reading request body"})
+		return
+	}
+	var body catalogRequest
+	if err := json.Unmarshal(data, &body); err != nil || body.Query == "" {
+		writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "request body must be an object with a query name and params"})
+		return
+	}
+
+	log = log.With().Str("query", body.Query).Logger()
+	ctx = log.WithContext(ctx)
+
+	cq, ok := h.catalog[body.Query]
+	if !ok || !h.Catalog.Allows(body.Query) {
+		writeError(log, w, http.StatusNotFound, &errorResponse{Error: "unknown query"})
+		return
+	}
+	if len(cq.Roles) > 0 && !principalFromContext(ctx).HasRole(cq.Roles...) {
+		writeError(log, w, http.StatusForbidden, &errorResponse{Error: "forbidden"})
+		return
+	}
+
+	bound, err := cq.Bind(body.Params)
+	if err != nil {
+		log.Trace().Err(err).Msg("Error binding query parameters. Request aborted.")
+		replyParamError(log, w, err)
+		return
+	}
+	params, err := h.ParseParams(req, pathParams)
+	if err != nil {
+		log.Trace().Err(err).Msg("Error parsing parameters. Request aborted.")
+		replyParamError(log, w, err)
+		return
+	}
+	params.Query = bound
+	params.Page.WriteHeaders(w.Header())
+
+	out, release, err := h.computeResponse(ctx, log, w, req, cq.def, params, nil)
+	if err != nil {
+		return
+	}
+	defer release()
+	h.reply(ctx, log, w, req, out)
+}
@@ -0,0 +1,230 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// version is the version of chisel. It may be set at build time with
+// -ldflags "-X main.version=...". Otherwise, the module version is used.
+var version = ""
+
+// subcommand is a chisel subcommand. Run is given a flag set named for the
+// subcommand and the arguments following its name.
+type subcommand struct {
+	Usage string
+	Run   func(ctx context.Context, fs *flag.FlagSet, args []string) int
+}
+
+var subcommands = map[string]subcommand{
+	"serve":        {"Serve the config's endpoints (default).", Serve},
+	"validate":     {"Check a config without serving it.", ValidateConfig},
+	"print-config": {"Print the parsed config as JSON, with secrets redacted.", PrintConfig},
+	"routes":       {"List the routes served by each binding.", PrintRoutes},
+	"version":      {"Print the version of chisel.", PrintVersion},
+	"scaffold":     {"Generate a config for a database's tables.", Scaffold},
+	"init":         {"Write an example config to start a project from.", Init},
+}
+
+// Main runs the subcommand named by the first of args. If args is empty or
+// begins with a flag, chisel serves its config, as it did before it had
+// subcommands.
+func Main(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printSubcommands(fs.Output(), fs.Name())
+		return 0
+	}
+	cmd, ok := subcommands[name]
+	if !ok {
+		fmt.Fprintf(fs.Output(), "unknown command %q\n", name)
+		printSubcommands(fs.Output(), fs.Name())
+		return 2
+	}
+	if name == "serve" {
+		// Serve keeps the program's flag set so that its flags are read
+		// from the same environment variables as before subcommands.
+		return cmd.Run(ctx, fs, args)
+	}
+	sfs := flag.NewFlagSet(fs.Name()+" "+name, fs.ErrorHandling())
+	sfs.SetOutput(fs.Output())
+	return cmd.Run(ctx, sfs, args)
+}
+
+func printSubcommands(w io.Writer, prog string) {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "Usage: %s [command] [flags]\n\nCommands:\n", prog)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, subcommands[name].Usage)
+	}
+	_ = tw.Flush()
+}
+
+// configFlags are the flags that select the config subcommands load.
+type configFlags struct {
+	path     string
+	profile  string
+	values   string
+	noStrict bool
+	remote   *remoteConfig
+}
+
+// addConfigFlags adds the flags that select a config to fs.
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{path: "config.json"}
+	fs.StringVar(&cf.path, "c", cf.path, "The `path` to load program config JSON or YAML from. May be a directory or an https:// or s3:// URL.")
+	fs.StringVar(&cf.profile, "profile", cf.profile, "The config `profile` to apply overlays for, such as prod for config.prod.yaml. Defaults to $"+profileEnv+".")
+	fs.StringVar(&cf.values, "values", cf.values, "The `path` of a JSON or YAML file of values for config templates.")
+	fs.BoolVar(&cf.noStrict, "no-strict", cf.noStrict, "Ignore unknown fields in the config instead of failing.")
+	cf.remote = addRemoteConfigFlags(fs)
+	return cf
+}
+
+// resolveProfile defaults the profile to $CHISEL_PROFILE and checks it.
+func (cf *configFlags) resolveProfile() error {
+	if cf.profile == "" {
+		cf.profile = os.Getenv(profileEnv)
+	}
+	return validProfile(cf.profile)
+}
+
+// load loads the selected config.
+func (cf *configFlags) load() (*Config, error) {
+	allowUnknownFields = cf.noStrict
+	configValuesPath = cf.values
+	return loadConfig(cf.path, cf.profile, cf.remote)
+}
+
+// parseCommandFlags parses args with fs and returns the exit code to use if
+// they can't be parsed.
+func parseCommandFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 2, false
+	} else if err != nil {
+		return 1, false
+	}
+	return 0, true
+}
+
+// PrintConfig implements the print-config subcommand, which prints the
+// parsed config as JSON or YAML with its secrets redacted.
+func PrintConfig(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	format := "json"
+	cf := addConfigFlags(fs)
+	fs.StringVar(&format, "f", format, "The `format` to print the config in: json or yaml.")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	out := fs.Output()
+	if !validConfigFormat(format) {
+		fmt.Fprintf(out, "error: unrecognized config format %q\n", format)
+		return 2
+	}
+	if err := cf.resolveProfile(); err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return 2
+	}
+	conf, err := cf.load()
+	if err != nil {
+		return reportErrors(out, err)
+	}
+	data, err := redactConfig(conf, format)
+	if err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return 1
+	}
+	if format == "json" {
+		data = append(data, '\n')
+	}
+	_, _ = os.Stdout.Write(data)
+	return 0
+}
+
+// PrintRoutes implements the routes subcommand, which lists the method and
+// path of every route served on each binding.
+func PrintRoutes(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	cf := addConfigFlags(fs)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	out := fs.Output()
+	if err := cf.resolveProfile(); err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return 2
+	}
+	conf, err := cf.load()
+	if err != nil {
+		return reportErrors(out, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BIND\tMETHOD\tPATH\tNAME")
+	for bid, bd := range conf.Bind {
+		for _, ed := range conf.Endpoints {
+			if len(ed.Bind) > 0 && !ed.Bind.Contains(bid) {
+				continue
+			}
+			name := ed.Name
+			if name == "" {
+				name = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", bd.Addr.String(), strings.ToUpper(ed.Method), ed.Path, name)
+		}
+		if conf.Discovery.servedOn(bid) {
+			fmt.Fprintf(tw, "%s\tGET\t%s\t(discovery)\n", bd.Addr.String(), conf.Discovery.Path)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// PrintVersion implements the version subcommand.
+func PrintVersion(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	v := version
+	if v == "" {
+		v = "(devel)"
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+			v = bi.Main.Version
+		}
+	}
+	fmt.Fprintf(os.Stdout, "chisel %s\n", v)
+	return 0
+}
@@ -0,0 +1,148 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CommitOrder determines the order a query's transactions are committed in.
+// Once a commit fails, the transactions after it are rolled back instead,
+// and the compensations of those already committed are run.
+type CommitOrder int
+
+const (
+	DeclaredCommitOrder   CommitOrder = iota // declared - Default
+	ReverseCommitOrder                       // reverse
+	WritesLastCommitOrder                    // writes_last - Read-only transactions first, then the rest in declared order.
+)
+
+func (o CommitOrder) MarshalText() ([]byte, error) {
+	typ := "declared"
+	switch o {
+	case DeclaredCommitOrder:
+	case ReverseCommitOrder:
+		typ = "reverse"
+	case WritesLastCommitOrder:
+		typ = "writes_last"
+	default:
+		return nil, fmt.Errorf("unrecognized commit order %d", o)
+	}
+	return []byte(typ), nil
+}
+
+func (o *CommitOrder) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "declared":
+		*o = DeclaredCommitOrder
+	case "reverse":
+		*o = ReverseCommitOrder
+	case "writes_last":
+		*o = WritesLastCommitOrder
+	default:
+		return fmt.Errorf("unrecognized commit order %q", src)
+	}
+	return nil
+}
+
+// Order returns the indices of tds in the order they should be committed.
+func (o CommitOrder) Order(tds []*TransactionDef) []int {
+	order := make([]int, 0, len(tds))
+	switch o {
+	case ReverseCommitOrder:
+		for i := len(tds) - 1; i >= 0; i-- {
+			order = append(order, i)
+		}
+	case WritesLastCommitOrder:
+		for i, td := range tds {
+			if td.ReadOnly {
+				order = append(order, i)
+			}
+		}
+		for i, td := range tds {
+			if !td.ReadOnly {
+				order = append(order, i)
+			}
+		}
+	default:
+		for i := range tds {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// CompensateDef is a statement that undoes the writes of a committed
+// transaction. It runs outside of any transaction if a transaction
+// committed after it fails to commit. Its args are resolved as for steps,
+// and may refer to the results of every step that ran.
+type CompensateDef struct {
+	Query string  `json:"query" yaml:"query"`
+	Args  ArgDefs `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+func (cd *CompensateDef) Validate() error {
+	if cd.Query == "" {
+		return errors.New("query is empty")
+	}
+	return nil
+}
+
+// compensate runs the compensations of the committed transactions, in
+// reverse of the order they were committed in. Errors are logged, since
+// the request has already failed.
+func (ex *executor) compensate(ctx context.Context, committed []int) {
+	for i := len(committed) - 1; i >= 0; i-- {
+		ti := committed[i]
+		cd := ex.def.Transactions[ti].Compensate
+		if cd == nil {
+			continue
+		}
+		log := ex.log.With().Int("transaction", ti).Logger()
+		if err := ex.runCompensation(ctx, ti, cd); err != nil {
+			log.Error().Err(err).Msg("Error compensating committed transaction.")
+			continue
+		}
+		log.Warn().Msg("Compensated committed transaction.")
+	}
+}
+
+func (ex *executor) runCompensation(ctx context.Context, ti int, cd *CompensateDef) error {
+	args := make([]interface{}, len(cd.Args))
+	for i, ad := range cd.Args {
+		arg, err := ex.argCtx.Resolve(ctx, ad)
+		if err != nil {
+			return fmt.Errorf("error resolving argument %d: %w", i, err)
+		}
+		args[i] = arg
+	}
+	query, args, err := sqlx.In(cd.Query, args...)
+	if err != nil {
+		return fmt.Errorf("error expanding IN(?) arguments: %w", err)
+	}
+	db := ex.db[ex.def.Transactions[ti].DB]
+	db.acquire()
+	defer db.release()
+	query = db.Comment.Prepend(rebind(db.options.BindType, query), ex.tags, "compensate")
+	if _, err := db.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("error running compensation: %w", err)
+	}
+	return nil
+}
@@ -22,7 +22,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,14 +33,19 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/itchyny/gojq"
+	"github.com/julienschmidt/httprouter"
 	"github.com/tailscale/hujson"
 	"go.spiff.io/sql/vdb"
 	"gopkg.in/yaml.v3"
 )
 
+// unmarshalStrict decodes HuJSON from p into dest, rejecting unknown fields
+// unless allowUnknownFields is set.
 func unmarshalStrict(p []byte, dest interface{}) error {
 	dec := hujson.NewDecoder(bytes.NewReader(p))
-	dec.DisallowUnknownFields()
+	if !allowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
 	return dec.Decode(&dest)
 }
 
@@ -59,32 +66,709 @@ func (sa *SockAddr) UnmarshalText(src []byte) error {
 	return nil
 }
 
+// BindDef is an address to listen on and the middleware applied to all
+// requests received on it. A BindDef may be given as a plain address string
+// when no other options are needed.
+type BindDef struct {
+	Addr       SockAddr        `json:"addr" yaml:"addr"`
+	Middleware MiddlewareNames `json:"middleware,omitempty" yaml:"middleware,omitempty"`
+
+	// RedirectTrailingSlash and RedirectFixedPath override the config's
+	// strict_routing for the binding. See Config.StrictRouting.
+	RedirectTrailingSlash *bool `json:"redirect_trailing_slash,omitempty" yaml:"redirect_trailing_slash,omitempty"`
+	RedirectFixedPath     *bool `json:"redirect_fixed_path,omitempty" yaml:"redirect_fixed_path,omitempty"`
+
+	ServerDef `yaml:",inline"`
+}
+
+// ServerDef tunes the HTTP server and listener of a binding. Zero values
+// use Go's defaults.
+type ServerDef struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout,omitempty" yaml:"read_header_timeout,omitempty"`
+	IdleTimeout       Duration `json:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty"`
+	MaxHeaderBytes    int      `json:"max_header_bytes,omitempty" yaml:"max_header_bytes,omitempty"`
+	DisableKeepAlives bool     `json:"disable_keep_alives,omitempty" yaml:"disable_keep_alives,omitempty"`
+	// TCPKeepAlive is the keep-alive period of accepted TCP connections.
+	// If negative, TCP keep-alives are disabled.
+	TCPKeepAlive Duration `json:"tcp_keep_alive,omitempty" yaml:"tcp_keep_alive,omitempty"`
+	// DeferAccept, if set, defers accepting TCP connections until they
+	// have data to read or DeferAccept passes. It is only supported on
+	// Linux.
+	DeferAccept Duration `json:"defer_accept,omitempty" yaml:"defer_accept,omitempty"`
+}
+
+func (sd *ServerDef) Validate() error {
+	var me *multierror.Error
+	if sd.ReadHeaderTimeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("read_header_timeout must not be negative"))
+	}
+	if sd.IdleTimeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("idle_timeout must not be negative"))
+	}
+	if sd.MaxHeaderBytes < 0 {
+		me = multierror.Append(me, errors.New("max_header_bytes must not be negative"))
+	}
+	if sd.DeferAccept.Duration < 0 {
+		me = multierror.Append(me, errors.New("defer_accept must not be negative"))
+	} else if sd.DeferAccept.Duration > 0 && !deferAcceptSupported {
+		me = multierror.Append(me, errors.New("defer_accept is only supported on Linux"))
+	}
+	return errorOrNil(me)
+}
+
+// Server returns an HTTP server for handler configured by sd.
+func (sd *ServerDef) Server(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: sd.ReadHeaderTimeout.Duration,
+		IdleTimeout:       sd.IdleTimeout.Duration,
+		MaxHeaderBytes:    sd.MaxHeaderBytes,
+	}
+	if sd.DisableKeepAlives {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	return srv
+}
+
+// newRouter returns a router for the binding. Unless strict is set or
+// overridden by the binding, requests are redirected to the path of a route
+// that matches them with or without a trailing slash, or after cleaning the
+// path and correcting its case.
+func (bd *BindDef) newRouter(strict bool) *httprouter.Router {
+	rt := httprouter.New()
+	rt.RedirectTrailingSlash = !strict
+	rt.RedirectFixedPath = !strict
+	if bd.RedirectTrailingSlash != nil {
+		rt.RedirectTrailingSlash = *bd.RedirectTrailingSlash
+	}
+	if bd.RedirectFixedPath != nil {
+		rt.RedirectFixedPath = *bd.RedirectFixedPath
+	}
+	return rt
+}
+
+type bindDef BindDef
+
+func (bd *BindDef) UnmarshalJSON(src []byte) error {
+	var addr string
+	if unmarshalStrict(src, &addr) == nil {
+		*bd = BindDef{}
+		return bd.Addr.UnmarshalText([]byte(addr))
+	}
+	var def bindDef
+	if err := unmarshalStrict(src, &def); err != nil {
+		return err
+	}
+	*bd = BindDef(def)
+	return nil
+}
+
+func (bd *BindDef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*bd = BindDef{}
+		return node.Decode(&bd.Addr)
+	}
+	var def bindDef
+	if err := decodeNodeStrict(node, &def); err != nil {
+		return err
+	}
+	*bd = BindDef(def)
+	return nil
+}
+
 type Config struct {
-	Bind      []SockAddr              `json:"bind" yaml:"bind"`
+	// Version is the version of the config format the file is written
+	// for. Files without a version are version 1. Files written for older
+	// versions are upgraded when they're loaded.
+	Version int `json:"version,omitempty" yaml:"version,omitempty"`
+
+	// Include lists additional config files to read and merge into this
+	// one, as for config directories. Paths may be globs, and relative
+	// paths are relative to the directory of the including file.
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+
+	Bind      []*BindDef              `json:"bind" yaml:"bind"`
 	Databases map[string]*DatabaseDef `json:"databases" yaml:"databases"`
 	Modules   map[string]*ModuleDef   `json:"modules" yaml:"modules"`
-	Endpoints EndpointDefs            `json:"endpoints" yaml:"endpoints"`
+	// Vars are constants that expressions may refer to as $vars, such as
+	// $vars.page_size.
+	Vars       map[string]interface{}      `json:"vars,omitempty" yaml:"vars,omitempty"`
+	Middleware map[string]*MiddlewareDef   `json:"middleware,omitempty" yaml:"middleware,omitempty"`
+	Endpoints  EndpointDefs                `json:"endpoints" yaml:"endpoints"`
+	Log        *LogDef                     `json:"log,omitempty" yaml:"log,omitempty"`
+	Admin      *BindDef                    `json:"admin,omitempty" yaml:"admin,omitempty"`
+	Trace      *TraceDef                   `json:"trace,omitempty" yaml:"trace,omitempty"`
+	Outboxes   map[string]*OutboxDef       `json:"outboxes,omitempty" yaml:"outboxes,omitempty"`
+	Datasets   map[string]*DatasetDef      `json:"datasets,omitempty" yaml:"datasets,omitempty"`
+	Templates  map[string]*TemplateDef     `json:"templates,omitempty" yaml:"templates,omitempty"`
+	Generate   []*GenerateDef              `json:"generate,omitempty" yaml:"generate,omitempty"`
+	Catalog    map[string]*CatalogQueryDef `json:"catalog,omitempty" yaml:"catalog,omitempty"`
+	Links      *LinksDef                   `json:"links,omitempty" yaml:"links,omitempty"`
+	Pools      map[string]*PoolDef         `json:"pools,omitempty" yaml:"pools,omitempty"`
+	Secrets    map[string]*SecretDef       `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+
+	// HTTPClient, if set, configures the client of outbound HTTP requests
+	// that don't name one of HTTPClients, such as for proxies and private
+	// CAs.
+	HTTPClient  *HTTPClientDef            `json:"http_client,omitempty" yaml:"http_client,omitempty"`
+	HTTPClients map[string]*HTTPClientDef `json:"http_clients,omitempty" yaml:"http_clients,omitempty"`
+
+	// Diagnostics, if set, allows diagnostic bundles to be written on
+	// SIGQUIT or through the admin API.
+	Diagnostics *DiagnosticsDef `json:"diagnostics,omitempty" yaml:"diagnostics,omitempty"`
+
+	// Discovery, if set, serves a route listing the configured endpoints.
+	Discovery *DiscoveryDef `json:"discovery,omitempty" yaml:"discovery,omitempty"`
+
+	// EndpointDefaults, if set, holds values that endpoints use unless they
+	// set their own.
+	EndpointDefaults *EndpointDefaultsDef `json:"endpoint_defaults,omitempty" yaml:"endpoint_defaults,omitempty"`
+
+	// ExternalURL is the base URL clients reach the server at, such as
+	// https://api.example.com/v1, for building absolute URLs behind
+	// proxies. If empty, URLs are built from the forwarding headers of
+	// requests from TrustedProxies, or from requests themselves.
+	ExternalURL    string   `json:"external_url,omitempty" yaml:"external_url,omitempty"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty" yaml:"trusted_proxies,omitempty"`
+	external       *externalURLs
+
+	// StrictRouting, if true, disables redirects to the canonical path of
+	// a route for requests whose paths differ from it by a trailing slash,
+	// case, or unclean elements such as "..". API clients often do not
+	// follow these redirects. Bindings may override this.
+	StrictRouting bool `json:"strict_routing,omitempty" yaml:"strict_routing,omitempty"`
+
+	// StrictSecrets, if true, refuses to print the config (with -C or the
+	// admin API) if it contains values that look like secrets but are
+	// not redacted.
+	StrictSecrets bool `json:"strict_secrets,omitempty" yaml:"strict_secrets,omitempty"`
+
+	profileChanges []string // Keys changed by profile overlays, as "file: key".
+	migrations     []string // Changes made upgrading files from older versions, as "file: key: change".
+	fileVersion    int      // Version the file was written for, before it was upgraded. Not merged.
+	sources        []string // Files and globs the config was read from, watched by -watch.
 }
 
 func (c *Config) Validate() error {
 	var me *multierror.Error
-	// dbsUsed := StringSet{}
+	for k, md := range c.Middleware {
+		if err := md.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("middleware=%q failed validation: %w", k, err))
+			continue
+		}
+		if ld := md.limits(); ld != nil {
+			if _, ok := c.Databases[ld.DB]; !ok {
+				me = multierror.Append(me, fmt.Errorf("middleware=%q limits refer to undefined database %q", k, ld.DB))
+			}
+		}
+		if qm := md.quota(); qm != nil && qm.DB != "" {
+			if _, ok := c.Databases[qm.DB]; !ok {
+				me = multierror.Append(me, fmt.Errorf("middleware=%q refers to undefined database %q", k, qm.DB))
+			}
+		}
+	}
+	for bid, bd := range c.Bind {
+		if bd == nil {
+			me = multierror.Append(me, fmt.Errorf("bind=%d is nil", bid))
+			continue
+		}
+		if err := bd.Middleware.Validate(c.Middleware); err != nil {
+			me = multierror.Append(me, fmt.Errorf("bind=%d failed validation: %w", bid, err))
+		}
+		if err := bd.ServerDef.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("bind=%d failed validation: %w", bid, err))
+		}
+	}
+	if c.Admin != nil {
+		if err := c.Admin.Middleware.Validate(c.Middleware); err != nil {
+			me = multierror.Append(me, fmt.Errorf("admin failed validation: %w", err))
+		}
+		if err := c.Admin.ServerDef.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("admin failed validation: %w", err))
+		}
+	}
+	if c.Log != nil {
+		if err := c.Log.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("log failed validation: %w", err))
+		}
+	}
+	if c.HTTPClient != nil {
+		if err := c.HTTPClient.Validate(nil); err != nil {
+			me = multierror.Append(me, fmt.Errorf("http_client failed validation: %w", err))
+		}
+	}
+	for k, hd := range c.HTTPClients {
+		if err := hd.Validate(c.HTTPClient); err != nil {
+			me = multierror.Append(me, fmt.Errorf("http client=%q failed validation: %w", k, err))
+		}
+	}
+	for k, od := range c.Outboxes {
+		if err := od.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("outbox=%q failed validation: %w", k, err))
+			continue
+		}
+		if _, ok := c.Databases[od.DB]; !ok {
+			me = multierror.Append(me, fmt.Errorf("outbox=%q refers to undefined database %q", k, od.DB))
+		}
+		if client, ok := c.httpClient(od.Sink.Client); ok {
+			od.Sink.client = client
+		} else {
+			me = multierror.Append(me, fmt.Errorf("outbox=%q refers to undefined http client %q", k, od.Sink.Client))
+		}
+	}
+	for k, dd := range c.Datasets {
+		if err := dd.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("dataset=%q failed validation: %w", k, err))
+			continue
+		}
+		if _, ok := c.Databases[dd.DB]; !ok {
+			me = multierror.Append(me, fmt.Errorf("dataset=%q refers to undefined database %q", k, dd.DB))
+		}
+	}
+	for k, cq := range c.Catalog {
+		if cq == nil {
+			me = multierror.Append(me, fmt.Errorf("catalog query=%q is nil", k))
+			continue
+		}
+		if err := cq.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("catalog query=%q failed validation: %w", k, err))
+		}
+		if _, ok := c.Databases[cq.DB]; !ok {
+			me = multierror.Append(me, fmt.Errorf("catalog query=%q refers to undefined database %q", k, cq.DB))
+		}
+	}
+	if c.Trace != nil {
+		if err := c.Trace.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("trace failed validation: %w", err))
+		}
+	}
+	for k, pd := range c.Pools {
+		if pd == nil {
+			me = multierror.Append(me, fmt.Errorf("pool=%q is nil", k))
+			continue
+		}
+		if err := pd.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("pool=%q failed validation: %w", k, err))
+		}
+	}
+	modulesValid := true
+	for k, md := range c.Modules {
+		if md == nil {
+			me = multierror.Append(me, fmt.Errorf("module=%q is nil", k))
+			modulesValid = false
+			continue
+		}
+		if err := md.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("module=%q failed validation: %w", k, err))
+			modulesValid = false
+		}
+	}
+	if modulesValid {
+		if err := c.compileExprs(); err != nil {
+			me = multierror.Append(me, err)
+		}
+	}
+	if err := c.bindVars(); err != nil {
+		me = multierror.Append(me, err)
+	}
+	for k, sd := range c.Secrets {
+		if sd == nil {
+			me = multierror.Append(me, fmt.Errorf("secret=%q is nil", k))
+			continue
+		}
+		if err := sd.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("secret=%q failed validation: %w", k, err))
+		}
+	}
+	for k, dd := range c.Databases {
+		if name, ok := secretName(dd.URL); ok && c.Secrets[name] == nil {
+			me = multierror.Append(me, fmt.Errorf("database=%q refers to undefined secret %q", k, name))
+		}
+		if dd.Comment != nil {
+			if err := dd.Comment.Validate(); err != nil {
+				me = multierror.Append(me, fmt.Errorf("database=%q comment failed validation: %w", k, err))
+			}
+		}
+	}
+	if c.Diagnostics != nil {
+		if err := c.Diagnostics.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("diagnostics failed validation: %w", err))
+		}
+	}
+	if c.Discovery != nil {
+		if err := c.Discovery.Validate(c.Middleware); err != nil {
+			me = multierror.Append(me, fmt.Errorf("discovery failed validation: %w", err))
+		}
+		for _, bid := range c.Discovery.Bind.Ordered() {
+			if bid < 0 || bid >= len(c.Bind) {
+				me = multierror.Append(me, fmt.Errorf("discovery refers to undefined bind %d", bid))
+			}
+		}
+	}
+	external, err := newExternalURLs(c.ExternalURL, c.TrustedProxies)
+	if err != nil {
+		me = multierror.Append(me, err)
+	}
+	c.external = external
+	if c.Links != nil {
+		if err := c.Links.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("links failed validation: %w", err))
+		}
+	}
+	valid := make([]int, 0, len(c.Endpoints))
+	names := map[string]int{}
 	for edi, ed := range c.Endpoints {
-		ident := fmt.Sprintf("endpoint=%d method=%q path=%q", edi, ed.Method, ed.Path)
+		ident := ed.ident(edi)
 		if err := ed.Validate(); err != nil {
 			me = multierror.Append(me, fmt.Errorf("%s failed validation: %w", ident, err))
 			continue
 		}
+		ok := true
+		if ed.Name != "" {
+			if prev, dup := names[ed.Name]; dup {
+				me = multierror.Append(me, fmt.Errorf("%s has the same name as endpoint=%d", ident, prev))
+				ok = false
+			}
+			names[ed.Name] = edi
+		}
+		if err := ed.Middleware.Validate(c.Middleware); err != nil {
+			me = multierror.Append(me, fmt.Errorf("%s failed validation: %w", ident, err))
+		}
+		if ed.Pool != "" && c.Pools[ed.Pool] == nil {
+			me = multierror.Append(me, fmt.Errorf("%s refers to undefined pool %q", ident, ed.Pool))
+			ok = false
+		}
+		for _, bid := range ed.Bind.Ordered() {
+			if bid < 0 || bid >= len(c.Bind) {
+				me = multierror.Append(me, fmt.Errorf("%s refers to undefined bind %d", ident, bid))
+				ok = false
+			}
+		}
+		if ed.Catalog != nil {
+			for _, name := range ed.Catalog.Queries {
+				if _, defined := c.Catalog[name]; !defined {
+					me = multierror.Append(me, fmt.Errorf("%s refers to undefined catalog query %q", ident, name))
+				}
+			}
+			if ok {
+				valid = append(valid, edi)
+			}
+			continue
+		}
+		for ti, td := range ed.Query.Transactions {
+			if td == nil {
+				me = multierror.Append(me, fmt.Errorf("%s transaction %d is nil", ident, ti))
+			} else if _, defined := c.Databases[td.DB]; !defined {
+				me = multierror.Append(me, fmt.Errorf("%s transaction %d refers to undefined database %q", ident, ti, td.DB))
+			}
+		}
+		if err := c.validateEmits(ed); err != nil {
+			me = multierror.Append(me, fmt.Errorf("%s failed validation: %w", ident, err))
+		}
+		for si, sd := range ed.Query.Steps {
+			if sd.HTTP != nil {
+				if client, ok := c.httpClient(sd.HTTP.Client); ok {
+					sd.HTTP.client = client
+				} else {
+					me = multierror.Append(me, fmt.Errorf("%s step %d refers to undefined http client %q", ident, si, sd.HTTP.Client))
+				}
+			}
+			if sd.Dataset == nil {
+				continue
+			}
+			if _, defined := c.Datasets[sd.Dataset.Name]; !defined {
+				me = multierror.Append(me, fmt.Errorf("%s step %d refers to undefined dataset %q", ident, si, sd.Dataset.Name))
+			}
+		}
+		if ok {
+			valid = append(valid, edi)
+		}
+	}
+	if err := c.validateRoutes(valid); err != nil {
+		me = multierror.Append(me, err)
 	}
 
 	return errorOrNil(me)
 }
 
+// validateEmits checks that steps emitting outbox events refer to defined
+// outboxes and append to them in the same database transaction as the step.
+func (c *Config) validateEmits(ed *EndpointDef) error {
+	var me *multierror.Error
+	for si, sd := range ed.Query.Steps {
+		if sd.Emit == nil {
+			continue
+		}
+		od, ok := c.Outboxes[sd.Emit.Outbox]
+		if !ok {
+			me = multierror.Append(me, fmt.Errorf("step %d refers to undefined outbox %q", si, sd.Emit.Outbox))
+			continue
+		}
+		td := ed.Query.Transactions[sd.Transaction.Index]
+		if td == nil {
+			continue
+		}
+		if td.DB != od.DB {
+			me = multierror.Append(me, fmt.Errorf("step %d emits to outbox %q in database %q from a transaction in database %q", si, sd.Emit.Outbox, od.DB, td.DB))
+		}
+		if !td.Isolation.RequiresTranscation() {
+			me = multierror.Append(me, fmt.Errorf("step %d emits events outside of a transaction", si))
+		}
+	}
+	return errorOrNil(me)
+}
+
+type routeKey struct {
+	bind   int
+	method string
+	path   string
+}
+
+// validateRoutes checks that the given endpoints can be added to the router
+// of each binding they're bound to without conflicting with one another.
+// Conflicts are reported here since the router panics on them otherwise.
+func (c *Config) validateRoutes(endpoints []int) error {
+	var me *multierror.Error
+	routers := make([]*httprouter.Router, len(c.Bind))
+	seen := map[routeKey]int{}
+	for _, edi := range endpoints {
+		ed := c.Endpoints[edi]
+		method := strings.ToUpper(ed.Method)
+		ident := ed.ident(edi)
+		for bid := range routers {
+			if len(ed.Bind) > 0 && !ed.Bind.Contains(bid) {
+				continue
+			}
+			key := routeKey{bind: bid, method: method, path: ed.Path}
+			if prev, ok := seen[key]; ok {
+				me = multierror.Append(me, fmt.Errorf("%s conflicts with endpoint=%d on bind=%d: method and path are the same", ident, prev, bid))
+				continue
+			}
+			seen[key] = edi
+			if routers[bid] == nil {
+				routers[bid] = httprouter.New()
+			}
+			if err := checkRoute(routers[bid], method, ed.Path); err != nil {
+				me = multierror.Append(me, fmt.Errorf("%s conflicts with another endpoint on bind=%d: %w", ident, bid, err))
+			}
+		}
+	}
+	for bid := range routers {
+		if !c.Discovery.servedOn(bid) {
+			continue
+		}
+		if routers[bid] == nil {
+			routers[bid] = httprouter.New()
+		}
+		if err := checkRoute(routers[bid], "GET", c.Discovery.Path); err != nil {
+			me = multierror.Append(me, fmt.Errorf("discovery path %q conflicts with an endpoint on bind=%d: %w", c.Discovery.Path, bid, err))
+		}
+	}
+	return errorOrNil(me)
+}
+
+// checkRoute adds a no-op route to rt and returns an error if the router
+// rejects it.
+func checkRoute(rt *httprouter.Router, method, path string) (err error) {
+	defer func() {
+		if rc := recover(); rc != nil {
+			err = fmt.Errorf("%v", rc)
+		}
+	}()
+	rt.Handle(method, path, func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+	return nil
+}
+
+// Merge merges other into c. Bindings and endpoints are appended to those of
+// c, while databases, middleware, and modules are added by name. It is an
+// error for any of those to be defined by both c and other.
+func (c *Config) Merge(other *Config) error {
+	var me *multierror.Error
+	c.Bind = append(c.Bind, other.Bind...)
+	c.Endpoints = append(c.Endpoints, other.Endpoints...)
+	c.Generate = append(c.Generate, other.Generate...)
+	if other.Log != nil {
+		if c.Log != nil {
+			me = multierror.Append(me, errors.New("log is already defined"))
+		}
+		c.Log = other.Log
+	}
+	if other.Admin != nil {
+		if c.Admin != nil {
+			me = multierror.Append(me, errors.New("admin is already defined"))
+		}
+		c.Admin = other.Admin
+	}
+	for k, v := range other.Templates {
+		if _, ok := c.Templates[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("template %q is already defined", k))
+			continue
+		}
+		if c.Templates == nil {
+			c.Templates = make(map[string]*TemplateDef, len(other.Templates))
+		}
+		c.Templates[k] = v
+	}
+	for k, v := range other.Outboxes {
+		if _, ok := c.Outboxes[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("outbox %q is already defined", k))
+			continue
+		}
+		if c.Outboxes == nil {
+			c.Outboxes = make(map[string]*OutboxDef, len(other.Outboxes))
+		}
+		c.Outboxes[k] = v
+	}
+	if other.HTTPClient != nil {
+		if c.HTTPClient != nil {
+			me = multierror.Append(me, errors.New("http_client is already defined"))
+		}
+		c.HTTPClient = other.HTTPClient
+	}
+	for k, v := range other.HTTPClients {
+		if _, ok := c.HTTPClients[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("http client %q is already defined", k))
+			continue
+		}
+		if c.HTTPClients == nil {
+			c.HTTPClients = make(map[string]*HTTPClientDef, len(other.HTTPClients))
+		}
+		c.HTTPClients[k] = v
+	}
+	for k, v := range other.Datasets {
+		if _, ok := c.Datasets[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("dataset %q is already defined", k))
+			continue
+		}
+		if c.Datasets == nil {
+			c.Datasets = make(map[string]*DatasetDef, len(other.Datasets))
+		}
+		c.Datasets[k] = v
+	}
+	for k, v := range other.Pools {
+		if _, ok := c.Pools[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("pool %q is already defined", k))
+			continue
+		}
+		if c.Pools == nil {
+			c.Pools = make(map[string]*PoolDef, len(other.Pools))
+		}
+		c.Pools[k] = v
+	}
+	for k, v := range other.Secrets {
+		if _, ok := c.Secrets[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("secret %q is already defined", k))
+			continue
+		}
+		if c.Secrets == nil {
+			c.Secrets = make(map[string]*SecretDef, len(other.Secrets))
+		}
+		c.Secrets[k] = v
+	}
+	for k, v := range other.Catalog {
+		if _, ok := c.Catalog[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("catalog query %q is already defined", k))
+			continue
+		}
+		if c.Catalog == nil {
+			c.Catalog = make(map[string]*CatalogQueryDef, len(other.Catalog))
+		}
+		c.Catalog[k] = v
+	}
+	if other.Trace != nil {
+		if c.Trace != nil {
+			me = multierror.Append(me, errors.New("trace is already defined"))
+		}
+		c.Trace = other.Trace
+	}
+	if other.Links != nil {
+		if c.Links != nil {
+			me = multierror.Append(me, errors.New("links is already defined"))
+		}
+		c.Links = other.Links
+	}
+	if other.Diagnostics != nil {
+		if c.Diagnostics != nil {
+			me = multierror.Append(me, errors.New("diagnostics is already defined"))
+		}
+		c.Diagnostics = other.Diagnostics
+	}
+	if other.Discovery != nil {
+		if c.Discovery != nil {
+			me = multierror.Append(me, errors.New("discovery is already defined"))
+		}
+		c.Discovery = other.Discovery
+	}
+	if other.EndpointDefaults != nil {
+		if c.EndpointDefaults != nil {
+			me = multierror.Append(me, errors.New("endpoint_defaults is already defined"))
+		}
+		c.EndpointDefaults = other.EndpointDefaults
+	}
+	c.StrictSecrets = c.StrictSecrets || other.StrictSecrets
+	c.profileChanges = append(c.profileChanges, other.profileChanges...)
+	c.migrations = append(c.migrations, other.migrations...)
+	c.sources = append(c.sources, other.sources...)
+	if c.Version == 0 {
+		c.Version = other.Version
+	}
+	c.StrictRouting = c.StrictRouting || other.StrictRouting
+	if other.ExternalURL != "" {
+		if c.ExternalURL != "" {
+			me = multierror.Append(me, errors.New("external_url is already defined"))
+		}
+		c.ExternalURL = other.ExternalURL
+	}
+	c.TrustedProxies = append(c.TrustedProxies, other.TrustedProxies...)
+	for k, v := range other.Databases {
+		if _, ok := c.Databases[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("database %q is already defined", k))
+			continue
+		}
+		if c.Databases == nil {
+			c.Databases = make(map[string]*DatabaseDef, len(other.Databases))
+		}
+		c.Databases[k] = v
+	}
+	for k, v := range other.Middleware {
+		if _, ok := c.Middleware[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("middleware %q is already defined", k))
+			continue
+		}
+		if c.Middleware == nil {
+			c.Middleware = make(map[string]*MiddlewareDef, len(other.Middleware))
+		}
+		c.Middleware[k] = v
+	}
+	for k, v := range other.Modules {
+		if _, ok := c.Modules[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("module %q is already defined", k))
+			continue
+		}
+		if c.Modules == nil {
+			c.Modules = make(map[string]*ModuleDef, len(other.Modules))
+		}
+		c.Modules[k] = v
+	}
+	for k, v := range other.Vars {
+		if _, ok := c.Vars[k]; ok {
+			me = multierror.Append(me, fmt.Errorf("var %q is already defined", k))
+			continue
+		}
+		if c.Vars == nil {
+			c.Vars = make(map[string]interface{}, len(other.Vars))
+		}
+		c.Vars[k] = v
+	}
+	return errorOrNil(me)
+}
+
 type QueryOptions struct {
 	TryJSON    bool           `json:"try_json" yaml:"try_json"`
 	SkipJSON   bool           `json:"skip_json" yaml:"skip_json"`
 	TimeFormat vdb.TimeFormat `json:"time_format" yaml:"time_format"`
 	TimeLayout string         `json:"time_layout,omitempty" yaml:"time_layout,omitempty"` // Used if TimeFormat is TimeCustom.
+	Numeric    NumericFormat  `json:"numeric" yaml:"numeric"`
 
 	BindType int `json:"-" yaml:"-"`
 }
@@ -104,6 +788,8 @@ func (q *QueryOptions) QueryOptions() *vdb.QueryOptions {
 }
 
 type DatabaseDef struct {
+	// URL is the database URL, or secret://name to read it from the
+	// secret name.
 	URL string `json:"url" yaml:"url"`
 
 	MaxIdle     int      `json:"max_idle" yaml:"max_idle"`
@@ -111,8 +797,16 @@ type DatabaseDef struct {
 	MaxOpen     int      `json:"max_open" yaml:"max_open"`
 	MaxLifeTime Duration `json:"max_life_time" yaml:"max_life_time"`
 
+	// DrainTimeout is how long the database's pool is kept open for
+	// in-flight transactions after a reload replaces it.
+	DrainTimeout Duration `json:"drain_timeout" yaml:"drain_timeout"`
+
 	Options QueryOptions      `json:"options" yaml:"options"`
 	options *vdb.QueryOptions // Converted options.
+
+	// Comment, if set, prepends a comment identifying the request to the
+	// statements endpoints run on the database.
+	Comment *SQLCommentDef `json:"comment,omitempty" yaml:"comment,omitempty"`
 }
 
 type Duration struct {
@@ -132,9 +826,6 @@ func (d *Duration) UnmarshalText(src []byte) error {
 	return nil
 }
 
-type ModuleDef struct {
-}
-
 type IsolationLevel sql.IsolationLevel
 
 func (i *IsolationLevel) UnmarshalText(src []byte) error {
@@ -199,10 +890,13 @@ func (i IsolationLevel) Level() sql.IsolationLevel {
 type BodyType int
 
 const (
-	JSONBodyType   BodyType = iota // json - Default
-	FormBodyType                   // form
-	StringBodyType                 // string
-	NoBodyType                     // none
+	JSONBodyType      BodyType = iota // json - Default
+	FormBodyType                      // form
+	StringBodyType                    // string
+	NoBodyType                        // none
+	NDJSONBodyType                    // ndjson
+	CSVBodyType                       // csv
+	MultipartBodyType                 // multipart
 )
 
 func (b BodyType) MarshalText() ([]byte, error) {
@@ -215,6 +909,12 @@ func (b BodyType) MarshalText() ([]byte, error) {
 		typ = "string"
 	case NoBodyType:
 		typ = "none"
+	case NDJSONBodyType:
+		typ = "ndjson"
+	case CSVBodyType:
+		typ = "csv"
+	case MultipartBodyType:
+		typ = "multipart"
 	default:
 		return nil, fmt.Errorf("unrecognized body type %d", b)
 	}
@@ -231,40 +931,398 @@ func (b *BodyType) UnmarshalText(src []byte) error {
 		*b = StringBodyType
 	case "none":
 		*b = NoBodyType
+	case "ndjson":
+		*b = NDJSONBodyType
+	case "csv":
+		*b = CSVBodyType
+	case "multipart":
+		*b = MultipartBodyType
 	default:
 		return fmt.Errorf("unrecognized body type %q", src)
 	}
-	return nil
-}
-
-type EndpointDefs []*EndpointDef
-
-type ParamMappings map[string]*ParamMapping
-
-type EndpointDef struct {
-	Bind        IntSet        `json:"bind" yaml:"bind"`
-	Method      string        `json:"method" yaml:"method"`
-	Path        string        `json:"path" yaml:"path"`
-	BodyType    BodyType      `json:"body_type" yaml:"body_type"`
-	QueryParams ParamMappings `json:"query_params" yaml:"query_params"`
-	PathParams  ParamMappings `json:"path_params" yaml:"path_params"`
-
-	Query *QueryDef `json:"query" yaml:"query"`
-}
-
-func (ed *EndpointDef) Validate() error {
-	if ed == nil {
-		return errors.New("endpoint definition is nil")
+	return nil
+}
+
+// EndpointDefs is a config's list of endpoints. In a config file, it may
+// instead be a mapping of endpoint files to read the endpoints from (see
+// endpointFiles).
+type EndpointDefs []*EndpointDef
+
+type ParamMappings map[string]*ParamMapping
+
+func (pm ParamMappings) Ordered() []string {
+	names := make([]string, 0, len(pm))
+	for k := range pm {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type EndpointDef struct {
+	// Name, if set, is a stable name for the endpoint used in logs,
+	// metrics, and the discovery route. Names must be unique.
+	Name          string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Tags          []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Description   string            `json:"description,omitempty" yaml:"description,omitempty"` // Shown by the discovery route.
+	Bind          IntSet            `json:"bind" yaml:"bind"`
+	Method        string            `json:"method" yaml:"method"`
+	Path          string            `json:"path" yaml:"path"`
+	BodyType      *BodyType         `json:"body_type,omitempty" yaml:"body_type,omitempty"`         // If nil, the default body type is used.
+	ContentTypes  ContentTypes      `json:"content_types,omitempty" yaml:"content_types,omitempty"` // Accepted request body types. If empty, any are accepted.
+	RequireBody   bool              `json:"require_body,omitempty" yaml:"require_body,omitempty"`   // Reject requests with empty json or string bodies.
+	QueryParams   ParamMappings     `json:"query_params" yaml:"query_params"`
+	PathParams    ParamMappings     `json:"path_params" yaml:"path_params"`
+	HeaderParams  ParamMappings     `json:"header_params,omitempty" yaml:"header_params,omitempty"` // Keyed by header name.
+	CookieParams  ParamMappings     `json:"cookie_params,omitempty" yaml:"cookie_params,omitempty"` // Keyed by cookie name.
+	ParseQuery    bool              `json:"parse_query,omitempty" yaml:"parse_query,omitempty"`     // Parse unmapped query values that look like numbers or booleans.
+	Middleware    MiddlewareNames   `json:"middleware,omitempty" yaml:"middleware,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"` // Response headers to set.
+	SLO           *SLODef           `json:"slo,omitempty" yaml:"slo,omitempty"`
+	Mask          MaskDefs          `json:"mask,omitempty" yaml:"mask,omitempty"`
+	Xlsx          *XlsxDef          `json:"xlsx,omitempty" yaml:"xlsx,omitempty"`
+	JSONAPI       *JSONAPIDef       `json:"jsonapi,omitempty" yaml:"jsonapi,omitempty"` // Shape JSON responses as JSON:API documents.
+	Batch         *BatchDef         `json:"batch,omitempty" yaml:"batch,omitempty"`
+	Capture       *CaptureDef       `json:"capture,omitempty" yaml:"capture,omitempty"`
+	Deprecated    *DeprecationDef   `json:"deprecated,omitempty" yaml:"deprecated,omitempty"`
+	Pool          string            `json:"pool,omitempty" yaml:"pool,omitempty"` // Name of the worker pool to run requests on.
+	ResponseLimit *ResponseLimitDef `json:"response_limit,omitempty" yaml:"response_limit,omitempty"`
+	Page          *PageDef          `json:"page,omitempty" yaml:"page,omitempty"`                 // Page size limits for paginated endpoints.
+	Stream        *StreamDef        `json:"stream,omitempty" yaml:"stream,omitempty"`             // Chunking of ndjson and csv bodies.
+	StrictQuery   *StrictQueryDef   `json:"strict_query,omitempty" yaml:"strict_query,omitempty"` // Reject unknown and repeated query params.
+	Multipart     *MultipartDef     `json:"multipart,omitempty" yaml:"multipart,omitempty"`       // Limits of multipart bodies.
+
+	Query   *QueryDef   `json:"query" yaml:"query"`
+	Catalog *CatalogDef `json:"catalog,omitempty" yaml:"catalog,omitempty"`
+
+	catchAll string         // Name of the path's catch-all param, if it has one.
+	headers  []string       // Canonical names of the request headers the endpoint uses.
+	cookies  []string       // Names of the cookies the endpoint uses.
+	source   string         // Path of the config file the endpoint was read from.
+	files    *endpointFiles // Endpoint files to read in place of the endpoint, if not nil.
+}
+
+// validateHeaderParams canonicalizes the names of the endpoint's header
+// params and records the headers its mappings and args use, so that only
+// those are read from requests.
+func (ed *EndpointDef) validateHeaderParams() error {
+	var me *multierror.Error
+	used := map[string]bool{}
+	if len(ed.HeaderParams) > 0 {
+		mappings := make(ParamMappings, len(ed.HeaderParams))
+		for _, k := range ed.HeaderParams.Ordered() {
+			name := http.CanonicalHeaderKey(k)
+			if name == "" {
+				me = multierror.Append(me, errors.New("header_params must not map an empty header name"))
+				continue
+			}
+			if _, dup := mappings[name]; dup {
+				me = multierror.Append(me, fmt.Errorf("header_params maps header %q more than once", name))
+				continue
+			}
+			mappings[name] = ed.HeaderParams[k]
+			used[name] = true
+		}
+		ed.HeaderParams = mappings
+	}
+	if ed.Query != nil {
+		for _, sd := range ed.Query.Steps {
+			if sd != nil {
+				sd.Args.headerParams(used)
+			}
+		}
+		for _, td := range ed.Query.Transactions {
+			if td != nil && td.Compensate != nil {
+				td.Compensate.Args.headerParams(used)
+			}
+		}
+	}
+	ed.headers = ed.headers[:0]
+	for name := range used {
+		ed.headers = append(ed.headers, name)
+	}
+	sort.Strings(ed.headers)
+	return errorOrNil(me)
+}
+
+// validateCookieParams records the cookies the endpoint's mappings and args
+// use, so that only those are read from requests.
+func (ed *EndpointDef) validateCookieParams() error {
+	var me *multierror.Error
+	used := map[string]bool{}
+	for name := range ed.CookieParams {
+		if name == "" {
+			me = multierror.Append(me, errors.New("cookie_params must not map an empty cookie name"))
+			continue
+		}
+		used[name] = true
+	}
+	if ed.Query != nil {
+		for _, sd := range ed.Query.Steps {
+			if sd != nil {
+				sd.Args.cookieParams(used)
+			}
+		}
+		for _, td := range ed.Query.Transactions {
+			if td != nil && td.Compensate != nil {
+				td.Compensate.Args.cookieParams(used)
+			}
+		}
+	}
+	ed.cookies = ed.cookies[:0]
+	for name := range used {
+		ed.cookies = append(ed.cookies, name)
+	}
+	sort.Strings(ed.cookies)
+	return errorOrNil(me)
+}
+
+// streamed returns whether the body type's rows are streamed into the
+// query's steps rather than read in full.
+func (b BodyType) streamed() bool {
+	return b == NDJSONBodyType || b == CSVBodyType
+}
+
+// bodyType returns the endpoint's body type, or json if it has none.
+func (ed *EndpointDef) bodyType() BodyType {
+	if ed.BodyType == nil {
+		return JSONBodyType
+	}
+	return *ed.BodyType
+}
+
+// ident identifies the endpoint at index edi of the config in errors.
+func (ed *EndpointDef) ident(edi int) string {
+	if ed == nil {
+		return fmt.Sprintf("endpoint=%d", edi)
+	}
+	ident := fmt.Sprintf("endpoint=%d method=%q path=%q", edi, ed.Method, ed.Path)
+	if ed.Name != "" {
+		ident += fmt.Sprintf(" name=%q", ed.Name)
+	}
+	if ed.source != "" {
+		ident += fmt.Sprintf(" file=%q", ed.source)
+	}
+	return ident
+}
+
+// routeParams returns the names of the params in the route path and the
+// name of its catch-all param, if it has one. Catch-all params must be the
+// last segment of the path.
+func routeParams(path string) (names []string, catchAll string, err error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, "", errors.New("path must begin with /")
+	}
+	seen := map[string]bool{}
+	segs := strings.Split(path[1:], "/")
+	for i, seg := range segs {
+		if seg == "" || (seg[0] != ':' && seg[0] != '*') {
+			continue
+		}
+		name := seg[1:]
+		switch {
+		case name == "":
+			return nil, "", fmt.Errorf("path param %d has no name", len(names))
+		case strings.ContainsAny(name, ":*"):
+			return nil, "", fmt.Errorf("path segment %q may only hold one param", seg)
+		case seen[name]:
+			return nil, "", fmt.Errorf("path param %q is defined more than once", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+		if seg[0] == '*' {
+			if i != len(segs)-1 {
+				return nil, "", fmt.Errorf("catch-all param %q must be at the end of the path", name)
+			}
+			catchAll = name
+		}
+	}
+	return names, catchAll, nil
+}
+
+func (ed *EndpointDef) Validate() error {
+	if ed == nil {
+		return errors.New("endpoint definition is nil")
+	}
+	var me *multierror.Error
+	if ed.Method == "" {
+		me = multierror.Append(me, errors.New("method is empty"))
+	}
+	if ed.Path == "" {
+		me = multierror.Append(me, errors.New("path is empty"))
+	} else if names, catchAll, err := routeParams(ed.Path); err != nil {
+		me = multierror.Append(me, err)
+	} else {
+		ed.catchAll = catchAll
+		defined := make(map[string]bool, len(names))
+		for _, name := range names {
+			defined[name] = true
+		}
+		for _, k := range ed.PathParams.Ordered() {
+			if !defined[k] {
+				me = multierror.Append(me, fmt.Errorf("path_params maps undefined path param %q", k))
+			}
+		}
+		if ed.Query != nil {
+			for si, sd := range ed.Query.Steps {
+				if sd == nil {
+					continue
+				}
+				for _, name := range sd.Args.undefinedPathParams(defined) {
+					me = multierror.Append(me, fmt.Errorf("step %d refers to undefined path param %q", si, name))
+				}
+			}
+			for ti, td := range ed.Query.Transactions {
+				if td == nil || td.Compensate == nil {
+					continue
+				}
+				for _, name := range td.Compensate.Args.undefinedPathParams(defined) {
+					me = multierror.Append(me, fmt.Errorf("transaction %d compensate refers to undefined path param %q", ti, name))
+				}
+			}
+		}
+	}
+	if err := ed.validateHeaderParams(); err != nil {
+		me = multierror.Append(me, err)
+	}
+	if err := ed.validateCookieParams(); err != nil {
+		me = multierror.Append(me, err)
+	}
+	if ed.Catalog != nil {
+		if ed.Query != nil {
+			me = multierror.Append(me, errors.New("endpoint cannot define both query and catalog"))
+		}
+		if !strings.EqualFold(ed.Method, http.MethodPost) {
+			me = multierror.Append(me, errors.New("catalog endpoints must use the POST method"))
+		}
+	} else if err := ed.Query.Validate(); err != nil {
+		me = multierror.Append(me, fmt.Errorf("query failed validation: %w", err))
+	}
+	if ed.SLO != nil {
+		if err := ed.SLO.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("slo failed validation: %w", err))
+		}
+	}
+	for i, md := range ed.Mask {
+		if err := md.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("mask %d failed validation: %w", i, err))
+		}
+	}
+	if ed.Xlsx != nil {
+		if err := ed.Xlsx.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("xlsx failed validation: %w", err))
+		}
+	}
+	if ed.JSONAPI != nil {
+		if err := ed.JSONAPI.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("jsonapi failed validation: %w", err))
+		}
+	}
+	if ed.Batch != nil {
+		if err := ed.Batch.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("batch failed validation: %w", err))
+		}
+		if ed.Catalog != nil {
+			me = multierror.Append(me, errors.New("batch cannot be used with catalog endpoints"))
+		}
+		if strings.EqualFold(ed.Method, http.MethodGet) {
+			me = multierror.Append(me, errors.New("batch cannot be used with GET endpoints"))
+		}
+	}
+	if ed.Deprecated != nil {
+		if err := ed.Deprecated.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("deprecated failed validation: %w", err))
+		}
+	}
+	if ed.ResponseLimit != nil {
+		if err := ed.ResponseLimit.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("response_limit failed validation: %w", err))
+		}
+	}
+	if ed.Page != nil {
+		if err := ed.Page.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("page failed validation: %w", err))
+		}
+	}
+	if ed.StrictQuery != nil && ed.StrictQuery.off {
+		ed.StrictQuery = nil
+	}
+	if ed.StrictQuery != nil {
+		if err := ed.StrictQuery.Validate(ed); err != nil {
+			me = multierror.Append(me, fmt.Errorf("strict_query failed validation: %w", err))
+		}
+		if ed.Catalog != nil {
+			me = multierror.Append(me, errors.New("strict_query cannot be used with catalog endpoints"))
+		}
+	}
+	if bt := ed.bodyType(); bt.streamed() {
+		if ed.Stream == nil {
+			ed.Stream = &StreamDef{}
+		}
+		if err := ed.Stream.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("stream failed validation: %w", err))
+		}
+		if ed.Query == nil {
+			me = multierror.Append(me, errors.New("ndjson and csv bodies can only be used with query endpoints"))
+		}
+		if ed.Batch != nil {
+			me = multierror.Append(me, errors.New("ndjson and csv bodies cannot be used with batch"))
+		}
+		if strings.EqualFold(ed.Method, http.MethodGet) {
+			me = multierror.Append(me, errors.New("ndjson and csv bodies cannot be used with GET endpoints"))
+		}
+	} else if ed.Stream != nil {
+		me = multierror.Append(me, errors.New("stream can only be used with ndjson and csv body types"))
+	}
+	if ed.bodyType() == MultipartBodyType {
+		if ed.Multipart == nil {
+			ed.Multipart = &MultipartDef{}
+		}
+		if err := ed.Multipart.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("multipart failed validation: %w", err))
+		}
+		if ed.Query == nil {
+			me = multierror.Append(me, errors.New("multipart bodies can only be used with query endpoints"))
+		}
+		if ed.Batch != nil {
+			me = multierror.Append(me, errors.New("multipart bodies cannot be used with batch"))
+		}
+		if strings.EqualFold(ed.Method, http.MethodGet) {
+			me = multierror.Append(me, errors.New("multipart bodies cannot be used with GET endpoints"))
+		}
+	} else {
+		if ed.Multipart != nil {
+			me = multierror.Append(me, errors.New("multipart can only be used with the multipart body type"))
+		}
+		if ed.Query != nil {
+			for si, sd := range ed.Query.Steps {
+				if sd != nil && sd.Args.hasFileRefs() {
+					me = multierror.Append(me, fmt.Errorf("step %d refers to an uploaded file, but the body type is not multipart", si))
+				}
+			}
+			for ti, td := range ed.Query.Transactions {
+				if td != nil && td.Compensate != nil && td.Compensate.Args.hasFileRefs() {
+					me = multierror.Append(me, fmt.Errorf("transaction %d compensate refers to an uploaded file, but the body type is not multipart", ti))
+				}
+			}
+		}
 	}
-	var me *multierror.Error
-	if ed.Method == "" {
-		me = multierror.Append(me, errors.New("method is empty"))
+	if bt := ed.bodyType(); ed.RequireBody && bt != JSONBodyType && bt != StringBodyType && bt != FormBodyType && bt != MultipartBodyType {
+		me = multierror.Append(me, errors.New("require_body can only be used with json, string, form, and multipart body types"))
 	}
-	if ed.Path == "" {
-		me = multierror.Append(me, errors.New("path is empty"))
+	if err := ed.ContentTypes.Validate(); err != nil {
+		me = multierror.Append(me, fmt.Errorf("content_types failed validation: %w", err))
 	}
-	if err := ed.Query.Validate(); err != nil {
-		me = multierror.Append(me, fmt.Errorf("query failed validation: %w", err))
+	if ed.Capture != nil {
+		if err := ed.Capture.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("capture failed validation: %w", err))
+		}
+	}
+	if len(ed.Mask) > 0 && ed.Query != nil && len(ed.Query.Steps) > 0 {
+		last := ed.Query.Steps[len(ed.Query.Steps)-1]
+		if last != nil && last.Binary != nil && last.Binary.Encoding == RawBinaryEncoding {
+			me = multierror.Append(me, errors.New("mask cannot be used with a raw binary response"))
+		}
 	}
 	return errorOrNil(me)
 }
@@ -272,6 +1330,15 @@ func (ed *EndpointDef) Validate() error {
 type QueryDef struct {
 	Transactions []*TransactionDef `json:"transactions" yaml:"transactions"`
 	Steps        []*StepDef        `json:"steps" yaml:"steps"`
+	// Timeout, if set, fails the request if the query's steps are still
+	// running after the duration.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// StepBudget, if set, divides the time remaining before the query's
+	// deadline among its remaining steps, so that a slow step cannot use
+	// the time of the steps after it.
+	StepBudget StepBudget `json:"step_budget,omitempty" yaml:"step_budget,omitempty"`
+	// CommitOrder is the order the query's transactions are committed in.
+	CommitOrder CommitOrder `json:"commit_order,omitempty" yaml:"commit_order,omitempty"`
 }
 
 func (qd *QueryDef) Validate() error {
@@ -280,16 +1347,71 @@ func (qd *QueryDef) Validate() error {
 	}
 	var me *multierror.Error
 	all, refs := IntSet{}, IntSet{}
-	for i := range qd.Transactions {
+	names := map[string]int{}
+	for i, td := range qd.Transactions {
 		all.Put(i)
+		if td == nil {
+			continue
+		}
+		if td.Compensate != nil {
+			if err := td.Compensate.Validate(); err != nil {
+				me = multierror.Append(me, fmt.Errorf("transaction %d compensate failed validation: %w", i, err))
+			}
+		}
+		if td.Name == "" {
+			continue
+		}
+		if _, dup := names[td.Name]; dup {
+			me = multierror.Append(me, fmt.Errorf("transaction %d has duplicate name %q", i, td.Name))
+			continue
+		}
+		names[td.Name] = i
+	}
+	stepNames := map[string]bool{}
+	if len(qd.Steps) == 0 {
+		me = multierror.Append(me, errors.New("no step(s) defined"))
 	}
-	if len(all) == 0 {
-		me = multierror.Append(me, errors.New("no transaction(s) defined"))
+	if qd.Timeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("timeout must not be negative"))
+	}
+	if qd.StepBudget != NoStepBudget && qd.Timeout.Duration == 0 {
+		me = multierror.Append(me, errors.New("step_budget requires a timeout"))
 	}
 	for i, sd := range qd.Steps {
-		refs.Put(sd.Transaction)
-		if !all.Contains(sd.Transaction) {
-			me = multierror.Append(me, fmt.Errorf("step %d refers to undefined transaction %d", i, sd.Transaction))
+		if err := sd.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("step %d failed validation: %w", i, err))
+			continue
+		}
+		if sd.Name != "" {
+			if stepNames[sd.Name] {
+				me = multierror.Append(me, fmt.Errorf("step %d has duplicate name %q", i, sd.Name))
+			}
+			stepNames[sd.Name] = true
+		}
+		if sd.Weight != 0 && qd.StepBudget != WeightedStepBudget {
+			me = multierror.Append(me, fmt.Errorf("step %d defines a weight but step_budget is not weighted", i))
+		}
+		if sd.Binary != nil && sd.Binary.Encoding == RawBinaryEncoding && i != len(qd.Steps)-1 {
+			me = multierror.Append(me, fmt.Errorf("step %d uses the raw binary encoding but is not the last step", i))
+		}
+		if sd.HTTP != nil || sd.Dataset != nil {
+			continue
+		}
+		if len(all) == 0 {
+			me = multierror.Append(me, errors.New("no transaction(s) defined"))
+			break
+		}
+		if name := sd.Transaction.Name; name != "" {
+			ti, ok := names[name]
+			if !ok {
+				me = multierror.Append(me, fmt.Errorf("step %d refers to undefined transaction %q", i, name))
+				continue
+			}
+			sd.Transaction.Index = ti
+		}
+		refs.Put(sd.Transaction.Index)
+		if !all.Contains(sd.Transaction.Index) {
+			me = multierror.Append(me, fmt.Errorf("step %d refers to undefined transaction %d", i, sd.Transaction.Index))
 		}
 	}
 	if !all.Equal(refs) {
@@ -301,16 +1423,246 @@ func (qd *QueryDef) Validate() error {
 	return errorOrNil(me)
 }
 
+// stepNames returns the names of the query's steps in order, or nil if none
+// of them are named.
+func (qd *QueryDef) stepNames() []string {
+	var names []string
+	for i, sd := range qd.Steps {
+		if sd.Name == "" {
+			continue
+		}
+		if names == nil {
+			names = make([]string, len(qd.Steps))
+		}
+		names[i] = sd.Name
+	}
+	return names
+}
+
 type StepDef struct {
-	Transaction int     `json:"transaction" yaml:"transaction"`
-	Query       string  `json:"query" yaml:"query"`
-	Args        ArgDefs `json:"args" yaml:"args"`
-	Map         Mapping `json:"map" yaml:"map"`
+	// Name, if set, names the step so that expressions can refer to its
+	// results by name rather than index. Names must be unique within a
+	// query.
+	Name        string          `json:"name,omitempty" yaml:"name,omitempty"`
+	Transaction TransactionRef  `json:"transaction" yaml:"transaction"`
+	Query       string          `json:"query" yaml:"query"`
+	HTTP        *HTTPStepDef    `json:"http,omitempty" yaml:"http,omitempty"`
+	Dataset     *DatasetStepDef `json:"dataset,omitempty" yaml:"dataset,omitempty"`
+	Args        ArgDefs         `json:"args" yaml:"args"`
+	Filter      *Expr           `json:"filter,omitempty" yaml:"filter,omitempty"`
+	Binary      *BinaryDef      `json:"binary,omitempty" yaml:"binary,omitempty"`
+	Map         Mapping         `json:"map" yaml:"map"`
+	Emit        *EmitDef        `json:"emit,omitempty" yaml:"emit,omitempty"`
+	Call        *CallDef        `json:"call,omitempty" yaml:"call,omitempty"`
+	// ResultSets, if true, keeps every result set returned by the query,
+	// making the step's result a list of result sets. Calls always keep
+	// every result set.
+	ResultSets bool `json:"result_sets,omitempty" yaml:"result_sets,omitempty"`
+	// Exec, if true, runs the step's query as a statement that returns no
+	// rows. The step's result is null, and the rows it affected and the
+	// ID it last inserted are recorded in its steps_meta.
+	Exec bool `json:"exec,omitempty" yaml:"exec,omitempty"`
+	// QueryFile, if set, is a file to read the step's query from instead
+	// of query. Relative paths are relative to the config file's
+	// directory.
+	QueryFile string `json:"query_file,omitempty" yaml:"query_file,omitempty"`
+	// Weight is the step's share of the query's time relative to the
+	// steps after it when using the weighted step budget. Defaults to 1.
+	Weight float64 `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	queryFromFile bool // Query was read from QueryFile.
+}
+
+// resolveStepFiles makes the relative query_file and descriptor_set paths
+// of the steps of eds relative to dir.
+func resolveStepFiles(eds EndpointDefs, dir string) {
+	resolve := func(path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	for _, ed := range eds {
+		if ed == nil || ed.Query == nil {
+			continue
+		}
+		for _, sd := range ed.Query.Steps {
+			if sd == nil {
+				continue
+			}
+			resolve(&sd.QueryFile)
+			if sd.HTTP != nil && sd.HTTP.Proto != nil {
+				resolve(&sd.HTTP.Proto.DescriptorSet)
+			}
+		}
+	}
+}
+
+// multipleResultSets reports whether the step's result is a list of result
+// sets rather than a single result set.
+func (sd *StepDef) multipleResultSets() bool {
+	return sd.ResultSets || sd.Call != nil
+}
+
+func (sd *StepDef) Validate() error {
+	if sd == nil {
+		return errors.New("step definition is nil")
+	}
+	if sd.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	if sd.QueryFile != "" && !sd.queryFromFile {
+		if sd.Query != "" {
+			return errors.New("step cannot define both query and query_file")
+		}
+		p, err := os.ReadFile(sd.QueryFile)
+		if err != nil {
+			return fmt.Errorf("error reading query_file: %w", err)
+		}
+		sd.Query, sd.queryFromFile = string(p), true
+	}
+	if sd.HTTP != nil {
+		if sd.Query != "" {
+			return errors.New("step cannot define both query and http")
+		}
+		if sd.Dataset != nil {
+			return errors.New("step cannot define both http and dataset")
+		}
+		if sd.Binary != nil {
+			return errors.New("binary is only supported by query steps")
+		}
+		if sd.Emit != nil {
+			return errors.New("emit is only supported by query steps")
+		}
+		if sd.Call != nil {
+			return errors.New("call is only supported by query steps")
+		}
+		if sd.ResultSets {
+			return errors.New("result_sets is only supported by query steps")
+		}
+		if sd.Exec {
+			return errors.New("exec is only supported by query steps")
+		}
+		if err := sd.HTTP.Validate(); err != nil {
+			return fmt.Errorf("http failed validation: %w", err)
+		}
+		return nil
+	}
+	if sd.Dataset != nil {
+		if sd.Query != "" {
+			return errors.New("step cannot define both query and dataset")
+		}
+		if sd.Binary != nil || sd.Emit != nil || sd.Call != nil || sd.ResultSets || sd.Exec {
+			return errors.New("binary, emit, call, result_sets, and exec are only supported by query steps")
+		}
+		if sd.Dataset.Name == "" {
+			return errors.New("dataset name is empty")
+		}
+		if len(sd.Args) != len(sd.Dataset.Match) {
+			return fmt.Errorf("dataset step has %d arg(s) but matches %d column(s)", len(sd.Args), len(sd.Dataset.Match))
+		}
+		return nil
+	}
+	if sd.Query == "" {
+		return errors.New("query is empty")
+	}
+	if sd.Binary != nil {
+		if err := sd.Binary.Validate(); err != nil {
+			return fmt.Errorf("binary failed validation: %w", err)
+		}
+		if sd.Binary.Encoding == RawBinaryEncoding && len(sd.Map) > 0 {
+			return errors.New("step cannot define a map when using the raw binary encoding")
+		}
+	}
+	if sd.Emit != nil {
+		if err := sd.Emit.Validate(); err != nil {
+			return fmt.Errorf("emit failed validation: %w", err)
+		}
+	}
+	if sd.Call != nil {
+		if err := sd.Call.Validate(); err != nil {
+			return fmt.Errorf("call failed validation: %w", err)
+		}
+	}
+	if sd.Exec && (sd.Filter != nil || sd.Binary != nil || sd.Call != nil || sd.ResultSets) {
+		return errors.New("exec steps return no rows, so cannot define a filter, binary, call, or result_sets")
+	}
+	if sd.multipleResultSets() {
+		if sd.Filter != nil {
+			return errors.New("step cannot define a filter when keeping multiple result sets")
+		}
+		if sd.Binary != nil && sd.Binary.Encoding == RawBinaryEncoding {
+			return errors.New("step cannot use the raw binary encoding when keeping multiple result sets")
+		}
+	}
+	return nil
 }
 
 type TransactionDef struct {
+	// Name, if set, allows steps to refer to the transaction by name
+	// rather than index. Names must be unique within a query.
+	Name      string         `json:"name,omitempty" yaml:"name,omitempty"`
 	DB        string         `json:"db" yaml:"db"`
 	Isolation IsolationLevel `json:"isolation" yaml:"isolation"`
+	// WarnAfter, if set, logs a warning if the transaction is still open
+	// after the duration.
+	WarnAfter Duration `json:"warn_after" yaml:"warn_after"`
+	// Timeout, if set, rolls back the transaction if it is still open
+	// after the duration, failing the request.
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// ReadOnly, if true, begins the transaction as read-only. Read-only
+	// transactions are committed first by the writes_last commit order.
+	ReadOnly bool `json:"read_only,omitempty" yaml:"read_only,omitempty"`
+	// Compensate, if set, is run to undo the transaction's writes if it
+	// committed but a transaction committed after it did not.
+	Compensate *CompensateDef `json:"compensate,omitempty" yaml:"compensate,omitempty"`
+}
+
+// TransactionRef refers to one of a query's transactions, either by its
+// index or by its name. Names are resolved to indices when the query is
+// validated.
+type TransactionRef struct {
+	Index int
+	Name  string
+}
+
+func (r TransactionRef) MarshalJSON() ([]byte, error) {
+	if r.Name != "" {
+		return json.Marshal(r.Name)
+	}
+	return json.Marshal(r.Index)
+}
+
+func (r *TransactionRef) UnmarshalJSON(src []byte) error {
+	var name string
+	if unmarshalStrict(src, &name) == nil {
+		*r = TransactionRef{Name: name}
+		return nil
+	}
+	var index int
+	if err := unmarshalStrict(src, &index); err != nil {
+		return errors.New("transaction must be an index or a name")
+	}
+	*r = TransactionRef{Index: index}
+	return nil
+}
+
+func (r TransactionRef) MarshalYAML() (interface{}, error) {
+	if r.Name != "" {
+		return r.Name, nil
+	}
+	return r.Index, nil
+}
+
+func (r *TransactionRef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return errors.New("transaction must be an index or a name")
+	}
+	if node.ShortTag() == "!!int" {
+		*r = TransactionRef{}
+		return node.Decode(&r.Index)
+	}
+	*r = TransactionRef{Name: node.Value}
+	return nil
 }
 
 type ParamMapping struct {
@@ -337,6 +1689,73 @@ func (ads *ArgDefs) UnmarshalJSON(src []byte) error {
 	return nil
 }
 
+// undefinedPathParams returns the names of the path params referred to by
+// ads that are not in defined, the params of the endpoint's route.
+func (ads ArgDefs) undefinedPathParams(defined map[string]bool) []string {
+	var names []string
+	for _, ad := range ads {
+		if ta, ok := ad.(TypedArg); ok {
+			ad = ta.Arg
+		}
+		if ref, ok := ad.(PathParamRef); ok && !defined[ref.Name] {
+			names = append(names, ref.Name)
+		}
+	}
+	return names
+}
+
+// queryParams adds the names of the query params referred to by ads to
+// names.
+func (ads ArgDefs) queryParams(names map[string]bool) {
+	for _, ad := range ads {
+		if ta, ok := ad.(TypedArg); ok {
+			ad = ta.Arg
+		}
+		if ref, ok := ad.(QueryParamRef); ok {
+			names[ref.Name] = true
+		}
+	}
+}
+
+// hasFileRefs returns whether any of ads is bound to an uploaded file.
+func (ads ArgDefs) hasFileRefs() bool {
+	for _, ad := range ads {
+		if ta, ok := ad.(TypedArg); ok {
+			ad = ta.Arg
+		}
+		switch ad.(type) {
+		case FileRef, FilePathRef:
+			return true
+		}
+	}
+	return false
+}
+
+// headerParams adds the canonical names of the headers referred to by ads
+// to names.
+func (ads ArgDefs) headerParams(names map[string]bool) {
+	for _, ad := range ads {
+		if ta, ok := ad.(TypedArg); ok {
+			ad = ta.Arg
+		}
+		if ref, ok := ad.(HeaderParamRef); ok {
+			names[http.CanonicalHeaderKey(ref.Name)] = true
+		}
+	}
+}
+
+// cookieParams adds the names of the cookies referred to by ads to names.
+func (ads ArgDefs) cookieParams(names map[string]bool) {
+	for _, ad := range ads {
+		if ta, ok := ad.(TypedArg); ok {
+			ad = ta.Arg
+		}
+		if ref, ok := ad.(CookieParamRef); ok {
+			names[ref.Name] = true
+		}
+	}
+}
+
 func (ads *ArgDefs) UnmarshalYAML(node *yaml.Node) error {
 	if node.Kind != yaml.SequenceNode {
 		return fmt.Errorf("expected sequence node for arg defs, got %d", node.Kind)
@@ -357,7 +1776,11 @@ type ArgDef interface {
 	param()
 }
 
-var ErrBadArgDef = errors.New("invalid arg def: must be a scalar, null, or contain a single key of 'path', 'query', or 'expr'")
+var ErrBadArgDef = errors.New("invalid arg def: must be a scalar, null, or contain a single key of 'path', 'query', 'header', 'cookie', 'file', 'file_path', or 'expr' and an optional 'type'")
+
+// errParamRefOptions is returned for args other than path, query, header,
+// cookie, and file args that set missing or default.
+var errParamRefOptions = errors.New("invalid arg def: only path, query, header, cookie, and file args may set 'missing' or 'default'")
 
 func UnmarshalArgDefYAML(node *yaml.Node) (ArgDef, error) {
 	if node.Kind == yaml.SequenceNode {
@@ -371,40 +1794,106 @@ func UnmarshalArgDefYAML(node *yaml.Node) (ArgDef, error) {
 		return lit, nil
 	}
 
-	if len(node.Content) != 2 {
-		// Mapping has content with two items: a key, and
-		// a value.
+	// Mapping has content with two items per key: a key, and a value.
+	var (
+		content    []*yaml.Node
+		typ        *ArgType
+		opts       ParamRefOptions
+		hasOpts    bool
+		hasDefault bool
+	)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		switch key.Value {
+		case "type":
+			typ = new(ArgType)
+			if err := value.Decode(typ); err != nil {
+				return nil, fmt.Errorf("error unmarshaling arg def type: %w", err)
+			}
+		case "missing":
+			// An unquoted null is the same as "null".
+			if value.Tag == "!!null" {
+				opts.Missing = NullMissingParam
+			} else if err := value.Decode(&opts.Missing); err != nil {
+				return nil, fmt.Errorf("error unmarshaling arg def missing: %w", err)
+			}
+			hasOpts = true
+		case "default":
+			if err := value.Decode(&opts.Default); err != nil {
+				return nil, fmt.Errorf("error unmarshaling arg def default: %w", err)
+			}
+			hasOpts, hasDefault = true, true
+		default:
+			content = append(content, key, value)
+		}
+	}
+
+	if len(content) != 2 {
 		return nil, ErrBadArgDef
 	}
 
 	var key string
-	if err := node.Content[0].Decode(&key); err != nil {
+	if err := content[0].Decode(&key); err != nil {
 		return nil, fmt.Errorf("error unmarshaling arg def key: %w", err)
 	}
 
-	value := node.Content[1]
+	if err := opts.check(hasDefault); err != nil {
+		return nil, err
+	}
+
+	var def ArgDef
+	value := content[1]
 	switch key {
 	case "path":
-		var ref PathParamRef
+		ref := PathParamRef{ParamRefOptions: opts}
 		if err := value.Decode(&ref.Name); err != nil {
 			return nil, fmt.Errorf("error unmarshaling path arg def: %w", err)
 		}
-		return ref, nil
+		def = ref
 	case "query":
-		var ref QueryParamRef
+		ref := QueryParamRef{ParamRefOptions: opts}
 		if err := value.Decode(&ref.Name); err != nil {
 			return nil, fmt.Errorf("error unmarshaling query arg def: %w", err)
 		}
-		return ref, nil
+		def = ref
+	case "header":
+		ref := HeaderParamRef{ParamRefOptions: opts}
+		if err := value.Decode(&ref.Name); err != nil {
+			return nil, fmt.Errorf("error unmarshaling header arg def: %w", err)
+		}
+		def = ref
+	case "cookie":
+		ref := CookieParamRef{ParamRefOptions: opts}
+		if err := value.Decode(&ref.Name); err != nil {
+			return nil, fmt.Errorf("error unmarshaling cookie arg def: %w", err)
+		}
+		def = ref
+	case "file":
+		ref := FileRef{ParamRefOptions: opts}
+		if err := value.Decode(&ref.Name); err != nil {
+			return nil, fmt.Errorf("error unmarshaling file arg def: %w", err)
+		}
+		def = ref
+	case "file_path":
+		ref := FilePathRef{ParamRefOptions: opts}
+		if err := value.Decode(&ref.Name); err != nil {
+			return nil, fmt.Errorf("error unmarshaling file_path arg def: %w", err)
+		}
+		def = ref
 	case "expr":
+		if hasOpts {
+			return nil, errParamRefOptions
+		}
 		var expr Expr
 		if err := value.Decode(&expr); err != nil {
 			return nil, fmt.Errorf("error unmarshaling expr arg def: %w", err)
 		}
-		return ExprParam{&expr}, nil
+		def = ExprParam{&expr}
 	default:
 		return nil, ErrBadArgDef
 	}
+
+	return withArgType(def, typ), nil
 }
 
 func UnmarshalArgDef(blob json.RawMessage) (ArgDef, error) {
@@ -413,37 +1902,95 @@ func UnmarshalArgDef(blob json.RawMessage) (ArgDef, error) {
 		if m == nil {
 			return ArgLiteral{Literal: nil}, nil
 		}
+		var typ *ArgType
+		if raw, ok := m["type"]; ok {
+			typ = new(ArgType)
+			if err := unmarshalStrict(raw, typ); err != nil {
+				return nil, fmt.Errorf("error unmarshaling arg def type: %w", err)
+			}
+			delete(m, "type")
+		}
+		var opts ParamRefOptions
+		raw, hasMissing := m["missing"]
+		if hasMissing {
+			// A JSON null is the same as "null".
+			if string(bytes.TrimSpace(raw)) == "null" {
+				opts.Missing = NullMissingParam
+			} else if err := unmarshalStrict(raw, &opts.Missing); err != nil {
+				return nil, fmt.Errorf("error unmarshaling arg def missing: %w", err)
+			}
+			delete(m, "missing")
+		}
+		raw, hasDefault := m["default"]
+		if hasDefault {
+			if err := unmarshalStrict(raw, &opts.Default); err != nil {
+				return nil, fmt.Errorf("error unmarshaling arg def default: %w", err)
+			}
+			delete(m, "default")
+		}
 		if len(m) != 1 {
 			return nil, ErrBadArgDef
 		}
+		if err := opts.check(hasDefault); err != nil {
+			return nil, err
+		}
 		var key string
 		var value json.RawMessage
 		for k, v := range m {
 			key = k
 			value = v
 		}
+		var def ArgDef
 		switch key {
 		case "path":
-			var ref PathParamRef
+			ref := PathParamRef{ParamRefOptions: opts}
 			if err := unmarshalStrict(value, &ref.Name); err != nil {
 				return nil, fmt.Errorf("error unmarshaling path arg def: %w", err)
 			}
-			return ref, nil
+			def = ref
 		case "query":
-			var ref QueryParamRef
+			ref := QueryParamRef{ParamRefOptions: opts}
 			if err := unmarshalStrict(value, &ref.Name); err != nil {
 				return nil, fmt.Errorf("error unmarshaling query arg def: %w", err)
 			}
-			return ref, nil
+			def = ref
+		case "header":
+			ref := HeaderParamRef{ParamRefOptions: opts}
+			if err := unmarshalStrict(value, &ref.Name); err != nil {
+				return nil, fmt.Errorf("error unmarshaling header arg def: %w", err)
+			}
+			def = ref
+		case "cookie":
+			ref := CookieParamRef{ParamRefOptions: opts}
+			if err := unmarshalStrict(value, &ref.Name); err != nil {
+				return nil, fmt.Errorf("error unmarshaling cookie arg def: %w", err)
+			}
+			def = ref
+		case "file":
+			ref := FileRef{ParamRefOptions: opts}
+			if err := unmarshalStrict(value, &ref.Name); err != nil {
+				return nil, fmt.Errorf("error unmarshaling file arg def: %w", err)
+			}
+			def = ref
+		case "file_path":
+			ref := FilePathRef{ParamRefOptions: opts}
+			if err := unmarshalStrict(value, &ref.Name); err != nil {
+				return nil, fmt.Errorf("error unmarshaling file_path arg def: %w", err)
+			}
+			def = ref
 		case "expr":
+			if hasMissing || hasDefault {
+				return nil, errParamRefOptions
+			}
 			var expr Expr
 			if err := unmarshalStrict(value, &expr); err != nil {
 				return nil, fmt.Errorf("error unmarshaling expr arg def: %w", err)
 			}
-			return ExprParam{&expr}, nil
+			def = ExprParam{&expr}
 		default:
 			return nil, ErrBadArgDef
 		}
+		return withArgType(def, typ), nil
 	}
 
 	lit := ArgLiteral{}
@@ -454,6 +2001,13 @@ func UnmarshalArgDef(blob json.RawMessage) (ArgDef, error) {
 	return lit, nil
 }
 
+func withArgType(def ArgDef, typ *ArgType) ArgDef {
+	if typ == nil {
+		return def
+	}
+	return TypedArg{Arg: def, Type: *typ}
+}
+
 type ArgLiteral struct {
 	Literal interface{}
 }
@@ -464,8 +2018,95 @@ func (a ArgLiteral) MarshalJSON() ([]byte, error) {
 
 func (ArgLiteral) param() {}
 
+// MissingParam determines what a path or query arg resolves to when its
+// param is absent from a request.
+type MissingParam int
+
+const (
+	ErrorMissingParam   MissingParam = iota // error - Default
+	NullMissingParam                        // null
+	DefaultMissingParam                     // default
+)
+
+func (m MissingParam) MarshalText() ([]byte, error) {
+	typ := "error"
+	switch m {
+	case ErrorMissingParam:
+	case NullMissingParam:
+		typ = "null"
+	case DefaultMissingParam:
+		typ = "default"
+	default:
+		return nil, fmt.Errorf("unrecognized missing param handling %d", m)
+	}
+	return []byte(typ), nil
+}
+
+func (m *MissingParam) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "error":
+		*m = ErrorMissingParam
+	case "null":
+		*m = NullMissingParam
+	case "default":
+		*m = DefaultMissingParam
+	default:
+		return fmt.Errorf("unrecognized missing param handling %q", src)
+	}
+	return nil
+}
+
+// ParamRefOptions configure how path and query args handle absent params.
+// If Missing is ErrorMissingParam, requests without the param are rejected
+// with a 400 status.
+type ParamRefOptions struct {
+	Missing MissingParam `json:"missing,omitempty" yaml:"missing,omitempty"`
+	Default interface{}  `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// check validates the options of an arg def. If a default is given without
+// setting missing, missing is set to default.
+func (o *ParamRefOptions) check(hasDefault bool) error {
+	switch {
+	case hasDefault && o.Missing == ErrorMissingParam:
+		o.Missing = DefaultMissingParam
+	case hasDefault && o.Missing != DefaultMissingParam:
+		return errors.New("invalid arg def: 'default' requires missing to be 'default'")
+	case !hasDefault && o.Missing == DefaultMissingParam:
+		return errors.New("invalid arg def: missing is 'default' but no 'default' is set")
+	}
+	return nil
+}
+
+// resolve returns the value of the param name in a request, given as v and
+// whether it was present.
+func (o ParamRefOptions) resolve(in, name string, v interface{}, ok bool) (interface{}, error) {
+	if ok {
+		return v, nil
+	}
+	switch o.Missing {
+	case NullMissingParam:
+		return nil, nil
+	case DefaultMissingParam:
+		return o.Default, nil
+	}
+	return nil, &MissingParamError{In: in, Name: name}
+}
+
+// MissingParamError is returned when resolving an arg whose param is absent
+// from the request.
+type MissingParamError struct {
+	In   string
+	Name string
+}
+
+func (e *MissingParamError) Error() string {
+	return fmt.Sprintf("%s param %q not defined", e.In, e.Name)
+}
+
 type PathParamRef struct {
 	Name string `json:"path" yaml:"path"`
+	ParamRefOptions
 }
 
 func (p PathParamRef) Value() (interface{}, error) {
@@ -476,10 +2117,48 @@ func (PathParamRef) param() {}
 
 type QueryParamRef struct {
 	Name string `json:"query" yaml:"query"`
+	ParamRefOptions
 }
 
 func (QueryParamRef) param() {}
 
+// HeaderParamRef binds the value of a request header, after any mapping
+// in the endpoint's header_params. Names are case-insensitive.
+type HeaderParamRef struct {
+	Name string `json:"header" yaml:"header"`
+	ParamRefOptions
+}
+
+func (HeaderParamRef) param() {}
+
+// CookieParamRef binds the value of a request cookie, after any mapping in
+// the endpoint's cookie_params. Names are case-sensitive.
+type CookieParamRef struct {
+	Name string `json:"cookie" yaml:"cookie"`
+	ParamRefOptions
+}
+
+func (CookieParamRef) param() {}
+
+// FileRef binds the contents of a file uploaded in a multipart body, as
+// bytes. If several files are uploaded as the field, the first is used.
+type FileRef struct {
+	Name string `json:"file" yaml:"file"`
+	ParamRefOptions
+}
+
+func (FileRef) param() {}
+
+// FilePathRef binds the path of a temp file holding a file uploaded in a
+// multipart body, for drivers that load files by path. The temp file is
+// removed once the request completes.
+type FilePathRef struct {
+	Name string `json:"file_path" yaml:"file_path"`
+	ParamRefOptions
+}
+
+func (FilePathRef) param() {}
+
 type ExprParam struct {
 	Expr *Expr `json:"expr" yaml:"expr"`
 }
@@ -490,6 +2169,9 @@ type Expr struct {
 	Options []gojq.CompilerOption
 	Query   *gojq.Query
 	Code    *gojq.Code
+
+	src  string      // The normalized query, used to identify identical expressions.
+	vars interface{} // The config's vars, bound to $vars.
 }
 
 func gojqDebug(input interface{}, args []interface{}) interface{} {
@@ -507,24 +2189,57 @@ func (e *Expr) UnmarshalText(src []byte) error {
 		return fmt.Errorf("error parsing expression: %w", err)
 	}
 
-	c, err := gojq.Compile(q, gojq.WithVariables([]string{"$context"}))
-	if err != nil {
-		return fmt.Errorf("error compiling expression: %w", err)
-	}
-
 	dup := *e
 	dup.Query = q
-	dup.Code = c
+	dup.Code = nil
+	dup.src = q.String()
+	// Expressions that import modules are compiled once the config's
+	// modules are known, by compileExprs.
+	if len(q.Imports) == 0 {
+		if err := dup.compile(nil); err != nil {
+			return err
+		}
+	}
 	*e = dup
 	return nil
 }
 
+// compile compiles the expression's query. Modules are loaded with loader,
+// which may be nil if the query imports none.
+func (e *Expr) compile(loader gojq.ModuleLoader) error {
+	opts := []gojq.CompilerOption{
+		gojq.WithVariables(exprVariables),
+		gojq.WithFunction("_link", 3, 3, gojqLink),
+	}
+	if loader != nil {
+		opts = append(opts, gojq.WithModuleLoader(loader))
+	}
+	c, err := gojq.Compile(withLinkFuncs(e.Query), opts...)
+	if err != nil {
+		return fmt.Errorf("error compiling expression: %w", unknownVariableError(err))
+	}
+	e.Code = c
+	return nil
+}
+
 func (e *Expr) MarshalText() ([]byte, error) {
 	return []byte(e.Query.String()), nil
 }
 
 func (e *Expr) Apply(ctx context.Context, input, ctxVar interface{}) (interface{}, error) {
-	iter := e.Code.RunWithContext(ctx, input, ctxVar)
+	return e.apply(ctx, input, ctxVar, nil)
+}
+
+// apply applies the expression to input with $item bound to item.
+func (e *Expr) apply(ctx context.Context, input, ctxVar, item interface{}) (interface{}, error) {
+	if e.Code == nil {
+		return nil, errExprNotCompiled
+	}
+	vars := e.vars
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	iter := e.Code.RunWithContext(ctx, input, ctxVar, vars, item)
 	output, ok := iter.Next()
 	if !ok {
 		return nil, fmt.Errorf("no value returned by mapping: %w", ErrNoMapping)
@@ -539,6 +2254,17 @@ func (e *Expr) Apply(ctx context.Context, input, ctxVar interface{}) (interface{
 	return output, nil
 }
 
+// Test applies the expression to input and returns whether its result is
+// truthy (that is, neither null nor false), following jq's rules. Since
+// tests are applied to each item of a result, $item is bound to input.
+func (e *Expr) Test(ctx context.Context, input, ctxVar interface{}) (bool, error) {
+	output, err := e.apply(ctx, input, ctxVar, input)
+	if err != nil {
+		return false, err
+	}
+	return output != nil && output != false, nil
+}
+
 type Mapping []*Expr
 
 var ErrNoMapping = errors.New("no result from output mapping")
@@ -0,0 +1,168 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tmplExt is the extension of config files that are rendered as Go
+// text/templates before they're parsed, such as config.yaml.tmpl. It comes
+// before the age extension of encrypted templates, as in
+// config.yaml.tmpl.age.
+const tmplExt = ".tmpl"
+
+// configValuesPath is the values file given to config templates as
+// .Values. It is set by the -values flag.
+var configValuesPath = ""
+
+// splitConfigSuffix splits path into the name of the config file in its
+// format and the age and template extensions following it, such as
+// config.yaml and .tmpl.age for config.yaml.tmpl.age.
+func splitConfigSuffix(path string) (base, suffix string) {
+	base = path
+	for _, ext := range []string{ageExt, tmplExt} {
+		if strings.HasSuffix(base, ext) {
+			base = strings.TrimSuffix(base, ext)
+			suffix = ext + suffix
+		}
+	}
+	return base, suffix
+}
+
+// configTemplateData is the data config templates are executed with.
+type configTemplateData struct {
+	Env     map[string]string
+	Values  map[string]interface{}
+	Profile string
+}
+
+var configTemplateFuncs = template.FuncMap{
+	// env returns the value of an environment variable, or an empty string
+	// if it is unset.
+	"env": os.Getenv,
+	// default returns v, or def if v is empty.
+	"default": func(def, v interface{}) interface{} {
+		if isEmptyTemplateValue(v) {
+			return def
+		}
+		return v
+	},
+	// required returns v, or fails with msg if v is empty.
+	"required": func(msg string, v interface{}) (interface{}, error) {
+		if isEmptyTemplateValue(v) {
+			return nil, errors.New(msg)
+		}
+		return v, nil
+	},
+	// json encodes v as JSON, which is also valid YAML, for quoting
+	// strings and writing lists and objects inline.
+	"json": func(v interface{}) (string, error) {
+		p, err := json.Marshal(v)
+		return string(p), err
+	},
+}
+
+// isEmptyTemplateValue returns whether v is nil or the zero value of its
+// type, or an empty string, list, or map.
+func isEmptyTemplateValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	}
+	return rv.IsZero()
+}
+
+// renderConfigTemplate executes the config template data, read from path,
+// with the environment, the values file, and the profile. References to
+// values that don't exist are errors.
+func renderConfigTemplate(path, profile string, data []byte) ([]byte, error) {
+	t, err := template.New(filepath.Base(path)).
+		Option("missingkey=error").
+		Funcs(configTemplateFuncs).
+		Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config template: %w", err)
+	}
+	values, err := readConfigValues(configValuesPath)
+	if err != nil {
+		return nil, err
+	}
+	td := configTemplateData{
+		Env:     make(map[string]string),
+		Values:  values,
+		Profile: profile,
+	}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			td.Env[k] = v
+		}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, td); err != nil {
+		return nil, fmt.Errorf("error rendering config template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readConfigValues reads the values file for config templates, in JSON or
+// YAML by its extension. It is read each time a template is rendered, so
+// that reloads see changes to it. If path is empty, there are no values.
+func readConfigValues(path string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if path == "" {
+		return values, nil
+	}
+	data, err := os.ReadFile(path)
+	if err == nil && strings.HasSuffix(path, ageExt) {
+		data, err = decryptAge(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config values: %w", err)
+	}
+	var tree interface{}
+	switch configExt(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	default:
+		err = decodeJSONTree(data, &tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config values %s: %w", path, err)
+	}
+	switch tree := tree.(type) {
+	case nil:
+	case map[string]interface{}:
+		values = tree
+	default:
+		return nil, fmt.Errorf("config values %s are not a mapping", path)
+	}
+	return values, nil
+}
@@ -0,0 +1,80 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+)
+
+// ContentTypes is a list of media types that an endpoint accepts request
+// bodies in, such as application/json. A type may end in /* to accept all
+// of its subtypes, as in text/*. Parameters, such as charset, are ignored.
+type ContentTypes []string
+
+func (ct ContentTypes) Validate() error {
+	var me *multierror.Error
+	for i, t := range ct {
+		mt, _, err := mime.ParseMediaType(t)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("content type %q is invalid: %w", t, err))
+			continue
+		}
+		ct[i] = mt
+	}
+	return errorOrNil(me)
+}
+
+// Allows returns whether the media type of the Content-Type header value
+// contentType is one of the accepted types.
+func (ct ContentTypes) Allows(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range ct {
+		if t == mt || t == "*/*" || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap rejects requests to next with bodies whose Content-Type isn't
+// accepted, responding with a 415 status. Requests without bodies are
+// always passed to next.
+func (ct ContentTypes) Wrap(next http.Handler) http.Handler {
+	accept := strings.Join(ct, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength == 0 || req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if contentType := req.Header.Get("Content-Type"); !ct.Allows(contentType) {
+			log := *zerolog.Ctx(req.Context())
+			log.Debug().Str("content_type", contentType).Msg("Rejected request with unsupported content type.")
+			w.Header().Set("Accept", accept)
+			writeError(log, w, http.StatusUnsupportedMediaType, &errorResponse{Error: "unsupported content type"})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,322 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+	"go.spiff.io/sql/vdb"
+)
+
+// defaultDatasetRefresh is how often datasets are reloaded unless they set
+// refresh.
+const defaultDatasetRefresh = time.Minute
+
+// DatasetDef defines an in-memory dataset: the rows of a query, loaded
+// before the config is served and reloaded by a background job every
+// Refresh. Steps read datasets without a round trip to the database, which
+// suits small, hot reference data such as lookup tables.
+type DatasetDef struct {
+	DB    string `json:"db" yaml:"db"`
+	Query string `json:"query" yaml:"query"`
+	// Map transforms the query's rows each time they're loaded. Its
+	// result must be a list of rows.
+	Map     Mapping  `json:"map,omitempty" yaml:"map,omitempty"`
+	Refresh Duration `json:"refresh,omitempty" yaml:"refresh,omitempty"` // Defaults to 1m.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"` // Time to load the dataset. Defaults to 30s.
+
+	mu   sync.RWMutex
+	snap *datasetSnapshot // The last rows loaded, or nil if none have been.
+}
+
+func (dd *DatasetDef) Validate() error {
+	if dd == nil {
+		return errors.New("dataset definition is nil")
+	}
+	var me *multierror.Error
+	if dd.DB == "" {
+		me = multierror.Append(me, errors.New("db is empty"))
+	}
+	if dd.Query == "" {
+		me = multierror.Append(me, errors.New("query is empty"))
+	}
+	if dd.Refresh.Duration < 0 {
+		me = multierror.Append(me, errors.New("refresh must not be negative"))
+	} else if dd.Refresh.Duration == 0 {
+		dd.Refresh.Duration = defaultDatasetRefresh
+	}
+	if dd.Timeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("timeout must not be negative"))
+	} else if dd.Timeout.Duration == 0 {
+		dd.Timeout.Duration = 30 * time.Second
+	}
+	return errorOrNil(me)
+}
+
+// datasetSnapshot is the rows of a dataset as of a single load. Snapshots
+// are never modified once loaded, so steps may read them concurrently.
+type datasetSnapshot struct {
+	rows     []interface{}
+	loadedAt time.Time
+
+	mu      sync.Mutex
+	indexes map[string]map[string][]interface{} // Rows by the text of a column, built on first use.
+}
+
+// index returns the rows of the snapshot keyed by the text of their column
+// values. Rows without the column are left out.
+func (s *datasetSnapshot) index(column string) map[string][]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx, ok := s.indexes[column]; ok {
+		return idx
+	}
+	idx := make(map[string][]interface{})
+	for _, row := range s.rows {
+		obj, ok := row.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if v, ok := obj[column]; ok {
+			key := fmt.Sprint(v)
+			idx[key] = append(idx[key], row)
+		}
+	}
+	if s.indexes == nil {
+		s.indexes = make(map[string]map[string][]interface{})
+	}
+	s.indexes[column] = idx
+	return idx
+}
+
+// snapshot returns the dataset's current rows, or nil if it has never been
+// loaded.
+func (dd *DatasetDef) snapshot() *datasetSnapshot {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	return dd.snap
+}
+
+// Load runs the dataset's query against db and replaces its rows with the
+// result. If loading fails, the rows already loaded are kept.
+func (dd *DatasetDef) Load(ctx context.Context, name string, db *Database) error {
+	ctx, cancel := context.WithTimeout(ctx, dd.Timeout.Duration)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, dd.Query)
+	if err != nil {
+		return fmt.Errorf("error querying dataset: %w", err)
+	}
+	defer rows.Close()
+	var numerics []string
+	if db.Options.Numeric == NumberNumericFormat {
+		numerics = numericColumns(rows)
+	}
+	results, err := vdb.ScanRows(ctx, rows, db.options)
+	if err != nil {
+		return fmt.Errorf("error scanning dataset: %w", err)
+	}
+	res := results.Opaque()
+	if len(numerics) > 0 {
+		convertNumerics(res, numerics)
+	}
+	res, err = dd.Map.Apply(ctx, res, map[string]interface{}{"dataset": name})
+	if err != nil {
+		return fmt.Errorf("error mapping dataset: %w", err)
+	}
+	list, ok := res.([]interface{})
+	if res != nil && !ok {
+		return fmt.Errorf("dataset is a %T, not a list of rows", res)
+	}
+
+	dd.mu.Lock()
+	dd.snap = &datasetSnapshot{rows: list, loadedAt: time.Now()}
+	dd.mu.Unlock()
+	return nil
+}
+
+// DatasetStepDef reads the rows of a dataset in a step. If Match is set,
+// only rows whose Match columns equal the step's args, in order, are read.
+// Values are compared as text, so a path param of "1" matches a column
+// holding the number 1.
+type DatasetStepDef struct {
+	Name  string   `json:"name" yaml:"name"`
+	Match []string `json:"match,omitempty" yaml:"match,omitempty"`
+}
+
+// Read returns copies of the rows of dd matching args, so masks and other
+// steps may modify them without changing the dataset.
+func (ds *DatasetStepDef) Read(dd *DatasetDef, args []interface{}) ([]interface{}, error) {
+	snap := dd.snapshot()
+	if snap == nil {
+		return nil, fmt.Errorf("dataset %q has not been loaded", ds.Name)
+	}
+	if len(ds.Match) == 0 {
+		return copyOpaque(snap.rows).([]interface{}), nil
+	}
+	// The first column is indexed, and the rest are compared to its
+	// matches.
+	candidates := snap.index(ds.Match[0])[fmt.Sprint(args[0])]
+	rows := make([]interface{}, 0, len(candidates))
+outer:
+	for _, row := range candidates {
+		obj := row.(map[string]interface{})
+		for i, column := range ds.Match[1:] {
+			v, ok := obj[column]
+			if !ok || fmt.Sprint(v) != fmt.Sprint(args[i+1]) {
+				continue outer
+			}
+		}
+		rows = append(rows, copyOpaque(row))
+	}
+	return rows, nil
+}
+
+// copyOpaque returns a deep copy of v, a value of a dataset row. Only maps
+// and lists are copied; other values are immutable.
+func copyOpaque(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = copyOpaque(e)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			list[i] = copyOpaque(e)
+		}
+		return list
+	}
+	return v
+}
+
+// loadDatasets loads every dataset of conf from dbs, returning the errors of
+// those that fail.
+func loadDatasets(ctx context.Context, log zerolog.Logger, conf *Config, dbs Databases) error {
+	var me *multierror.Error
+	for name, dd := range conf.Datasets {
+		began := time.Now()
+		if err := dd.Load(ctx, name, dbs[dd.DB]); err != nil {
+			me = multierror.Append(me, fmt.Errorf("dataset=%q: %w", name, err))
+			continue
+		}
+		log.Debug().
+			Str("dataset", name).
+			Int("rows", len(dd.snapshot().rows)).
+			Dur("elapsed", time.Since(began)).
+			Msg("Loaded dataset.")
+	}
+	return errorOrNil(me)
+}
+
+// refreshDataset reloads a dataset every refresh interval until ctx ends.
+// Failed reloads are logged and keep the rows already loaded.
+func refreshDataset(ctx context.Context, name string, dd *DatasetDef, db *Database) {
+	log := zerolog.Ctx(ctx).With().Str("dataset", name).Logger()
+	ticker := time.NewTicker(dd.Refresh.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := dd.Load(ctx, name, db); err != nil {
+			if ctx.Err() == nil {
+				log.Warn().Err(err).Msg("Error refreshing dataset. Serving the rows already loaded.")
+			}
+			continue
+		}
+		log.Debug().Int("rows", len(dd.snapshot().rows)).Msg("Refreshed dataset.")
+	}
+}
+
+// StartDatasets starts refreshing the datasets of the current config,
+// stopping any refreshes already running. Refreshes stop when ctx ends.
+func (s *Server) StartDatasets(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startDatasets(ctx)
+}
+
+// startDatasets is StartDatasets for callers holding s.mu.
+func (s *Server) startDatasets(ctx context.Context) {
+	s.stopDatasets()
+	if len(s.conf.Datasets) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for name, dd := range s.conf.Datasets {
+		name, dd, db := name, dd, s.dbs[dd.DB]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshDataset(ctx, name, dd, db)
+		}()
+	}
+	s.datasetStop = func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// stopDatasets stops running refreshes and waits for them to exit. The
+// caller must hold s.mu.
+func (s *Server) stopDatasets() {
+	if s.datasetStop != nil {
+		s.datasetStop()
+		s.datasetStop = nil
+	}
+}
+
+// DatasetSummary describes the rows loaded for a dataset.
+type DatasetSummary struct {
+	Name     string     `json:"name"`
+	Loaded   bool       `json:"loaded"`
+	Rows     int        `json:"rows"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+}
+
+// adminGetDatasets lists the datasets of conf and the rows loaded for them.
+func adminGetDatasets(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		sums := make([]DatasetSummary, 0, len(conf.Datasets))
+		for name, dd := range conf.Datasets {
+			sum := DatasetSummary{Name: name}
+			if snap := dd.snapshot(); snap != nil {
+				loadedAt := snap.loadedAt.UTC()
+				sum.Loaded, sum.Rows, sum.LoadedAt = true, len(snap.rows), &loadedAt
+			}
+			sums = append(sums, sum)
+		}
+		sort.Slice(sums, func(i, j int) bool { return sums[i].Name < sums[j].Name })
+		writeJSON(log, w, http.StatusOK, sums)
+	}
+}
@@ -16,34 +16,257 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
 )
 
+// defaultDrainTimeout is how long a pool replaced by a reload waits for
+// in-flight transactions before it is closed, unless its database sets
+// drain_timeout.
+const defaultDrainTimeout = 30 * time.Second
+
 type Databases map[string]*Database
 
+// Close closes the connection pools of all databases.
+func (dbs Databases) Close() {
+	for _, db := range dbs {
+		_ = db.db.Close()
+	}
+}
+
+// closeNew closes the pools of all databases in dbs that are not also in
+// prev, such as those opened for a config that is then rejected.
+func (dbs Databases) closeNew(prev Databases) {
+	for name, db := range dbs {
+		if prev[name] != db {
+			_ = db.db.Close()
+		}
+	}
+}
+
+// Drain closes the pools of all databases in dbs that are not also in
+// keep once their in-flight transactions complete. Pools are drained in
+// the background and Drain does not wait for them.
+func (dbs Databases) Drain(log zerolog.Logger, keep Databases) {
+	for name, db := range dbs {
+		if keep[name] == db {
+			continue
+		}
+		timeout := db.DrainTimeout.Duration
+		if timeout <= 0 {
+			timeout = defaultDrainTimeout
+		}
+		log := log.With().Str("database", name).Logger()
+		poolDrains.begin(name, db)
+		go func(name string, db *Database) {
+			began := time.Now()
+			stragglers := db.drain(timeout)
+			poolDrains.end(name, db, stragglers)
+			if stragglers > 0 {
+				log.Warn().
+					Int("stragglers", stragglers).
+					Dur("timeout", timeout).
+					Msg("Closed database pool with transactions still in flight.")
+				return
+			}
+			log.Info().
+				Dur("elapsed", time.Since(began)).
+				Msg("Drained database pool.")
+		}(name, db)
+	}
+}
+
 type Database struct {
-	db *sqlx.DB
+	db  *sqlx.DB
+	url string // The URL the pool was opened with, after resolving secrets.
 
 	*DatabaseDef
+
+	mu       sync.Mutex
+	inflight int           // Transactions using the pool.
+	drained  chan struct{} // Closed when inflight reaches zero while draining.
+}
+
+// sameDef returns whether the database was opened from a definition
+// equivalent to def with the resolved URL url, in which case its pool can
+// be kept across a reload.
+func (db *Database) sameDef(def *DatabaseDef, url string) bool {
+	if db.url != url {
+		return false
+	}
+	a, aerr := json.Marshal(db.DatabaseDef)
+	b, berr := json.Marshal(def)
+	return aerr == nil && berr == nil && string(a) == string(b)
+}
+
+// explainable returns whether the database supports EXPLAIN of prepared
+// statements, as PostgreSQL and MySQL do.
+func (db *Database) explainable() bool {
+	u, err := url.Parse(db.url)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "postgres", "postgresql", "pgx", "mysql":
+		return true
+	}
+	return false
+}
+
+// acquire records a transaction using the pool. Every call to acquire must
+// be followed by a call to release.
+func (db *Database) acquire() {
+	db.mu.Lock()
+	db.inflight++
+	db.mu.Unlock()
+}
+
+func (db *Database) release() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.inflight--
+	if db.inflight == 0 && db.drained != nil {
+		close(db.drained)
+		db.drained = nil
+	}
+}
+
+// InFlight returns the number of transactions using the pool.
+func (db *Database) InFlight() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.inflight
 }
 
-// type Transaction struct {
-// 	steps     []*Transaction
-// 	isolation IsolationLevel
-// }
+// drain waits up to timeout for transactions using the pool to complete and
+// then closes it. It returns the number of transactions still in flight
+// when the pool was closed.
+func (db *Database) drain(timeout time.Duration) (stragglers int) {
+	defer func() { _ = db.db.Close() }()
 
-// type TransactionStep struct {
-// 	db    *Database
-// 	query string
-// 	args  ArgDefs
-// }
+	db.mu.Lock()
+	if db.inflight == 0 {
+		db.mu.Unlock()
+		return 0
+	}
+	done := make(chan struct{})
+	db.drained = done
+	db.mu.Unlock()
 
-// func (t *Transaction) Apply(ctx context.Context) (interface{}, error) {
-// 	return errors.New("unimplemented")
-// }
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+	}
 
-// func CompileTransaction(dbs map[string]*Database, isolation IsolationLevel, tds []*TransactionDef) (*Transaction, error) {
-// 	ts := make([]*Transaction, len)
-// 	for it, td := range tds {
-// 	}
-// }
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.drained = nil
+	return db.inflight
+}
+
+// poolDrains records pools being drained after a reload for the admin API.
+var poolDrains = &drainMetrics{
+	draining: map[*Database]string{},
+	totals:   map[string]*DrainSummary{},
+}
+
+type drainMetrics struct {
+	mu       sync.Mutex
+	draining map[*Database]string
+	totals   map[string]*DrainSummary
+}
+
+// DrainSummary describes the pools of a database replaced by reloads.
+type DrainSummary struct {
+	Database string `json:"database"`
+	// Draining is the number of replaced pools not yet closed, and
+	// InFlight the number of transactions still using them.
+	Draining int `json:"draining"`
+	InFlight int `json:"in_flight"`
+	// Drained is the number of replaced pools closed, and Stragglers the
+	// number of transactions that were in flight when they were closed.
+	Drained    int64 `json:"drained"`
+	Stragglers int64 `json:"stragglers"`
+}
+
+func (m *drainMetrics) begin(name string, db *Database) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining[db] = name
+	if m.totals[name] == nil {
+		m.totals[name] = &DrainSummary{Database: name}
+	}
+}
+
+func (m *drainMetrics) end(name string, db *Database, stragglers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.draining, db)
+	s := m.totals[name]
+	s.Drained++
+	s.Stragglers += int64(stragglers)
+}
+
+// Summaries returns drain summaries for all databases that have had a pool
+// replaced, sorted by database name.
+func (m *drainMetrics) Summaries() []DrainSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sums := make([]DrainSummary, 0, len(m.totals))
+	for _, s := range m.totals {
+		sum := *s
+		for db, name := range m.draining {
+			if name == s.Database {
+				sum.Draining++
+				sum.InFlight += db.InFlight()
+			}
+		}
+		sums = append(sums, sum)
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].Database < sums[j].Database })
+	return sums
+}
+
+func adminGetDrains(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log := *zerolog.Ctx(req.Context())
+	writeJSON(log, w, http.StatusOK, poolDrains.Summaries())
+}
+
+// adminGetDrainMetrics writes drain summaries in the Prometheus text format.
+func adminGetDrainMetrics(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	writeDrainMetrics(w, poolDrains.Summaries())
+}
+
+func writeDrainMetrics(w io.Writer, sums []DrainSummary) {
+	metric := func(name, typ, help string, value func(DrainSummary) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range sums {
+			fmt.Fprintf(w, "%s{database=%q} %s\n", name, s.Database, strconv.FormatInt(value(s), 10))
+		}
+	}
+	metric("chisel_db_draining_pools", "gauge", "Pools replaced by a reload that have not been closed.",
+		func(s DrainSummary) int64 { return int64(s.Draining) })
+	metric("chisel_db_draining_transactions", "gauge", "Transactions in flight on pools replaced by a reload.",
+		func(s DrainSummary) int64 { return int64(s.InFlight) })
+	metric("chisel_db_drained_pools_total", "counter", "Pools replaced by a reload and closed.",
+		func(s DrainSummary) int64 { return s.Drained })
+	metric("chisel_db_drain_stragglers_total", "counter", "Transactions in flight when a replaced pool was closed.",
+		func(s DrainSummary) int64 { return s.Stragglers })
+}
@@ -0,0 +1,85 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "net/http"
+
+// EndpointDefaultsDef holds defaults for every endpoint, including those
+// generated from templates. Endpoints override a default by setting the
+// value themselves.
+type EndpointDefaultsDef struct {
+	BodyType *BodyType `json:"body_type,omitempty" yaml:"body_type,omitempty"`
+	// DB is the database of transactions that don't name one.
+	DB string `json:"db,omitempty" yaml:"db,omitempty"`
+	// Headers are response headers set by every endpoint. Endpoints may
+	// override individual headers, which are compared case-insensitively.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Query holds defaults for the options of endpoint queries.
+	Query *QueryDefaultsDef `json:"query,omitempty" yaml:"query,omitempty"`
+}
+
+// QueryDefaultsDef holds defaults for the options of endpoint queries.
+type QueryDefaultsDef struct {
+	Timeout    Duration    `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	StepBudget *StepBudget `json:"step_budget,omitempty" yaml:"step_budget,omitempty"`
+}
+
+// applyEndpointDefaults fills in the values of endpoints that they leave
+// unset from the config's endpoint defaults. It must be called after
+// templates are expanded and before the config is validated.
+func (c *Config) applyEndpointDefaults() {
+	dd := c.EndpointDefaults
+	if dd == nil {
+		return
+	}
+	for _, ed := range c.Endpoints {
+		if ed == nil {
+			continue
+		}
+		if ed.BodyType == nil && dd.BodyType != nil {
+			bt := *dd.BodyType
+			ed.BodyType = &bt
+		}
+		if len(dd.Headers) > 0 {
+			headers := make(map[string]string, len(dd.Headers)+len(ed.Headers))
+			for k, v := range dd.Headers {
+				headers[http.CanonicalHeaderKey(k)] = v
+			}
+			for k, v := range ed.Headers {
+				headers[http.CanonicalHeaderKey(k)] = v
+			}
+			ed.Headers = headers
+		}
+		if ed.Query == nil {
+			continue
+		}
+		if dd.DB != "" {
+			for _, td := range ed.Query.Transactions {
+				if td != nil && td.DB == "" {
+					td.DB = dd.DB
+				}
+			}
+		}
+		if qd := dd.Query; qd != nil {
+			if ed.Query.Timeout.Duration == 0 {
+				ed.Query.Timeout = qd.Timeout
+			}
+			if ed.Query.StepBudget == NoStepBudget && qd.StepBudget != nil {
+				ed.Query.StepBudget = *qd.StepBudget
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// DeprecationDef marks an endpoint as deprecated. Responses from deprecated
+// endpoints carry Deprecation, Sunset, and Link headers describing when the
+// endpoint was deprecated, when it will be removed, and what replaces it.
+type DeprecationDef struct {
+	Since     string `json:"since,omitempty" yaml:"since,omitempty"`         // Date the endpoint was deprecated.
+	Sunset    string `json:"sunset,omitempty" yaml:"sunset,omitempty"`       // Date the endpoint will be removed.
+	Successor string `json:"successor,omitempty" yaml:"successor,omitempty"` // URL of the endpoint replacing it.
+	Docs      string `json:"docs,omitempty" yaml:"docs,omitempty"`           // URL of documentation on the deprecation.
+
+	since  time.Time
+	sunset time.Time
+}
+
+func (dd *DeprecationDef) Validate() error {
+	var me *multierror.Error
+	var err error
+	if dd.since, err = parseDeprecationDate(dd.Since); err != nil {
+		me = multierror.Append(me, fmt.Errorf("invalid since: %w", err))
+	}
+	if dd.sunset, err = parseDeprecationDate(dd.Sunset); err != nil {
+		me = multierror.Append(me, fmt.Errorf("invalid sunset: %w", err))
+	}
+	if !dd.since.IsZero() && !dd.sunset.IsZero() && dd.sunset.Before(dd.since) {
+		me = multierror.Append(me, errors.New("sunset must not be before since"))
+	}
+	for _, u := range []struct{ name, url string }{{"successor", dd.Successor}, {"docs", dd.Docs}} {
+		if u.url == "" {
+			continue
+		}
+		if _, err := url.Parse(u.url); err != nil {
+			me = multierror.Append(me, fmt.Errorf("invalid %s: %w", u.name, redactURLError(err)))
+		}
+	}
+	return errorOrNil(me)
+}
+
+// parseDeprecationDate parses an RFC 3339 time or a YYYY-MM-DD date. An
+// empty string is the zero time.
+func parseDeprecationDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// Wrap adds deprecation headers to responses from next, and counts requests
+// to the endpoint method and path.
+func (dd *DeprecationDef) Wrap(method, path string, next http.Handler) http.Handler {
+	deprecation := "true"
+	if !dd.since.IsZero() {
+		deprecation = "@" + strconv.FormatInt(dd.since.Unix(), 10)
+	}
+	var sunset string
+	if !dd.sunset.IsZero() {
+		sunset = dd.sunset.UTC().Format(http.TimeFormat)
+	}
+	var links []string
+	if dd.Successor != "" {
+		links = append(links, "<"+dd.Successor+`>; rel="successor-version"`)
+	}
+	if dd.Docs != "" {
+		links = append(links, "<"+dd.Docs+`>; rel="deprecation"`)
+	}
+	key := deprecatedEndpoint{Method: method, Path: path}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		deprecatedCalls.Add(key)
+		h := w.Header()
+		h.Set("Deprecation", deprecation)
+		if sunset != "" {
+			h.Set("Sunset", sunset)
+		}
+		for _, link := range links {
+			h.Add("Link", link)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type deprecatedEndpoint struct {
+	Method string
+	Path   string
+}
+
+// deprecatedCalls counts requests to deprecated endpoints. Counts are kept
+// across reloads.
+var deprecatedCalls = &deprecationMetrics{calls: map[deprecatedEndpoint]int64{}}
+
+type deprecationMetrics struct {
+	mu    sync.Mutex
+	calls map[deprecatedEndpoint]int64
+}
+
+func (dm *deprecationMetrics) Add(key deprecatedEndpoint) {
+	dm.mu.Lock()
+	dm.calls[key]++
+	dm.mu.Unlock()
+}
+
+func (dm *deprecationMetrics) Calls(key deprecatedEndpoint) int64 {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.calls[key]
+}
+
+// DeprecationSummary describes a deprecated endpoint and the number of
+// requests made to it.
+type DeprecationSummary struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Name      string `json:"name,omitempty"`
+	Since     string `json:"since,omitempty"`
+	Sunset    string `json:"sunset,omitempty"`
+	Successor string `json:"successor,omitempty"`
+	Calls     int64  `json:"calls"`
+}
+
+// deprecationSummaries returns the summaries of all deprecated endpoints.
+func deprecationSummaries(conf *Config) []DeprecationSummary {
+	var sums []DeprecationSummary
+	for _, ed := range conf.Endpoints {
+		dd := ed.Deprecated
+		if dd == nil {
+			continue
+		}
+		sums = append(sums, DeprecationSummary{
+			Method:    ed.Method,
+			Path:      ed.Path,
+			Name:      ed.Name,
+			Since:     dd.Since,
+			Sunset:    dd.Sunset,
+			Successor: dd.Successor,
+			Calls:     deprecatedCalls.Calls(deprecatedEndpoint{Method: ed.Method, Path: ed.Path}),
+		})
+	}
+	return sums
+}
+
+func adminGetDeprecations(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		sums := deprecationSummaries(conf)
+		if sums == nil {
+			sums = []DeprecationSummary{}
+		}
+		writeJSON(log, w, http.StatusOK, sums)
+	}
+}
+
+// adminGetDeprecationMetrics writes deprecated endpoint call counts in the
+// Prometheus text format.
+func adminGetDeprecationMetrics(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		sums := deprecationSummaries(conf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		writeDeprecationMetrics(w, sums)
+	}
+}
+
+func writeDeprecationMetrics(w io.Writer, sums []DeprecationSummary) {
+	const name = "chisel_deprecated_requests_total"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, "Requests to deprecated endpoints.", name, "counter")
+	for _, s := range sums {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, endpointLabels(s.Method, s.Path, s.Name), strconv.FormatInt(s.Calls, 10))
+	}
+}
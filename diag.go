@@ -0,0 +1,198 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// recentErrorsSize is the number of error logs kept for diagnostic bundles.
+const recentErrorsSize = 100
+
+// recentErrors records the most recent error logs for diagnostic bundles.
+var recentErrors = &errorRing{lines: make([][]byte, recentErrorsSize)}
+
+// DiagnosticsDef configures diagnostic bundles. A bundle is written on
+// SIGQUIT or through the admin API and holds goroutine stacks, a heap
+// profile, a hash of the loaded config, and recent error logs.
+type DiagnosticsDef struct {
+	// Dir is the directory bundles are written to. Each bundle is written
+	// to its own subdirectory.
+	Dir string `json:"dir" yaml:"dir"`
+}
+
+func (dd *DiagnosticsDef) Validate() error {
+	if dd.Dir == "" {
+		return errors.New("diagnostics requires a dir")
+	}
+	return nil
+}
+
+// diagnosticsInfo is written to info.json in each diagnostic bundle.
+type diagnosticsInfo struct {
+	Time         time.Time `json:"time"`
+	PID          int       `json:"pid"`
+	GoVersion    string    `json:"go_version"`
+	Goroutines   int       `json:"goroutines"`
+	ConfigSHA256 string    `json:"config_sha256"`
+}
+
+// writeDiagnostics writes a diagnostic bundle for conf to a new directory
+// under conf.Diagnostics.Dir and returns its path.
+func writeDiagnostics(conf *Config) (string, error) {
+	if conf.Diagnostics == nil {
+		return "", errors.New("diagnostics are not configured")
+	}
+
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		return "", fmt.Errorf("error encoding config: %w", err)
+	}
+	sum := sha256.Sum256(confJSON)
+
+	now := time.Now().UTC()
+	if err := os.MkdirAll(conf.Diagnostics.Dir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating diagnostics directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(conf.Diagnostics.Dir, "chisel-"+now.Format("20060102T150405Z")+"-")
+	if err != nil {
+		return "", fmt.Errorf("error creating diagnostic bundle: %w", err)
+	}
+
+	write := func(name string, fn func(f *os.File) error) error {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing %s: %w", name, err)
+		}
+		return f.Close()
+	}
+
+	info := &diagnosticsInfo{
+		Time:         now,
+		PID:          os.Getpid(),
+		GoVersion:    runtime.Version(),
+		Goroutines:   runtime.NumGoroutine(),
+		ConfigSHA256: hex.EncodeToString(sum[:]),
+	}
+	err = write("info.json", func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	})
+	if err == nil {
+		err = write("goroutines.txt", func(f *os.File) error {
+			return pprof.Lookup("goroutine").WriteTo(f, 2)
+		})
+	}
+	if err == nil {
+		err = write("heap.pprof", func(f *os.File) error {
+			runtime.GC()
+			return pprof.Lookup("heap").WriteTo(f, 0)
+		})
+	}
+	if err == nil {
+		err = write("errors.log", func(f *os.File) error {
+			for _, line := range recentErrors.Lines() {
+				if _, err := f.Write(line); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return dir, err
+}
+
+// errorRing is a zerolog.LevelWriter that keeps the most recent logs at
+// error level and above.
+type errorRing struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+func (er *errorRing) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (er *errorRing) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < zerolog.ErrorLevel || level >= zerolog.NoLevel {
+		return len(p), nil
+	}
+	line := append([]byte(nil), p...)
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.lines[er.next] = line
+	er.next++
+	if er.next == len(er.lines) {
+		er.next, er.full = 0, true
+	}
+	return len(p), nil
+}
+
+// Lines returns the recorded logs, oldest first.
+func (er *errorRing) Lines() [][]byte {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if !er.full {
+		return append([][]byte(nil), er.lines[:er.next]...)
+	}
+	lines := make([][]byte, 0, len(er.lines))
+	lines = append(lines, er.lines[er.next:]...)
+	return append(lines, er.lines[:er.next]...)
+}
+
+type diagnosticsBody struct {
+	Path string `json:"path"`
+}
+
+// adminWriteDiagnostics writes a diagnostic bundle and returns its path.
+func adminWriteDiagnostics(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		if conf.Diagnostics == nil {
+			writeError(log, w, http.StatusNotFound, &errorResponse{Error: "diagnostics are not configured"})
+			return
+		}
+		dir, err := writeDiagnostics(conf)
+		if err != nil {
+			log.Error().Err(err).Str("path", dir).Msg("Failed to write diagnostic bundle.")
+			writeError(log, w, http.StatusInternalServerError, &errorResponse{Error: "diagnostic bundle cannot be written"})
+			return
+		}
+		log.Info().Str("path", dir).Msg("Wrote diagnostic bundle.")
+		writeJSON(log, w, http.StatusOK, &diagnosticsBody{Path: dir})
+	}
+}
@@ -0,0 +1,108 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// defaultDiscoveryPath is the path of the discovery route if none is set.
+const defaultDiscoveryPath = "/__endpoints"
+
+// DiscoveryDef enables a route that lists the endpoints served on a binding,
+// for service catalogs. The route is served on the bindings in Bind, or all
+// bindings if Bind is empty, and is wrapped in Middleware, which should
+// normally authenticate requests.
+type DiscoveryDef struct {
+	Path       string          `json:"path,omitempty" yaml:"path,omitempty"`
+	Bind       IntSet          `json:"bind,omitempty" yaml:"bind,omitempty"`
+	Middleware MiddlewareNames `json:"middleware,omitempty" yaml:"middleware,omitempty"`
+}
+
+func (dd *DiscoveryDef) Validate(middleware map[string]*MiddlewareDef) error {
+	var me *multierror.Error
+	if dd.Path == "" {
+		dd.Path = defaultDiscoveryPath
+	} else if !strings.HasPrefix(dd.Path, "/") {
+		me = multierror.Append(me, fmt.Errorf("path %q must begin with /", dd.Path))
+	} else if strings.ContainsAny(dd.Path, ":*") {
+		me = multierror.Append(me, errors.New("path must not have parameters"))
+	}
+	if err := dd.Middleware.Validate(middleware); err != nil {
+		me = multierror.Append(me, err)
+	}
+	return errorOrNil(me)
+}
+
+// servedOn returns whether the discovery route is served on the binding bid.
+func (dd *DiscoveryDef) servedOn(bid int) bool {
+	return dd != nil && (len(dd.Bind) == 0 || dd.Bind.Contains(bid))
+}
+
+// EndpointSummary describes an endpoint in the discovery route's response.
+// Auth lists the names of the middleware that authenticate requests to the
+// endpoint, including those of its binding.
+type EndpointSummary struct {
+	Method      string   `json:"method"`
+	Path        string   `json:"path"`
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Auth        []string `json:"auth,omitempty"`
+}
+
+// discoveryHandle returns the discovery route's handler for the binding bid,
+// listing the endpoints served on it.
+func (r *Registry) discoveryHandle(bid int) httprouter.Handle {
+	conf := r.conf
+	sums := make([]EndpointSummary, 0, len(r.endpoints))
+	for _, ce := range r.endpoints {
+		if len(ce.def.Bind) > 0 && !ce.def.Bind.Contains(bid) {
+			continue
+		}
+		var auth []string
+		for _, names := range []MiddlewareNames{conf.Bind[bid].Middleware, ce.def.Middleware} {
+			for _, name := range names {
+				if _, ok := conf.Middleware[name].Middleware.(*BasicAuthMiddleware); ok {
+					auth = append(auth, name)
+				}
+			}
+		}
+		sums = append(sums, EndpointSummary{
+			Method:      ce.method,
+			Path:        ce.def.Path,
+			Name:        ce.def.Name,
+			Description: ce.def.Description,
+			Tags:        ce.def.Tags,
+			Auth:        auth,
+		})
+	}
+
+	h := conf.Discovery.Middleware.Wrap(conf.Middleware, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := *zerolog.Ctx(req.Context())
+		writeJSON(log, w, http.StatusOK, sums)
+	}))
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		h.ServeHTTP(w, req)
+	}
+}
@@ -0,0 +1,446 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !omit_athena
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	sql.Register("athena", &warehouseDriver{open: openAthena})
+	localDSNs["athena"] = athenaDSN
+}
+
+// athenaDSN accepts athena:// URLs, which are passed as-is to chisel's own
+// Athena driver.
+func athenaDSN(u *url.URL) (drv, dsn string, bindType int, err error) {
+	return "athena", u.String(), sqlx.QUESTION, nil
+}
+
+const (
+	// athenaPageSize is the number of rows requested per page of results,
+	// which is the most Athena allows.
+	athenaPageSize = 1000
+	// athenaMaxParam is the most characters Athena allows in an execution
+	// parameter.
+	athenaMaxParam = 1024
+)
+
+// athenaClient runs queries with the Athena API. Requests are signed with
+// AWS Signature Version 4.
+type athenaClient struct {
+	http      *http.Client
+	endpoint  string
+	region    string
+	database  string
+	catalog   string
+	workgroup string
+	output    string        // The S3 location results are written to.
+	maxBytes  int64         // Queries are stopped once they scan or return more than this.
+	poll      time.Duration // Time between checks of a running query.
+
+	awsCredentials
+}
+
+// openAthena creates a client from a URL of the form
+// athena://[access-key:secret-key@]region[/database][?options]. If the URL
+// has no credentials, they're read from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables.
+func openAthena(u *url.URL) (warehouseClient, error) {
+	q := u.Query()
+	c := &athenaClient{
+		http:      http.DefaultClient,
+		endpoint:  "https://athena." + u.Host + ".amazonaws.com/",
+		region:    u.Host,
+		database:  strings.Trim(u.Path, "/"),
+		catalog:   q.Get("catalog"),
+		workgroup: q.Get("workgroup"),
+		output:    q.Get("output"),
+	}
+	if c.region == "" {
+		return nil, errors.New("athena URL has no region")
+	}
+	var err error
+	if c.maxBytes, err = warehouseMaxBytes(q); err != nil {
+		return nil, err
+	}
+	if c.poll, err = warehouseDuration(q, "poll", time.Second); err != nil {
+		return nil, err
+	}
+
+	if u.User != nil {
+		c.accessKey = u.User.Username()
+		c.secretKey, _ = u.User.Password()
+	} else {
+		c.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("no athena credentials in URL or environment")
+	}
+	return c, nil
+}
+
+type athenaExecution struct {
+	QueryExecution struct {
+		StatementType string `json:"StatementType"`
+		Status        struct {
+			State             string `json:"State"`
+			StateChangeReason string `json:"StateChangeReason"`
+		} `json:"Status"`
+		Statistics struct {
+			DataScannedInBytes int64 `json:"DataScannedInBytes"`
+		} `json:"Statistics"`
+	} `json:"QueryExecution"`
+}
+
+type athenaResults struct {
+	UpdateCount int64 `json:"UpdateCount"`
+	ResultSet   struct {
+		ResultSetMetadata struct {
+			ColumnInfo []struct {
+				Name string `json:"Name"`
+				Type string `json:"Type"`
+			} `json:"ColumnInfo"`
+		} `json:"ResultSetMetadata"`
+		Rows []struct {
+			Data []struct {
+				VarCharValue *string `json:"VarCharValue"`
+			} `json:"Data"`
+		} `json:"Rows"`
+	} `json:"ResultSet"`
+	NextToken string `json:"NextToken"`
+}
+
+func (c *athenaClient) Query(ctx context.Context, query string, args []driver.NamedValue) (warehouseResult, error) {
+	start := map[string]interface{}{
+		"QueryString": query,
+	}
+	if c.database != "" || c.catalog != "" {
+		qctx := map[string]string{}
+		if c.database != "" {
+			qctx["Database"] = c.database
+		}
+		if c.catalog != "" {
+			qctx["Catalog"] = c.catalog
+		}
+		start["QueryExecutionContext"] = qctx
+	}
+	if c.output != "" {
+		start["ResultConfiguration"] = map[string]string{"OutputLocation": c.output}
+	}
+	if c.workgroup != "" {
+		start["WorkGroup"] = c.workgroup
+	}
+	if len(args) > 0 {
+		params := make([]string, len(args))
+		for i, arg := range args {
+			lit, err := athenaLiteral(arg.Value)
+			if err != nil {
+				return nil, fmt.Errorf("arg %d: %w", arg.Ordinal, err)
+			}
+			if n := utf8.RuneCountInString(lit); n > athenaMaxParam {
+				return nil, fmt.Errorf("arg %d is %d characters as a literal, more than the %d athena allows",
+					arg.Ordinal, n, athenaMaxParam)
+			}
+			params[i] = lit
+		}
+		start["ExecutionParameters"] = params
+	}
+
+	var started struct {
+		QueryExecutionID string `json:"QueryExecutionId"`
+	}
+	if err := c.call(ctx, "StartQueryExecution", start, &started); err != nil {
+		return nil, err
+	}
+	id := map[string]string{"QueryExecutionId": started.QueryExecutionID}
+	stop := func(ctx context.Context) error {
+		return c.call(ctx, "StopQueryExecution", id, nil)
+	}
+
+	for {
+		var exec athenaExecution
+		if err := c.call(ctx, "GetQueryExecution", id, &exec); err != nil {
+			if ctx.Err() != nil {
+				cancelJob(stop)
+			}
+			return nil, err
+		}
+		qe := exec.QueryExecution
+		scanned := c.maxBytes > 0 && qe.Statistics.DataScannedInBytes > c.maxBytes
+		switch {
+		case qe.Status.State == "SUCCEEDED" && scanned:
+			// The query finished between polls, after scanning more
+			// than it should have, so its results aren't read.
+			return nil, fmt.Errorf("%w: athena query %s scanned %d bytes", errMaxBytes,
+				started.QueryExecutionID, qe.Statistics.DataScannedInBytes)
+		case qe.Status.State == "SUCCEEDED":
+			res := &athenaResult{client: c, id: started.QueryExecutionID, header: qe.StatementType == "DML"}
+			if err := res.fetch(ctx); err != nil {
+				return nil, err
+			}
+			return res, nil
+		case qe.Status.State == "FAILED", qe.Status.State == "CANCELLED":
+			return nil, fmt.Errorf("athena query %s %s: %s", started.QueryExecutionID,
+				strings.ToLower(qe.Status.State), qe.Status.StateChangeReason)
+		case scanned:
+			cancelJob(stop)
+			return nil, fmt.Errorf("%w: athena query %s scanned %d bytes", errMaxBytes,
+				started.QueryExecutionID, qe.Statistics.DataScannedInBytes)
+		}
+
+		select {
+		case <-ctx.Done():
+			cancelJob(stop)
+			return nil, ctx.Err()
+		case <-time.After(c.poll):
+		}
+	}
+}
+
+// call calls an action of the Athena API.
+func (c *athenaClient) call(ctx context.Context, action string, in, out interface{}) error {
+	return warehouseCall(ctx, c.http, "POST", c.endpoint, in, out, func(req *http.Request, body []byte) {
+		c.sign(req, "athena", c.region, "AmazonAthena."+action, body, time.Now())
+	}, athenaError)
+}
+
+func athenaError(status int, body []byte) error {
+	var resp struct {
+		Type    string `json:"__type"`
+		Message string `json:"Message"`
+		Lower   string `json:"message"`
+	}
+	if json.Unmarshal(body, &resp) != nil || (resp.Message == "" && resp.Lower == "") {
+		return fmt.Errorf("athena responded with status %d", status)
+	}
+	if resp.Message == "" {
+		resp.Message = resp.Lower
+	}
+	if i := strings.LastIndexByte(resp.Type, '#'); i != -1 {
+		resp.Type = resp.Type[i+1:]
+	}
+	return fmt.Errorf("athena: %s: %s", resp.Type, resp.Message)
+}
+
+// athenaLiteral returns an arg as a SQL literal. Athena substitutes
+// execution parameters into the query as written, so strings must be
+// quoted.
+func athenaLiteral(v driver.Value) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan()", nil
+		case math.IsInf(v, 1):
+			return "infinity()", nil
+		case math.IsInf(v, -1):
+			return "-infinity()", nil
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return athenaString(v)
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'", nil
+	case time.Time:
+		return "TIMESTAMP '" + v.UTC().Format("2006-01-02 15:04:05.000") + "'", nil
+	default:
+		return "", fmt.Errorf("unsupported arg type %T", v)
+	}
+}
+
+// athenaString returns s as a string literal. Quotes are doubled, and
+// strings holding control or other unprintable characters are written as
+// Unicode escape literals (U&'...') so that every character of the literal
+// is printable. Strings that aren't valid UTF-8 are an error.
+func athenaString(s string) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", errors.New("string arg is not valid UTF-8")
+	}
+	printable := true
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+	if printable {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'", nil
+	}
+
+	var b strings.Builder
+	b.WriteString("U&'")
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\'':
+			b.WriteString("''")
+		case !unicode.IsPrint(r) && r > 0xffff:
+			fmt.Fprintf(&b, `\+%06X`, r)
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String(), nil
+}
+
+// athenaResult is a finished query's results, read with GetQueryResults.
+type athenaResult struct {
+	client   *athenaClient
+	id       string
+	header   bool // Whether the first row may be a header row.
+	cols     []warehouseColumn
+	affected int64
+	page     [][]driver.Value
+	token    string
+	done     bool
+	read     int64 // Bytes of values read, limited by the client's maxBytes.
+}
+
+// fetch reads the next page of results.
+func (r *athenaResult) fetch(ctx context.Context) error {
+	in := map[string]interface{}{
+		"QueryExecutionId": r.id,
+		"MaxResults":       athenaPageSize,
+	}
+	if r.token != "" {
+		in["NextToken"] = r.token
+	}
+	var out athenaResults
+	if err := r.client.call(ctx, "GetQueryResults", in, &out); err != nil {
+		return err
+	}
+
+	first := r.cols == nil
+	if first {
+		r.affected = out.UpdateCount
+		r.cols = make([]warehouseColumn, len(out.ResultSet.ResultSetMetadata.ColumnInfo))
+		for i, ci := range out.ResultSet.ResultSetMetadata.ColumnInfo {
+			r.cols[i] = warehouseColumn{Name: ci.Name, Type: strings.ToUpper(ci.Type)}
+		}
+	}
+	rows := out.ResultSet.Rows
+	// The first row of a SELECT query's results holds its column names.
+	if first && r.header && len(rows) > 0 && len(rows[0].Data) == len(r.cols) {
+		header := true
+		for i, d := range rows[0].Data {
+			header = header && d.VarCharValue != nil && *d.VarCharValue == r.cols[i].Name
+		}
+		if header {
+			rows = rows[1:]
+		}
+	}
+
+	r.page = make([][]driver.Value, len(rows))
+	for i, row := range rows {
+		values := make([]driver.Value, len(r.cols))
+		for j, d := range row.Data {
+			if d.VarCharValue != nil {
+				r.read += int64(len(*d.VarCharValue))
+			}
+			if j < len(values) {
+				values[j] = athenaValue(r.cols[j].Type, d.VarCharValue)
+			}
+		}
+		r.page[i] = values
+	}
+	if max := r.client.maxBytes; max > 0 && r.read > max {
+		r.page, r.done = nil, true
+		return fmt.Errorf("%w: athena query %s returned more than %d bytes", errMaxBytes, r.id, max)
+	}
+	r.token = out.NextToken
+	r.done = r.token == ""
+	return nil
+}
+
+func (r *athenaResult) Columns() []warehouseColumn {
+	return r.cols
+}
+
+func (r *athenaResult) RowsAffected() int64 {
+	return r.affected
+}
+
+func (r *athenaResult) NextPage(ctx context.Context) ([][]driver.Value, error) {
+	if r.page == nil {
+		if r.done {
+			return nil, io.EOF
+		}
+		if err := r.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	page := r.page
+	r.page = nil
+	return page, nil
+}
+
+// athenaValue converts a value, which Athena always returns as text, to a
+// driver value according to its column's type.
+func athenaValue(typ string, s *string) driver.Value {
+	if s == nil {
+		return nil
+	}
+	switch typ {
+	case "BOOLEAN":
+		return *s == "true"
+	case "TINYINT", "SMALLINT", "INTEGER", "INT", "BIGINT":
+		if i, err := strconv.ParseInt(*s, 10, 64); err == nil {
+			return i
+		}
+	case "DOUBLE", "FLOAT", "REAL":
+		if f, err := strconv.ParseFloat(*s, 64); err == nil {
+			return f
+		}
+	case "TIMESTAMP":
+		if t, err := time.Parse("2006-01-02 15:04:05.999999999", *s); err == nil {
+			return t
+		}
+	}
+	return *s
+}
@@ -0,0 +1,177 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !omit_athena
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAthenaLiteral(t *testing.T) {
+	cases := []struct {
+		in   driver.Value
+		want string
+	}{
+		{nil, "NULL"},
+		{int64(-1), "-1"},
+		{1.5, "1.5"},
+		{true, "true"},
+		{"plain", "'plain'"},
+		{"it's", "'it''s'"},
+		{`back\slash`, `'back\slash'`},
+		{"café", "'café'"},
+		{"line\nbreak", `U&'line\000Abreak'`},
+		{"it's\\\x00", `U&'it''s\\\0000'`},
+		{"tab\there \U000E0001", `U&'tab\0009here \+0E0001'`},
+		{[]byte{0xde, 0xad}, "X'dead'"},
+		{time.Date(2021, 1, 2, 3, 4, 5, 6e6, time.UTC), "TIMESTAMP '2021-01-02 03:04:05.006'"},
+	}
+	for _, c := range cases {
+		got, err := athenaLiteral(c.in)
+		if err != nil {
+			t.Errorf("athenaLiteral(%#v) = %v", c.in, err)
+		} else if got != c.want {
+			t.Errorf("athenaLiteral(%#v) = %s; want %s", c.in, got, c.want)
+		}
+	}
+
+	if _, err := athenaLiteral("bad \xff"); err == nil {
+		t.Error("athenaLiteral(invalid UTF-8) = nil; want an error")
+	}
+}
+
+// newTestAthena returns a client of a fake Athena API whose queries succeed
+// having scanned scanned bytes and return pages of rows, each row holding
+// one value.
+func newTestAthena(t *testing.T, maxBytes, scanned int64, pages [][]string) *athenaClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var in struct {
+			NextToken string `json:"NextToken"`
+		}
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &in)
+
+		var out interface{}
+		switch req.Header.Get("X-Amz-Target") {
+		case "AmazonAthena.StartQueryExecution":
+			out = map[string]string{"QueryExecutionId": "q"}
+		case "AmazonAthena.GetQueryExecution":
+			out = map[string]interface{}{"QueryExecution": map[string]interface{}{
+				"Status":     map[string]string{"State": "SUCCEEDED"},
+				"Statistics": map[string]int64{"DataScannedInBytes": scanned},
+			}}
+		case "AmazonAthena.GetQueryResults":
+			i := 0
+			if in.NextToken != "" {
+				i, _ = strconv.Atoi(in.NextToken)
+			}
+			rows := []interface{}{}
+			for _, v := range pages[i] {
+				v := v
+				rows = append(rows, map[string]interface{}{"Data": []interface{}{map[string]*string{"VarCharValue": &v}}})
+			}
+			res := map[string]interface{}{"ResultSet": map[string]interface{}{
+				"ResultSetMetadata": map[string]interface{}{
+					"ColumnInfo": []interface{}{map[string]string{"Name": "v", "Type": "varchar"}},
+				},
+				"Rows": rows,
+			}}
+			if i+1 < len(pages) {
+				res["NextToken"] = strconv.Itoa(i + 1)
+			}
+			out = res
+		default:
+			http.Error(w, `{"message":"unexpected target"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(srv.Close)
+	return &athenaClient{
+		http:           srv.Client(),
+		endpoint:       srv.URL + "/",
+		region:         "us-east-1",
+		maxBytes:       maxBytes,
+		poll:           time.Millisecond,
+		awsCredentials: sigV4TestCredentials,
+	}
+}
+
+// readAthena runs a query with c and reads all of its rows.
+func readAthena(c *athenaClient) (int, error) {
+	ctx := context.Background()
+	res, err := c.Query(ctx, "SELECT v FROM t", nil)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		page, err := res.NextPage(ctx)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n += len(page)
+	}
+}
+
+func TestAthenaMaxBytes(t *testing.T) {
+	pages := [][]string{{"aaaa", "bbbb"}, {"cccc", "dddd"}}
+	cases := []struct {
+		name     string
+		maxBytes int64
+		scanned  int64
+		rows     int
+		err      bool
+	}{
+		{"no limit", 0, 1 << 30, 4, false},
+		{"under limit", 16, 16, 4, false},
+		{"scanned", 16, 17, 0, true},
+		{"returned", 12, 0, 2, true},
+	}
+	for _, c := range cases {
+		n, err := readAthena(newTestAthena(t, c.maxBytes, c.scanned, pages))
+		if c.err && !errors.Is(err, errMaxBytes) {
+			t.Errorf("%s: error = %v; want %v", c.name, err, errMaxBytes)
+		} else if !c.err && err != nil {
+			t.Errorf("%s: error = %v", c.name, err)
+		}
+		if n != c.rows {
+			t.Errorf("%s: rows = %d; want %d", c.name, n, c.rows)
+		}
+	}
+}
+
+func TestAthenaParamLength(t *testing.T) {
+	c := newTestAthena(t, 0, 0, [][]string{{}})
+	args := []driver.NamedValue{{Ordinal: 1, Value: strings.Repeat("a", athenaMaxParam)}}
+	if _, err := c.Query(context.Background(), "SELECT ?", args); err == nil {
+		t.Error("Query() = nil; want an error for an arg longer than athena allows")
+	}
+}
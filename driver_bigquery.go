@@ -0,0 +1,441 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !omit_bigquery
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func init() {
+	sql.Register("bigquery", &warehouseDriver{open: openBigQuery})
+	localDSNs["bigquery"] = bigqueryDSN
+}
+
+// bigqueryDSN accepts bigquery:// URLs, which are passed as-is to chisel's
+// own BigQuery driver.
+func bigqueryDSN(u *url.URL) (drv, dsn string, bindType int, err error) {
+	return "bigquery", u.String(), sqlx.QUESTION, nil
+}
+
+const (
+	bigqueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2"
+	bigqueryScope    = "https://www.googleapis.com/auth/bigquery"
+
+	// bigqueryWait is how long each request for a job's results waits for
+	// the job to finish before returning.
+	bigqueryWait = 10 * time.Second
+)
+
+// bigqueryClient runs queries with the BigQuery REST API. Queries are
+// written in standard SQL with positional parameters.
+type bigqueryClient struct {
+	http     *http.Client
+	endpoint string
+	project  string
+	dataset  string // The default dataset of queries, if set.
+	location string
+	maxBytes int64 // Passed as maximumBytesBilled.
+	pageSize int
+}
+
+// openBigQuery creates a client from a URL of the form
+// bigquery://project[/dataset][?options]. Credentials are read from the
+// file given by the credentials option or, if unset, found the same way as
+// other Google Cloud clients (GOOGLE_APPLICATION_CREDENTIALS, gcloud, or
+// the metadata server).
+func openBigQuery(u *url.URL) (warehouseClient, error) {
+	q := u.Query()
+	c := &bigqueryClient{
+		endpoint: bigqueryEndpoint,
+		project:  u.Host,
+		dataset:  strings.Trim(u.Path, "/"),
+		location: q.Get("location"),
+		pageSize: 10000,
+	}
+	if c.project == "" {
+		return nil, errors.New("bigquery URL has no project")
+	}
+	if strings.Contains(c.dataset, "/") {
+		return nil, fmt.Errorf("invalid bigquery dataset %q", c.dataset)
+	}
+	var err error
+	if c.maxBytes, err = warehouseMaxBytes(q); err != nil {
+		return nil, err
+	}
+	if s := q.Get("page_size"); s != "" {
+		if c.pageSize, err = strconv.Atoi(s); err != nil || c.pageSize <= 0 {
+			return nil, fmt.Errorf("invalid page_size %q", s)
+		}
+	}
+
+	ctx := context.Background()
+	var creds *google.Credentials
+	if path := q.Get("credentials"); path != "" {
+		p, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading bigquery credentials: %w", err)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, p, bigqueryScope)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing bigquery credentials: %w", err)
+		}
+	} else if creds, err = google.FindDefaultCredentials(ctx, bigqueryScope); err != nil {
+		return nil, fmt.Errorf("error finding bigquery credentials: %w", err)
+	}
+	c.http = oauth2.NewClient(ctx, creds.TokenSource)
+	return c, nil
+}
+
+type bigqueryJobRef struct {
+	ProjectID string `json:"projectId"`
+	JobID     string `json:"jobId"`
+	Location  string `json:"location,omitempty"`
+}
+
+type bigqueryDatasetRef struct {
+	ProjectID string `json:"projectId"`
+	DatasetID string `json:"datasetId"`
+}
+
+type bigqueryParam struct {
+	ParameterType struct {
+		Type string `json:"type"`
+	} `json:"parameterType"`
+	ParameterValue struct {
+		Value *string `json:"value,omitempty"`
+	} `json:"parameterValue"`
+}
+
+type bigqueryRequest struct {
+	Query              string              `json:"query"`
+	UseLegacySQL       bool                `json:"useLegacySql"`
+	Location           string              `json:"location,omitempty"`
+	DefaultDataset     *bigqueryDatasetRef `json:"defaultDataset,omitempty"`
+	MaximumBytesBilled int64               `json:"maximumBytesBilled,string,omitempty"`
+	MaxResults         int                 `json:"maxResults"`
+	TimeoutMs          int64               `json:"timeoutMs"`
+	ParameterMode      string              `json:"parameterMode,omitempty"`
+	QueryParameters    []bigqueryParam     `json:"queryParameters,omitempty"`
+	FormatOptions      struct {
+		UseInt64Timestamp bool `json:"useInt64Timestamp"`
+	} `json:"formatOptions"`
+}
+
+type bigqueryField struct {
+	Name   string           `json:"name"`
+	Type   string           `json:"type"`
+	Mode   string           `json:"mode"`
+	Fields []*bigqueryField `json:"fields"`
+}
+
+// bigqueryResponse is the response of both jobs.query and
+// jobs.getQueryResults.
+type bigqueryResponse struct {
+	JobReference bigqueryJobRef `json:"jobReference"`
+	JobComplete  bool           `json:"jobComplete"`
+	Schema       *struct {
+		Fields []*bigqueryField `json:"fields"`
+	} `json:"schema"`
+	Rows []struct {
+		F []struct {
+			V interface{} `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+	PageToken          string `json:"pageToken"`
+	NumDMLAffectedRows string `json:"numDmlAffectedRows"`
+}
+
+func (c *bigqueryClient) Query(ctx context.Context, query string, args []driver.NamedValue) (warehouseResult, error) {
+	req := bigqueryRequest{
+		Query:              query,
+		Location:           c.location,
+		MaximumBytesBilled: c.maxBytes,
+		MaxResults:         c.pageSize,
+		TimeoutMs:          bigqueryWait.Milliseconds(),
+	}
+	req.FormatOptions.UseInt64Timestamp = true
+	if c.dataset != "" {
+		req.DefaultDataset = &bigqueryDatasetRef{ProjectID: c.project, DatasetID: c.dataset}
+	}
+	if len(args) > 0 {
+		req.ParameterMode = "POSITIONAL"
+		for _, arg := range args {
+			p, err := bigqueryParamOf(arg.Value)
+			if err != nil {
+				return nil, fmt.Errorf("arg %d: %w", arg.Ordinal, err)
+			}
+			req.QueryParameters = append(req.QueryParameters, p)
+		}
+	}
+
+	resp := new(bigqueryResponse)
+	uri := c.endpoint + "/projects/" + url.PathEscape(c.project) + "/queries"
+	if err := warehouseCall(ctx, c.http, "POST", uri, req, resp, nil, bigqueryError); err != nil {
+		return nil, err
+	}
+	job := resp.JobReference
+	for !resp.JobComplete {
+		resp = new(bigqueryResponse)
+		if err := c.results(ctx, job, "", resp); err != nil {
+			if ctx.Err() != nil {
+				cancelJob(func(ctx context.Context) error { return c.cancel(ctx, job) })
+			}
+			return nil, err
+		}
+	}
+
+	res := &bigqueryResult{client: c, job: job, first: resp}
+	if resp.Schema != nil {
+		res.fields = resp.Schema.Fields
+	}
+	res.affected, _ = strconv.ParseInt(resp.NumDMLAffectedRows, 10, 64)
+	return res, nil
+}
+
+// results calls jobs.getQueryResults, which waits for the job to finish
+// and returns the page of results starting at pageToken.
+func (c *bigqueryClient) results(ctx context.Context, job bigqueryJobRef, pageToken string, resp *bigqueryResponse) error {
+	q := url.Values{
+		"maxResults":                      {strconv.Itoa(c.pageSize)},
+		"timeoutMs":                       {strconv.FormatInt(bigqueryWait.Milliseconds(), 10)},
+		"formatOptions.useInt64Timestamp": {"true"},
+	}
+	if job.Location != "" {
+		q.Set("location", job.Location)
+	}
+	if pageToken != "" {
+		q.Set("pageToken", pageToken)
+	}
+	uri := c.endpoint + "/projects/" + url.PathEscape(job.ProjectID) + "/queries/" + url.PathEscape(job.JobID) + "?" + q.Encode()
+	return warehouseCall(ctx, c.http, "GET", uri, nil, resp, nil, bigqueryError)
+}
+
+func (c *bigqueryClient) cancel(ctx context.Context, job bigqueryJobRef) error {
+	uri := c.endpoint + "/projects/" + url.PathEscape(job.ProjectID) + "/jobs/" + url.PathEscape(job.JobID) + "/cancel"
+	if job.Location != "" {
+		uri += "?location=" + url.QueryEscape(job.Location)
+	}
+	return warehouseCall(ctx, c.http, "POST", uri, nil, nil, nil, bigqueryError)
+}
+
+// bigqueryError converts an error response into an error. Responses for
+// queries that would bill more than maximumBytesBilled wrap errMaxBytes.
+func bigqueryError(status int, body []byte) error {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error.Message == "" {
+		return fmt.Errorf("bigquery responded with status %d", status)
+	}
+	for _, e := range resp.Error.Errors {
+		if e.Reason == "bytesBilledLimitExceeded" {
+			return fmt.Errorf("%w: %s", errMaxBytes, resp.Error.Message)
+		}
+	}
+	return fmt.Errorf("bigquery: %s", resp.Error.Message)
+}
+
+// bigqueryParamOf returns the query parameter for an arg. Null args are
+// passed as null strings.
+func bigqueryParamOf(v driver.Value) (bigqueryParam, error) {
+	var p bigqueryParam
+	var s string
+	switch v := v.(type) {
+	case nil:
+		p.ParameterType.Type = "STRING"
+		return p, nil
+	case int64:
+		p.ParameterType.Type, s = "INT64", strconv.FormatInt(v, 10)
+	case float64:
+		p.ParameterType.Type, s = "FLOAT64", strconv.FormatFloat(v, 'g', -1, 64)
+		if math.IsInf(v, 1) {
+			s = "+inf"
+		} else if math.IsInf(v, -1) {
+			s = "-inf"
+		}
+	case bool:
+		p.ParameterType.Type, s = "BOOL", strconv.FormatBool(v)
+	case string:
+		p.ParameterType.Type, s = "STRING", v
+	case []byte:
+		p.ParameterType.Type, s = "BYTES", base64.StdEncoding.EncodeToString(v)
+	case time.Time:
+		p.ParameterType.Type, s = "TIMESTAMP", v.UTC().Format("2006-01-02 15:04:05.999999Z07:00")
+	default:
+		return p, fmt.Errorf("unsupported arg type %T", v)
+	}
+	p.ParameterValue.Value = &s
+	return p, nil
+}
+
+// bigqueryResult is a finished query's results. The first page is returned
+// with the finished job, and later pages are fetched by page token.
+type bigqueryResult struct {
+	client   *bigqueryClient
+	job      bigqueryJobRef
+	fields   []*bigqueryField
+	affected int64
+	first    *bigqueryResponse
+	token    string
+	done     bool
+}
+
+func (r *bigqueryResult) Columns() []warehouseColumn {
+	cols := make([]warehouseColumn, len(r.fields))
+	for i, f := range r.fields {
+		cols[i] = warehouseColumn{Name: f.Name, Type: strings.ToUpper(f.Type)}
+		switch {
+		case f.Mode == "REPEATED", cols[i].Type == "RECORD", cols[i].Type == "STRUCT":
+			cols[i].Type = "JSON"
+		}
+	}
+	return cols
+}
+
+func (r *bigqueryResult) RowsAffected() int64 {
+	return r.affected
+}
+
+func (r *bigqueryResult) NextPage(ctx context.Context) ([][]driver.Value, error) {
+	resp := r.first
+	r.first = nil
+	if resp == nil {
+		if r.done || r.token == "" {
+			return nil, io.EOF
+		}
+		resp = new(bigqueryResponse)
+		if err := r.client.results(ctx, r.job, r.token, resp); err != nil {
+			return nil, err
+		}
+	}
+	r.token = resp.PageToken
+	r.done = r.token == ""
+
+	page := make([][]driver.Value, len(resp.Rows))
+	for i, row := range resp.Rows {
+		values := make([]driver.Value, len(r.fields))
+		for j, f := range r.fields {
+			if j < len(row.F) {
+				values[j] = bigqueryColumnValue(f, row.F[j].V)
+			}
+		}
+		page[i] = values
+	}
+	return page, nil
+}
+
+// bigqueryColumnValue converts a cell to a driver value. Records and
+// repeated fields are returned as JSON.
+func bigqueryColumnValue(f *bigqueryField, v interface{}) driver.Value {
+	t := strings.ToUpper(f.Type)
+	if v == nil || (f.Mode != "REPEATED" && t != "RECORD" && t != "STRUCT") {
+		return bigqueryValue(f, v)
+	}
+	p, err := json.Marshal(bigqueryValue(f, v))
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// bigqueryValue converts a cell of the REST API's row format, in which
+// records are objects of the form {"f": [{"v": ...}, ...]} and repeated
+// fields are lists of the form [{"v": ...}, ...], to a Go value.
+func bigqueryValue(f *bigqueryField, v interface{}) interface{} {
+	if f.Mode == "REPEATED" {
+		cells, _ := v.([]interface{})
+		elem := *f
+		elem.Mode = ""
+		list := make([]interface{}, len(cells))
+		for i, cell := range cells {
+			if m, ok := cell.(map[string]interface{}); ok {
+				list[i] = bigqueryValue(&elem, m["v"])
+			}
+		}
+		return list
+	}
+
+	switch strings.ToUpper(f.Type) {
+	case "RECORD", "STRUCT":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cells, _ := m["f"].([]interface{})
+		rec := make(map[string]interface{}, len(f.Fields))
+		for i, sub := range f.Fields {
+			var sv interface{}
+			if i < len(cells) {
+				if cell, ok := cells[i].(map[string]interface{}); ok {
+					sv = cell["v"]
+				}
+			}
+			rec[sub.Name] = bigqueryValue(sub, sv)
+		}
+		return rec
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	switch strings.ToUpper(f.Type) {
+	case "INTEGER", "INT64":
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case "FLOAT", "FLOAT64":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "BOOLEAN", "BOOL":
+		return s == "true"
+	case "TIMESTAMP":
+		if us, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.UnixMicro(us).UTC()
+		}
+	case "BYTES":
+		if p, err := base64.StdEncoding.DecodeString(s); err == nil {
+			return p
+		}
+	}
+	return s
+}
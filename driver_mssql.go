@@ -0,0 +1,38 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !omit_mssql
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+func init() {
+	localDSNs["sqlserver"] = mssqlDSN
+	localDSNs["mssql"] = mssqlDSN
+}
+
+// mssqlDSN accepts sqlserver:// and mssql:// URLs, which are passed to the
+// driver as sqlserver:// URLs.
+func mssqlDSN(u *url.URL) (drv, dsn string, bindType int, err error) {
+	du := *u
+	du.Scheme = "sqlserver"
+	return "sqlserver", du.String(), sqlx.AT, nil
+}
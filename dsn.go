@@ -0,0 +1,156 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"go.spiff.io/sql/driver"
+)
+
+// bindColon is the bind type of drivers using numbered colon parameters,
+// such as :1, as Oracle does. It extends the bind types of sqlx.
+const bindColon = 100
+
+// dsnFunc returns the driver name, DSN, and bind type for a database URL.
+type dsnFunc func(u *url.URL) (drv, dsn string, bindType int, err error)
+
+// localDSNs maps URL schemes to the DSN functions of drivers registered by
+// chisel itself, rather than by go.spiff.io/sql.
+var localDSNs = map[string]dsnFunc{}
+
+// dsnFromURL returns the driver name, DSN, and bind type for a database URL.
+func dsnFromURL(u *url.URL) (drv, dsn string, bindType int, err error) {
+	if fn, ok := localDSNs[strings.ToLower(u.Scheme)]; ok {
+		return fn(u)
+	}
+	return driver.DSNFromURL(u)
+}
+
+// rebind rewrites the ? parameters of query to the parameters of bindType.
+func rebind(bindType int, query string) string {
+	if bindType != bindColon {
+		return sqlx.Rebind(bindType, query)
+	}
+	var sb strings.Builder
+	sb.Grow(len(query) + 8)
+	n := 0
+	for i := strings.IndexByte(query, '?'); i != -1; i = strings.IndexByte(query, '?') {
+		n++
+		sb.WriteString(query[:i])
+		sb.WriteByte(':')
+		sb.WriteString(strconv.Itoa(n))
+		query = query[i+1:]
+	}
+	sb.WriteString(query)
+	return sb.String()
+}
+
+// limitClause returns a clause limiting a query to n rows. SQL Server and
+// Oracle use OFFSET ... FETCH, which requires an ORDER BY clause, instead
+// of LIMIT.
+func limitClause(bindType, n int) string {
+	if bindType == sqlx.AT || bindType == bindColon {
+		return " OFFSET 0 ROWS FETCH NEXT " + strconv.Itoa(n) + " ROWS ONLY"
+	}
+	return " LIMIT " + strconv.Itoa(n)
+}
+
+// NumericFormat controls how exact numeric columns (such as NUMERIC,
+// DECIMAL, NUMBER, and MONEY) are returned when a driver scans them as text.
+type NumericFormat int
+
+const (
+	StringNumericFormat NumericFormat = iota // string - Default
+	NumberNumericFormat                      // number
+)
+
+func (f NumericFormat) MarshalText() ([]byte, error) {
+	switch f {
+	case StringNumericFormat:
+		return []byte("string"), nil
+	case NumberNumericFormat:
+		return []byte("number"), nil
+	default:
+		return nil, fmt.Errorf("unrecognized numeric format %d", f)
+	}
+}
+
+func (f *NumericFormat) UnmarshalText(src []byte) error {
+	switch string(src) {
+	case "string", "":
+		*f = StringNumericFormat
+	case "number":
+		*f = NumberNumericFormat
+	default:
+		return fmt.Errorf("unrecognized numeric format %q", src)
+	}
+	return nil
+}
+
+// numericColumns returns the names of the exact numeric columns of rows.
+func numericColumns(rows *sql.Rows) []string {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, ct := range types {
+		switch strings.ToUpper(ct.DatabaseTypeName()) {
+		case "NUMERIC", "DECIMAL", "NUMBER", "MONEY", "SMALLMONEY":
+			names = append(names, ct.Name())
+		}
+	}
+	return names
+}
+
+// convertNumerics converts the values of the named columns of res from text
+// to numbers. Integers are converted to int64s, or *big.Ints if they don't
+// fit, and other values to float64s. Values that aren't numeric text are
+// left alone.
+func convertNumerics(res interface{}, columns []string) {
+	rows, _ := res.([]interface{})
+	for _, row := range rows {
+		cols, ok := row.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, name := range columns {
+			var s string
+			switch v := cols[name].(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				continue
+			}
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				cols[name] = i
+			} else if b, ok := new(big.Int).SetString(s, 10); ok {
+				cols[name] = b
+			} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+				cols[name] = f
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer is the capacity above which response buffers are dropped
+// instead of returned to the pool, so that one very large response doesn't
+// pin its memory.
+const maxPooledBuffer = 16 << 20
+
+// jsonEncoder encodes response bodies as JSON. It may be replaced with an
+// encoder backed by a faster JSON library, provided its output matches
+// json.Marshal's.
+type jsonEncoder interface {
+	// Encode writes the JSON encoding of v to w, without a trailing
+	// newline.
+	Encode(w io.Writer, v interface{}) error
+}
+
+// stdJSONEncoder encodes JSON with encoding/json.
+type stdJSONEncoder struct{}
+
+func (stdJSONEncoder) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(trimNewlineWriter{w}).Encode(v)
+}
+
+// trimNewlineWriter drops the newline json.Encoder writes after each value.
+type trimNewlineWriter struct {
+	w io.Writer
+}
+
+func (tw trimNewlineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if n > 0 && p[n-1] == '\n' {
+		p = p[:n-1]
+	}
+	if _, err := tw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// responseEncoder encodes response bodies.
+var responseEncoder jsonEncoder = stdJSONEncoder{}
+
+var responseBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// encodeResponse encodes v as JSON into a pooled buffer. The buffer must be
+// returned with releaseResponse once the response has been written.
+func encodeResponse(v interface{}) (*bytes.Buffer, error) {
+	buf := responseBuffers.Get().(*bytes.Buffer)
+	if err := responseEncoder.Encode(buf, v); err != nil {
+		releaseResponse(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releaseResponse(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	responseBuffers.Put(buf)
+}
@@ -0,0 +1,207 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// endpointFiles is the endpoints of a config file given as the files to read
+// them from, so that each endpoint, or group of endpoints, can live in its
+// own file while databases and bindings stay in the main config. Each file
+// holds a single endpoint or a list of them.
+type endpointFiles struct {
+	// From lists the endpoint files, as paths or globs relative to the
+	// config file's directory. Files are read in order, and the files a
+	// glob matches are read in lexical order.
+	From []string `json:"from" yaml:"from"`
+}
+
+func (eds *EndpointDefs) UnmarshalJSON(src []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(src), []byte("{")) {
+		var ef endpointFiles
+		if err := unmarshalStrict(src, &ef); err != nil {
+			return err
+		}
+		*eds = EndpointDefs{{files: &ef}}
+		return nil
+	}
+	var list []*EndpointDef
+	if err := unmarshalStrict(src, &list); err != nil {
+		return err
+	}
+	*eds = list
+	return nil
+}
+
+func (eds *EndpointDefs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		var ef endpointFiles
+		if err := decodeNodeStrict(node, &ef); err != nil {
+			return err
+		}
+		*eds = EndpointDefs{{files: &ef}}
+		return nil
+	}
+	var list []*EndpointDef
+	if err := decodeNodeStrict(node, &list); err != nil {
+		return err
+	}
+	*eds = list
+	return nil
+}
+
+// endpointFile is the content of an endpoint file: a single endpoint or a
+// list of them.
+type endpointFile []*EndpointDef
+
+func (ef *endpointFile) UnmarshalJSON(src []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(src), []byte("{")) {
+		var ed EndpointDef
+		if err := unmarshalStrict(src, &ed); err != nil {
+			return err
+		}
+		*ef = endpointFile{&ed}
+		return nil
+	}
+	var list []*EndpointDef
+	if err := unmarshalStrict(src, &list); err != nil {
+		return err
+	}
+	*ef = list
+	return nil
+}
+
+func (ef *endpointFile) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		var ed EndpointDef
+		if err := decodeNodeStrict(node, &ed); err != nil {
+			return err
+		}
+		*ef = endpointFile{&ed}
+		return nil
+	}
+	var list []*EndpointDef
+	if err := decodeNodeStrict(node, &list); err != nil {
+		return err
+	}
+	*ef = list
+	return nil
+}
+
+// hasEndpointFiles returns whether any of eds refers to endpoint files.
+func hasEndpointFiles(eds EndpointDefs) bool {
+	for _, ed := range eds {
+		if ed != nil && ed.files != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readEndpointFiles returns the endpoints of conf, read from the config file
+// at path, with any endpoint files it refers to read in their place. Endpoint
+// files are read as config files of the version conf was written for, and
+// notes on upgrading them are added to its migrations.
+func readEndpointFiles(conf *Config, path, profile string) (EndpointDefs, error) {
+	if !hasEndpointFiles(conf.Endpoints) {
+		return conf.Endpoints, nil
+	}
+	var eds EndpointDefs
+	for _, ed := range conf.Endpoints {
+		if ed == nil || ed.files == nil {
+			eds = append(eds, ed)
+			continue
+		}
+		if len(ed.files.From) == 0 {
+			return nil, errors.New("endpoints: from must list at least one endpoint file")
+		}
+		for _, pattern := range ed.files.From {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			conf.sources = append(conf.sources, pattern)
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid endpoint file %q: %w", pattern, err)
+			}
+			if matches == nil && !hasGlobMeta(pattern) {
+				return nil, fmt.Errorf("endpoint file %s does not exist", pattern)
+			}
+			for _, file := range matches {
+				fe, notes, err := parseEndpointFile(file, profile, conf.fileVersion)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", file, err)
+				}
+				for _, note := range notes {
+					conf.migrations = append(conf.migrations, file+": "+note)
+				}
+				eds = append(eds, fe...)
+			}
+		}
+	}
+	return eds, nil
+}
+
+// parseEndpointFile reads the endpoint file at path, written for the config
+// version version. Environment variables are expanded in it as in config
+// files, and the relative query files of its steps are relative to its
+// directory. It returns the file's endpoints and notes on what upgrading
+// it changed.
+func parseEndpointFile(path, profile string, version int) (EndpointDefs, []string, error) {
+	data, err := readConfigData(path, profile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading endpoint file: %w", err)
+	}
+	var ef endpointFile
+	var notes []string
+	switch ext := configExt(path); ext {
+	case ".yaml", ".yml":
+		if data, err = expandConfigEnvYAML(data); err != nil {
+			break
+		}
+		if data, _, notes, err = migrateConfig(ext, data, version); err != nil {
+			break
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(!allowUnknownFields)
+		err = dec.Decode(&ef)
+	default:
+		if data, err = expandConfigEnvJSON(data); err != nil {
+			break
+		}
+		if data, _, notes, err = migrateConfig(ext, data, version); err != nil {
+			break
+		}
+		err = unmarshalStrict(data, &ef)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing endpoint file: %w", err)
+	}
+	for _, ed := range ef {
+		if ed != nil {
+			ed.source = path
+		}
+	}
+	eds := EndpointDefs(ef)
+	resolveStepFiles(eds, filepath.Dir(path))
+	return eds, notes, nil
+}
@@ -0,0 +1,163 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"gopkg.in/yaml.v3"
+)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in s with the value of the
+// environment variable VAR. The default is used if VAR is unset or empty,
+// and it is an error for VAR to be unset if there is no default. $${ is
+// replaced with a literal ${. Other uses of $ are left as-is so that SQL
+// such as $1 and $$ is unaffected.
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i == -1 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			sb.WriteString(s[:i-1])
+			sb.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		sb.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated ${ in %q", s[i:])
+		}
+		expr := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		name, def, hasDef := strings.Cut(expr, ":-")
+		if name == "" {
+			return "", fmt.Errorf("empty environment variable name in ${%s}", expr)
+		}
+		v, ok := os.LookupEnv(name)
+		switch {
+		case hasDef && v == "":
+			v = def
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		sb.WriteString(v)
+	}
+}
+
+// expandConfigEnvYAML returns the YAML document data with environment
+// variables expanded in its string values.
+func expandConfigEnvYAML(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if err := expandEnvYAML(&node); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(&node)
+}
+
+// expandConfigEnvJSON returns the JSON (or HuJSON) document data with
+// environment variables expanded in its string values. Comments are
+// dropped.
+func expandConfigEnvJSON(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil
+	}
+	var tree interface{}
+	dec := hujson.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	tree, err := expandEnvJSON(tree)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// expandEnvYAML expands environment variables in the string values of node.
+func expandEnvYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag != "!!str" {
+			return nil
+		}
+		v, err := expandEnv(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		node.Value = v
+	case yaml.MappingNode:
+		// Only expand values, not keys.
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnvYAML(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, n := range node.Content {
+			if err := expandEnvYAML(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnvJSON expands environment variables in the string values of tree,
+// a decoded JSON value, and returns the result.
+func expandEnvJSON(tree interface{}) (interface{}, error) {
+	switch tree := tree.(type) {
+	case string:
+		return expandEnv(tree)
+	case map[string]interface{}:
+		for k, e := range tree {
+			v, err := expandEnvJSON(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			tree[k] = v
+		}
+	case []interface{}:
+		for i, e := range tree {
+			v, err := expandEnvJSON(e)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %w", i, err)
+			}
+			tree[i] = v
+		}
+	}
+	return tree, nil
+}
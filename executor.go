@@ -0,0 +1,576 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"go.spiff.io/sql/vdb"
+)
+
+// stepError is an error from executing a query that carries the response
+// status and public message it should be reported to the client with.
+type stepError struct {
+	Status int         // HTTP status of the response.
+	Public string      // Response body.
+	Params ParamErrors // Invalid params, if the request was rejected for them.
+	Step   int         // Index of the step that failed, or -1 if none did.
+	Err    error
+}
+
+func (e *stepError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.Err
+}
+
+// fail logs err with msg and returns a stepError for it.
+func fail(log zerolog.Logger, status int, public, msg string, err error) error {
+	log.Error().Err(err).Msg(msg)
+	return &stepError{Status: status, Public: public, Step: -1, Err: err}
+}
+
+// failParam logs err, an invalid param, and returns a stepError that
+// rejects the request with a 400 describing it.
+func failParam(log zerolog.Logger, pe *ParamError, err error) error {
+	log.Info().Err(err).Msg("Request has an invalid parameter.")
+	return &stepError{
+		Status: http.StatusBadRequest,
+		Public: "invalid parameters",
+		Params: ParamErrors{pe},
+		Step:   -1,
+		Err:    err,
+	}
+}
+
+// failInternal is fail for internal server errors.
+func failInternal(log zerolog.Logger, msg string, err error) error {
+	return fail(log, http.StatusInternalServerError, "internal server error", msg, err)
+}
+
+// executor runs the transactions and steps of an endpoint's query for a
+// single request. It owns every resource opened while running, and releases
+// them before Run returns.
+type executor struct {
+	def      *QueryDef
+	db       Databases
+	outboxes map[string]*OutboxDef
+	datasets map[string]*DatasetDef
+	log      zerolog.Logger
+	trace    *requestTrace
+
+	transactions []*transactionState
+	argCtx       argContext
+	tags         *sqlCommentTags // Identify the request in SQL comments.
+	stream       *rowStream      // The body's rows, if the endpoint streams its body.
+}
+
+// newExecutor returns an executor for def. If body is a *rowStream, the
+// query's steps are run once for each chunk of its rows.
+func (h *Handler) newExecutor(def *QueryDef, log zerolog.Logger, tr *requestTrace, params *Params, body interface{}) *executor {
+	rs, _ := body.(*rowStream)
+	if rs != nil {
+		body = nil
+	}
+	bufs := getArgBuffers(len(def.Steps))
+	return &executor{
+		def:          def,
+		db:           h.db,
+		outboxes:     h.outboxes,
+		datasets:     h.datasets,
+		log:          log,
+		trace:        tr,
+		transactions: make([]*transactionState, len(def.Transactions)),
+		argCtx: argContext{
+			body:        body,
+			params:      params,
+			links:       h.links.Opaque(),
+			stepResults: bufs.stepResults,
+			stepsMeta:   bufs.stepsMeta,
+			outputs:     bufs.outputs,
+			stepNames:   def.stepNames(),
+			bufs:        bufs,
+		},
+		stream: rs,
+	}
+}
+
+// Run begins the query's transactions, runs its steps, and commits the
+// transactions if all steps succeed or rolls them back otherwise. Errors
+// returned by Run are always *stepErrors and have already been logged.
+func (ex *executor) Run(ctx context.Context) (out interface{}, err error) {
+	defer func() {
+		cerr := ex.closeTransactions(ctx, err)
+		if err == nil && cerr != nil {
+			out, err = nil, fail(ex.log, http.StatusInternalServerError, "error committing request",
+				"Error committing transactions for request.", cerr)
+		}
+	}()
+
+	if err := ex.beginTransactions(ctx); err != nil {
+		return nil, err
+	}
+	// Transactions are closed with the request's context, since the
+	// query's may have expired and is canceled before they close.
+	qctx := ctx
+	if ex.def.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		qctx, cancel = context.WithTimeout(ctx, ex.def.Timeout.Duration)
+		defer cancel()
+	}
+	if ex.stream != nil {
+		return ex.runStream(qctx)
+	}
+	return ex.runSteps(qctx)
+}
+
+// runSteps runs the query's steps in transactions that have already begun.
+// If the query has a step budget, each step is limited to its share of the
+// time remaining before ctx's deadline.
+func (ex *executor) runSteps(ctx context.Context) (interface{}, error) {
+	for si, s := range ex.def.Steps {
+		sctx, budget, cancel := ex.def.StepBudget.stepContext(ctx, ex.def.Steps, si)
+		res, done, err := ex.step(sctx, si, s)
+		if err != nil && ctx.Err() == nil && errors.Is(sctx.Err(), context.DeadlineExceeded) {
+			ex.log.Warn().Int("step", si).Dur("budget", budget).Msg("Step exceeded its share of the query's time.")
+		}
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return res, nil
+		}
+	}
+	return ex.argCtx.outputs[len(ex.argCtx.outputs)-1], nil
+}
+
+func (ex *executor) beginTransactions(ctx context.Context) error {
+	for tdi, td := range ex.def.Transactions {
+		began := time.Now()
+		db := ex.db[td.DB]
+		if db == nil {
+			// Configs are validated, so this is only reachable if the
+			// databases and endpoints are out of sync.
+			return failInternal(ex.log.With().Int("transaction", tdi).Logger(),
+				"Transaction refers to a database that is not open.", fmt.Errorf("undefined database %q", td.DB))
+		}
+		t, err := newTransaction(ctx, db, tdi, td)
+		if err != nil {
+			log := ex.log.With().Int("transaction", tdi).Logger()
+			return fail(log, http.StatusInternalServerError, "error preparing request",
+				"Error starting transaction for request.", err)
+		}
+		ex.trace.Begin(tdi, began)
+		ex.transactions[tdi] = t
+	}
+	ex.log.Trace().Msg("Transactions started.")
+	return nil
+}
+
+// closeTransactions commits or rolls back the query's transactions in the
+// query's commit order and returns the first error doing so. If a commit
+// fails, the transactions after it are rolled back and the transactions
+// already committed are compensated in reverse order.
+func (ex *executor) closeTransactions(ctx context.Context, err error) (first error) {
+	defer ex.log.Trace().Msg("Transactions closed.")
+	if err == nil {
+		err = ctx.Err()
+	}
+	var committed []int
+	for _, ti := range ex.def.CommitOrder.Order(ex.def.Transactions) {
+		t := ex.transactions[ti]
+		if t == nil {
+			// Partial setup.
+			continue
+		}
+		ended := time.Now()
+		cerr := t.CommitOrRollback(ctx, err)
+		ex.trace.End(ti, ended, err == nil && cerr == nil)
+		if cerr != nil {
+			ex.log.Warn().Int("transaction", ti).Err(cerr).Msg("Error committing or rolling back transaction.")
+			if first == nil {
+				first = cerr
+			}
+		}
+		if err != nil {
+			continue
+		}
+		if cerr != nil {
+			err = cerr
+			ex.compensate(ctx, committed)
+			continue
+		}
+		committed = append(committed, ti)
+	}
+	return first
+}
+
+// step runs a single step. If the step's result is the response and no
+// further steps should run, it returns true.
+func (ex *executor) step(ctx context.Context, si int, s *StepDef) (out interface{}, done bool, err error) {
+	defer func() {
+		var se *stepError
+		if errors.As(err, &se) {
+			se.Step = si
+		}
+	}()
+	log := ex.log.With().Int("step", si).Logger()
+	began := time.Now()
+
+	args := make([]interface{}, len(s.Args))
+	for adi, ad := range s.Args {
+		arg, err := ex.argCtx.Resolve(ctx, ad)
+		var mpe *MissingParamError
+		var pe *ParamError
+		if errors.As(err, &mpe) {
+			return nil, false, fail(log, http.StatusBadRequest, "missing "+mpe.In+" parameter "+strconv.Quote(mpe.Name),
+				"Request is missing a required parameter.", err)
+		} else if errors.As(err, &pe) {
+			return nil, false, failParam(log, pe, err)
+		} else if err != nil {
+			return nil, false, fail(log, http.StatusInternalServerError, "error resolving arguments",
+				"Failed to resolve arguments. This implies an invalid endpoint config.", err)
+		}
+		args[adi] = arg
+	}
+	ex.argCtx.SetArgs(args)
+
+	var res interface{}
+	meta := stepMeta{}
+	if s.HTTP != nil {
+		res, err = s.HTTP.Fetch(ctx, ex.argCtx.Opaque())
+		if err != nil {
+			return nil, false, fail(log, http.StatusBadGateway, "bad gateway",
+				"Failed to fetch upstream response.", err)
+		}
+	} else if s.Dataset != nil {
+		res, err = s.Dataset.Read(ex.datasets[s.Dataset.Name], args)
+		if err != nil {
+			return nil, false, fail(log, http.StatusServiceUnavailable, "dataset unavailable",
+				"Failed to read dataset.", err)
+		}
+	} else {
+		t := ex.transactions[s.Transaction.Index]
+		t.SetStep(si)
+		meta.DB = ex.def.Transactions[s.Transaction.Index].DB
+		if s.Exec {
+			args, err = ex.exec(ctx, log, t, si, s, args, &meta)
+		} else {
+			res, args, err = ex.query(ctx, log, t, si, s, args, &meta)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if s.HTTP != nil || s.Dataset != nil {
+		meta.Rows = countRows(res, false)
+		if s.Filter != nil {
+			res, err = filterRows(ctx, s.Filter, res, ex.argCtx.Opaque())
+			if err != nil {
+				return nil, false, failInternal(log, "Failed to filter result set.", err)
+			}
+		}
+	}
+	meta.Duration = time.Since(began)
+	ex.trace.Step(si, s, began, res)
+
+	if s.Binary != nil && s.Binary.Encoding == RawBinaryEncoding {
+		raw, err := s.Binary.Raw(res)
+		if err != nil {
+			return nil, false, failInternal(log, "Failed to read raw body from result set.", err)
+		}
+		// The raw step is always the last step, so its body is the
+		// response.
+		log.Info().Interface("args", args).Bool("found", raw != nil).Msg("Raw result.")
+		return raw, true, nil
+	}
+	log.Info().Interface("args", args).Interface("results", res).Msg("Results.")
+	ex.argCtx.AddStepMeta(&meta)
+	ex.argCtx.AddStepResult(res)
+
+	res, err = s.Map.Apply(ctx, res, ex.argCtx.Opaque())
+	if err != nil {
+		return nil, false, failInternal(log, "Failed to transform result set.", err)
+	}
+
+	if s.Emit != nil {
+		if err := ex.emit(ctx, s, ex.transactions[s.Transaction.Index], res); err != nil {
+			return nil, false, failInternal(log, "Failed to emit outbox events.", err)
+		}
+	}
+
+	ex.argCtx.AddOutput(res)
+	return res, false, nil
+}
+
+// query runs a step's SQL query in t and returns its scanned results along
+// with the args it was run with, after IN (?) expansion. The result set is
+// always closed before query returns. The number of rows the query returned
+// is recorded in meta.
+//
+// If the step has a filter, rows are filtered as they're scanned, so rows
+// the filter drops are never held in memory.
+//
+// If the step keeps multiple result sets, its results are a list of every
+// result set the query returned, followed by the OUT parameters of a call,
+// if it has any. Otherwise, only the first result set is kept, and a warning
+// is logged if there were more.
+func (ex *executor) query(ctx context.Context, log zerolog.Logger, t *transactionState, si int, s *StepDef, args []interface{}, meta *stepMeta) (interface{}, []interface{}, error) {
+	query, args, err := ex.statement(t, si, s, args)
+	if err != nil {
+		return nil, nil, failInternal(log, "Failed to expand IN(?) arguments.", err)
+	}
+
+	queryArgs, outs := args, []interface{}(nil)
+	if s.Call != nil && len(s.Call.Out) > 0 {
+		var outArgs []interface{}
+		outArgs, outs = s.Call.outArgs()
+		queryArgs = append(append([]interface{}(nil), args...), outArgs...)
+	}
+
+	qctx, cancel := statementContext(ctx, t)
+	defer cancel()
+	rows, err := t.QueryContext(qctx, query, queryArgs...)
+	if err != nil {
+		return nil, args, failInternal(log, "Failed to execute query.", err)
+	}
+	defer rows.Close()
+
+	var sets []interface{}
+	for {
+		var res interface{}
+		if s.Filter != nil {
+			res, err = ex.scanFiltered(ctx, rows, t.db, s, meta)
+		} else {
+			res, err = ex.scan(ctx, rows, t.db, s, meta)
+		}
+		if err != nil {
+			return nil, args, failInternal(log, "Failed to scan result set.", err)
+		}
+		if !s.multipleResultSets() {
+			sets = append(sets, res)
+			if rows.NextResultSet() {
+				log.Warn().Msg("Query returned more than one result set. Only the first was kept; set result_sets to keep all of them.")
+			}
+			break
+		}
+		if res == nil {
+			res = []interface{}{}
+		}
+		sets = append(sets, res)
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	// Drivers assign OUT parameters once the result sets are closed.
+	if err := rows.Close(); err != nil {
+		return nil, args, failInternal(log, "Failed to close result set.", err)
+	}
+
+	if !s.multipleResultSets() {
+		return sets[0], args, nil
+	}
+	if outs != nil {
+		sets = append(sets, []interface{}{s.Call.outRow(outs)})
+		meta.Rows++
+	}
+	return sets, args, nil
+}
+
+// scan scans the current result set of rows and encodes its binary values.
+func (ex *executor) scan(ctx context.Context, rows *sql.Rows, db *Database, s *StepDef, meta *stepMeta) (interface{}, error) {
+	var numerics []string
+	if db.Options.Numeric == NumberNumericFormat {
+		numerics = numericColumns(rows)
+	}
+	results, err := vdb.ScanRows(ctx, rows, db.options)
+	if err != nil {
+		return nil, err
+	}
+	res := results.Opaque()
+	if len(numerics) > 0 {
+		convertNumerics(res, numerics)
+	}
+	if s.Binary != nil && s.Binary.Encoding != RawBinaryEncoding {
+		res = s.Binary.Encode(res)
+	}
+	meta.Rows += countRows(res, false)
+	return res, nil
+}
+
+// scanFiltered scans the current result set of rows one row at a time,
+// keeping only the rows that pass the step's filter, so that the rows it
+// drops are never held in memory with the rest of the set.
+func (ex *executor) scanFiltered(ctx context.Context, rows *sql.Rows, db *Database, s *StepDef, meta *stepMeta) (interface{}, error) {
+	rs, err := newRowScanner(rows, &db.Options)
+	if err != nil {
+		return nil, err
+	}
+	ctxVar := ex.argCtx.Opaque()
+	kept := []interface{}{}
+	for rows.Next() {
+		row, err := rs.Scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if s.Binary != nil && s.Binary.Encoding != RawBinaryEncoding {
+			s.Binary.Encode([]interface{}{row})
+		}
+		meta.Rows++
+		keep, err := s.Filter.Test(ctx, row, ctxVar)
+		if err != nil {
+			return nil, fmt.Errorf("error filtering row %d: %w", meta.Rows-1, err)
+		}
+		if keep {
+			kept = append(kept, row)
+		}
+	}
+	return kept, rows.Err()
+}
+
+// execer is implemented by the databases and transactions that can run
+// statements without reading rows from them.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// exec runs a step's query in t as a statement that returns no rows, and
+// returns the args it was run with, after IN (?) expansion. The rows the
+// statement affected and the ID it last inserted are recorded in meta, if
+// the driver reports them.
+func (ex *executor) exec(ctx context.Context, log zerolog.Logger, t *transactionState, si int, s *StepDef, args []interface{}, meta *stepMeta) ([]interface{}, error) {
+	query, args, err := ex.statement(t, si, s, args)
+	if err != nil {
+		return nil, failInternal(log, "Failed to expand IN(?) arguments.", err)
+	}
+	e, ok := t.DB.(execer)
+	if !ok {
+		return args, failInternal(log, "Failed to execute statement.", errors.New("database cannot execute statements"))
+	}
+
+	qctx, cancel := statementContext(ctx, t)
+	defer cancel()
+	res, err := e.ExecContext(qctx, query, args...)
+	if err != nil {
+		return args, failInternal(log, "Failed to execute statement.", err)
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		meta.RowsAffected = &n
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		meta.LastInsertID = &id
+	}
+	return args, nil
+}
+
+// statement returns a step's query and args as they're run in t: with
+// IN (?) args expanded, rebound for the database, and commented.
+func (ex *executor) statement(t *transactionState, si int, s *StepDef, args []interface{}) (string, []interface{}, error) {
+	query, args, err := sqlx.In(s.Query, args...)
+	if err != nil {
+		return "", nil, err
+	}
+	query = rebind(t.db.options.BindType, query)
+	query = t.db.Comment.Prepend(query, ex.tags, strconv.Itoa(si))
+	return query, args, nil
+}
+
+// statementContext returns the context a statement in t runs with: the
+// transaction's, if it has a timeout, limited to ctx's deadline.
+func statementContext(ctx context.Context, t *transactionState) (context.Context, context.CancelFunc) {
+	qctx := t.Context(ctx)
+	if deadline, ok := ctx.Deadline(); ok && qctx != ctx {
+		return context.WithDeadline(qctx, deadline)
+	}
+	return qctx, func() {}
+}
+
+// emit appends the events of a step to its outbox in the step's transaction.
+func (ex *executor) emit(ctx context.Context, s *StepDef, t *transactionState, res interface{}) error {
+	payloads, err := s.Emit.Events(ctx, res, ex.argCtx.Opaque())
+	if err != nil {
+		return err
+	}
+	if len(payloads) == 0 {
+		return nil
+	}
+	return appendOutbox(ctx, t, ex.outboxes[s.Emit.Outbox], payloads)
+}
+
+// stepMeta describes how a step ran. It is available to expressions as
+// $context.steps_meta.
+type stepMeta struct {
+	DB       string        // The step's database, or empty for HTTP steps.
+	Rows     int           // The number of rows the step returned, before filtering.
+	Duration time.Duration // How long the step took to run.
+
+	// Set for exec steps, if the driver reports them.
+	RowsAffected *int64
+	LastInsertID *int64
+}
+
+func (m *stepMeta) Opaque() map[string]interface{} {
+	var db, affected, insertID interface{}
+	if m.DB != "" {
+		db = m.DB
+	}
+	if m.RowsAffected != nil {
+		affected = int(*m.RowsAffected)
+	}
+	if m.LastInsertID != nil {
+		insertID = int(*m.LastInsertID)
+	}
+	return map[string]interface{}{
+		"db":             db,
+		"rows":           m.Rows,
+		"rows_affected":  affected,
+		"last_insert_id": insertID,
+		"duration_ms":    float64(m.Duration) / float64(time.Millisecond),
+	}
+}
+
+// countRows returns the number of rows in res. If sets is true, res is a
+// list of result sets and the rows of every set are counted. Results that
+// aren't lists, such as an HTTP step's response object, count as one row
+// unless they're null.
+func countRows(res interface{}, sets bool) int {
+	switch res := res.(type) {
+	case nil:
+		return 0
+	case []interface{}:
+		if !sets {
+			return len(res)
+		}
+		n := 0
+		for _, set := range res {
+			n += countRows(set, false)
+		}
+		return n
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,372 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo && !omit_sqlite
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// newTestRouter compiles endpoints, the YAML of a config's endpoints list,
+// against a fresh SQLite database named main with an items table. It
+// returns a router serving the endpoints and the database.
+func newTestRouter(t *testing.T, endpoints string) (http.Handler, *Database) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	src := "databases:\n" +
+		"  main:\n" +
+		"    url: sqlite://" + filepath.ToSlash(filepath.Join(dir, "test.db")) + "\n" +
+		"endpoints:\n" + endpoints
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := readConfigFile(path, "")
+	if err != nil {
+		t.Fatalf("readConfigFile() = %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	dbs, err := openDatabases(zerolog.Nop(), conf, nil)
+	if err != nil {
+		t.Fatalf("openDatabases() = %v", err)
+	}
+	t.Cleanup(dbs.Close)
+
+	db := dbs["main"]
+	if _, err := db.db.Exec(`CREATE TABLE items (name TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	rt := httprouter.New()
+	for _, ed := range conf.Endpoints {
+		ce := compileEndpoint(conf, dbs, ed)
+		rt.Handle(ce.method, ed.Path, ce.handle)
+	}
+	return rt, db
+}
+
+// serveTest sends a GET request for target to h and returns the response.
+func serveTest(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+// countItems returns the number of rows in the items table.
+func countItems(t *testing.T, db *Database) int {
+	t.Helper()
+	var n int
+	if err := db.db.Get(&n, `SELECT COUNT(*) FROM items`); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestExecutorQueryError(t *testing.T) {
+	rt, _ := newTestRouter(t, `
+  - method: GET
+    path: /missing
+    query:
+      transactions: [{ db: main }]
+      steps: [{ query: SELECT * FROM no_such_table }]
+`)
+
+	w := serveTest(rt, "/missing")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "internal server error") {
+		t.Errorf("body = %q; want internal server error", body)
+	}
+}
+
+func TestExecutorScanError(t *testing.T) {
+	// SQLite reports integer overflow while stepping through rows, after
+	// the query has started, so the error comes from scanning.
+	rt, _ := newTestRouter(t, `
+  - method: GET
+    path: /overflow
+    query:
+      transactions: [{ db: main }]
+      steps:
+        - query: SELECT 1 AS n UNION ALL SELECT abs(-9223372036854775808) AS n
+`)
+
+	w := serveTest(rt, "/overflow")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestExecutorHTTPStepBadGateway(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	rt, _ := newTestRouter(t, `
+  - method: GET
+    path: /upstream
+    query:
+      steps:
+        - http: { url: '"`+upstream.URL+`"' }
+`)
+
+	w := serveTest(rt, "/upstream")
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusBadGateway)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "bad gateway") {
+		t.Errorf("body = %q; want bad gateway", body)
+	}
+}
+
+func TestExecutorHTTPStepMaxBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`"0123456789"`))
+	}))
+	defer upstream.Close()
+
+	rt, _ := newTestRouter(t, `
+  - method: GET
+    path: /small
+    query:
+      steps:
+        - http: { url: '"`+upstream.URL+`"', max_body: 12 }
+  - method: GET
+    path: /large
+    query:
+      steps:
+        - http: { url: '"`+upstream.URL+`"', max_body: 11 }
+`)
+
+	if w := serveTest(rt, "/small"); w.Code != http.StatusOK {
+		t.Errorf("status at max_body = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := serveTest(rt, "/large"); w.Code != http.StatusBadGateway {
+		t.Errorf("status over max_body = %d; want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestExecutorHTTPStepTimeout(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-done:
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	rt, _ := newTestRouter(t, `
+  - method: GET
+    path: /slow
+    query:
+      steps:
+        - http: { url: '"`+upstream.URL+`"', timeout: 50ms }
+`)
+
+	if w := serveTest(rt, "/slow"); w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestExecutorMissingParam(t *testing.T) {
+	rt, db := newTestRouter(t, `
+  - method: GET
+    path: /items
+    query:
+      transactions: [{ db: main }]
+      steps:
+        - query: INSERT INTO items (name) VALUES (?)
+          args: [{ query: name }]
+`)
+
+	w := serveTest(rt, "/items")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	if want, body := `missing query parameter "name"`, w.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("body = %q; want %q", body, want)
+	}
+	if n := countItems(t, db); n != 0 {
+		t.Errorf("items = %d; want 0", n)
+	}
+}
+
+func TestExecutorCommit(t *testing.T) {
+	rt, db := newTestRouter(t, `
+  - method: GET
+    path: /items
+    query:
+      transactions: [{ db: main }]
+      steps:
+        - query: INSERT INTO items (name) VALUES (?)
+          args: [{ query: name }]
+        - query: SELECT COUNT(*) AS n FROM items
+`)
+
+	w := serveTest(rt, "/items?name=a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatalf("error decoding response %q: %v", w.Body, err)
+	}
+	if len(rows) != 1 || rows[0]["n"] != float64(1) {
+		t.Errorf("response = %v; want [{n: 1}]", rows)
+	}
+	if n := countItems(t, db); n != 1 {
+		t.Errorf("items = %d; want 1", n)
+	}
+}
+
+func TestExecutorRollback(t *testing.T) {
+	rt, db := newTestRouter(t, `
+  - method: GET
+    path: /items
+    query:
+      transactions: [{ db: main }]
+      steps:
+        - query: INSERT INTO items (name) VALUES (?)
+          args: [{ query: name }]
+        - query: SELECT * FROM no_such_table
+`)
+
+	w := serveTest(rt, "/items?name=a")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if n := countItems(t, db); n != 0 {
+		t.Errorf("items = %d; want 0 after rollback", n)
+	}
+}
+
+func TestExecutorTimeout(t *testing.T) {
+	// The second step counts long past the query's timeout, which
+	// interrupts it and rolls back the insert.
+	rt, db := newTestRouter(t, `
+  - method: GET
+    path: /items
+    query:
+      timeout: 50ms
+      transactions: [{ db: main }]
+      steps:
+        - query: INSERT INTO items (name) VALUES (?)
+          args: [{ query: name }]
+        - query: |
+            WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n)
+            SELECT COUNT(*) AS n FROM (SELECT i FROM n LIMIT 1000000000)
+`)
+
+	w := serveTest(rt, "/items?name=a")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if n := countItems(t, db); n != 0 {
+		t.Errorf("items = %d; want 0 after timeout", n)
+	}
+}
+
+func TestExecutorTimeoutCommit(t *testing.T) {
+	// The query's context is canceled once its steps finish, which must
+	// not roll back its transactions.
+	rt, db := newTestRouter(t, `
+  - method: GET
+    path: /items
+    query:
+      timeout: 5s
+      transactions: [{ db: main }]
+      steps:
+        - query: INSERT INTO items (name) VALUES (?)
+          args: [{ query: name }]
+`)
+
+	w := serveTest(rt, "/items?name=a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if n := countItems(t, db); n != 1 {
+		t.Errorf("items = %d; want 1", n)
+	}
+}
+
+func TestExecutorExecMeta(t *testing.T) {
+	rt, db := newTestRouter(t, `
+  - method: GET
+    path: /items
+    query:
+      transactions: [{ db: main }]
+      steps:
+        - query: INSERT INTO items (name) VALUES (?), (?)
+          args: [{ query: name }, { query: name }]
+          exec: true
+          map:
+          - '$context.steps_meta[-1] | { rows_affected, last_insert_id }'
+`)
+
+	w := serveTest(rt, "/items?name=a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatalf("error decoding response %q: %v", w.Body, err)
+	}
+	if meta["rows_affected"] != float64(2) || meta["last_insert_id"] != float64(2) {
+		t.Errorf("response = %v; want rows_affected 2 and last_insert_id 2", meta)
+	}
+	if n := countItems(t, db); n != 2 {
+		t.Errorf("items = %d; want 2", n)
+	}
+}
+
+func TestExecutorFilter(t *testing.T) {
+	rt, _ := newTestRouter(t, `
+  - method: GET
+    path: /even
+    query:
+      transactions: [{ db: main }]
+      steps:
+        - query: SELECT column1 AS n FROM (VALUES (1), (2), (3), (4))
+          filter: .n % 2 == 0
+          map:
+          - '{ rows: $context.steps_meta[-1].rows, kept: [.[].n] }'
+`)
+
+	w := serveTest(rt, "/even")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if want, body := `{"kept":[2,4],"rows":4}`, strings.TrimSpace(w.Body.String()); body != want {
+		t.Errorf("body = %s; want %s", body, want)
+	}
+}
@@ -0,0 +1,156 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// externalURLs builds the external URLs of requests, as clients see them,
+// for links. If an external URL is configured, it's always used.
+// Otherwise, the forwarding headers of requests from trusted proxies are
+// used, falling back to the request's own scheme and host.
+type externalURLs struct {
+	base    *url.URL
+	proxies []*net.IPNet
+}
+
+// newExternalURLs parses the external_url and trusted_proxies of a config.
+// Trusted proxies are IP addresses or CIDR ranges.
+func newExternalURLs(externalURL string, trustedProxies []string) (*externalURLs, error) {
+	var me *multierror.Error
+	x := &externalURLs{}
+	if externalURL != "" {
+		u, err := url.Parse(externalURL)
+		switch {
+		case err != nil:
+			me = multierror.Append(me, fmt.Errorf("invalid external_url: %w", err))
+		case u.Scheme != "http" && u.Scheme != "https", u.Host == "":
+			me = multierror.Append(me, fmt.Errorf("external_url %q is not an absolute http(s) URL", externalURL))
+		case u.RawQuery != "" || u.Fragment != "":
+			me = multierror.Append(me, fmt.Errorf("external_url %q may not have a query or fragment", externalURL))
+		default:
+			u.Path = strings.TrimRight(u.Path, "/")
+			u.RawPath = ""
+			x.base = u
+		}
+	}
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				me = multierror.Append(me, fmt.Errorf("invalid trusted proxy %q", p))
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			x.proxies = append(x.proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("invalid trusted proxy %q: %w", p, err))
+			continue
+		}
+		x.proxies = append(x.proxies, ipnet)
+	}
+	return x, errorOrNil(me)
+}
+
+// BaseURL returns the external base URL of the server for req, without a
+// trailing slash.
+func (x *externalURLs) BaseURL(req *http.Request) string {
+	if x != nil && x.base != nil {
+		return x.base.String()
+	}
+	scheme, host, prefix := "http", req.Host, ""
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if x.trusted(req) {
+		proto, fhost, ok := forwarded(req.Header.Get("Forwarded"))
+		if !ok {
+			proto = firstValue(req.Header.Get("X-Forwarded-Proto"))
+			fhost = firstValue(req.Header.Get("X-Forwarded-Host"))
+		}
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fhost != "" {
+			host = fhost
+		}
+		prefix = strings.TrimRight(firstValue(req.Header.Get("X-Forwarded-Prefix")), "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			prefix = ""
+		}
+	}
+	return scheme + "://" + host + prefix
+}
+
+// trusted returns whether req was sent by a trusted proxy.
+func (x *externalURLs) trusted(req *http.Request) bool {
+	if x == nil || len(x.proxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(clientIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, p := range x.proxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded returns the proto and host of the first element of a Forwarded
+// header (RFC 7239), which was added by the proxy that received the
+// original request. It returns false if the header has neither.
+func forwarded(header string) (proto, host string, ok bool) {
+	if header == "" {
+		return "", "", false
+	}
+	first, _, _ := strings.Cut(header, ",")
+	for _, pair := range strings.Split(first, ";") {
+		k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			continue
+		}
+		v = strings.Trim(v, "\"")
+		switch strings.ToLower(k) {
+		case "proto":
+			proto = strings.ToLower(v)
+		case "host":
+			host = v
+		}
+	}
+	return proto, host, proto != "" || host != ""
+}
+
+// firstValue returns the first of a comma-separated list of header values.
+func firstValue(header string) string {
+	first, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(first)
+}
@@ -0,0 +1,284 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// defaultFetchTimeout is the time an HTTP step's request, including
+	// reading its response body, may take if its timeout is unset.
+	defaultFetchTimeout = 30 * time.Second
+	// defaultFetchMaxBody is the largest response body an HTTP step reads
+	// if its max_body is unset.
+	defaultFetchMaxBody = 16 << 20
+)
+
+type DecodeType int
+
+const (
+	JSONDecodeType     DecodeType = iota // json - Default
+	StringDecodeType                     // string
+	ProtobufDecodeType                   // protobuf
+)
+
+func (d DecodeType) MarshalText() ([]byte, error) {
+	typ := "json"
+	switch d {
+	case JSONDecodeType:
+	case StringDecodeType:
+		typ = "string"
+	case ProtobufDecodeType:
+		typ = "protobuf"
+	default:
+		return nil, fmt.Errorf("unrecognized decode type %d", d)
+	}
+	return []byte(typ), nil
+}
+
+func (d *DecodeType) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "json":
+		*d = JSONDecodeType
+	case "string":
+		*d = StringDecodeType
+	case "protobuf":
+		*d = ProtobufDecodeType
+	default:
+		return fmt.Errorf("unrecognized decode type %q", src)
+	}
+	return nil
+}
+
+// HTTPStepDef defines a query step that fetches its results from an upstream
+// HTTP server instead of a database.
+type HTTPStepDef struct {
+	Method  string            `json:"method" yaml:"method"`
+	URL     *Expr             `json:"url" yaml:"url"`
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	Body    *Expr             `json:"body,omitempty" yaml:"body,omitempty"`
+	Decode  DecodeType        `json:"decode" yaml:"decode"`
+	Proto   *ProtoDef         `json:"proto,omitempty" yaml:"proto,omitempty"`
+	// Client, if set, names the http_clients entry the request is sent
+	// with instead of the config's http_client.
+	Client  string   `json:"client,omitempty" yaml:"client,omitempty"`
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`   // Defaults to 30s.
+	MaxBody int64    `json:"max_body,omitempty" yaml:"max_body,omitempty"` // Defaults to 16MiB.
+
+	client *http.Client // Resolved when the config is validated.
+}
+
+func (hd *HTTPStepDef) Validate() error {
+	var me *multierror.Error
+	if hd.URL == nil {
+		me = multierror.Append(me, errors.New("url is empty"))
+	}
+	if hd.Timeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("timeout must not be negative"))
+	} else if hd.Timeout.Duration == 0 {
+		hd.Timeout.Duration = defaultFetchTimeout
+	}
+	if hd.MaxBody < 0 {
+		me = multierror.Append(me, errors.New("max_body must not be negative"))
+	} else if hd.MaxBody == 0 {
+		hd.MaxBody = defaultFetchMaxBody
+	}
+	if hd.Decode == ProtobufDecodeType && hd.Proto == nil {
+		me = multierror.Append(me, errors.New("protobuf decoding requires a proto definition"))
+	}
+	if hd.Proto != nil {
+		if err := hd.Proto.Load(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("proto failed validation: %w", err))
+		}
+	}
+	return errorOrNil(me)
+}
+
+// Fetch performs the HTTP request described by the step and returns its
+// decoded response body. The URL and body expressions receive ctxVar as both
+// their input and $context. The request and reading its body are bounded by
+// the step's timeout, whatever the client's, and bodies larger than its
+// max_body are an error.
+func (hd *HTTPStepDef) Fetch(ctx context.Context, ctxVar interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, hd.Timeout.Duration)
+	defer cancel()
+
+	uv, err := hd.URL.Apply(ctx, ctxVar, ctxVar)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating url: %w", err)
+	}
+	url, ok := uv.(string)
+	if !ok {
+		return nil, fmt.Errorf("url expression returned %T, expected string", uv)
+	}
+
+	var body io.Reader
+	if hd.Body != nil {
+		bv, err := hd.Body.Apply(ctx, ctxVar, ctxVar)
+		if err != nil {
+			return nil, fmt.Errorf("error evaluating body: %w", err)
+		}
+		blob, err := json.Marshal(bv)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding body: %w", err)
+		}
+		body = bytes.NewReader(blob)
+	}
+
+	method := strings.ToUpper(hd.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	for k, v := range hd.Headers {
+		req.Header.Set(k, v)
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := hd.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error performing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, hd.MaxBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	if int64(len(data)) > hd.MaxBody {
+		return nil, fmt.Errorf("response body is larger than %d bytes", hd.MaxBody)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("upstream responded with status %s", resp.Status)
+	}
+
+	switch hd.Decode {
+	case StringDecodeType:
+		return string(data), nil
+	case ProtobufDecodeType:
+		return hd.Proto.Decode(data)
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("error parsing response body: %w", err)
+	}
+	return out, nil
+}
+
+// ProtoDef names a protobuf message type in a compiled descriptor set, such
+// as one produced by `protoc --include_imports --descriptor_set_out`.
+// Relative descriptor set paths are relative to the config file's directory.
+type ProtoDef struct {
+	DescriptorSet string `json:"descriptor_set" yaml:"descriptor_set"`
+	Message       string `json:"message" yaml:"message"`
+
+	desc protoreflect.MessageDescriptor
+}
+
+// Load reads the descriptor set and resolves the message descriptor used to
+// decode responses.
+func (pd *ProtoDef) Load() error {
+	if pd.desc != nil {
+		return nil
+	}
+	if pd.DescriptorSet == "" {
+		return errors.New("descriptor_set is empty")
+	}
+	if pd.Message == "" {
+		return errors.New("message is empty")
+	}
+
+	data, err := os.ReadFile(pd.DescriptorSet)
+	if err != nil {
+		return fmt.Errorf("error reading descriptor set: %w", err)
+	}
+
+	var fds descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &fds); err != nil {
+		return fmt.Errorf("error parsing descriptor set: %w", err)
+	}
+
+	files, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		return fmt.Errorf("error building descriptor set: %w", err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(pd.Message))
+	if err != nil {
+		return fmt.Errorf("error finding message %q: %w", pd.Message, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return fmt.Errorf("descriptor %q is not a message", pd.Message)
+	}
+
+	pd.desc = md
+	return nil
+}
+
+// Decode unmarshals a binary protobuf message and converts it to opaque JSON
+// values using the canonical protobuf JSON mapping.
+func (pd *ProtoDef) Decode(data []byte) (interface{}, error) {
+	msg := dynamicpb.NewMessage(pd.desc)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("error parsing protobuf response: %w", err)
+	}
+
+	blob, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("error converting protobuf response to JSON: %w", err)
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(blob, &out); err != nil {
+		return nil, fmt.Errorf("error parsing converted protobuf response: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,86 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestProtoDescriptorSetRelative(t *testing.T) {
+	// The descriptor set is beside the config file, not in the working
+	// directory, and must be found relative to the config file.
+	dir := t.TempDir()
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("item.proto"),
+		Package: proto.String("test.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Item"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("name"),
+				JsonName: proto.String("name"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+		}},
+	}}}
+	data, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "protos"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "protos", "item.pb"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	src := `
+endpoints:
+  - method: GET
+    path: /item
+    query:
+      steps:
+        - http:
+            url: '"http://localhost/item"'
+            decode: protobuf
+            proto: { descriptor_set: protos/item.pb, message: test.v1.Item }
+`
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := readConfigFile(path, "")
+	if err != nil {
+		t.Fatalf("readConfigFile() = %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	pd := conf.Endpoints[0].Query.Steps[0].HTTP.Proto
+	if want := filepath.Join(dir, "protos", "item.pb"); pd.DescriptorSet != want {
+		t.Errorf("descriptor_set = %q; want %q", pd.DescriptorSet, want)
+	}
+	if pd.desc == nil || pd.desc.FullName() != "test.v1.Item" {
+		t.Errorf("message = %v; want test.v1.Item", pd.desc)
+	}
+}
@@ -3,24 +3,41 @@ module go.spiff.io/chisel
 go 1.18
 
 require (
+	filippo.io/age v1.0.0
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/hashicorp/go-sockaddr v1.0.2
 	github.com/itchyny/gojq v0.12.4
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/microsoft/go-mssqldb v1.7.2
+	github.com/redis/go-redis/v9 v9.0.5
 	github.com/rs/zerolog v1.23.0
+	github.com/sijms/go-ora/v2 v2.7.6
 	github.com/tailscale/hujson v0.0.0-20210818175511-7360507a6e88
 	go.spiff.io/flagenv v0.1.0
 	go.spiff.io/sql v0.3.0
+	golang.org/x/crypto v0.18.0
+	golang.org/x/oauth2 v0.7.0
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.1.0
-	gopkg.in/yaml.v3 v3.0.0
+	golang.org/x/sys v0.16.0
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	cloud.google.com/go/compute/metadata v0.2.3 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
+	github.com/golang-sql/civil v0.0.0-20220223132316-b832511892a9 // indirect
+	github.com/golang-sql/sqlexp v0.1.0 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/itchyny/timefmt-go v0.1.3 // indirect
 	github.com/lib/pq v1.10.2 // indirect
 	github.com/mattn/go-sqlite3 v1.14.8 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/appengine v1.6.7 // indirect
 )
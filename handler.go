@@ -16,45 +16,111 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/zerolog"
 	"go.spiff.io/sql/vdb"
 )
 
 type Params struct {
-	Path  map[string]interface{} `json:"path"`
-	Query map[string]interface{} `json:"query"`
+	Path    map[string]interface{} `json:"path"`
+	Query   map[string]interface{} `json:"query"`
+	Header  map[string]interface{} `json:"header"` // Only the headers the endpoint uses.
+	Cookie  map[string]interface{} `json:"cookie"` // Only the cookies the endpoint uses.
+	Request *RequestInfo           `json:"request,omitempty"`
+	Page    *PageInfo              `json:"page,omitempty"` // Set if the endpoint is paginated.
+
+	uploads *uploads // Set if the request has a multipart body.
 }
 
 func newParams(pathCap, queryCap int) *Params {
 	return &Params{
-		Path:  make(map[string]interface{}, pathCap),
-		Query: make(map[string]interface{}, queryCap),
+		Path:   make(map[string]interface{}, pathCap),
+		Query:  make(map[string]interface{}, queryCap),
+		Header: map[string]interface{}{},
+		Cookie: map[string]interface{}{},
 	}
 }
 
 func (p *Params) Opaque() map[string]interface{} {
 	return map[string]interface{}{
-		"path":  p.Path,
-		"query": p.Query,
+		"path":   p.Path,
+		"query":  p.Query,
+		"header": p.Header,
+		"cookie": p.Cookie,
+	}
+}
+
+// RequestInfo describes the request being handled. It's available to
+// expressions as $context.request, such as to build links back to the
+// request.
+type RequestInfo struct {
+	Method  string `json:"method"`
+	URL     string `json:"url"`      // The full external URL of the request.
+	BaseURL string `json:"base_url"` // The external base URL of the server.
+	Path    string `json:"path"`     // The escaped path.
+	Query   string `json:"query"`    // The raw query string, without a leading '?'.
+	Route   string `json:"route"`    // The path template of the matched endpoint.
+}
+
+func newRequestInfo(req *http.Request, route string, external *externalURLs) *RequestInfo {
+	base := external.BaseURL(req)
+	full := base + req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		full += "?" + req.URL.RawQuery
+	}
+	return &RequestInfo{
+		Method:  req.Method,
+		URL:     full,
+		BaseURL: base,
+		Path:    req.URL.EscapedPath(),
+		Query:   req.URL.RawQuery,
+		Route:   route,
+	}
+}
+
+func (ri *RequestInfo) Opaque() map[string]interface{} {
+	return map[string]interface{}{
+		"method":   ri.Method,
+		"url":      ri.URL,
+		"base_url": ri.BaseURL,
+		"path":     ri.Path,
+		"query":    ri.Query,
+		"route":    ri.Route,
 	}
 }
 
 type Handler struct {
 	*EndpointDef
 
-	db map[string]*Database
+	db       map[string]*Database
+	trace    *TraceDef
+	outboxes map[string]*OutboxDef
+	datasets map[string]*DatasetDef
+	catalog  map[string]*CatalogQueryDef
+	links    *LinksDef
+	external *externalURLs
+	batcher  *batcher // Set if the endpoint batches requests.
 }
 
 func (h *Handler) ParseParams(req *http.Request, pathParams httprouter.Params) (*Params, error) {
@@ -62,47 +128,209 @@ func (h *Handler) ParseParams(req *http.Request, pathParams httprouter.Params) (
 	queryParams := req.URL.Query()
 	params := newParams(len(pathParams), len(queryParams))
 	for k, v := range queryParams {
+		_, mapped := h.QueryParams[k]
 		vi := make([]interface{}, len(v))
 		for i, s := range v {
 			vi[i] = s
+			if h.ParseQuery && !mapped {
+				vi[i] = parseQueryValue(s)
+			}
 		}
 		params.Query[k] = vi
 	}
+	var perrs ParamErrors
+	if h.StrictQuery != nil {
+		perrs = append(perrs, h.StrictQuery.Check(queryParams)...)
+	}
+	if h.Page != nil {
+		// The enforced limit replaces the requested one, so that mappings
+		// and args see the limit that applies.
+		page, err := h.Page.Apply(queryParams)
+		if err != nil {
+			perrs = append(perrs, &ParamError{In: "query", Name: h.Page.Param, Err: err})
+		} else {
+			params.Page = page
+			params.Query[h.Page.Param] = []interface{}{page.Limit}
+		}
+	}
 	for _, entry := range pathParams {
-		params.Path[entry.Key] = entry.Value
+		if entry.Key != h.catchAll {
+			params.Path[entry.Key] = entry.Value
+			continue
+		}
+		segs, err := splitCatchAll(entry.Value)
+		if err != nil {
+			perrs = append(perrs, &ParamError{In: "path", Name: entry.Key, Err: err})
+			continue
+		}
+		params.Path[entry.Key] = segs
+	}
+	for _, name := range h.headers {
+		if vs := req.Header.Values(name); len(vs) > 0 {
+			params.Header[name] = vs[0]
+		}
+	}
+	for _, name := range h.cookies {
+		if c, err := req.Cookie(name); err == nil {
+			params.Cookie[name] = c.Value
+		}
+	}
+	params.Request = newRequestInfo(req, h.Path, h.external)
+	// Param mappings run before the request's other context exists, so
+	// their $context only holds the request and links.
+	ctxVar := map[string]interface{}{
+		"request": params.Request.Opaque(),
+	}
+	if h.links != nil {
+		ctxVar["links"] = h.links.Opaque()
 	}
 
-	mapParams := func(mappings ParamMappings, params map[string]interface{}) error {
-		for k, pd := range mappings {
+	mapParams := func(in string, mappings ParamMappings, params map[string]interface{}) {
+		for _, k := range mappings.Ordered() {
 			v, ok := params[k]
 			if !ok {
 				continue
 			}
-			v, err := pd.Map.Apply(ctx, v, nil)
+			v, err := mappings[k].Map.Apply(ctx, v, ctxVar)
 			if err != nil {
-				return fmt.Errorf("error mapping parameter %q: %w", k, err)
+				perrs = append(perrs, &ParamError{In: in, Name: k, Err: err})
+				continue
 			}
 			params[k] = v
 		}
-		return nil
 	}
 
-	if err := mapParams(h.PathParams, params.Path); err != nil {
-		return nil, fmt.Errorf("failed to map path parameters: %w", err)
+	mapParams("path", h.PathParams, params.Path)
+	mapParams("query", h.QueryParams, params.Query)
+	mapParams("header", h.HeaderParams, params.Header)
+	mapParams("cookie", h.CookieParams, params.Cookie)
+	if len(perrs) > 0 {
+		return nil, perrs
+	}
+
+	return params, nil
+}
+
+// splitCatchAll splits the value of a catch-all path param into its
+// segments, dropping empty ones. Segments that refer to the current or
+// parent directory are rejected.
+func splitCatchAll(v string) ([]interface{}, error) {
+	segs := []interface{}{}
+	for _, seg := range strings.Split(v, "/") {
+		switch seg {
+		case "":
+			continue
+		case ".", "..":
+			return nil, fmt.Errorf("path segment %q is not allowed", seg)
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// parseQueryValue returns s as an int, float, or bool if it is one in JSON,
+// and s otherwise.
+func parseQueryValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
 	}
+	if i, err := strconv.Atoi(s); err == nil {
+		return i
+	}
+	var f float64
+	if json.Unmarshal([]byte(s), &f) == nil {
+		return f
+	}
+	return s
+}
+
+// ParamError describes a request parameter that failed its mapping.
+type ParamError struct {
+	In   string `json:"in"`
+	Name string `json:"name"`
+	Err  error  `json:"-"`
+}
+
+func (p *ParamError) Error() string {
+	return fmt.Sprintf("invalid %s parameter %q: %v", p.In, p.Name, p.Err)
+}
+
+func (p *ParamError) Unwrap() error {
+	return p.Err
+}
+
+func (p *ParamError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"in":     p.In,
+		"name":   p.Name,
+		"reason": p.Err.Error(),
+	})
+}
 
-	if err := mapParams(h.QueryParams, params.Query); err != nil {
-		return nil, fmt.Errorf("failed to map query parameters: %w", err)
+// ParamErrors is a list of all parameters that failed mapping for a request.
+type ParamErrors []*ParamError
+
+func (ps ParamErrors) Error() string {
+	msgs := make([]string, len(ps))
+	for i, p := range ps {
+		msgs[i] = p.Error()
 	}
+	return strings.Join(msgs, "; ")
+}
 
-	return params, nil
+// errorResponse is the JSON body written for requests rejected by chisel
+// before any queries run.
+type errorResponse struct {
+	Error  string      `json:"error"`
+	Params ParamErrors `json:"params,omitempty"`
+}
+
+func writeError(log zerolog.Logger, w http.ResponseWriter, status int, resp *errorResponse) {
+	writeJSON(log, w, status, resp)
+}
+
+// writeJSON writes v to w as a JSON response with the given status.
+func writeJSON(log zerolog.Logger, w http.ResponseWriter, status int, v interface{}) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Error().Err(err).Msg("Failed to marshal response.")
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if _, err = w.Write(blob); err != nil {
+		log.Warn().Err(err).Msg("Failed to write response to client.")
+	}
+}
+
+// replyParamError writes a 400 response describing all parameters that
+// failed to map.
+func replyParamError(log zerolog.Logger, w http.ResponseWriter, err error) {
+	resp := &errorResponse{Error: "bad request"}
+	var perrs ParamErrors
+	if errors.As(err, &perrs) {
+		resp.Error = "invalid parameters"
+		resp.Params = perrs
+	}
+	writeError(log, w, http.StatusBadRequest, resp)
 }
 
 func (h *Handler) WithLogger(req *http.Request) (*http.Request, context.Context, zerolog.Logger) {
 	ctx := req.Context()
-	log := zerolog.Ctx(ctx).With().
+	lc := zerolog.Ctx(ctx).With().
 		Str("method", h.Method).
-		Str("path", h.Path).
+		Str("path", h.Path)
+	if h.Name != "" {
+		lc = lc.Str("endpoint", h.Name)
+	}
+	log := lc.
 		Str("url", req.URL.Redacted()).
 		Str("ua", req.UserAgent()).
 		Str("raddr", req.RemoteAddr).
@@ -117,27 +345,35 @@ func (h *Handler) Get(w http.ResponseWriter, req *http.Request, pathParams httpr
 	params, err := h.ParseParams(req, pathParams)
 	if err != nil {
 		log.Trace().Err(err).Msg("Error parsing parameters. Request aborted.")
-		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		replyParamError(log, w, err)
 		return
 	}
+	params.Page.WriteHeaders(w.Header())
 
-	out, err := h.computeResponse(ctx, log, w, req, params, nil)
+	out, release, err := h.computeResponse(ctx, log, w, req, h.Query, params, nil)
 	if err != nil {
 		return
 	}
-	h.reply(ctx, log, w, out)
+	defer release()
+	h.reply(ctx, log, w, req, out)
 }
 
 func (h *Handler) Post(w http.ResponseWriter, req *http.Request, pathParams httprouter.Params) {
 	req, ctx, log := h.WithLogger(req)
 
 	var body interface{}
-	switch h.BodyType {
+	var files *uploads
+	switch h.bodyType() {
 	case FormBodyType:
 		if pe := req.ParseForm(); pe != nil {
-			// TODO: Assign parsed form to body as
-			// map[string]interface{} (for gojq).
+			http.Error(w, "error parsing request body", http.StatusNotAcceptable)
+			return
 		}
+		if len(req.PostForm) == 0 && h.RequireBody {
+			writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "request body is required"})
+			return
+		}
+		body = formBody(req.PostForm)
 	case JSONBodyType:
 		data, re := io.ReadAll(req.Body)
 		if re != nil {
@@ -145,6 +381,10 @@ func (h *Handler) Post(w http.ResponseWriter, req *http.Request, pathParams http
 			return
 		}
 		if len(data) == 0 {
+			if h.RequireBody {
+				writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "request body is required"})
+				return
+			}
 			break
 		}
 		if je := json.Unmarshal(data, &body); je != nil {
@@ -158,27 +398,79 @@ func (h *Handler) Post(w http.ResponseWriter, req *http.Request, pathParams http
 			return
 		}
 		if len(data) == 0 {
+			if h.RequireBody {
+				writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "request body is required"})
+				return
+			}
 			break
 		}
 		body = string(data)
+	case MultipartBodyType:
+		var lb *limitedBody
+		if h.Multipart.MaxSize > 0 {
+			lb = &limitedBody{r: req.Body, n: h.Multipart.MaxSize}
+			req.Body = lb
+		}
+		if pe := req.ParseMultipartForm(h.Multipart.MaxMemory); pe != nil {
+			if lb != nil && lb.exceeded {
+				writeError(log, w, http.StatusRequestEntityTooLarge, &errorResponse{Error: errMultipartTooLarge.Error()})
+				return
+			}
+			http.Error(w, "error parsing request body", http.StatusNotAcceptable)
+			return
+		}
+		files = newUploads(req.MultipartForm)
+		defer func() {
+			if err := files.Close(); err != nil {
+				log.Warn().Err(err).Msg("Failed to remove uploaded files.")
+			}
+		}()
+		if len(req.MultipartForm.Value) == 0 && len(req.MultipartForm.File) == 0 && h.RequireBody {
+			writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "request body is required"})
+			return
+		}
+		body = multipartBody(req.MultipartForm)
+	case NDJSONBodyType, CSVBodyType:
+		// Rows are read as the query runs. Bodies are closed by the
+		// server once the handler returns.
+		body = newRowStream(req.Body, h.bodyType(), h.Stream)
 	case NoBodyType:
 		// Nop.
 	}
 
 	params, err := h.ParseParams(req, pathParams)
 	if err != nil {
-		zerolog.Ctx(req.Context()).Error().
-			Err(err).
-			Msg("Error parsing parameters. Request aborted.")
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Trace().Err(err).Msg("Error parsing parameters. Request aborted.")
+		replyParamError(log, w, err)
 		return
 	}
+	params.Page.WriteHeaders(w.Header())
+	params.uploads = files
 
-	out, err := h.computeResponse(ctx, log, w, req, params, body)
+	out, release, err := h.computeResponse(ctx, log, w, req, h.Query, params, body)
 	if err != nil {
 		return
 	}
-	h.reply(ctx, log, w, out)
+	defer release()
+	h.reply(ctx, log, w, req, out)
+}
+
+// formBody returns the fields of a form body for jq: fields with a single
+// value are strings, and fields with several are lists of strings.
+func formBody(form url.Values) map[string]interface{} {
+	body := make(map[string]interface{}, len(form))
+	for k, vs := range form {
+		if len(vs) == 1 {
+			body[k] = vs[0]
+			continue
+		}
+		list := make([]interface{}, len(vs))
+		for i, v := range vs {
+			list[i] = v
+		}
+		body[k] = list
+	}
+	return body
 }
 
 func opaqueInt(v interface{}) (int64, bool) {
@@ -242,9 +534,14 @@ func opaqueString(v interface{}) (string, bool) {
 	}
 }
 
-func (h *Handler) reply(ctx context.Context, log zerolog.Logger, w http.ResponseWriter, out interface{}) {
+func (h *Handler) reply(ctx context.Context, log zerolog.Logger, w http.ResponseWriter, req *http.Request, out interface{}) {
 	const responseKey = "__response"
 
+	if raw, ok := out.(*rawBody); ok {
+		h.replyRaw(log, w, req, raw)
+		return
+	}
+
 	status := http.StatusOK
 	mr, _ := out.(map[string]interface{})
 	if r, ok := mr[responseKey].(map[string]interface{}); ok && r != nil {
@@ -279,113 +576,205 @@ func (h *Handler) reply(ctx context.Context, log zerolog.Logger, w http.Response
 	}
 	delete(mr, responseKey)
 
-	blob, err := json.Marshal(out)
+	h.Mask.Apply(principalFromContext(ctx), out)
+
+	xd := h.Xlsx
+	if xd == nil || !xd.Default {
+		// The encoding depends on the Accept header.
+		w.Header().Add("Vary", "Accept")
+	}
+	if (xd != nil && xd.Default) || accepts(req, xlsxContentType) {
+		if xd == nil {
+			xd = &XlsxDef{}
+		}
+		h.replyTable(log, w, req, status, xlsxContentType, xd.Filename, out, xd.Encode)
+		return
+	}
+	for _, enc := range columnarEncodings {
+		if accepts(req, enc.ContentType) {
+			h.replyTable(log, w, req, status, enc.ContentType, "", out, enc.Encode)
+			return
+		}
+	}
+
+	contentType := "application/json"
+	if h.JSONAPI != nil {
+		doc, err := h.JSONAPI.Document(out)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			log.Error().Err(err).Msg("Failed to shape output as a JSON:API document.")
+			return
+		}
+		out, contentType = doc, jsonAPIContentType
+	}
+
+	buf, err := encodeResponse(out)
 	if err != nil {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		log.Error().Err(err).Msg("Failed to marshal output.")
 		return
 	}
+	defer releaseResponse(buf)
 
-	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
+	if status == http.StatusOK {
+		serveContent(w, req, buf.Bytes())
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 	w.WriteHeader(status)
 
-	_, err = w.Write(blob)
+	_, err = w.Write(buf.Bytes())
 	if err != nil {
 		log.Warn().Err(err).Msg("Failed to write response to client.")
 	}
 }
 
-func (h *Handler) computeResponse(ctx context.Context, log zerolog.Logger, w http.ResponseWriter, req *http.Request, params *Params, body interface{}) (out interface{}, err error) {
-	transactions := make([]*transactionState, len(h.Query.Transactions))
-	closeTransactions := func(ctx context.Context, err error) {
-		defer log.Trace().Msg("Transactions closed.")
-		for ti, t := range transactions {
-			if t == nil {
-				// Partial setup.
-				return
-			}
-			cerr := t.CommitOrRollback(ctx, err)
-			if cerr != nil {
-				log.Warn().Int("transaction", ti).Err(cerr).Msg("Error committing or rolling back transaction.")
-			}
-		}
-	}
-	defer func() { closeTransactions(ctx, err) }()
+// serveContent writes a 200 response body with a strong ETag so that clients
+// can make conditional and Range requests against it, and with its digest so
+// that they can check the body they reassemble from ranges.
+func serveContent(w http.ResponseWriter, req *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	setDigestHeaders(w.Header(), sum[:])
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+}
 
-	for tdi, td := range h.Query.Transactions {
-		db := h.db[td.DB]
-		t, err := newTransaction(ctx, db, td)
-		if err != nil {
-			http.Error(w, "error preparing request", http.StatusInternalServerError)
-			log.Error().Err(err).Int("transaction", tdi).Msg("Error starting transaction for request.")
-			return nil, err
-		}
-		transactions[tdi] = t
-	}
-	log.Trace().Msg("Transactions started.")
+// setDigestHeaders sets the Repr-Digest header, and the older Digest header,
+// to the SHA-256 digest sum of a full response body. Both describe the whole
+// body, including in partial responses.
+func setDigestHeaders(h http.Header, sum []byte) {
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	h.Set("Digest", "SHA-256="+b64)
+}
+
+// columnarEncodings are the encodings of tabular responses, other than xlsx,
+// that may be requested with the Accept header.
+var columnarEncodings = []struct {
+	ContentType string
+	Encode      func(interface{}) ([]byte, error)
+}{
+	{parquetContentType, encodeParquet},
+	{arrowStreamContentType, encodeArrowStream},
+}
 
-	argCtx := argContext{
-		body:        body,
-		params:      params,
-		stepResults: make([]interface{}, 0, len(h.Query.Steps)),
-		outputs:     make([]interface{}, 0, len(h.Query.Steps)),
+// replyTable writes out using a tabular encoding, such as xlsx. Responses
+// that aren't tabular are rejected with a 406 status. If filename is set,
+// the response is sent as an attachment with that name.
+func (h *Handler) replyTable(log zerolog.Logger, w http.ResponseWriter, req *http.Request, status int, contentType, filename string, out interface{}, encode func(interface{}) ([]byte, error)) {
+	blob, err := encode(out)
+	if errors.Is(err, errNotTabular) {
+		writeError(log, w, http.StatusNotAcceptable, &errorResponse{Error: "response cannot be encoded as " + contentType})
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Error().Err(err).Str("content_type", contentType).Msg("Failed to encode output.")
+		return
 	}
-	for si, s := range h.Query.Steps {
-		t := transactions[s.Transaction]
-		log := log.With().Int("step", si).Logger()
 
-		args := make([]interface{}, len(s.Args))
-		for adi, ad := range s.Args {
-			arg, err := argCtx.Resolve(ctx, ad)
-			if err != nil {
-				http.Error(w, "error resolving arguments", http.StatusInternalServerError)
-				log.Error().Err(err).Msg("Failed to resolve arguments. This implies an invalid endpoint config.")
-				return nil, err
-			}
-			args[adi] = arg
-		}
+	w.Header().Set("Content-Type", contentType)
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	if status == http.StatusOK {
+		serveContent(w, req, blob)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	w.WriteHeader(status)
+	if _, err := w.Write(blob); err != nil {
+		log.Warn().Err(err).Msg("Failed to write response to client.")
+	}
+}
 
-		argCtx.args = args
+// replyRaw writes a raw response body. A nil body means the raw step found
+// no rows.
+func (h *Handler) replyRaw(log zerolog.Logger, w http.ResponseWriter, req *http.Request, raw *rawBody) {
+	if raw == nil {
+		writeError(log, w, http.StatusNotFound, &errorResponse{Error: "not found"})
+		return
+	}
+	w.Header().Set("Content-Type", raw.ContentType)
+	serveContent(w, req, raw.Data)
+}
 
-		query, args, err := sqlx.In(s.Query, args...)
-		if err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Error().Err(err).Msg("Failed to expand IN(?) arguments.")
-			return nil, err
-		}
-		query = sqlx.Rebind(t.db.options.BindType, query)
+// computeResponse runs def for the request and returns its output, or
+// replies with an error. The returned func releases the buffers the output
+// was computed in, and must be called once the output has been encoded.
+func (h *Handler) computeResponse(ctx context.Context, log zerolog.Logger, w http.ResponseWriter, req *http.Request, def *QueryDef, params *Params, body interface{}) (interface{}, func(), error) {
+	tr := h.trace.Start(req)
+	tags := h.commentTags(req)
+	newExecutor := func() *executor {
+		ex := h.newExecutor(def, log, tr, params, body)
+		ex.tags = tags
+		return ex
+	}
+	var out interface{}
+	var err error
+	release := func() {}
+	if h.batcher != nil {
+		// The batcher creates the request's executors itself, and
+		// may create more than one if its batch fails, so their
+		// buffers are left to the garbage collector.
+		out, err = h.batcher.Do(ctx, newExecutor)
+	} else {
+		ex := newExecutor()
+		release = ex.argCtx.release
+		out, err = ex.Run(ctx)
+	}
+	tr.Write(w)
+	if err == nil {
+		return out, release, nil
+	}
+	release()
 
-		rows, err := t.QueryContext(ctx, query, args...)
-		defer rows.Close()
-		if err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Error().Err(err).Msg("Failed to execute query.")
-			return nil, err
+	status, public := http.StatusInternalServerError, "internal server error"
+	re := &RecentError{
+		Time:      time.Now().UTC(),
+		Method:    h.Method,
+		Path:      h.Path,
+		SQLState:  sqlState(err),
+		RequestID: req.Header.Get(requestIDHeader),
+		Error:     err.Error(),
+	}
+	var se *stepError
+	if errors.As(err, &se) {
+		status, public = se.Status, se.Public
+		if se.Step >= 0 {
+			step := se.Step
+			re.Step = &step
 		}
+	}
+	re.Status = status
+	recentRequestErrors.Add(re)
+	if se != nil && len(se.Params) > 0 {
+		writeError(log, w, status, &errorResponse{Error: public, Params: se.Params})
+		return nil, nil, err
+	}
+	http.Error(w, public, status)
+	return nil, nil, err
+}
 
-		results, err := vdb.ScanRows(ctx, rows, t.db.options)
+// filterRows applies filter to each row of a result set, dropping rows for
+// which the filter is not truthy. Rows are filtered in place.
+func filterRows(ctx context.Context, filter *Expr, res, ctxVar interface{}) (interface{}, error) {
+	rows, ok := res.([]interface{})
+	if !ok {
+		return res, nil
+	}
+	kept := rows[:0]
+	for i, row := range rows {
+		keep, err := filter.Test(ctx, row, ctxVar)
 		if err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Error().Err(err).Msg("Failed to scan result set.")
-			return nil, err
+			return nil, fmt.Errorf("error filtering row %d: %w", i, err)
 		}
-
-		var res interface{} = results.Opaque()
-		log.Info().Interface("args", args).Interface("results", res).Msg("Results.")
-		argCtx.stepResults = append(argCtx.stepResults, res)
-
-		res, err = s.Map.Apply(ctx, res, argCtx.Opaque())
-		if err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Error().Err(err).Msg("Failed to transform result set.")
-			return nil, err
+		if keep {
+			kept = append(kept, row)
 		}
-
-		argCtx.outputs = append(argCtx.outputs, res)
 	}
-
-	return argCtx.outputs[len(argCtx.outputs)-1], nil
+	return kept, nil
 }
 
 type Committer interface {
@@ -398,9 +787,60 @@ type Committer interface {
 type transactionState struct {
 	vdb.DB
 	db *Database
+
+	step   int32 // The step currently using the transaction, for logging.
+	timers []*time.Timer
+	ctx    context.Context // Set if the transaction has a timeout.
+	cancel context.CancelFunc
+}
+
+// Context returns the context queries in the transaction should use. If the
+// transaction has a timeout, queries are canceled when it expires.
+func (t *transactionState) Context(ctx context.Context) context.Context {
+	if t.ctx != nil {
+		return t.ctx
+	}
+	return ctx
+}
+
+// SetStep records the step currently using the transaction so that
+// watchdog logs can attribute long-lived transactions to it.
+func (t *transactionState) SetStep(si int) {
+	atomic.StoreInt32(&t.step, int32(si))
+}
+
+// watch starts the watchdog timers for a transaction begun at began. If the
+// transaction is still open after td.WarnAfter, a warning is logged. If it is
+// still open after td.Timeout, an error is logged; the transaction itself is
+// rolled back by the expiry of its context.
+func (t *transactionState) watch(log zerolog.Logger, ti int, td *TransactionDef, began time.Time) {
+	logOpen := func(ev *zerolog.Event, msg string) {
+		ev.Int("transaction", ti).
+			Int32("step", atomic.LoadInt32(&t.step)).
+			Dur("elapsed", time.Since(began)).
+			Msg(msg)
+	}
+	if d := td.WarnAfter.Duration; d > 0 {
+		t.timers = append(t.timers, time.AfterFunc(d, func() {
+			logOpen(log.Warn(), "Transaction has been open longer than expected.")
+		}))
+	}
+	if d := td.Timeout.Duration; d > 0 {
+		t.timers = append(t.timers, time.AfterFunc(d, func() {
+			logOpen(log.Error(), "Transaction timed out and is being rolled back.")
+		}))
+	}
 }
 
 func (t *transactionState) CommitOrRollback(ctx context.Context, err error) error {
+	defer t.db.release()
+	for _, timer := range t.timers {
+		timer.Stop()
+	}
+	if t.cancel != nil {
+		defer t.cancel()
+	}
+
 	if err == nil {
 		err = ctx.Err()
 	}
@@ -423,7 +863,8 @@ func (t *transactionState) CommitOrRollback(ctx context.Context, err error) erro
 	return operr
 }
 
-func newTransaction(ctx context.Context, db *Database, td *TransactionDef) (*transactionState, error) {
+func newTransaction(ctx context.Context, db *Database, ti int, td *TransactionDef) (*transactionState, error) {
+	db.acquire()
 	if !td.Isolation.RequiresTranscation() {
 		return &transactionState{
 			DB: db.db,
@@ -431,13 +872,29 @@ func newTransaction(ctx context.Context, db *Database, td *TransactionDef) (*tra
 		}, nil
 	}
 
+	began := time.Now()
+	var cancel context.CancelFunc
+	if td.Timeout.Duration > 0 {
+		// The transaction is rolled back when its context ends.
+		ctx, cancel = context.WithTimeout(ctx, td.Timeout.Duration)
+	}
 	tx, err := db.db.BeginTxx(ctx, &sql.TxOptions{
 		Isolation: td.Isolation.Level(),
+		ReadOnly:  td.ReadOnly,
 	})
 	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		db.release()
 		return nil, fmt.Errorf("error beginning transaction: %w", err)
 	}
-	return &transactionState{DB: tx, db: db}, nil
+	t := &transactionState{DB: tx, db: db}
+	if cancel != nil {
+		t.ctx, t.cancel = ctx, cancel
+	}
+	t.watch(*zerolog.Ctx(ctx), ti, td, began)
+	return t, nil
 }
 
 type argContext struct {
@@ -445,41 +902,228 @@ type argContext struct {
 	body        interface{}
 	stepResults []interface{}
 	outputs     []interface{}
+	stepsMeta   []interface{}
 	args        []interface{}
+	links       map[string]interface{}
+	stream      map[string]interface{} // Progress of a streamed body, if any.
 	opaque      map[string]interface{}
+
+	// stepNames holds the name of each of the query's steps, or is nil if
+	// none of them are named.
+	stepNames []string
+
+	// memo holds the results of expressions evaluated against the current
+	// opaque context, keyed by their source. It is cleared whenever the
+	// context changes.
+	memo map[string]interface{}
+
+	bufs *argBuffers // Pooled buffers, returned by release.
+}
+
+// maxPooledSteps is the capacity above which argBuffers slices are dropped
+// instead of being returned to the pool.
+const maxPooledSteps = 64
+
+// argBuffers holds the slices an argContext collects step results, outputs,
+// and metadata in. Every request allocates them, so they're pooled and
+// released once the request's response has been encoded.
+type argBuffers struct {
+	stepResults []interface{}
+	outputs     []interface{}
+	stepsMeta   []interface{}
+}
+
+var argBufferPool = sync.Pool{
+	New: func() interface{} { return new(argBuffers) },
+}
+
+// getArgBuffers returns pooled buffers with room for n steps.
+func getArgBuffers(n int) *argBuffers {
+	b := argBufferPool.Get().(*argBuffers)
+	if cap(b.stepResults) < n {
+		b.stepResults = make([]interface{}, 0, n)
+	}
+	if cap(b.outputs) < n {
+		b.outputs = make([]interface{}, 0, n)
+	}
+	if cap(b.stepsMeta) < n {
+		b.stepsMeta = make([]interface{}, 0, n)
+	}
+	return b
+}
+
+// resetBuffer clears the values of s so that they can be collected, and
+// returns it empty. Slices too large to pool are dropped.
+func resetBuffer(s []interface{}) []interface{} {
+	if cap(s) > maxPooledSteps {
+		return nil
+	}
+	s = s[:cap(s)]
+	for i := range s {
+		s[i] = nil
+	}
+	return s[:0]
+}
+
+// release returns the context's buffers to the pool. Expressions may have
+// retained views of them in the response, so release must not be called
+// until the response has been encoded, and the context must not be used
+// afterward.
+func (c *argContext) release() {
+	b := c.bufs
+	if b == nil {
+		return
+	}
+	b.stepResults = resetBuffer(c.stepResults)
+	b.outputs = resetBuffer(c.outputs)
+	b.stepsMeta = resetBuffer(c.stepsMeta)
+	*c = argContext{}
+	argBufferPool.Put(b)
+}
+
+// SetChunk starts a run of the query's steps for a chunk of a streamed
+// body, discarding the results of the previous chunk's run.
+func (c *argContext) SetChunk(chunk []interface{}, progress map[string]interface{}) {
+	c.body = chunk
+	c.stream = progress
+	c.args = nil
+	c.stepResults = make([]interface{}, 0, cap(c.stepResults))
+	c.stepsMeta = make([]interface{}, 0, cap(c.stepsMeta))
+	c.outputs = make([]interface{}, 0, cap(c.outputs))
+	c.opaque = nil
+	c.memo = nil
+}
+
+func (c *argContext) SetArgs(args []interface{}) {
+	c.args = args
+	c.memo = nil
+}
+
+func (c *argContext) AddStepResult(res interface{}) {
+	c.stepResults = append(c.stepResults, res)
+	c.memo = nil
+}
+
+func (c *argContext) AddStepMeta(meta *stepMeta) {
+	c.stepsMeta = append(c.stepsMeta, meta.Opaque())
+	c.memo = nil
+}
+
+func (c *argContext) AddOutput(res interface{}) {
+	c.outputs = append(c.outputs, res)
+	c.memo = nil
 }
 
 func (c *argContext) Opaque() map[string]interface{} {
 	if c.opaque == nil {
-		c.opaque = make(map[string]interface{}, 5)
+		c.opaque = make(map[string]interface{}, 8)
 		c.opaque["params"] = c.params.Opaque()
 		c.opaque["body"] = c.body
+		if c.params.Request != nil {
+			c.opaque["request"] = c.params.Request.Opaque()
+		}
+		if c.params.Page != nil {
+			c.opaque["page"] = c.params.Page.Opaque()
+		}
+		if c.links != nil {
+			c.opaque["links"] = c.links
+		}
+		if c.stream != nil {
+			c.opaque["stream"] = c.stream
+		}
+	}
+	// Refresh opaque data that changes. The slices are only ever appended
+	// to, so rather than copy them, their capacity is capped: expressions
+	// that append to them (or retain them in a cached response) get a copy
+	// instead of seeing later steps' results.
+	c.opaque["args"] = c.args[:len(c.args):len(c.args)]
+	c.opaque["steps"] = c.stepResults[:len(c.stepResults):len(c.stepResults)]
+	c.opaque["outputs"] = c.outputs[:len(c.outputs):len(c.outputs)]
+	c.opaque["steps_meta"] = c.stepsMeta[:len(c.stepsMeta):len(c.stepsMeta)]
+	if c.stepNames != nil {
+		c.opaque["named_steps"] = c.byName(c.stepResults)
+		c.opaque["named_outputs"] = c.byName(c.outputs)
 	}
-	// Refresh opaque data that changes.
-	c.opaque["args"] = append([]interface{}(nil), c.args...)
-	c.opaque["steps"] = append([]interface{}(nil), c.stepResults...)
-	c.opaque["outputs"] = append([]interface{}(nil), c.outputs...)
 	return c.opaque
 }
 
+// byName returns a map of the values of named steps in values, which are
+// in step order. A new map is returned each time, since expressions may
+// retain it.
+func (c *argContext) byName(values []interface{}) map[string]interface{} {
+	named := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		if name := c.stepNames[i]; name != "" {
+			named[name] = v
+		}
+	}
+	return named
+}
+
 func (c *argContext) Resolve(ctx context.Context, arg ArgDef) (interface{}, error) {
 	switch arg := arg.(type) {
 	case ArgLiteral:
 		return arg.Literal, nil
 	case PathParamRef:
 		param, ok := c.params.Path[arg.Name]
-		if !ok {
-			return nil, fmt.Errorf("path param %q not defined", arg.Name)
-		}
-		return param, nil
+		return arg.resolve("path", arg.Name, param, ok)
 	case QueryParamRef:
 		param, ok := c.params.Query[arg.Name]
-		if !ok {
-			return nil, fmt.Errorf("query param %q not defined", arg.Name)
+		return arg.resolve("query", arg.Name, param, ok)
+	case HeaderParamRef:
+		param, ok := c.params.Header[http.CanonicalHeaderKey(arg.Name)]
+		return arg.resolve("header", arg.Name, param, ok)
+	case CookieParamRef:
+		param, ok := c.params.Cookie[arg.Name]
+		return arg.resolve("cookie", arg.Name, param, ok)
+	case FileRef:
+		data, ok, err := c.params.uploads.Contents(arg.Name)
+		if err != nil {
+			return nil, err
 		}
-		return param, nil
+		return arg.resolve("file", arg.Name, data, ok)
+	case FilePathRef:
+		path, ok, err := c.params.uploads.Path(arg.Name)
+		if err != nil {
+			return nil, err
+		}
+		return arg.resolve("file", arg.Name, path, ok)
 	case ExprParam:
-		return arg.Expr.Apply(ctx, c.Opaque(), c.Opaque())
+		return c.eval(ctx, arg.Expr)
+	case TypedArg:
+		v, err := c.Resolve(ctx, arg.Arg)
+		if err != nil {
+			return nil, err
+		}
+		conv, err := arg.Type.Convert(v)
+		if err != nil {
+			// Params come from the client, so a param that can't be
+			// converted is the client's error.
+			if in, name, ok := arg.paramSource(); ok {
+				return nil, &ParamError{In: in, Name: name, Err: err}
+			}
+			return nil, err
+		}
+		return conv, nil
 	}
 	panic(fmt.Errorf("unreachable: bad ArgDef %#+ v", arg))
 }
+
+// eval applies expr to the opaque context. Results are memoized so that
+// identical expressions, such as the same expression used for several
+// args, are only evaluated once per context. Errors are not memoized.
+func (c *argContext) eval(ctx context.Context, expr *Expr) (interface{}, error) {
+	if v, ok := c.memo[expr.src]; ok {
+		return v, nil
+	}
+	opaque := c.Opaque()
+	v, err := expr.Apply(ctx, opaque, opaque)
+	if err != nil {
+		return nil, err
+	}
+	if c.memo == nil {
+		c.memo = make(map[string]interface{})
+	}
+	c.memo[expr.src] = v
+	return v, nil
+}
@@ -0,0 +1,300 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+var (
+	errConfigVersionNotFound = errors.New("config version not found")
+	errConfigVersionCurrent  = errors.New("config version is already current")
+)
+
+// ConfigVersion describes a config loaded by the server.
+type ConfigVersion struct {
+	ID         int       `json:"id"`
+	Loaded     time.Time `json:"loaded"`
+	SHA256     string    `json:"sha256"`                // Digest of the loaded config, to tell versions apart.
+	RollbackOf int       `json:"rollback_of,omitempty"` // The version this one restored, if it's a rollback.
+	Current    bool      `json:"current"`
+}
+
+// configSnapshot is a loaded config, encoded so that it can be restored
+// without reading its files again.
+type configSnapshot struct {
+	ConfigVersion
+	data    []byte
+	sources []string
+}
+
+// configHistory holds the last configs loaded by a server, oldest first,
+// so that a bad reload can be rolled back. Its methods must be called with
+// the server's mu held.
+type configHistory struct {
+	size      int
+	next      int
+	snapshots []*configSnapshot
+}
+
+func newConfigHistory(size int) *configHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &configHistory{size: size, next: 1}
+}
+
+// Add records conf as the current config and returns its version. If conf
+// restores an earlier version, rollbackOf is its ID. Configs that can't be
+// encoded are logged and left out of the history.
+func (h *configHistory) Add(log zerolog.Logger, conf *Config, rollbackOf int) ConfigVersion {
+	if h == nil {
+		return ConfigVersion{}
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to record config version; it can't be rolled back to.")
+		return ConfigVersion{}
+	}
+	sum := sha256.Sum256(data)
+	for _, cs := range h.snapshots {
+		cs.Current = false
+	}
+	cs := &configSnapshot{
+		ConfigVersion: ConfigVersion{
+			ID:         h.next,
+			Loaded:     time.Now().UTC(),
+			SHA256:     hex.EncodeToString(sum[:]),
+			RollbackOf: rollbackOf,
+			Current:    true,
+		},
+		data:    data,
+		sources: append([]string(nil), conf.sources...),
+	}
+	h.next++
+	h.snapshots = append(h.snapshots, cs)
+	if len(h.snapshots) > h.size {
+		h.snapshots = append(h.snapshots[:0], h.snapshots[len(h.snapshots)-h.size:]...)
+	}
+	return cs.ConfigVersion
+}
+
+// Versions returns the versions in the history, oldest first.
+func (h *configHistory) Versions() []ConfigVersion {
+	if h == nil {
+		return []ConfigVersion{}
+	}
+	vs := make([]ConfigVersion, len(h.snapshots))
+	for i, cs := range h.snapshots {
+		vs[i] = cs.ConfigVersion
+	}
+	return vs
+}
+
+// Get returns the snapshot of the version id, or nil if it isn't in the
+// history.
+func (h *configHistory) Get(id int) *configSnapshot {
+	if h == nil {
+		return nil
+	}
+	for _, cs := range h.snapshots {
+		if cs.ID == id {
+			return cs
+		}
+	}
+	return nil
+}
+
+// decode returns the snapshot's config without validating it.
+func (cs *configSnapshot) decode() (*Config, error) {
+	var conf Config
+	if err := unmarshalStrict(cs.data, &conf); err != nil {
+		return nil, fmt.Errorf("error decoding config version %d: %w", cs.ID, err)
+	}
+	conf.sources = cs.sources
+	return &conf, nil
+}
+
+// restore returns the snapshot's config, validated. Queries read from
+// query files are kept, so that the files aren't read again.
+func (cs *configSnapshot) restore() (*Config, error) {
+	conf, err := cs.decode()
+	if err != nil {
+		return nil, err
+	}
+	for _, ed := range conf.Endpoints {
+		if ed == nil || ed.Query == nil {
+			continue
+		}
+		for _, sd := range ed.Query.Steps {
+			if sd != nil && sd.QueryFile != "" && sd.Query != "" {
+				sd.queryFromFile = true
+			}
+		}
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("config version %d failed validation: %w", cs.ID, err)
+	}
+	return conf, nil
+}
+
+// Rollback replaces the server's config with the version id from its
+// history, as a reload does, and records it as a new version.
+func (s *Server) Rollback(ctx context.Context, id int) (ConfigVersion, error) {
+	log := zerolog.Ctx(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := s.history.Get(id)
+	if cs == nil {
+		return ConfigVersion{}, errConfigVersionNotFound
+	} else if cs.Current {
+		return ConfigVersion{}, errConfigVersionCurrent
+	}
+	conf, err := cs.restore()
+	if err != nil {
+		return ConfigVersion{}, err
+	}
+	if err := s.swap(ctx, conf); err != nil {
+		return ConfigVersion{}, err
+	}
+	cv := s.history.Add(*log, conf, id)
+
+	log.Info().Int("version", id).Msg("Config rolled back.")
+	return cv, nil
+}
+
+// rollbackRequest asks the goroutine reloading the server's config to roll
+// it back to the version id, and receives the result on reply.
+type rollbackRequest struct {
+	id    int
+	reply chan rollbackResult
+}
+
+type rollbackResult struct {
+	version ConfigVersion
+	err     error
+}
+
+// RequestRollback rolls the server back to the version id, as Rollback
+// does, on the goroutine that reloads its config, so that the outboxes and
+// datasets of the restored config run for the server's lifetime rather
+// than ctx's. It returns when the rollback completes or ctx ends.
+func (s *Server) RequestRollback(ctx context.Context, id int) (ConfigVersion, error) {
+	rr := rollbackRequest{id: id, reply: make(chan rollbackResult, 1)}
+	select {
+	case s.rollbacks <- rr:
+	case <-ctx.Done():
+		return ConfigVersion{}, ctx.Err()
+	}
+	select {
+	case res := <-rr.reply:
+		return res.version, res.err
+	case <-ctx.Done():
+		return ConfigVersion{}, ctx.Err()
+	}
+}
+
+// ConfigVersions returns the versions of the configs the server has loaded,
+// oldest first.
+func (s *Server) ConfigVersions() []ConfigVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.history.Versions()
+}
+
+// configVersionParam returns the config version named by the id path
+// param, writing an error response if it isn't an integer.
+func configVersionParam(log zerolog.Logger, w http.ResponseWriter, ps httprouter.Params) (int, bool) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(log, w, http.StatusBadRequest, &errorResponse{Error: "invalid config version"})
+		return 0, false
+	}
+	return id, true
+}
+
+// adminGetConfigVersions lists the configs srv has loaded.
+func adminGetConfigVersions(srv *Server) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		writeJSON(log, w, http.StatusOK, srv.ConfigVersions())
+	}
+}
+
+// adminGetConfigVersion returns a config srv has loaded, with its secrets
+// redacted.
+func adminGetConfigVersion(srv *Server) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		id, ok := configVersionParam(log, w, ps)
+		if !ok {
+			return
+		}
+		srv.mu.Lock()
+		cs := srv.history.Get(id)
+		srv.mu.Unlock()
+		if cs == nil {
+			writeError(log, w, http.StatusNotFound, &errorResponse{Error: errConfigVersionNotFound.Error()})
+			return
+		}
+		conf, err := cs.decode()
+		if err == nil {
+			var data []byte
+			if data, err = redactJSON(conf, conf.StrictSecrets); err == nil {
+				writeJSON(log, w, http.StatusOK, json.RawMessage(data))
+				return
+			}
+		}
+		log.Error().Err(err).Int("version", id).Msg("Failed to encode config version.")
+		writeError(log, w, http.StatusInternalServerError, &errorResponse{Error: "config cannot be returned"})
+	}
+}
+
+// adminRollbackConfig rolls srv back to a config it has loaded.
+func adminRollbackConfig(srv *Server) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		id, ok := configVersionParam(log, w, ps)
+		if !ok {
+			return
+		}
+		cv, err := srv.RequestRollback(req.Context(), id)
+		switch {
+		case errors.Is(err, errConfigVersionNotFound):
+			writeError(log, w, http.StatusNotFound, &errorResponse{Error: err.Error()})
+		case errors.Is(err, errConfigVersionCurrent):
+			writeError(log, w, http.StatusConflict, &errorResponse{Error: err.Error()})
+		case err != nil:
+			log.Error().Err(err).Int("version", id).Msg("Failed to roll back config.")
+			writeError(log, w, http.StatusInternalServerError, &errorResponse{Error: "rollback failed: " + err.Error()})
+		default:
+			writeJSON(log, w, http.StatusOK, &cv)
+		}
+	}
+}
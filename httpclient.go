@@ -0,0 +1,233 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// noProxy is the proxy of HTTP clients that connect directly, ignoring the
+// proxy environment variables.
+const noProxy = "none"
+
+// HTTPClientDef configures the client of outbound HTTP requests, such as
+// those of http steps and outbox webhooks. The config's http_client applies
+// to requests that don't name a client of their own, and its settings are
+// the defaults of named clients in http_clients.
+type HTTPClientDef struct {
+	// Proxy is the URL of the proxy requests are sent through, such as
+	// http://proxy.internal:3128. If empty, the HTTP_PROXY, HTTPS_PROXY,
+	// and NO_PROXY environment variables are used. If "none", requests
+	// are never proxied.
+	Proxy string `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	// CAFile is a PEM bundle of certificate authorities to trust in
+	// addition to the system's, such as a private CA.
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile are a PEM client certificate and its key,
+	// presented to servers that ask for one.
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+
+	Timeout             Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`                                 // Time for a whole request, including its response body. If 0, there is no limit.
+	DialTimeout         Duration `json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`                       // Defaults to 30s.
+	TLSHandshakeTimeout Duration `json:"tls_handshake_timeout,omitempty" yaml:"tls_handshake_timeout,omitempty"`     // Defaults to 10s.
+	IdleConnTimeout     Duration `json:"idle_conn_timeout,omitempty" yaml:"idle_conn_timeout,omitempty"`             // Defaults to 90s.
+	MaxIdleConns        int      `json:"max_idle_conns,omitempty" yaml:"max_idle_conns,omitempty"`                   // Defaults to 100.
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host,omitempty" yaml:"max_idle_conns_per_host,omitempty"` // Defaults to 2.
+	MaxConnsPerHost     int      `json:"max_conns_per_host,omitempty" yaml:"max_conns_per_host,omitempty"`           // If 0, there is no limit.
+
+	client *http.Client
+}
+
+// Validate checks the client's settings, with unset ones taken from base if
+// it's not nil, and builds the client.
+func (hd *HTTPClientDef) Validate(base *HTTPClientDef) error {
+	if hd == nil {
+		return errors.New("http client definition is nil")
+	}
+	eff := *hd
+	if base != nil {
+		eff.inherit(base)
+	}
+	var me *multierror.Error
+	if (eff.CertFile == "") != (eff.KeyFile == "") {
+		me = multierror.Append(me, errors.New("cert_file and key_file must be set together"))
+	}
+	for _, d := range []struct {
+		name string
+		d    Duration
+	}{
+		{"timeout", eff.Timeout},
+		{"dial_timeout", eff.DialTimeout},
+		{"tls_handshake_timeout", eff.TLSHandshakeTimeout},
+		{"idle_conn_timeout", eff.IdleConnTimeout},
+	} {
+		if d.d.Duration < 0 {
+			me = multierror.Append(me, fmt.Errorf("%s must not be negative", d.name))
+		}
+	}
+	if eff.MaxIdleConns < 0 || eff.MaxIdleConnsPerHost < 0 || eff.MaxConnsPerHost < 0 {
+		me = multierror.Append(me, errors.New("connection limits must not be negative"))
+	}
+	if err := errorOrNil(me); err != nil {
+		return err
+	}
+	client, err := eff.newClient()
+	if err != nil {
+		return err
+	}
+	hd.client = client
+	return nil
+}
+
+// inherit sets the unset fields of hd to those of base.
+func (hd *HTTPClientDef) inherit(base *HTTPClientDef) {
+	if hd.Proxy == "" {
+		hd.Proxy = base.Proxy
+	}
+	if hd.CAFile == "" {
+		hd.CAFile = base.CAFile
+	}
+	if hd.CertFile == "" && hd.KeyFile == "" {
+		hd.CertFile, hd.KeyFile = base.CertFile, base.KeyFile
+	}
+	for _, d := range []struct{ dst, src *Duration }{
+		{&hd.Timeout, &base.Timeout},
+		{&hd.DialTimeout, &base.DialTimeout},
+		{&hd.TLSHandshakeTimeout, &base.TLSHandshakeTimeout},
+		{&hd.IdleConnTimeout, &base.IdleConnTimeout},
+	} {
+		if d.dst.Duration == 0 {
+			*d.dst = *d.src
+		}
+	}
+	for _, n := range []struct{ dst, src *int }{
+		{&hd.MaxIdleConns, &base.MaxIdleConns},
+		{&hd.MaxIdleConnsPerHost, &base.MaxIdleConnsPerHost},
+		{&hd.MaxConnsPerHost, &base.MaxConnsPerHost},
+	} {
+		if *n.dst == 0 {
+			*n.dst = *n.src
+		}
+	}
+}
+
+// newClient builds an HTTP client from the settings of hd. Unset settings
+// keep the defaults of http.DefaultTransport.
+func (hd *HTTPClientDef) newClient() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	switch hd.Proxy {
+	case "":
+	case noProxy:
+		tr.Proxy = nil
+	default:
+		u, err := url.Parse(hd.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", redactURLError(err))
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	if hd.CAFile != "" || hd.CertFile != "" {
+		conf := &tls.Config{MinVersion: tls.VersionTLS12}
+		if hd.CAFile != "" {
+			pem, err := os.ReadFile(hd.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading ca_file: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("ca_file %s holds no certificates", hd.CAFile)
+			}
+			conf.RootCAs = pool
+		}
+		if hd.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(hd.CertFile, hd.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client certificate: %w", err)
+			}
+			conf.Certificates = []tls.Certificate{cert}
+		}
+		tr.TLSClientConfig = conf
+	}
+
+	if d := hd.DialTimeout.Duration; d > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: d, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if d := hd.TLSHandshakeTimeout.Duration; d > 0 {
+		tr.TLSHandshakeTimeout = d
+	}
+	if d := hd.IdleConnTimeout.Duration; d > 0 {
+		tr.IdleConnTimeout = d
+	}
+	if hd.MaxIdleConns > 0 {
+		tr.MaxIdleConns = hd.MaxIdleConns
+	}
+	if hd.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = hd.MaxIdleConnsPerHost
+	}
+	tr.MaxConnsPerHost = hd.MaxConnsPerHost
+	return &http.Client{Transport: tr, Timeout: hd.Timeout.Duration}, nil
+}
+
+// httpClient returns the client of outbound requests naming the client
+// name, or the config's http_client if name is empty. It returns false if
+// name isn't defined. Requests fall back to http.DefaultClient if no client
+// is configured or the client failed validation.
+func (c *Config) httpClient(name string) (*http.Client, bool) {
+	hd := c.HTTPClient
+	if name != "" {
+		var ok bool
+		if hd, ok = c.HTTPClients[name]; !ok {
+			return nil, false
+		}
+	}
+	if hd == nil || hd.client == nil {
+		return http.DefaultClient, true
+	}
+	return hd.client, true
+}
+
+// closeHTTPClients closes the idle connections of the HTTP clients of
+// conf, once they're no longer used for new requests.
+func closeHTTPClients(conf *Config) {
+	if conf.HTTPClient != nil && conf.HTTPClient.client != nil {
+		conf.HTTPClient.client.CloseIdleConnections()
+	}
+	for _, hd := range conf.HTTPClients {
+		if hd != nil && hd.client != nil {
+			hd.client.CloseIdleConnections()
+		}
+	}
+}
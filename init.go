@@ -0,0 +1,262 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// initDatabaseURL is the database URL of configs written by init
+	// without -d.
+	initDatabaseURL = "${DATABASE_URL:-sqlite://app.db}"
+	// initPasswordVar is the environment variable the configs written by
+	// init read the password of the database from, if -d has one.
+	initPasswordVar = "DATABASE_PASSWORD"
+)
+
+// initTemplate is the config written by init, as HuJSON so that it can
+// explain itself with comments. Trailing commas are allowed.
+var initTemplate = template.Must(template.New("init").Funcs(template.FuncMap{
+	"json": initJSON,
+}).Parse(`// Config written by chisel init. Serve it with:
+//
+//     chisel -c {{ .Path }}
+//
+// This file is HuJSON: JSON with comments and trailing commas. See the
+// README for every option.
+{
+  // The version of the config format.
+  "version": {{ .Version }},
+
+  // Addresses to serve endpoints on.
+  "bind": ["127.0.0.1:8080"],
+
+  // Databases, by name. Values may refer to environment variables as
+  // ${VAR}, or ${VAR:-default}, to keep secrets out of this file.
+  "databases": {
+    {{ json .DB }}: {
+      "url": {{ json .URL }},
+    },
+  },
+
+  "endpoints": [
+{{- range $i, $e := .Endpoints }}
+    // {{ .Comment }}
+    {
+      "method": "GET",
+      "path": {{ json .Path }},
+      "query": {
+{{- if not $i }}
+        // Transactions group the steps' statements; each names the
+        // database it runs against.
+{{- end }}
+        "transactions": [{"name": "main", "db": {{ json $.DB }}}],
+{{- if not $i }}
+        // Steps run in order. Args fill the query's ? placeholders
+        // from the request, such as .params.query for its query string.
+{{- end }}
+        "steps": [
+          {
+            "query": {{ json .Query }},
+{{- if .Args }}
+            "args": [
+{{- range .Args }}
+              {{ json . }},
+{{- end }}
+            ],
+{{- end }}
+{{- if not $i }}
+            // jq filters applied to the step's rows, in order.
+{{- end }}
+            "map": [{{ json .Map }}],
+          },
+        ],
+      },
+    },
+{{- end }}
+  ],
+}
+`))
+
+// initEndpoint is an endpoint of a config written by init.
+type initEndpoint struct {
+	Comment string
+	Path    string
+	Query   string
+	Args    []interface{}
+	Map     string
+}
+
+// initJSON returns v as JSON, without escaping HTML characters, so that jq
+// expressions stay readable.
+func initJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Init implements the init subcommand, which writes an example config to
+// start a project from. With -d, it has an endpoint listing the rows of each
+// of the database's tables.
+func Init(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	var (
+		dbURL  string
+		dbName = "main"
+		tables string
+		output = "config.json"
+		force  bool
+	)
+	fs.StringVar(&dbURL, "d", dbURL, "The database `url` to seed endpoints from. If unset, the config has a single example endpoint.")
+	fs.StringVar(&dbName, "n", dbName, "The `name` of the database in the config.")
+	fs.StringVar(&tables, "t", tables, "A comma-separated `list` of tables to write endpoints for. Defaults to all tables.")
+	fs.StringVar(&output, "o", output, "The `path` to write the config to, or - for standard output.")
+	fs.BoolVar(&force, "force", force, "Overwrite the output file if it exists.")
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	} else if err != nil {
+		return 1
+	}
+
+	log := zerolog.New(fs.Output()).With().Timestamp().Logger()
+	if output != "-" && !force {
+		if _, err := os.Stat(output); err == nil {
+			log.Error().Str("path", output).Msg("Config file already exists. Use -force to overwrite it.")
+			return 1
+		}
+	}
+
+	confURL := initDatabaseURL
+	endpoints := []initEndpoint{{
+		Comment: "GET /ping responds with {\"message\": \"pong\"}.",
+		Path:    "/ping",
+		Query:   "SELECT 'pong' AS message",
+		Map:     ".[0]",
+	}}
+	if dbURL != "" {
+		schema, ok := scaffoldSchema(ctx, log, dbURL, tables)
+		if !ok {
+			return 1
+		}
+		if len(schema) == 0 {
+			log.Error().Msg("Database has no tables to write endpoints for.")
+			return 1
+		}
+		if confURL, err = initConfigURL(dbURL); err != nil {
+			log.Error().Err(err).Msg("Failed to parse database URL.")
+			return 1
+		}
+		endpoints = initTableEndpoints(schema)
+	}
+
+	path := output
+	if path == "-" {
+		path = "config.json"
+	}
+	var buf bytes.Buffer
+	err = initTemplate.Execute(&buf, map[string]interface{}{
+		"Path":      path,
+		"Version":   currentConfigVersion,
+		"DB":        dbName,
+		"URL":       confURL,
+		"Endpoints": endpoints,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to write config.")
+		return 1
+	}
+
+	// Check the config before writing it.
+	var check Config
+	if err := unmarshalStrict(buf.Bytes(), &check); err != nil {
+		log.Error().Err(err).Msg("Generated config could not be parsed.")
+		return 1
+	}
+	if err := check.Validate(); err != nil {
+		log.Error().Err(err).Msg("Generated config is invalid.")
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create config file.")
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Error().Err(err).Msg("Failed to write config.")
+		return 1
+	}
+	return 0
+}
+
+// initConfigURL returns dbURL with its password, if any, replaced by a
+// reference to the initPasswordVar environment variable, so that it isn't
+// written to the config.
+func initConfigURL(dbURL string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", redactURLError(err)
+	}
+	if _, ok := u.User.Password(); !ok {
+		return dbURL, nil
+	}
+	// Braces would be escaped in the URL's user info, so the reference
+	// replaces a placeholder.
+	const placeholder = "CHISEL_INIT_PASSWORD"
+	u.User = url.UserPassword(u.User.Username(), placeholder)
+	return strings.Replace(u.String(), placeholder, "${"+initPasswordVar+"}", 1), nil
+}
+
+// initTableEndpoints returns an endpoint listing the rows of each table of
+// schema, a page at a time.
+func initTableEndpoints(schema []*scaffoldTable) []initEndpoint {
+	sort.Slice(schema, func(i, j int) bool { return schema[i].Name < schema[j].Name })
+	endpoints := make([]initEndpoint, 0, len(schema))
+	for _, t := range schema {
+		query, args := scaffoldList(t)
+		endpoints = append(endpoints, initEndpoint{
+			Comment: "GET /" + t.Name + "?limit=100&offset=0 lists the rows of " + t.Name + ".",
+			Path:    "/" + t.Name,
+			Query:   query,
+			Args:    args,
+			Map:     "{ data: . }",
+		})
+	}
+	return endpoints
+}
@@ -0,0 +1,202 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const jsonAPIContentType = "application/vnd.api+json"
+
+var errNotJSONAPI = errors.New("response must be null, an object, or a list of objects")
+
+// JSONAPIDef shapes an endpoint's response as a JSON:API document. Each
+// object of the response becomes a resource object of Type, with its ID
+// taken from the ID field and its relationships from the fields named by
+// Relationships. The remaining fields are its attributes.
+type JSONAPIDef struct {
+	Type string `json:"type" yaml:"type"`
+	ID   string `json:"id,omitempty" yaml:"id,omitempty"` // Defaults to id.
+	// Attributes lists the fields that are attributes. If empty, every
+	// field other than the ID and relationships is an attribute.
+	Attributes    []string                           `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	Relationships map[string]*JSONAPIRelationshipDef `json:"relationships,omitempty" yaml:"relationships,omitempty"`
+
+	relNames []string // Relationship names, sorted.
+}
+
+// JSONAPIRelationshipDef is a relationship of a JSON:API resource. Its
+// field holds the ID of the related resource, a list of IDs for to-many
+// relationships, or null.
+type JSONAPIRelationshipDef struct {
+	Type  string `json:"type" yaml:"type"`
+	Field string `json:"field,omitempty" yaml:"field,omitempty"` // Defaults to the relationship's name.
+}
+
+func (jd *JSONAPIDef) Validate() error {
+	var me *multierror.Error
+	if jd.Type == "" {
+		me = multierror.Append(me, errors.New("type is required"))
+	}
+	if jd.ID == "" {
+		jd.ID = "id"
+	}
+	seen := map[string]bool{}
+	for _, attr := range jd.Attributes {
+		switch {
+		case attr == jd.ID:
+			me = multierror.Append(me, fmt.Errorf("attribute %q is the id field", attr))
+		case seen[attr]:
+			me = multierror.Append(me, fmt.Errorf("attribute %q is listed more than once", attr))
+		}
+		seen[attr] = true
+	}
+	jd.relNames = jd.relNames[:0]
+	for name, rd := range jd.Relationships {
+		if rd == nil {
+			me = multierror.Append(me, fmt.Errorf("relationship %q is empty", name))
+			continue
+		}
+		if rd.Type == "" {
+			me = multierror.Append(me, fmt.Errorf("relationship %q: type is required", name))
+		}
+		if rd.Field == "" {
+			rd.Field = name
+		}
+		if seen[name] {
+			me = multierror.Append(me, fmt.Errorf("relationship %q is also an attribute", name))
+		}
+		jd.relNames = append(jd.relNames, name)
+	}
+	sort.Strings(jd.relNames)
+	return errorOrNil(me)
+}
+
+// Document returns out as a JSON:API document. An object becomes a single
+// resource, and a list of objects a list of resources.
+func (jd *JSONAPIDef) Document(out interface{}) (map[string]interface{}, error) {
+	switch out := out.(type) {
+	case nil:
+		return map[string]interface{}{"data": nil}, nil
+	case map[string]interface{}:
+		res, err := jd.resource(out)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"data": res}, nil
+	case []interface{}:
+		data := make([]interface{}, len(out))
+		for i, v := range out {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errNotJSONAPI
+			}
+			res, err := jd.resource(obj)
+			if err != nil {
+				return nil, fmt.Errorf("resource %d: %w", i, err)
+			}
+			data[i] = res
+		}
+		return map[string]interface{}{"data": data}, nil
+	default:
+		return nil, errNotJSONAPI
+	}
+}
+
+// resource returns obj as a resource object.
+func (jd *JSONAPIDef) resource(obj map[string]interface{}) (map[string]interface{}, error) {
+	id, err := jsonAPIID(obj[jd.ID])
+	if err != nil {
+		return nil, fmt.Errorf("id field %q: %w", jd.ID, err)
+	}
+
+	res := map[string]interface{}{"type": jd.Type, "id": id}
+	relFields := make(map[string]bool, len(jd.relNames))
+	if len(jd.relNames) > 0 {
+		rels := make(map[string]interface{}, len(jd.relNames))
+		for _, name := range jd.relNames {
+			rd := jd.Relationships[name]
+			relFields[rd.Field] = true
+			data, err := rd.linkage(obj[rd.Field])
+			if err != nil {
+				return nil, fmt.Errorf("relationship %q: %w", name, err)
+			}
+			rels[name] = map[string]interface{}{"data": data}
+		}
+		res["relationships"] = rels
+	}
+
+	attrs := make(map[string]interface{}, len(obj))
+	if len(jd.Attributes) > 0 {
+		for _, name := range jd.Attributes {
+			if v, ok := obj[name]; ok {
+				attrs[name] = v
+			}
+		}
+	} else {
+		for k, v := range obj {
+			if k != jd.ID && !relFields[k] {
+				attrs[k] = v
+			}
+		}
+	}
+	if len(attrs) > 0 {
+		res["attributes"] = attrs
+	}
+	return res, nil
+}
+
+// linkage returns the resource linkage of the relationship for v, the
+// value of its field: null, a resource identifier, or a list of them.
+func (rd *JSONAPIRelationshipDef) linkage(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		ids := make([]interface{}, len(v))
+		for i, iv := range v {
+			id, err := jsonAPIID(iv)
+			if err != nil {
+				return nil, err
+			}
+			ids[i] = map[string]interface{}{"type": rd.Type, "id": id}
+		}
+		return ids, nil
+	default:
+		id, err := jsonAPIID(v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": rd.Type, "id": id}, nil
+	}
+}
+
+// jsonAPIID returns v as a resource ID, which JSON:API requires to be a
+// string. Numbers are formatted as strings.
+func jsonAPIID(v interface{}) (string, error) {
+	switch v.(type) {
+	case nil:
+		return "", errors.New("missing or null id")
+	case map[string]interface{}, []interface{}, bool:
+		return "", fmt.Errorf("id must be a string or number, got %T", v)
+	}
+	id, _ := opaqueString(v)
+	return id, nil
+}
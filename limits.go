@@ -0,0 +1,244 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"go.spiff.io/sql/vdb"
+)
+
+// maxLimitsEntries is the most clients whose limits a LimitsDef caches.
+const maxLimitsEntries = 10000
+
+// LimitsDef loads the limits of a rate_limit or quota middleware for each
+// client from a database, so that clients on different plans can have
+// different limits without a config change. Query is run with the value the
+// middleware limits requests by, such as the principal's name, as its only
+// arg, and returns at most one row of limits. Clients without a row get the
+// middleware's own limits. Rows are cached for TTL.
+type LimitsDef struct {
+	DB      string   `json:"db" yaml:"db"`
+	Query   string   `json:"query" yaml:"query"`
+	TTL     Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`         // Defaults to 1m.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"` // Defaults to 5s.
+
+	db *Database // Set by bindLimits.
+
+	mu      sync.Mutex
+	entries map[string]limitsEntry
+}
+
+// limitsEntry is the cached row of limits for a client, or nil if the
+// client has none.
+type limitsEntry struct {
+	row     map[string]interface{}
+	expires time.Time
+}
+
+func (ld *LimitsDef) Validate() error {
+	var me *multierror.Error
+	if ld.DB == "" {
+		me = multierror.Append(me, errors.New("db is empty"))
+	}
+	if ld.Query == "" {
+		me = multierror.Append(me, errors.New("query is empty"))
+	}
+	if ld.TTL.Duration < 0 {
+		me = multierror.Append(me, errors.New("ttl must not be negative"))
+	} else if ld.TTL.Duration == 0 {
+		ld.TTL.Duration = time.Minute
+	}
+	if ld.Timeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("timeout must not be negative"))
+	} else if ld.Timeout.Duration == 0 {
+		ld.Timeout.Duration = 5 * time.Second
+	}
+	return errorOrNil(me)
+}
+
+// Lookup returns the row of limits for the client key, or nil if it has
+// none.
+func (ld *LimitsDef) Lookup(ctx context.Context, key string) (map[string]interface{}, error) {
+	now := time.Now()
+	ld.mu.Lock()
+	e, ok := ld.entries[key]
+	ld.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.row, nil
+	}
+
+	row, err := ld.query(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	if ld.entries == nil {
+		ld.entries = map[string]limitsEntry{}
+	}
+	if _, ok := ld.entries[key]; !ok && len(ld.entries) >= maxLimitsEntries {
+		for k, e := range ld.entries {
+			if now.After(e.expires) {
+				delete(ld.entries, k)
+			}
+		}
+		for k := range ld.entries {
+			if len(ld.entries) < maxLimitsEntries {
+				break
+			}
+			delete(ld.entries, k)
+		}
+	}
+	ld.entries[key] = limitsEntry{row: row, expires: now.Add(ld.TTL.Duration)}
+	return row, nil
+}
+
+// query runs the limits query for the client key.
+func (ld *LimitsDef) query(ctx context.Context, key string) (map[string]interface{}, error) {
+	if ld.db == nil {
+		return nil, fmt.Errorf("database %q is not open", ld.DB)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ld.Timeout.Duration)
+	defer cancel()
+
+	rows, err := ld.db.db.QueryContext(ctx, ld.Query, key)
+	if err != nil {
+		return nil, fmt.Errorf("error querying limits: %w", err)
+	}
+	defer rows.Close()
+	var numerics []string
+	if ld.db.Options.Numeric == NumberNumericFormat {
+		numerics = numericColumns(rows)
+	}
+	results, err := vdb.ScanRows(ctx, rows, ld.db.options)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning limits: %w", err)
+	}
+	res := results.Opaque()
+	if len(numerics) > 0 {
+		convertNumerics(res, numerics)
+	}
+	list, _ := res.([]interface{})
+	switch len(list) {
+	case 0:
+		return nil, nil
+	case 1:
+		row, _ := list[0].(map[string]interface{})
+		return row, nil
+	default:
+		return nil, fmt.Errorf("limits query returned %d rows, expected at most 1", len(list))
+	}
+}
+
+// limits returns the limits def of a rate_limit or quota middleware, or nil
+// if it has none.
+func (md *MiddlewareDef) limits() *LimitsDef {
+	if md == nil {
+		return nil
+	}
+	switch m := md.Middleware.(type) {
+	case *RateLimitMiddleware:
+		return m.Limits
+	case *QuotaMiddleware:
+		return m.Limits
+	}
+	return nil
+}
+
+// quota returns md's middleware if it's a quota middleware, or nil.
+func (md *MiddlewareDef) quota() *QuotaMiddleware {
+	if md == nil {
+		return nil
+	}
+	qm, _ := md.Middleware.(*QuotaMiddleware)
+	return qm
+}
+
+// bindLimits gives the limits defs and quota tables of conf's middleware
+// their databases.
+func bindLimits(conf *Config, dbs Databases) {
+	for _, md := range conf.Middleware {
+		if ld := md.limits(); ld != nil {
+			ld.db = dbs[ld.DB]
+		}
+		if qm := md.quota(); qm != nil && qm.DB != "" {
+			qm.db = dbs[qm.DB]
+		}
+	}
+}
+
+// requestKey returns the value a request is limited by for key, the key of
+// a rate_limit or quota middleware: the client IP for "ip", the name of the
+// principal for "principal", or the value of the header NAME for
+// "header:NAME". It returns false if the request has none.
+func requestKey(key string, req *http.Request) (string, bool) {
+	switch key {
+	case "ip":
+		return clientIP(req), true
+	case "principal":
+		p := principalFromContext(req.Context())
+		if p == nil {
+			return "", false
+		}
+		return p.Name, true
+	default:
+		v := req.Header.Get(strings.TrimPrefix(key, "header:"))
+		return v, v != ""
+	}
+}
+
+// limitedKey returns the name of the count or bucket of the value a request
+// is limited by for key, such as "ip:127.0.0.1".
+func limitedKey(key, value string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		key = key[:i]
+	}
+	return key + ":" + value
+}
+
+// validRequestKey returns whether key is a key requestKey accepts.
+func validRequestKey(key string) bool {
+	switch {
+	case key == "ip", key == "principal":
+		return true
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		return true
+	}
+	return false
+}
+
+// limitFloat returns v, a value of a limits row, as a float.
+func limitFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	i, ok := opaqueInt(v)
+	return float64(i), ok
+}
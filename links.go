@@ -0,0 +1,257 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/itchyny/gojq"
+)
+
+// LinksDef defines named link templates for building links in responses
+// with the link() function, and the external base URL that links are
+// relative to.
+type LinksDef struct {
+	// BaseURL is the base URL of links, such as https://api.example.com/v1.
+	// If empty, the external base URL of the request is used.
+	BaseURL string `json:"base_url,omitempty" yaml:"base_url,omitempty"`
+	// Templates maps link names to paths (or absolute URLs) with {name}
+	// placeholders, such as /builds/{id}.
+	Templates map[string]string `json:"templates,omitempty" yaml:"templates,omitempty"`
+
+	opaque map[string]interface{}
+}
+
+func (ld *LinksDef) Validate() error {
+	var me *multierror.Error
+	if ld.BaseURL != "" {
+		u, err := url.Parse(ld.BaseURL)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("invalid base_url: %w", err))
+		} else if u.Scheme == "" || u.Host == "" {
+			me = multierror.Append(me, fmt.Errorf("base_url %q is not an absolute URL", ld.BaseURL))
+		}
+	}
+	templates := make(map[string]interface{}, len(ld.Templates))
+	for name, tmpl := range ld.Templates {
+		if _, err := linkPlaceholders(tmpl); err != nil {
+			me = multierror.Append(me, fmt.Errorf("template %q: %w", name, err))
+		}
+		templates[name] = tmpl
+	}
+	ld.opaque = map[string]interface{}{
+		"base_url":  ld.BaseURL,
+		"templates": templates,
+	}
+	return errorOrNil(me)
+}
+
+// Opaque returns the links as they're passed to link() in $context.links.
+func (ld *LinksDef) Opaque() map[string]interface{} {
+	if ld == nil {
+		return nil
+	}
+	return ld.opaque
+}
+
+// linkPlaceholders returns the names of the {name} placeholders of a link
+// template.
+func linkPlaceholders(tmpl string) ([]string, error) {
+	var names []string
+	for rest := tmpl; ; {
+		i := strings.IndexAny(rest, "{}")
+		if i == -1 {
+			return names, nil
+		}
+		if rest[i] == '}' {
+			return nil, errors.New("unbalanced '}'")
+		}
+		rest = rest[i+1:]
+		j := strings.IndexAny(rest, "{}")
+		if j == -1 || rest[j] == '{' {
+			return nil, errors.New("unterminated placeholder")
+		}
+		if j == 0 {
+			return nil, errors.New("empty placeholder")
+		}
+		names = append(names, rest[:j])
+		rest = rest[j+1:]
+	}
+}
+
+// linkPrelude defines link/1 and link/2 for every expression. They pass
+// $context to _link, since functions defined in Go can't see variables.
+var linkPrelude = mustParseQuery(`def link($name): _link($name; {}; $context); def link($name; $params): _link($name; $params; $context); .`)
+
+func mustParseQuery(src string) *gojq.Query {
+	q, err := gojq.Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// withLinkFuncs returns q with the link functions defined before its own.
+func withLinkFuncs(q *gojq.Query) *gojq.Query {
+	dup := *q
+	dup.FuncDefs = append(append([]*gojq.FuncDef(nil), linkPrelude.FuncDefs...), q.FuncDefs...)
+	return &dup
+}
+
+// gojqLink implements _link(name; params; $context). Name is either the name
+// of a link template or a path, which must start with a '/'. Placeholders
+// are filled in from params, and params that aren't placeholders are added
+// to the query string, except those that are null. The link is resolved
+// against the configured base URL, or the request's external base URL if
+// there isn't one.
+func gojqLink(_ interface{}, args []interface{}) interface{} {
+	name, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("link: name must be a string, got %T", args[0])
+	}
+	params, ok := args[1].(map[string]interface{})
+	if !ok && args[1] != nil {
+		return fmt.Errorf("link: params must be an object, got %T", args[1])
+	}
+	ctxVar, _ := args[2].(map[string]interface{})
+	links, _ := ctxVar["links"].(map[string]interface{})
+
+	tmpl := name
+	if !strings.HasPrefix(name, "/") {
+		templates, _ := links["templates"].(map[string]interface{})
+		if tmpl, ok = templates[name].(string); !ok {
+			return fmt.Errorf("link: undefined link template %q", name)
+		}
+	}
+
+	link, err := expandLink(tmpl, params)
+	if err != nil {
+		return fmt.Errorf("link %q: %w", name, err)
+	}
+	if !strings.HasPrefix(link, "/") {
+		// Templates may be absolute URLs.
+		return link
+	}
+
+	base, _ := links["base_url"].(string)
+	if base == "" {
+		req, _ := ctxVar["request"].(map[string]interface{})
+		if base, _ = req["base_url"].(string); base == "" {
+			return fmt.Errorf("link %q: no base_url is configured and the request's is unknown", name)
+		}
+	}
+	return strings.TrimRight(base, "/") + link
+}
+
+// expandLink fills in the placeholders of a link template. Values are
+// escaped for the part of the URL they're in.
+func expandLink(tmpl string, params map[string]interface{}) (string, error) {
+	used := map[string]bool{}
+	var sb strings.Builder
+	inQuery := false
+	for rest := tmpl; rest != ""; {
+		i := strings.IndexByte(rest, '{')
+		if i == -1 {
+			sb.WriteString(rest)
+			inQuery = inQuery || strings.Contains(rest, "?")
+			break
+		}
+		sb.WriteString(rest[:i])
+		inQuery = inQuery || strings.Contains(rest[:i], "?")
+		j := strings.IndexByte(rest[i:], '}')
+		if j == -1 {
+			return "", errors.New("unterminated placeholder")
+		}
+		key := rest[i+1 : i+j]
+		rest = rest[i+j+1:]
+
+		v, ok := params[key]
+		if !ok || v == nil {
+			return "", fmt.Errorf("missing param %q", key)
+		}
+		s, err := linkParam(v)
+		if err != nil {
+			return "", fmt.Errorf("param %q: %w", key, err)
+		}
+		used[key] = true
+		if inQuery {
+			sb.WriteString(url.QueryEscape(s))
+		} else {
+			sb.WriteString(url.PathEscape(s))
+		}
+	}
+
+	extra := url.Values{}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if used[k] || params[k] == nil {
+			continue
+		}
+		values, ok := params[k].([]interface{})
+		if !ok {
+			values = []interface{}{params[k]}
+		}
+		for _, v := range values {
+			s, err := linkParam(v)
+			if err != nil {
+				return "", fmt.Errorf("param %q: %w", k, err)
+			}
+			extra.Add(k, s)
+		}
+	}
+	link := sb.String()
+	if len(extra) > 0 {
+		sep := "?"
+		if inQuery {
+			sep = "&"
+		}
+		link += sep + extra.Encode()
+	}
+	return link, nil
+}
+
+// linkParam formats a param value for a link.
+func linkParam(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case *big.Int:
+		return v.String(), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return strconv.FormatInt(int64(v), 10), nil
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
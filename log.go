@@ -0,0 +1,280 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+type LogFormat int
+
+const (
+	JSONLogFormat    LogFormat = iota // json - Default
+	ConsoleLogFormat                  // console
+)
+
+func (f LogFormat) MarshalText() ([]byte, error) {
+	typ := "json"
+	switch f {
+	case JSONLogFormat:
+	case ConsoleLogFormat:
+		typ = "console"
+	default:
+		return nil, fmt.Errorf("unrecognized log format %d", f)
+	}
+	return []byte(typ), nil
+}
+
+func (f *LogFormat) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "json":
+		*f = JSONLogFormat
+	case "console":
+		*f = ConsoleLogFormat
+	default:
+		return fmt.Errorf("unrecognized log format %q", src)
+	}
+	return nil
+}
+
+// LogDef configures where logs are written and how they're formatted.
+type LogDef struct {
+	Level  string        `json:"level,omitempty" yaml:"level,omitempty"`
+	Format LogFormat     `json:"format" yaml:"format"`
+	Output *LogOutputDef `json:"output,omitempty" yaml:"output,omitempty"`
+	// ErrorOutput, if set, receives all logs at error level and above
+	// instead of Output.
+	ErrorOutput *LogOutputDef `json:"error_output,omitempty" yaml:"error_output,omitempty"`
+
+	level zerolog.Level
+}
+
+func (ld *LogDef) Validate() error {
+	var me *multierror.Error
+	ld.level = zerolog.InfoLevel
+	if ld.Level != "" {
+		lev, err := zerolog.ParseLevel(ld.Level)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("invalid level: %w", err))
+		}
+		ld.level = lev
+	}
+	if ld.Output != nil {
+		if err := ld.Output.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("output failed validation: %w", err))
+		}
+	}
+	if ld.ErrorOutput != nil {
+		if err := ld.ErrorOutput.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("error_output failed validation: %w", err))
+		}
+	}
+	return errorOrNil(me)
+}
+
+// Writer opens the log outputs and returns a writer for them. The returned
+// io.Closer closes all outputs opened by the writer.
+func (ld *LogDef) Writer() (zerolog.LevelWriter, io.Closer, error) {
+	var closers multiCloser
+	open := func(od *LogOutputDef) (zerolog.LevelWriter, error) {
+		if od == nil {
+			od = &LogOutputDef{Type: "stderr"}
+		}
+		w, c, err := od.Open()
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			closers = append(closers, c)
+		}
+		if ld.Format == ConsoleLogFormat {
+			w = consoleLevelWriter{w}
+		}
+		return w, nil
+	}
+
+	out, err := open(ld.Output)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening log output: %w", err)
+	}
+
+	lr := levelRouter{out: out}
+	if ld.ErrorOutput != nil {
+		lr.errs, err = open(ld.ErrorOutput)
+		if err != nil {
+			_ = closers.Close()
+			return nil, nil, fmt.Errorf("error opening error log output: %w", err)
+		}
+	}
+
+	return lr, closers, nil
+}
+
+// LogOutputDef is a log destination. It may be given as a string naming
+// the output type when no other options are needed.
+type LogOutputDef struct {
+	Type string `json:"type" yaml:"type"`                     // stderr (default), stdout, file, syslog, or journald.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"` // Path to the log file.
+	// Address is the syslog server address, as network://host:port. If
+	// empty, the local syslog server is used.
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+	Tag     string `json:"tag,omitempty" yaml:"tag,omitempty"` // Syslog tag or journald identifier.
+}
+
+type logOutputDef LogOutputDef
+
+func (od *LogOutputDef) UnmarshalJSON(src []byte) error {
+	var typ string
+	if unmarshalStrict(src, &typ) == nil {
+		*od = LogOutputDef{Type: typ}
+		return nil
+	}
+	var def logOutputDef
+	if err := unmarshalStrict(src, &def); err != nil {
+		return err
+	}
+	*od = LogOutputDef(def)
+	return nil
+}
+
+func (od *LogOutputDef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*od = LogOutputDef{}
+		return node.Decode(&od.Type)
+	}
+	var def logOutputDef
+	if err := decodeNodeStrict(node, &def); err != nil {
+		return err
+	}
+	*od = LogOutputDef(def)
+	return nil
+}
+
+func (od *LogOutputDef) Validate() error {
+	if od.Tag == "" {
+		od.Tag = "chisel"
+	}
+	switch od.Type {
+	case "":
+		od.Type = "stderr"
+	case "stderr", "stdout", "syslog", "journald":
+	case "file":
+		if od.Path == "" {
+			return errors.New("file output requires a path")
+		}
+	default:
+		return fmt.Errorf("unrecognized log output type %q", od.Type)
+	}
+	return nil
+}
+
+// Open opens the log output. If the output needs to be closed, it returns
+// a non-nil io.Closer.
+func (od *LogOutputDef) Open() (zerolog.LevelWriter, io.Closer, error) {
+	switch od.Type {
+	case "", "stderr":
+		return zerolog.MultiLevelWriter(os.Stderr), nil, nil
+	case "stdout":
+		return zerolog.MultiLevelWriter(os.Stdout), nil, nil
+	case "file":
+		f, err := os.OpenFile(od.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zerolog.MultiLevelWriter(f), f, nil
+	case "syslog":
+		return openSyslog(od.Address, od.Tag)
+	case "journald":
+		return openJournald(od.Tag)
+	default:
+		return nil, nil, fmt.Errorf("unrecognized log output type %q", od.Type)
+	}
+}
+
+// levelRouter writes logs at error level and above to errs, if set, and all
+// other logs to out.
+type levelRouter struct {
+	out  zerolog.LevelWriter
+	errs zerolog.LevelWriter
+}
+
+func (lr levelRouter) Write(p []byte) (int, error) {
+	return lr.out.Write(p)
+}
+
+func (lr levelRouter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if lr.errs != nil && level >= zerolog.ErrorLevel && level < zerolog.NoLevel {
+		return lr.errs.WriteLevel(level, p)
+	}
+	return lr.out.WriteLevel(level, p)
+}
+
+// consoleLevelWriter formats JSON log lines for humans before passing them
+// on to the underlying writer.
+type consoleLevelWriter struct {
+	w zerolog.LevelWriter
+}
+
+func (cw consoleLevelWriter) format(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	console := zerolog.ConsoleWriter{Out: &buf, NoColor: true}
+	if _, err := console.Write(p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cw consoleLevelWriter) Write(p []byte) (int, error) {
+	formatted, err := cw.format(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.Write(formatted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cw consoleLevelWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	formatted, err := cw.format(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.WriteLevel(level, formatted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var me *multierror.Error
+	for _, c := range mc {
+		if err := c.Close(); err != nil {
+			me = multierror.Append(me, err)
+		}
+	}
+	return errorOrNil(me)
+}
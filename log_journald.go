@@ -0,0 +1,96 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/rs/zerolog"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+func openJournald(tag string) (zerolog.LevelWriter, io.Closer, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to journald: %w", err)
+	}
+	return &journaldWriter{conn: conn, tag: tag}, conn, nil
+}
+
+// journaldWriter writes log entries to journald using its native protocol.
+// Each entry is sent as a single datagram, so very large entries may be
+// rejected by the socket.
+type journaldWriter struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+func (jw *journaldWriter) Write(p []byte) (int, error) {
+	return jw.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (jw *journaldWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "PRIORITY", []byte(strconv.Itoa(journaldPriority(level))))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", []byte(jw.tag))
+	writeJournaldField(&buf, "MESSAGE", bytes.TrimRight(p, "\n"))
+	if _, err := jw.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeJournaldField writes a single field in journald's native format.
+// Values containing newlines are written with an explicit length.
+func writeJournaldField(buf *bytes.Buffer, key string, value []byte) {
+	buf.WriteString(key)
+	if bytes.IndexByte(value, '\n') == -1 {
+		buf.WriteByte('=')
+		buf.Write(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.Write(value)
+	buf.WriteByte('\n')
+}
+
+// journaldPriority maps zerolog levels to syslog priorities.
+func journaldPriority(level zerolog.Level) int {
+	switch level {
+	case zerolog.TraceLevel, zerolog.DebugLevel:
+		return 7
+	case zerolog.WarnLevel:
+		return 4
+	case zerolog.ErrorLevel:
+		return 3
+	case zerolog.FatalLevel:
+		return 0
+	case zerolog.PanicLevel:
+		return 2
+	default:
+		return 6
+	}
+}
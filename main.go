@@ -18,7 +18,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -33,13 +32,10 @@ import (
 
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/jmoiron/sqlx"
-	"github.com/julienschmidt/httprouter"
 	"github.com/rs/zerolog"
 	"github.com/tailscale/hujson"
 	"go.spiff.io/flagenv"
-	"go.spiff.io/sql/driver"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 )
 
@@ -50,27 +46,46 @@ func main() {
 
 	fs := flag.NewFlagSet("chisel", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
-	run := func() int {
-		ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM)
-		defer cancel()
+	os.Exit(runProgram(func(ctx context.Context) int {
 		return Main(ctx, fs, os.Args[1:])
-	}
-	os.Exit(run())
+	}))
 }
 
-func Main(ctx context.Context, fs *flag.FlagSet, args []string) int {
+// Serve implements the serve subcommand, which serves the config's endpoints
+// until ctx is done.
+func Serve(ctx context.Context, fs *flag.FlagSet, args []string) int {
 	var (
 		logLevel           = zerolog.InfoLevel
-		configPath         = "config.json"
+		logLevelSet        bool
 		printConfigAndExit bool
+		printFormat        = "json"
+		checkQueries       bool
+		check              = &queryCheck{timeout: 30 * time.Second}
+		startStandby       bool
+		watch              bool
+		historySize        = 5
+		standby            = &standbyDef{timeout: 30 * time.Second}
+		shutdown           = &shutdownDef{timeout: 10 * time.Second, report: 2 * time.Second}
 	)
 
-	fs.StringVar(&configPath, "c", configPath, "The `path` to load program config JSON or YAML from.")
-	fs.BoolVar(&printConfigAndExit, "C", printConfigAndExit, "Print the parsed program config and exit.")
+	cf := addConfigFlags(fs)
+	fs.BoolVar(&printConfigAndExit, "C", printConfigAndExit, "Print the parsed program config and exit. Deprecated: use print-config.")
+	fs.StringVar(&printFormat, "format", printFormat, "The `format` -C prints the config in: json or yaml.")
+	fs.BoolVar(&checkQueries, "check-queries", checkQueries, "Prepare every SQL statement against its database before serving, and fail if any can't be.")
+	fs.BoolVar(&check.explain, "explain", check.explain, "With -check-queries, also EXPLAIN SQL statements on PostgreSQL and MySQL databases.")
+	fs.DurationVar(&check.timeout, "check-timeout", check.timeout, "How long to spend checking SQL statements.")
+	fs.BoolVar(&watch, "watch", watch, "Reload the config whenever the files it was read from, including includes and query files, change.")
+	fs.IntVar(&historySize, "config-history", historySize, "The `number` of loaded configs to keep in memory for rollbacks through the admin API. If 0, rollbacks are disabled.")
+	fs.BoolVar(&startStandby, "standby", startStandby, "Start in standby: load the config and open databases, but serve only the admin API until promoted.")
+	fs.BoolVar(&standby.auto, "standby-auto", standby.auto, "In standby, promote as soon as every binding's address is free.")
+	fs.DurationVar(&standby.timeout, "standby-timeout", standby.timeout, "How long a promotion from standby waits for binding addresses to be released.")
+	fs.DurationVar(&shutdown.timeout, "shutdown-timeout", shutdown.timeout, "How long to wait for requests in flight to finish on exit before closing their connections.")
+	fs.DurationVar(&shutdown.report, "shutdown-report", shutdown.report, "How often to log the requests still in flight while waiting for them on exit. If 0, they're only logged if -shutdown-timeout passes.")
+	fs.BoolVar(&shutdown.cancel, "shutdown-cancel", shutdown.cancel, "Cancel requests still in flight once -shutdown-timeout passes, so that they abort their queries and respond, before closing their connections.")
 	fs.Func("v", "Set the log `level`.", func(v string) error {
 		lev, err := zerolog.ParseLevel(v)
 		if err == nil {
-			logLevel = lev
+			logLevel, logLevelSet = lev, true
 		}
 		return err
 	})
@@ -82,7 +97,9 @@ func Main(ctx context.Context, fs *flag.FlagSet, args []string) int {
 		return 1
 	}
 
-	log := zerolog.New(fs.Output()).Level(logLevel).With().Timestamp().Logger()
+	// Log levels are set globally so that they can be changed at runtime.
+	zerolog.SetGlobalLevel(logLevel)
+	log := zerolog.New(zerolog.MultiLevelWriter(fs.Output(), recentErrors)).With().Timestamp().Logger()
 	ctx = log.WithContext(ctx)
 
 	if err := flagenv.SetMissing(fs); err != nil {
@@ -90,155 +107,178 @@ func Main(ctx context.Context, fs *flag.FlagSet, args []string) int {
 		return 1
 	}
 
-	conf, err := readConfigFile(configPath)
-	if err != nil {
-		log.Error().Err(err).Str("config", configPath).Msg("Failed to read config file.")
-		return 1
+	if err := cf.resolveProfile(); err != nil {
+		log.Error().Err(err).Msg("Invalid config profile.")
+		return 2
 	}
+	configPath, profile, remote := cf.path, cf.profile, cf.remote
 
-	if err := conf.Validate(); err != nil {
-		log.Error().Err(err).Msg("Config validation failed.")
+	conf, err := cf.load()
+	if err != nil {
+		log.Error().Err(err).Str("config", configPath).Msg("Failed to load config.")
 		return 1
 	}
+	logProfileChanges(log, profile, conf)
+	logConfigMigrations(log, conf)
+	if cf.noStrict {
+		log.Warn().Msg("Unknown config fields are ignored; typos in the config will not be reported.")
+	}
 
 	if printConfigAndExit {
-		data, err := json.Marshal(conf)
+		if !validConfigFormat(printFormat) {
+			log.Error().Str("format", printFormat).Msg("Unrecognized config format.")
+			return 2
+		}
+		data, err := redactConfig(conf, printFormat)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to marshal program config.")
 			return 1
 		}
-		log.Info().RawJSON("config", data).Msg("Config parsed, exiting.")
+		if printFormat == "json" {
+			log.Info().RawJSON("config", data).Msg("Config parsed, exiting.")
+			return 0
+		}
+		// YAML can't be embedded in a log message, so it's written on
+		// its own.
+		_, _ = os.Stdout.Write(data)
 		return 0
 	}
 
-	dbs := make(map[string]*Database, len(conf.Databases))
-	for k, dbe := range conf.Databases {
-		dbe := *dbe
-
-		log := log.With().
-			Err(err).
-			Str("database", k).
-			Logger()
-
-		u, err := url.Parse(dbe.URL)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to parse database URL.")
-			return 1
-		}
-
-		driver, dsn, bindType, err := driver.DSNFromURL(u)
+	if conf.Log != nil {
+		w, closer, err := conf.Log.Writer()
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to construct database DSN.")
+			log.Error().Err(err).Msg("Failed to configure logging.")
 			return 1
 		}
-		dbe.Options.BindType = bindType
-		dbe.options = dbe.Options.QueryOptions()
+		defer closer.Close()
 
-		pool, err := sqlx.Open(driver, dsn)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to open database connection pool.")
-			return 1
+		if !logLevelSet {
+			zerolog.SetGlobalLevel(conf.Log.level)
 		}
-		defer pool.Close()
+		log = zerolog.New(zerolog.MultiLevelWriter(w, recentErrors)).With().Timestamp().Logger()
+		ctx = log.WithContext(ctx)
+	}
 
-		// Set optional config.
-		if dbe.MaxIdle > 0 {
-			pool.SetMaxIdleConns(dbe.MaxIdle)
-		}
-		if dbe.MaxOpen > 0 {
-			pool.SetMaxIdleConns(dbe.MaxOpen)
-		}
-		if dbe.MaxIdleTime.Duration > 0 {
-			pool.SetConnMaxIdleTime(dbe.MaxIdleTime.Duration)
-		}
-		if dbe.MaxLifeTime.Duration > 0 {
-			pool.SetConnMaxLifetime(dbe.MaxLifeTime.Duration)
-		}
+	if watch && isRemoteConfig(configPath) {
+		log.Error().Msg("Remote configs can't be watched; use -config-refresh instead.")
+		return 2
+	}
 
-		dbs[k] = &Database{
-			db:          pool,
-			DatabaseDef: &dbe,
-		}
+	if !startStandby {
+		standby = nil
+	} else if conf.Admin == nil && !standby.auto {
+		log.Error().Msg("Standby requires an admin binding to be promoted through, or -standby-auto.")
+		return 2
 	}
 
-	if len(conf.Bind) == 0 {
-		conf.Bind = []SockAddr{
-			SockAddr{
-				SockAddr: sockaddr.MustIPv4Addr("127.0.0.1:8080"),
-			},
-		}
+	dbs, err := openDatabases(log, conf, nil)
+	if err != nil {
+		return 1
+	}
+	if !checkQueries {
+		check = nil
+	} else if err := check.Run(ctx, conf, dbs); err != nil {
+		dbs.Close()
+		logQueryErrors(log, err)
+		return 1
+	}
+	if err := loadDatasets(ctx, log, conf, dbs); err != nil {
+		dbs.Close()
+		log.Error().Err(err).Msg("Failed to load datasets.")
+		return 1
 	}
 
-	listeners := make([]net.Listener, len(conf.Bind))
-	servers := make([]*http.Server, len(conf.Bind))
-	for bid, caddr := range conf.Bind {
-		network, addr := caddr.ListenStreamArgs()
-		llog := log.With().
-			Int("binding", bid).
-			Str("addr", addr).
-			Str("net", network).
-			Logger()
-		switch t := caddr.Type(); t {
-		case sockaddr.TypeUnix:
-		case sockaddr.TypeIPv4, sockaddr.TypeIPv6:
-		default:
-			llog.Error().Stringer("type", t).Msg("Unrecognized binding type for address.")
-			return 1
-		}
+	srv := &Server{
+		configPath: configPath,
+		profile:    profile,
+		remote:     remote,
+		bind:       conf.Bind,
+		admin:      conf.Admin,
+		conf:       conf,
+		dbs:        dbs,
+		check:      check,
+		handlers:   make([]*swapHandler, len(conf.Bind)),
+		standby:    standby,
+		promote:    make(chan struct{}, 1),
+		rollbacks:  make(chan rollbackRequest),
+		history:    newConfigHistory(historySize),
+	}
+	srv.history.Add(log, conf, 0)
+	defer srv.Close()
 
-		l, err := net.Listen(network, addr)
-		if err != nil {
-			llog.Error().Err(err).Msg("Failed to bind to address.")
+	var cw *configWatcher
+	if watch {
+		if cw, err = newConfigWatcher(srv); err != nil {
+			log.Error().Err(err).Msg("Failed to watch config files.")
 			return 1
 		}
-		defer l.Close()
-
-		rt := httprouter.New()
-		for _, ed := range conf.Endpoints {
-			if len(ed.Bind) > 0 && !ed.Bind.Contains(bid) {
-				continue
-			}
-			handler := &Handler{
-				EndpointDef: ed,
-				db:          dbs,
-			}
-			method := strings.ToUpper(ed.Method)
-			fn := handler.Get
-			if method != "GET" {
-				fn = handler.Post
-			}
-			rt.Handle(method, ed.Path, fn)
-		}
+	}
 
-		listeners[bid] = l
+	var (
+		listeners []net.Listener
+		servers   []*http.Server
+		loggers   []zerolog.Logger
+	)
+	serveOn := func(llog zerolog.Logger, bd *BindDef, handler http.Handler, l net.Listener) {
 		laddr := l.Addr().String()
 		llog.Info().Stringer("laddr", l.Addr()).Msg("Listening on address.")
 
-		log := log.With().
-			Int("binding", bid).
+		log := llog.With().
 			Str("laddr", laddr).
 			Logger()
 
 		ctx := log.WithContext(ctx)
 
-		servers[bid] = &http.Server{
-			Handler: rt,
-			BaseContext: func(net.Listener) context.Context {
-				return ctx
-			},
+		listeners = append(listeners, l)
+		loggers = append(loggers, log)
+		sv := bd.Server(handler)
+		sv.BaseContext = func(net.Listener) context.Context {
+			return ctx
+		}
+		servers = append(servers, sv)
+	}
+	serve := func(llog zerolog.Logger, bd *BindDef, handler http.Handler) bool {
+		l, ok := listen(llog, bd)
+		if !ok {
+			return false
+		}
+		serveOn(llog, bd, handler, l)
+		return true
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	reg := NewRegistry(conf, dbs)
+	for bid, bd := range conf.Bind {
+		srv.handlers[bid] = newSwapHandler(reg.Router(bid))
+		if standby != nil {
+			// Bindings are listened on once the server is promoted.
+			continue
+		}
+		llog := log.With().Int("binding", bid).Logger()
+		if !serve(llog, bd, srv.handlers[bid]) {
+			return 1
+		}
+	}
+
+	if conf.Admin != nil {
+		srv.adminHandler = newSwapHandler(buildAdminRouter(srv, conf))
+		llog := log.With().Str("binding", "admin").Logger()
+		if !serve(llog, conf.Admin, srv.adminHandler) {
+			return 1
 		}
 	}
 
 	wg, ctx := errgroup.WithContext(ctx)
-	for sid, sv := range servers {
-		sv := sv
+	srv.StartOutboxes(ctx)
+	srv.StartDatasets(ctx)
+	start := func(sid int) {
+		sv := servers[sid]
 		l := listeners[sid]
-		laddr := l.Addr().String()
-
-		log := log.With().
-			Int("binding", sid).
-			Str("laddr", laddr).
-			Logger()
+		log := loggers[sid]
 
 		// Server.
 		wg.Go(func() error {
@@ -253,20 +293,116 @@ func Main(ctx context.Context, fs *flag.FlagSet, args []string) int {
 		wg.Go(func() error {
 			<-ctx.Done()
 			log.Debug().Msg("Shutting down server.")
-			closex, cancel := context.WithTimeout(context.Background(), time.Second*10)
-			defer cancel()
-			if err := sv.Shutdown(closex); err != nil {
-				log.Warn().Err(err).Msg("Error closing server gracefully, forcing shutdown.")
-			} else if err == nil {
-				log.Info().Msg("Server closed.")
+			return shutdown.Shutdown(log, sv)
+		})
+	}
+	for sid := range servers {
+		start(sid)
+	}
+
+	// Requests in flight at shutdown.
+	wg.Go(func() error {
+		<-ctx.Done()
+		shutdown.Report(log)
+		return nil
+	})
+
+	// Promotion from standby.
+	if standby != nil {
+		log.Info().Msg("Server is in standby; bindings are served once it's promoted.")
+		wg.Go(func() error {
+			ls, err := srv.awaitPromotion(ctx, log)
+			if err != nil {
 				return nil
 			}
-			if err := sv.Close(); err != nil {
-				log.Error().Err(err).Msg("Error forcing server shutdown.")
-			} else {
-				log.Info().Msg("Server forced closed.")
+			first := len(servers)
+			for bid, bd := range conf.Bind {
+				llog := log.With().Int("binding", bid).Logger()
+				serveOn(llog, bd, srv.handlers[bid], ls[bid])
 			}
-			return err
+			for sid := first; sid < len(servers); sid++ {
+				start(sid)
+			}
+			log.Info().Msg("Promoted server from standby.")
+			return nil
+		})
+	}
+
+	// Config reloads.
+	hup := make(chan os.Signal, 1)
+	notifyReload(hup)
+	defer signal.Stop(hup)
+	reload := make(chan struct{}, 1)
+	wg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case rr := <-srv.rollbacks:
+				cv, err := srv.Rollback(ctx, rr.id)
+				rr.reply <- rollbackResult{version: cv, err: err}
+				continue
+			case <-hup:
+			case <-reload:
+			}
+			if err := srv.Reload(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to reload config, keeping current config.")
+			}
+		}
+	})
+
+	// Diagnostic bundles. SIGQUIT is only caught if diagnostics are
+	// configured at startup, so that it otherwise keeps its default
+	// behavior of dumping stacks and exiting.
+	if conf.Diagnostics != nil {
+		quit := make(chan os.Signal, 1)
+		notifyDiagnostics(quit)
+		defer signal.Stop(quit)
+		wg.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-quit:
+				}
+				dir, err := writeDiagnostics(srv.Config())
+				if err != nil {
+					log.Error().Err(err).Str("path", dir).Msg("Failed to write diagnostic bundle.")
+					continue
+				}
+				log.Info().Str("path", dir).Msg("Wrote diagnostic bundle.")
+			}
+		})
+	}
+
+	if isRemoteConfig(configPath) && remote.refresh > 0 {
+		wg.Go(func() error {
+			return watchRemoteConfig(ctx, configPath, remote, remote.refresh, func() {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			})
+		})
+	} else if isConfigMapDir(configPath) {
+		wg.Go(func() error {
+			return watchConfigMapDir(ctx, configPath, configMapPollInterval, func() {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			})
+		})
+	}
+
+	if cw != nil {
+		wg.Go(func() error {
+			return cw.Run(ctx, func() {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			})
 		})
 	}
 
@@ -278,26 +414,394 @@ func Main(ctx context.Context, fs *flag.FlagSet, args []string) int {
 	return 0
 }
 
-func readConfigFile(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+// loadConfig reads the config at path with the overlays of profile, if set,
+// validates it, and fills in defaults. Remote configs are read with the
+// options of rc.
+func loadConfig(path, profile string, rc *remoteConfig) (*Config, error) {
+	conf, err := readConfig(path, profile, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conf.ExpandTemplates(); err != nil {
+		return nil, fmt.Errorf("error generating endpoints: %w", err)
+	}
+	conf.applyEndpointDefaults()
+
+	if len(conf.Bind) == 0 {
+		conf.Bind = []*BindDef{
+			{Addr: SockAddr{
+				SockAddr: sockaddr.MustIPv4Addr("127.0.0.1:8080"),
+			}},
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+
+	return conf, nil
+}
+
+// readConfig reads config from path. If path is a directory, all JSON and
+// YAML files in it are read in lexical order and merged, except for profile
+// overlays, which are only read with the files they overlay. If path is an
+// https:// or s3:// URL, the config is fetched from it.
+func readConfig(path, profile string, rc *remoteConfig) (*Config, error) {
+	if isRemoteConfig(path) {
+		if rc == nil {
+			rc = &remoteConfig{}
+		}
+		return readRemoteConfig(path, profile, rc)
+	} else if strings.HasPrefix(path, "http://") {
+		return nil, errors.New("remote configs must be read over https")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	if !fi.IsDir() {
+		return readConfigFile(path, profile)
+	}
+	return readConfigDir(path, profile)
+}
+
+func readConfigDir(dir, profile string) (*Config, error) {
+	// Kubernetes ConfigMap volumes expose files through a ..data symlink
+	// that is swapped atomically on update. Resolve it once so that every
+	// file is read from the same generation of the ConfigMap.
+	if isConfigMapDir(dir) {
+		target, err := filepath.EvalSymlinks(filepath.Join(dir, configMapDataDir))
+		if err != nil {
+			return nil, fmt.Errorf("error resolving config directory: %w", err)
+		}
+		dir = target
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config directory: %w", err)
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+
+	conf := &Config{}
+	// Files added to the directory are reloaded with -watch.
+	for _, ext := range []string{".json", ".yaml", ".yml"} {
+		for _, suffix := range []string{"", tmplExt, ageExt, tmplExt + ageExt} {
+			conf.sources = append(conf.sources, filepath.Join(dir, "*"+ext+suffix))
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || isProfileOverlay(name, names) {
+			continue
+		}
+		switch configExt(name) {
+		case ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		fc, err := readConfigFile(path, profile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := conf.Merge(fc); err != nil {
+			return nil, fmt.Errorf("error merging config file %s: %w", path, err)
+		}
+	}
+
+	return conf, nil
+}
+
+func readConfigFile(path, profile string) (*Config, error) {
+	return readConfigInclude(path, profile, map[string]bool{})
+}
+
+// readConfigInclude reads the config file at path and merges the files it
+// includes into it. Files being read are marked in reading so that include
+// cycles are rejected.
+func readConfigInclude(path, profile string, reading map[string]bool) (*Config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving config file path: %w", err)
+	}
+	if reading[abs] {
+		return nil, fmt.Errorf("config file %s includes itself", path)
+	}
+	reading[abs] = true
+	defer delete(reading, abs)
+
+	conf, err := parseConfigFile(path, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range conf.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		conf.sources = append(conf.sources, pattern)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include %q: %w", pattern, err)
+		}
+		if matches == nil && !hasGlobMeta(pattern) {
+			return nil, fmt.Errorf("included config file %s does not exist", pattern)
+		}
+		included := make(map[string]bool, len(matches))
+		for _, inc := range matches {
+			included[inc] = true
+		}
+		for _, inc := range matches {
+			if isProfileOverlay(inc, included) {
+				continue
+			}
+			ic, err := readConfigInclude(inc, profile, reading)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inc, err)
+			}
+			if err := conf.Merge(ic); err != nil {
+				return nil, fmt.Errorf("error merging included config file %s: %w", inc, err)
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+// hasGlobMeta returns whether pattern has glob characters.
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// parseConfigFile reads the config file at path, with the profile's overlay
+// merged over it, without its includes.
+func parseConfigFile(path, profile string) (*Config, error) {
+	data, err := readConfigData(path, profile)
 	if err != nil {
 		return nil, fmt.Errorf("error reading config file: %w", err)
 	}
+	conf, changes, err := decodeConfig(configExt(path), profile, data, func(data []byte) ([]byte, []string, error) {
+		return applyProfileOverlay(path, profile, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range changes {
+		conf.profileChanges = append(conf.profileChanges, path+": "+key)
+	}
+	for i, note := range conf.migrations {
+		conf.migrations[i] = path + ": " + note
+	}
+	conf.sources = append(conf.sources, path)
+	if profile != "" {
+		conf.sources = append(conf.sources, profileOverlayPath(path, profile))
+	}
+	for _, ed := range conf.Endpoints {
+		if ed != nil {
+			ed.source = path
+		}
+	}
+	resolveStepFiles(conf.Endpoints, filepath.Dir(path))
+	if conf.Endpoints, err = readEndpointFiles(conf, path, profile); err != nil {
+		return nil, err
+	}
+	for _, td := range conf.Templates {
+		if td != nil {
+			td.dir = filepath.Dir(path)
+		}
+	}
+
+	return conf, nil
+}
 
+// decodeConfig decodes config data in the format of the file extension ext,
+// after expanding environment variables in it, applying the profile's
+// section of its profiles, merging overlays over it with overlay, and
+// upgrading it to the current config version. It returns the config and
+// the keys changed by the profile and overlay. Notes on what the upgrade
+// changed are kept in the config's migrations, without the file's name.
+func decodeConfig(ext, profile string, data []byte, overlay func([]byte) ([]byte, []string, error)) (*Config, []string, error) {
 	var conf *Config
-	switch filepath.Ext(path) {
+	var changes, overlaid, migrated []string
+	var version int
+	var err error
+	switch ext {
 	case ".yaml", ".yml":
+		data, err = expandConfigEnvYAML(data)
+		if err != nil {
+			break
+		}
+		data, changes, err = applyInlineProfile(ext, profile, data)
+		if err != nil {
+			break
+		}
+		data, overlaid, err = overlay(data)
+		if err != nil {
+			break
+		}
+		data, version, migrated, err = migrateConfig(ext, data, 0)
+		if err != nil {
+			break
+		}
 		dec := yaml.NewDecoder(bytes.NewReader(data))
-		dec.KnownFields(true)
+		dec.KnownFields(!allowUnknownFields)
 		err = dec.Decode(&conf)
 	default:
+		data, err = expandConfigEnvJSON(data)
+		if err != nil {
+			break
+		}
+		data, changes, err = applyInlineProfile(ext, profile, data)
+		if err != nil {
+			break
+		}
+		data, overlaid, err = overlay(data)
+		if err != nil {
+			break
+		}
+		data, version, migrated, err = migrateConfig(ext, data, 0)
+		if err != nil {
+			break
+		}
 		dec := hujson.NewDecoder(bytes.NewReader(data))
-		dec.DisallowUnknownFields()
+		if !allowUnknownFields {
+			dec.DisallowUnknownFields()
+		}
 		err = dec.Decode(&conf)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error parsing config file: %w", err)
+		return nil, nil, fmt.Errorf("error parsing config file: %w", err)
 	}
+	if conf == nil {
+		conf = &Config{}
+	}
+	// Older configs have been upgraded to the current version.
+	conf.Version = currentConfigVersion
+	conf.fileVersion = version
+	conf.migrations = migrated
+	return conf, append(changes, overlaid...), nil
+}
 
-	return conf, nil
+// openDatabases opens connection pools for all databases in conf. Databases
+// in prev whose definitions are unchanged keep their pools. If any pool
+// cannot be opened, all pools opened up to that point are closed.
+func openDatabases(log zerolog.Logger, conf *Config, prev Databases) (_ Databases, err error) {
+	dbs := make(Databases, len(conf.Databases))
+	opened := make(Databases, len(conf.Databases))
+	defer func() {
+		if err != nil {
+			opened.Close()
+		}
+	}()
+
+	for k, dbe := range conf.Databases {
+		log := log.With().
+			Str("database", k).
+			Logger()
+
+		// Secrets are read again on each reload so that rotated
+		// credentials replace the pool.
+		dbURL, err := conf.resolveSecret(context.Background(), dbe.URL)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read database URL secret.")
+			return nil, err
+		}
+		if db := prev[k]; db != nil && db.sameDef(dbe, dbURL) {
+			dbs[k] = db
+			continue
+		}
+		dbe := *dbe
+		_, isSecret := secretName(dbe.URL)
+
+		u, err := url.Parse(dbURL)
+		if err != nil && isSecret {
+			err = errors.New("secret is not a valid URL")
+			log.Error().Err(err).Msg("Failed to parse database URL.")
+			return nil, err
+		} else if err != nil {
+			err = redactURLError(err)
+			log.Error().Err(err).Msg("Failed to parse database URL.")
+			return nil, err
+		}
+
+		driver, dsn, bindType, err := dsnFromURL(u)
+		if err != nil {
+			ev := log.Error().Err(err)
+			if !isSecret {
+				ev = ev.Str("url", u.Redacted())
+			}
+			ev.Msg("Failed to construct database DSN.")
+			return nil, err
+		}
+		dbe.Options.BindType = bindType
+		dbe.options = dbe.Options.QueryOptions()
+
+		pool, err := sqlx.Open(driver, dsn)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open database connection pool.")
+			return nil, err
+		}
+
+		// Set optional config.
+		if dbe.MaxIdle > 0 {
+			pool.SetMaxIdleConns(dbe.MaxIdle)
+		}
+		if dbe.MaxOpen > 0 {
+			pool.SetMaxOpenConns(dbe.MaxOpen)
+		}
+		if dbe.MaxIdleTime.Duration > 0 {
+			pool.SetConnMaxIdleTime(dbe.MaxIdleTime.Duration)
+		}
+		if dbe.MaxLifeTime.Duration > 0 {
+			pool.SetConnMaxLifetime(dbe.MaxLifeTime.Duration)
+		}
+
+		dbs[k] = &Database{
+			db:          pool,
+			url:         dbURL,
+			DatabaseDef: &dbe,
+		}
+		opened[k] = dbs[k]
+	}
+
+	return dbs, nil
+}
+
+// listen opens a listener for the binding bd, logging why if it can't.
+func listen(log zerolog.Logger, bd *BindDef) (net.Listener, bool) {
+	network, addr := bd.Addr.ListenStreamArgs()
+	l, err := listenBinding(bd)
+	if err != nil {
+		log.Error().
+			Str("addr", addr).
+			Str("net", network).
+			Err(err).
+			Msg("Failed to bind to address.")
+		return nil, false
+	}
+	return l, true
+}
+
+// listenBinding opens a listener for the binding bd.
+func listenBinding(bd *BindDef) (net.Listener, error) {
+	network, addr := bd.Addr.ListenStreamArgs()
+	switch t := bd.Addr.Type(); t {
+	case sockaddr.TypeUnix:
+	case sockaddr.TypeIPv4, sockaddr.TypeIPv6:
+	default:
+		return nil, fmt.Errorf("unrecognized binding type %v for address", t)
+	}
+
+	lc := net.ListenConfig{KeepAlive: bd.TCPKeepAlive.Duration}
+	if d := bd.DeferAccept.Duration; d > 0 && network != "unix" {
+		lc.Control = deferAccept(d)
+	}
+	return lc.Listen(context.Background(), network, addr)
 }
@@ -0,0 +1,98 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// MaskDef hides fields of an endpoint's response from requesters that do
+// not have one of the roles in Unless. Fields are dotted paths into the
+// response; lists along a path are masked element-wise, so "email" masks the
+// email field of every row in a list of rows. Masked fields are removed
+// unless Replace is set, in which case their values are replaced with it.
+type MaskDef struct {
+	Fields  []string    `json:"fields" yaml:"fields"`
+	Unless  []string    `json:"unless,omitempty" yaml:"unless,omitempty"`
+	Replace interface{} `json:"replace,omitempty" yaml:"replace,omitempty"`
+}
+
+func (md *MaskDef) Validate() error {
+	if len(md.Fields) == 0 {
+		return errors.New("no fields given")
+	}
+	var me *multierror.Error
+	for i, f := range md.Fields {
+		for _, part := range strings.Split(f, ".") {
+			if part == "" {
+				me = multierror.Append(me, fmt.Errorf("field %d (%q) is not a valid path", i, f))
+				break
+			}
+		}
+	}
+	return errorOrNil(me)
+}
+
+// applies reports whether the mask applies to the principal p, which may be
+// nil for unauthenticated requests.
+func (md *MaskDef) applies(p *Principal) bool {
+	return !p.HasRole(md.Unless...)
+}
+
+// Apply masks the fields of out in place.
+func (md *MaskDef) Apply(out interface{}) {
+	for _, f := range md.Fields {
+		md.mask(out, strings.Split(f, "."))
+	}
+}
+
+func (md *MaskDef) mask(v interface{}, path []string) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			md.mask(e, path)
+		}
+	case map[string]interface{}:
+		if len(path) > 1 {
+			md.mask(v[path[0]], path[1:])
+			return
+		}
+		if _, ok := v[path[0]]; !ok {
+			return
+		}
+		if md.Replace == nil {
+			delete(v, path[0])
+		} else {
+			v[path[0]] = md.Replace
+		}
+	}
+}
+
+// MaskDefs is a list of masks applied in order.
+type MaskDefs []*MaskDef
+
+// Apply applies each mask that applies to the principal p to out.
+func (ms MaskDefs) Apply(p *Principal, out interface{}) {
+	for _, md := range ms {
+		if md.applies(p) {
+			md.Apply(out)
+		}
+	}
+}
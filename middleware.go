@@ -0,0 +1,717 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// Middleware wraps an http.Handler with additional behavior, such as
+// setting headers or rejecting requests.
+type Middleware interface {
+	Wrap(next http.Handler) http.Handler
+}
+
+// middlewareTypes maps the type names of middleware to constructors for
+// their definitions.
+var middlewareTypes = map[string]func() Middleware{
+	"headers":     func() Middleware { return &HeadersMiddleware{} },
+	"cors":        func() Middleware { return &CORSMiddleware{} },
+	"log":         func() Middleware { return &LogMiddleware{} },
+	"compress":    func() Middleware { return &CompressMiddleware{} },
+	"rate_limit":  func() Middleware { return &RateLimitMiddleware{} },
+	"basic_auth":  func() Middleware { return &BasicAuthMiddleware{} },
+	"quota":       func() Middleware { return &QuotaMiddleware{} },
+	"cache":       func() Middleware { return &CacheMiddleware{} },
+	"idempotency": func() Middleware { return &IdempotencyMiddleware{} },
+}
+
+// MiddlewareDef is a named middleware definition. Its type determines which
+// other fields it accepts.
+type MiddlewareDef struct {
+	Type       string
+	Middleware Middleware
+}
+
+func (md *MiddlewareDef) Validate() error {
+	if md == nil || md.Middleware == nil {
+		return errors.New("middleware definition is nil")
+	}
+	if v, ok := md.Middleware.(interface{ Validate() error }); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// closeMiddleware closes any middleware in defs that holds resources, such
+// as connections, that outlive a single request.
+func closeMiddleware(log zerolog.Logger, defs map[string]*MiddlewareDef) {
+	for k, md := range defs {
+		c, ok := md.Middleware.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			log.Warn().Err(err).Str("middleware", k).Msg("Error closing middleware.")
+		}
+	}
+}
+
+func newMiddleware(typ string) (Middleware, error) {
+	fn, ok := middlewareTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized middleware type %q", typ)
+	}
+	return fn(), nil
+}
+
+func (md *MiddlewareDef) UnmarshalJSON(src []byte) error {
+	var fields map[string]json.RawMessage
+	if err := unmarshalStrict(src, &fields); err != nil {
+		return err
+	}
+
+	var typ string
+	if fields["type"] == nil {
+		return errors.New("middleware type is empty")
+	}
+	if err := unmarshalStrict(fields["type"], &typ); err != nil {
+		return fmt.Errorf("error unmarshaling middleware type: %w", err)
+	}
+	delete(fields, "type")
+
+	mw, err := newMiddleware(typ)
+	if err != nil {
+		return err
+	}
+
+	opts, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := unmarshalStrict(opts, mw); err != nil {
+		return fmt.Errorf("error unmarshaling %s middleware: %w", typ, err)
+	}
+
+	*md = MiddlewareDef{Type: typ, Middleware: mw}
+	return nil
+}
+
+func (md *MiddlewareDef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected mapping node for middleware, got %d", node.Kind)
+	}
+
+	var typ string
+	opts := *node
+	opts.Content = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if k.Value == "type" {
+			if err := v.Decode(&typ); err != nil {
+				return fmt.Errorf("error unmarshaling middleware type: %w", err)
+			}
+			continue
+		}
+		opts.Content = append(opts.Content, k, v)
+	}
+
+	mw, err := newMiddleware(typ)
+	if err != nil {
+		return err
+	}
+	if err := decodeNodeStrict(&opts, mw); err != nil {
+		return fmt.Errorf("error unmarshaling %s middleware: %w", typ, err)
+	}
+
+	*md = MiddlewareDef{Type: typ, Middleware: mw}
+	return nil
+}
+
+func (md *MiddlewareDef) redactInline() interface{} {
+	return md.Middleware
+}
+
+func (md *MiddlewareDef) MarshalJSON() ([]byte, error) {
+	blob, err := json.Marshal(md.Middleware)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["type"] = md.Type
+	return json.Marshal(fields)
+}
+
+// MiddlewareNames is an ordered list of middleware names. The first
+// middleware in the list is the outermost, and sees requests first.
+type MiddlewareNames []string
+
+// Wrap wraps next in the named middleware from defs.
+func (mn MiddlewareNames) Wrap(defs map[string]*MiddlewareDef, next http.Handler) http.Handler {
+	for i := len(mn) - 1; i >= 0; i-- {
+		next = defs[mn[i]].Middleware.Wrap(next)
+	}
+	return next
+}
+
+// Validate checks that every name in mn refers to a middleware definition.
+func (mn MiddlewareNames) Validate(defs map[string]*MiddlewareDef) error {
+	var me []string
+	for _, name := range mn {
+		if _, ok := defs[name]; !ok {
+			me = append(me, strconv.Quote(name))
+		}
+	}
+	if len(me) > 0 {
+		return fmt.Errorf("undefined middleware: %s", strings.Join(me, ", "))
+	}
+	return nil
+}
+
+// HeadersMiddleware sets headers on all responses.
+type HeadersMiddleware struct {
+	Set map[string]string `json:"set" yaml:"set"`
+}
+
+func (m *HeadersMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for k, v := range m.Set {
+			w.Header().Set(k, v)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// CORSMiddleware adds CORS headers to responses for allowed origins and
+// answers preflight requests. Because preflight requests use the OPTIONS
+// method, it should be attached to bindings rather than endpoints.
+type CORSMiddleware struct {
+	AllowOrigins     []string `json:"allow_origins" yaml:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods" yaml:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers" yaml:"allow_headers"`
+	ExposeHeaders    []string `json:"expose_headers" yaml:"expose_headers"`
+	AllowCredentials bool     `json:"allow_credentials" yaml:"allow_credentials"`
+	MaxAge           Duration `json:"max_age" yaml:"max_age"`
+}
+
+func (m *CORSMiddleware) Validate() error {
+	if len(m.AllowOrigins) == 0 {
+		return errors.New("allow_origins is empty")
+	}
+	return nil
+}
+
+func (m *CORSMiddleware) allowOrigin(origin string) (string, bool) {
+	for _, o := range m.AllowOrigins {
+		if o == "*" {
+			if m.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(o, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func (m *CORSMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowed, ok := m.allowOrigin(origin)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", allowed)
+		if m.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		reqMethod := req.Header.Get("Access-Control-Request-Method")
+		if req.Method != http.MethodOptions || reqMethod == "" {
+			if len(m.ExposeHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(m.ExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// Preflight.
+		methods := reqMethod
+		if len(m.AllowMethods) > 0 {
+			methods = strings.Join(m.AllowMethods, ", ")
+		}
+		h.Set("Access-Control-Allow-Methods", methods)
+
+		headers := req.Header.Get("Access-Control-Request-Headers")
+		if len(m.AllowHeaders) > 0 {
+			headers = strings.Join(m.AllowHeaders, ", ")
+		}
+		if headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+
+		if m.MaxAge.Duration > 0 {
+			h.Set("Access-Control-Max-Age", strconv.FormatInt(int64(m.MaxAge.Seconds()), 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// LogMiddleware logs every request once it has completed.
+type LogMiddleware struct {
+	Level string `json:"level,omitempty" yaml:"level,omitempty"`
+
+	level zerolog.Level
+}
+
+func (m *LogMiddleware) Validate() error {
+	m.level = zerolog.InfoLevel
+	if m.Level == "" {
+		return nil
+	}
+	lev, err := zerolog.ParseLevel(m.Level)
+	if err != nil {
+		return fmt.Errorf("invalid level: %w", err)
+	}
+	m.level = lev
+	return nil
+}
+
+func (m *LogMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		zerolog.Ctx(req.Context()).WithLevel(m.level).
+			Str("method", req.Method).
+			Str("url", req.URL.Redacted()).
+			Str("raddr", req.RemoteAddr).
+			Int("status", sw.Status()).
+			Int64("bytes", sw.written).
+			Dur("elapsed", time.Since(start)).
+			Msg("Request completed.")
+	})
+}
+
+// statusWriter records the status code and number of bytes written to
+// a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.written += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying response, if it supports flushing, so that
+// streamed responses pass through.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CompressMiddleware gzip-compresses responses for clients that accept it.
+type CompressMiddleware struct {
+	Level int `json:"level,omitempty" yaml:"level,omitempty"`
+}
+
+func (m *CompressMiddleware) Validate() error {
+	if m.Level == 0 {
+		m.Level = gzip.DefaultCompression
+	}
+	if m.Level < gzip.HuffmanOnly || m.Level > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip level %d", m.Level)
+	}
+	return nil
+}
+
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *CompressMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(req) || req.Method == http.MethodHead {
+			next.ServeHTTP(w, req)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, level: m.Level}
+		defer gw.Close()
+		next.ServeHTTP(gw, req)
+	})
+}
+
+// gzipWriter compresses a response body if the response has one and is not
+// already encoded.
+type gzipWriter struct {
+	http.ResponseWriter
+	level       int
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	h := gw.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		// Digests describe the uncompressed body.
+		h.Del("Repr-Digest")
+		h.Del("Digest")
+		gw.gz, _ = gzip.NewWriterLevel(gw.ResponseWriter, gw.level)
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(p)
+	}
+	return gw.gz.Write(p)
+}
+
+func (gw *gzipWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// RateLimitMiddleware limits the rate of requests using a token bucket,
+// either for all requests or per client. Buckets are kept in Redis, if
+// configured, so that limits apply across all instances of chisel rather
+// than to each one. Otherwise, they're kept in memory.
+type RateLimitMiddleware struct {
+	Rate  float64 `json:"rate" yaml:"rate"`   // Requests per second.
+	Burst int     `json:"burst" yaml:"burst"` // Maximum requests at once.
+	// Key is what requests are limited by: "ip" (default), "global" (all
+	// requests share one bucket), "principal", or "header:NAME", as for
+	// quotas.
+	Key string `json:"key" yaml:"key"`
+	// Redis is the URL of a Redis server, such as redis://localhost:6379/0.
+	Redis  string `json:"redis,omitempty" yaml:"redis,omitempty"`
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"` // Prefix of Redis keys.
+	// Limits loads each client's rate and burst from a database, from the
+	// columns rate and burst of its row.
+	Limits *LimitsDef `json:"limits,omitempty" yaml:"limits,omitempty"`
+
+	redisOpts *redis.Options
+	initOnce  sync.Once
+	client    *redis.Client
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func (m *RateLimitMiddleware) Validate() error {
+	var me *multierror.Error
+	if m.Rate <= 0 {
+		me = multierror.Append(me, errors.New("rate must be greater than zero"))
+	}
+	if m.Burst <= 0 {
+		m.Burst = int(math.Ceil(m.Rate))
+	}
+	switch {
+	case m.Key == "":
+		m.Key = "ip"
+	case m.Key == "global", validRequestKey(m.Key):
+	default:
+		me = multierror.Append(me, fmt.Errorf("unrecognized key %q", m.Key))
+	}
+	if m.Limits != nil {
+		if err := m.Limits.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("limits failed validation: %w", err))
+		}
+		if m.Key == "global" {
+			me = multierror.Append(me, errors.New("limits cannot be used with the global key"))
+		}
+	}
+	if m.Prefix == "" {
+		m.Prefix = "chisel:ratelimit:"
+	}
+	if m.Redis != "" {
+		opts, err := redis.ParseURL(m.Redis)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("invalid redis url: %w", redactURLError(err)))
+		}
+		m.redisOpts = opts
+	}
+	return errorOrNil(me)
+}
+
+// Close closes the middleware's Redis client, if it has one.
+func (m *RateLimitMiddleware) Close() error {
+	m.initOnce.Do(func() {})
+	if m.client == nil {
+		return nil
+	}
+	return m.client.Close()
+}
+
+func (m *RateLimitMiddleware) redisClient() *redis.Client {
+	m.initOnce.Do(func() {
+		if m.redisOpts != nil {
+			m.client = redis.NewClient(m.redisOpts)
+		}
+	})
+	return m.client
+}
+
+// rateLimitScript implements a token bucket as a generic cell rate
+// algorithm: each key holds the theoretical arrival time (TAT) of the next
+// request, in microseconds, which advances by interval with every allowed
+// request. A request is allowed if the TAT is no more than burst intervals
+// ahead of now. The script returns 0 if the request is allowed, or else the
+// microseconds until it would be. Redis's clock is used so that every
+// instance agrees on the time.
+var rateLimitScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local new_tat = math.ceil(tat + interval)
+local wait = new_tat - burst * interval - now
+if wait > 0 then
+	return math.ceil(wait)
+end
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.max(1, math.ceil((new_tat - now) / 1000)))
+return 0
+`)
+
+// allowRedis is allow for buckets kept in Redis.
+func (m *RateLimitMiddleware) allowRedis(ctx context.Context, client *redis.Client, key string, rate float64, burst int) (bool, time.Duration, error) {
+	if key == "" {
+		key = "global"
+	}
+	interval := 1e6 / rate
+	wait, err := rateLimitScript.Run(ctx, client, []string{m.Prefix + key}, interval, burst).Int64()
+	if err != nil {
+		return false, 0, fmt.Errorf("error updating rate limit: %w", err)
+	}
+	if wait > 0 {
+		return false, time.Duration(wait) * time.Microsecond, nil
+	}
+	return true, 0, nil
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// allow takes a token from the bucket for key, which fills at rate up to
+// burst tokens. If no token is available, it returns false and the time
+// until one will be.
+func (m *RateLimitMiddleware) allow(key string, now time.Time, rate float64, burst int) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.buckets == nil {
+		m.buckets = make(map[string]*tokenBucket)
+		m.lastPrune = now
+	}
+
+	// Drop buckets that have refilled completely, since they are
+	// equivalent to new ones.
+	if now.Sub(m.lastPrune) > time.Minute {
+		for k, b := range m.buckets {
+			if b.fill(now, b.rate, b.burst) >= float64(b.burst) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastPrune = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	// A client's limits may change when they're loaded from a database.
+	b.rate, b.burst = rate, burst
+
+	if b.fill(now, rate, burst) < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limits returns the rate and burst of the client value.
+func (m *RateLimitMiddleware) limits(ctx context.Context, log zerolog.Logger, value string) (float64, int) {
+	if m.Limits == nil {
+		return m.Rate, m.Burst
+	}
+	row, err := m.Limits.Lookup(ctx, value)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to load rate limits. Using the default limits.")
+		return m.Rate, m.Burst
+	}
+	if row == nil {
+		return m.Rate, m.Burst
+	}
+	rate, ok := limitFloat(row["rate"])
+	if !ok || rate <= 0 {
+		log.Warn().Interface("rate", row["rate"]).Msg("Rate limits row has an invalid rate. Using the default limits.")
+		return m.Rate, m.Burst
+	}
+	burst := int(math.Ceil(rate))
+	if v, ok := opaqueInt(row["burst"]); ok && v > 0 {
+		burst = int(v)
+	}
+	return rate, burst
+}
+
+func (m *RateLimitMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		log := *zerolog.Ctx(ctx)
+
+		key, rate, burst := "", m.Rate, m.Burst
+		if m.Key != "global" {
+			value, ok := requestKey(m.Key, req)
+			if !ok {
+				writeError(log, w, http.StatusUnauthorized, &errorResponse{
+					Error: "unauthorized",
+				})
+				return
+			}
+			key = limitedKey(m.Key, value)
+			rate, burst = m.limits(ctx, log, value)
+		}
+		var ok bool
+		var wait time.Duration
+		if client := m.redisClient(); client != nil {
+			var err error
+			ok, wait, err = m.allowRedis(ctx, client, key, rate, burst)
+			if err != nil {
+				// Fail open, as quotas do.
+				log.Warn().Err(err).Msg("Unable to check rate limit.")
+				ok = true
+			}
+		} else {
+			ok, wait = m.allow(key, time.Now(), rate, burst)
+		}
+		if !ok {
+			secs := int64(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+			writeError(log, w, http.StatusTooManyRequests, &errorResponse{
+				Error: "too many requests",
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+func (b *tokenBucket) fill(now time.Time, rate float64, burst int) float64 {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b.tokens
+}
@@ -0,0 +1,356 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// currentConfigVersion is the version of the config format. Files without a
+// version are version 1.
+const currentConfigVersion = 2
+
+// versionKey is the key of a config file's version.
+const versionKey = "version"
+
+// configMigration upgrades config files older than its version to the shape
+// of that version. Files already at or past its version are checked
+// instead: the migration returns errors for shapes it would have upgraded,
+// since they're no longer accepted. Migrations record what they change in
+// notes, as "key: change".
+type configMigration struct {
+	to   int
+	yaml func(root *yaml.Node, strict bool, notes *[]string) error
+	json func(root interface{}, strict bool, notes *[]string) error
+}
+
+// configMigrations are the migrations between config versions, in order.
+var configMigrations = []configMigration{
+	{to: 2, yaml: nameYAMLTransactionRefs, json: nameJSONTransactionRefs},
+}
+
+// migrateConfig upgrades data, a config file in the format of the file
+// extension ext, from its version to the current one. If version is 0, the
+// version is read from the file's version key, and is 1 if it has none.
+// Otherwise data is of that version, as for endpoint files, which take the
+// version of the file referring to them. It returns the upgraded data, the
+// version it was upgraded from, and notes describing what changed. Data
+// that needs no changes is returned as-is.
+func migrateConfig(ext string, data []byte, version int) ([]byte, int, []string, error) {
+	var notes []string
+	var me *multierror.Error
+	switch ext {
+	case ".yaml", ".yml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+			// Errors are reported when the config is decoded.
+			return data, version, nil, nil
+		}
+		root := doc.Content[0]
+		if version == 0 {
+			version = 1
+			if v := yamlValue(root, versionKey); v != nil {
+				if err := v.Decode(&version); err != nil {
+					return nil, 0, nil, errors.New("version must be an integer")
+				}
+			}
+		}
+		if err := validConfigVersion(version); err != nil {
+			return nil, 0, nil, err
+		}
+		for _, m := range configMigrations {
+			if err := m.yaml(root, version >= m.to, &notes); err != nil {
+				me = multierror.Append(me, err)
+			}
+		}
+		if err := errorOrNil(me); err != nil || len(notes) == 0 {
+			return data, version, nil, err
+		}
+		data, err := yaml.Marshal(&doc)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("error upgrading config: %w", err)
+		}
+		sort.Strings(notes)
+		return data, version, notes, nil
+	default:
+		var root interface{}
+		if err := decodeJSONTree(data, &root); err != nil {
+			return data, version, nil, nil
+		}
+		if version == 0 {
+			version = 1
+			obj, _ := root.(map[string]interface{})
+			if v, ok := obj[versionKey]; ok {
+				n, ok := v.(json.Number)
+				i, err := n.Int64()
+				if !ok || err != nil {
+					return nil, 0, nil, errors.New("version must be an integer")
+				}
+				version = int(i)
+			}
+		}
+		if err := validConfigVersion(version); err != nil {
+			return nil, 0, nil, err
+		}
+		for _, m := range configMigrations {
+			if err := m.json(root, version >= m.to, &notes); err != nil {
+				me = multierror.Append(me, err)
+			}
+		}
+		if err := errorOrNil(me); err != nil || len(notes) == 0 {
+			return data, version, nil, err
+		}
+		data, err := json.Marshal(root)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("error upgrading config: %w", err)
+		}
+		sort.Strings(notes)
+		return data, version, notes, nil
+	}
+}
+
+// validConfigVersion returns an error if version is not a config version
+// this build can read.
+func validConfigVersion(version int) error {
+	if version < 1 {
+		return fmt.Errorf("invalid config version %d", version)
+	}
+	if version > currentConfigVersion {
+		return fmt.Errorf("config version %d is newer than the latest supported version, %d", version, currentConfigVersion)
+	}
+	return nil
+}
+
+// logConfigMigrations warns of config files that were upgraded from an
+// older version, listing what was changed in them.
+func logConfigMigrations(log zerolog.Logger, conf *Config) {
+	if len(conf.migrations) == 0 {
+		return
+	}
+	log.Warn().
+		Int("version", currentConfigVersion).
+		Strs("upgraded", conf.migrations).
+		Msg("Upgraded config written for an older version. Update the config and set its version to stop upgrading it on each load.")
+}
+
+// stepNeedsTransaction returns whether a step with the given keys runs in
+// one of its query's transactions.
+func stepNeedsTransaction(hasKey func(string) bool) bool {
+	return !hasKey("http") && !hasKey("dataset")
+}
+
+// transactionName returns the name of the transaction at index i of names,
+// the names of a query's transactions, naming it tx<i> if it has none.
+// It reports whether the name is new.
+func transactionName(names []string, i int) (string, bool) {
+	if names[i] != "" {
+		return names[i], false
+	}
+	taken := make(map[string]bool, len(names))
+	for _, name := range names {
+		taken[name] = true
+	}
+	name := "tx" + strconv.Itoa(i)
+	for taken[name] {
+		name += "_"
+	}
+	names[i] = name
+	return name, true
+}
+
+// nameYAMLTransactionRefs replaces the transaction indices of steps in
+// queries with more than one transaction, including steps that default to
+// the first, with the names of their transactions, naming transactions
+// that have none. Version 2 configs refer to these transactions only by
+// name, so that reordering them can't silently move steps between them.
+// Queries are found anywhere they occur, such as in templates and generate
+// overrides.
+func nameYAMLTransactionRefs(root *yaml.Node, strict bool, notes *[]string) error {
+	var me *multierror.Error
+	walkYAMLQueries(root, "", func(query *yaml.Node, prefix string) {
+		txs, steps := yamlValue(query, "transactions"), yamlValue(query, "steps")
+		if len(txs.Content) < 2 {
+			return
+		}
+		names := make([]string, len(txs.Content))
+		for i, tx := range txs.Content {
+			if name := yamlValue(tx, "name"); name != nil && name.Kind == yaml.ScalarNode {
+				names[i] = name.Value
+			}
+		}
+		for si, step := range steps.Content {
+			if step.Kind != yaml.MappingNode || !stepNeedsTransaction(func(key string) bool { return hasYAMLKey(step, key) }) {
+				continue
+			}
+			ref := yamlValue(step, "transaction")
+			if ref != nil && (ref.Kind != yaml.ScalarNode || ref.ShortTag() != "!!int") {
+				continue
+			}
+			key := overlayKey(prefix, "steps."+strconv.Itoa(si)+".transaction")
+			if strict {
+				me = multierror.Append(me, fmt.Errorf("%s: steps of queries with more than one transaction must refer to it by name", key))
+				continue
+			}
+			ti := 0
+			if ref != nil {
+				var err error
+				if ti, err = strconv.Atoi(ref.Value); err != nil || ti < 0 || ti >= len(txs.Content) {
+					// Undefined transactions are reported when the config
+					// is validated.
+					continue
+				}
+			}
+			tx := txs.Content[ti]
+			if tx.Kind != yaml.MappingNode {
+				continue
+			}
+			name, named := transactionName(names, ti)
+			if named {
+				tx.Content = append(tx.Content, yamlString("name"), yamlString(name))
+				*notes = append(*notes, fmt.Sprintf("%s: named transaction %q", overlayKey(prefix, "transactions."+strconv.Itoa(ti)), name))
+			}
+			if ref == nil {
+				step.Content = append(step.Content, yamlString("transaction"), yamlString(name))
+				*notes = append(*notes, fmt.Sprintf("%s: set to the first transaction, %q", key, name))
+			} else {
+				*ref = *yamlString(name)
+				*notes = append(*notes, fmt.Sprintf("%s: replaced index %d with transaction %q", key, ti, name))
+			}
+		}
+	})
+	return errorOrNil(me)
+}
+
+// nameJSONTransactionRefs is nameYAMLTransactionRefs for JSON configs.
+func nameJSONTransactionRefs(root interface{}, strict bool, notes *[]string) error {
+	var me *multierror.Error
+	walkJSONQueries(root, "", func(query map[string]interface{}, prefix string) {
+		txs, steps := query["transactions"].([]interface{}), query["steps"].([]interface{})
+		if len(txs) < 2 {
+			return
+		}
+		names := make([]string, len(txs))
+		for i, tx := range txs {
+			if tx, ok := tx.(map[string]interface{}); ok {
+				names[i], _ = tx["name"].(string)
+			}
+		}
+		for si, step := range steps {
+			step, ok := step.(map[string]interface{})
+			if !ok || !stepNeedsTransaction(func(key string) bool { _, ok := step[key]; return ok }) {
+				continue
+			}
+			ref, isIndex := step["transaction"].(json.Number)
+			if step["transaction"] != nil && !isIndex {
+				continue
+			}
+			key := overlayKey(prefix, "steps."+strconv.Itoa(si)+".transaction")
+			if strict {
+				me = multierror.Append(me, fmt.Errorf("%s: steps of queries with more than one transaction must refer to it by name", key))
+				continue
+			}
+			ti := 0
+			if isIndex {
+				var err error
+				if ti, err = strconv.Atoi(ref.String()); err != nil || ti < 0 || ti >= len(txs) {
+					continue
+				}
+			}
+			tx, ok := txs[ti].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, named := transactionName(names, ti)
+			if named {
+				tx["name"] = name
+				*notes = append(*notes, fmt.Sprintf("%s: named transaction %q", overlayKey(prefix, "transactions."+strconv.Itoa(ti)), name))
+			}
+			step["transaction"] = name
+			if isIndex {
+				*notes = append(*notes, fmt.Sprintf("%s: replaced index %d with transaction %q", key, ti, name))
+			} else {
+				*notes = append(*notes, fmt.Sprintf("%s: set to the first transaction, %q", key, name))
+			}
+		}
+	})
+	return errorOrNil(me)
+}
+
+// yamlString returns a YAML string node holding s.
+func yamlString(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+}
+
+// yamlValue returns the value of key in the YAML mapping node, or nil if
+// it has none.
+func yamlValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// walkYAMLQueries calls fn with each mapping under node that has lists of
+// transactions and steps, and its key.
+func walkYAMLQueries(node *yaml.Node, prefix string, fn func(query *yaml.Node, prefix string)) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		txs, steps := yamlValue(node, "transactions"), yamlValue(node, "steps")
+		if txs != nil && steps != nil && txs.Kind == yaml.SequenceNode && steps.Kind == yaml.SequenceNode {
+			fn(node, prefix)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			walkYAMLQueries(node.Content[i+1], overlayKey(prefix, node.Content[i].Value), fn)
+		}
+	case yaml.SequenceNode:
+		for i, elem := range node.Content {
+			walkYAMLQueries(elem, overlayKey(prefix, strconv.Itoa(i)), fn)
+		}
+	}
+}
+
+// walkJSONQueries calls fn with each object under node that has lists of
+// transactions and steps, and its key.
+func walkJSONQueries(node interface{}, prefix string, fn func(query map[string]interface{}, prefix string)) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		_, txs := node["transactions"].([]interface{})
+		_, steps := node["steps"].([]interface{})
+		if txs && steps {
+			fn(node, prefix)
+		}
+		for k, v := range node {
+			walkJSONQueries(v, overlayKey(prefix, k), fn)
+		}
+	case []interface{}:
+		for i, elem := range node {
+			walkJSONQueries(elem, overlayKey(prefix, strconv.Itoa(i)), fn)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/itchyny/gojq"
+)
+
+// errExprNotCompiled is returned when applying an expression that imports
+// modules but was never compiled with the config's modules.
+var errExprNotCompiled = errors.New("expression imports modules and was not compiled")
+
+// ModuleDef is a library of jq functions that expressions may import by the
+// module's name, as in `import "paging" as p; p::envelope`. Its functions
+// are defined either inline by Defs or in the file File.
+type ModuleDef struct {
+	Defs string `json:"defs,omitempty" yaml:"defs,omitempty"`
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+
+	query *gojq.Query
+}
+
+func (md *ModuleDef) Validate() error {
+	src := md.Defs
+	switch {
+	case md.Defs != "" && md.File != "":
+		return errors.New("only one of defs or file may be set")
+	case md.File != "":
+		p, err := os.ReadFile(md.File)
+		if err != nil {
+			return err
+		}
+		src = string(p)
+	case md.Defs == "":
+		return errors.New("one of defs or file is required")
+	}
+
+	q, err := gojq.Parse(src)
+	if err != nil {
+		return fmt.Errorf("error parsing module: %w", err)
+	}
+	if q.Term != nil || q.Left != nil || q.Right != nil || q.Func != "" {
+		return errors.New("module may only define functions")
+	}
+	md.query = q
+	return nil
+}
+
+// moduleLoader loads the config's modules for gojq. Modules are parsed once,
+// when the config is validated.
+type moduleLoader map[string]*ModuleDef
+
+func (ml moduleLoader) LoadModule(name string) (*gojq.Query, error) {
+	md := ml[name]
+	if md == nil || md.query == nil {
+		return nil, fmt.Errorf("module not found: %q", name)
+	}
+	return md.query, nil
+}
+
+// compileExprs compiles all expressions in c that import modules. It must
+// be called after the config's modules are validated.
+func (c *Config) compileExprs() error {
+	var me *multierror.Error
+	loader := moduleLoader(c.Modules)
+	walkExprs(c, func(e *Expr) {
+		if e.Code == nil && e.Query != nil {
+			if err := e.compile(loader); err != nil {
+				me = multierror.Append(me, fmt.Errorf("%s: %w", e.src, err))
+			}
+		}
+	})
+	return errorOrNil(me)
+}
+
+// walkExprs calls fn for each expression reachable from v through exported
+// fields, pointers, interfaces, slices, and maps. Each expression is visited
+// once, even if it is reachable more than once.
+func walkExprs(v interface{}, fn func(*Expr)) {
+	type ptr struct {
+		t reflect.Type
+		p uintptr
+	}
+	seen := map[ptr]bool{}
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Ptr:
+			key := ptr{v.Type(), v.Pointer()}
+			if v.IsNil() || seen[key] {
+				return
+			}
+			seen[key] = true
+			if e, ok := v.Interface().(*Expr); ok {
+				fn(e)
+				return
+			}
+			walk(v.Elem())
+		case reflect.Interface:
+			walk(v.Elem())
+		case reflect.Struct:
+			t := v.Type()
+			for i := 0; i < v.NumField(); i++ {
+				if t.Field(i).IsExported() {
+					walk(v.Field(i))
+				}
+			}
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i))
+			}
+		case reflect.Map:
+			iter := v.MapRange()
+			for iter.Next() {
+				walk(iter.Value())
+			}
+		}
+	}
+	walk(reflect.ValueOf(v))
+}
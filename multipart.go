@@ -0,0 +1,225 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const defaultMultipartMaxMemory = 32 << 20
+
+var errMultipartTooLarge = errors.New("request body is too large")
+
+// MultipartDef configures how multipart/form-data request bodies are read.
+// Files beyond MaxMemory bytes are written to temp files, which are removed
+// once the request completes.
+type MultipartDef struct {
+	MaxMemory int64 `json:"max_memory,omitempty" yaml:"max_memory,omitempty"` // Defaults to 32MiB.
+	MaxSize   int64 `json:"max_size,omitempty" yaml:"max_size,omitempty"`     // If 0, there is no limit.
+}
+
+func (md *MultipartDef) Validate() error {
+	var me *multierror.Error
+	if md.MaxMemory < 0 {
+		me = multierror.Append(me, errors.New("max_memory must not be negative"))
+	} else if md.MaxMemory == 0 {
+		md.MaxMemory = defaultMultipartMaxMemory
+	}
+	if md.MaxSize < 0 {
+		me = multierror.Append(me, errors.New("max_size must not be negative"))
+	}
+	return errorOrNil(me)
+}
+
+// limitedBody reads a request body, failing with errMultipartTooLarge once
+// more than n bytes have been read. The error returned by the multipart
+// reader may not wrap it, so exceeded records that it happened.
+type limitedBody struct {
+	r        io.ReadCloser
+	n        int64
+	exceeded bool
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.n < 0 {
+		lb.exceeded = true
+		return 0, errMultipartTooLarge
+	}
+	if int64(len(p)) > lb.n+1 {
+		p = p[:lb.n+1]
+	}
+	n, err := lb.r.Read(p)
+	lb.n -= int64(n)
+	if lb.n < 0 {
+		lb.exceeded = true
+		return n, errMultipartTooLarge
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.r.Close()
+}
+
+// multipartBody returns the fields of a multipart form for jq. Values are
+// given as in form bodies, and each file is an object of its filename,
+// size, and content type. A field with several values or files is a list.
+func multipartBody(form *multipart.Form) map[string]interface{} {
+	body := make(map[string]interface{}, len(form.Value)+len(form.File))
+	for k, vs := range form.Value {
+		for _, v := range vs {
+			body[k] = appendField(body[k], v, len(vs)+len(form.File[k]) > 1)
+		}
+	}
+	for k, fhs := range form.File {
+		for _, fh := range fhs {
+			meta := map[string]interface{}{
+				"filename":     fh.Filename,
+				"size":         int(fh.Size),
+				"content_type": fh.Header.Get("Content-Type"),
+			}
+			body[k] = appendField(body[k], meta, len(fhs)+len(form.Value[k]) > 1)
+		}
+	}
+	return body
+}
+
+// appendField adds v to field, a field of a multipart body. If list is
+// false, the field has only the one value.
+func appendField(field, v interface{}, list bool) interface{} {
+	if !list {
+		return v
+	}
+	vs, _ := field.([]interface{})
+	return append(vs, v)
+}
+
+// uploads are the files of a multipart request body, bound to args by
+// FileRef and FilePathRef.
+type uploads struct {
+	form *multipart.Form
+
+	mu    sync.Mutex
+	paths map[string]string // Temp files written for file_path args, by field.
+}
+
+func newUploads(form *multipart.Form) *uploads {
+	return &uploads{form: form}
+}
+
+// file returns the first file uploaded as the field name, if any.
+func (u *uploads) file(name string) (*multipart.FileHeader, bool) {
+	if u == nil {
+		return nil, false
+	}
+	fhs := u.form.File[name]
+	if len(fhs) == 0 {
+		return nil, false
+	}
+	return fhs[0], true
+}
+
+// Contents returns the contents of the first file uploaded as the field
+// name, and whether there was one.
+func (u *uploads) Contents(name string) ([]byte, bool, error) {
+	fh, ok := u.file(name)
+	if !ok {
+		return nil, false, nil
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening uploaded file %q: %w", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading uploaded file %q: %w", name, err)
+	}
+	return data, true, nil
+}
+
+// Path returns the path of a temp file holding the first file uploaded as
+// the field name, and whether there was one. The temp file is written on
+// first use and removed by Close.
+func (u *uploads) Path(name string) (string, bool, error) {
+	fh, ok := u.file(name)
+	if !ok {
+		return "", false, nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if path, ok := u.paths[name]; ok {
+		return path, true, nil
+	}
+	path, err := writeUpload(fh)
+	if err != nil {
+		return "", false, fmt.Errorf("error writing uploaded file %q: %w", name, err)
+	}
+	if u.paths == nil {
+		u.paths = map[string]string{}
+	}
+	u.paths[name] = path
+	return path, true, nil
+}
+
+// writeUpload copies fh to a new temp file and returns its path.
+func writeUpload(fh *multipart.FileHeader) (string, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp("", "chisel-upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// Close removes the temp files of the uploads.
+func (u *uploads) Close() error {
+	if u == nil {
+		return nil
+	}
+	var me *multierror.Error
+	u.mu.Lock()
+	for _, path := range u.paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			me = multierror.Append(me, err)
+		}
+	}
+	u.paths = nil
+	u.mu.Unlock()
+	if err := u.form.RemoveAll(); err != nil {
+		me = multierror.Append(me, err)
+	}
+	return errorOrNil(me)
+}
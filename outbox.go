@@ -0,0 +1,315 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+)
+
+// tableNamePattern matches table names that are safe to interpolate into
+// queries.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// OutboxDef defines a transactional outbox: a table that steps append events
+// to in the same transaction as their writes, and that a background
+// dispatcher delivers to a sink. Events are delivered at least once.
+//
+// The table must have the columns id (an auto-incrementing integer),
+// payload (text), created_at (a timestamp), and delivered_at (a nullable
+// timestamp).
+type OutboxDef struct {
+	DB        string         `json:"db" yaml:"db"`
+	Table     string         `json:"table" yaml:"table"`
+	Sink      *OutboxSinkDef `json:"sink" yaml:"sink"`
+	Interval  Duration       `json:"interval" yaml:"interval"`     // Time between polls of the outbox table.
+	BatchSize int            `json:"batch_size" yaml:"batch_size"` // Events read from the table at a time.
+}
+
+func (od *OutboxDef) Validate() error {
+	if od == nil {
+		return errors.New("outbox definition is nil")
+	}
+	var me *multierror.Error
+	if od.DB == "" {
+		me = multierror.Append(me, errors.New("db is empty"))
+	}
+	if !tableNamePattern.MatchString(od.Table) {
+		me = multierror.Append(me, fmt.Errorf("invalid table name %q", od.Table))
+	}
+	if od.Sink == nil {
+		me = multierror.Append(me, errors.New("sink is not defined"))
+	} else if err := od.Sink.Validate(); err != nil {
+		me = multierror.Append(me, fmt.Errorf("sink failed validation: %w", err))
+	}
+	if od.Interval.Duration <= 0 {
+		od.Interval.Duration = time.Second
+	}
+	if od.BatchSize <= 0 {
+		od.BatchSize = 100
+	}
+	return errorOrNil(me)
+}
+
+// OutboxSinkDef is where an outbox's events are delivered. Only webhooks are
+// currently supported.
+type OutboxSinkDef struct {
+	Type    string            `json:"type" yaml:"type"` // webhook (default).
+	URL     string            `json:"url" yaml:"url"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Timeout Duration          `json:"timeout" yaml:"timeout"`
+	// Client, if set, names the http_clients entry webhooks are sent with
+	// instead of the config's http_client.
+	Client string `json:"client,omitempty" yaml:"client,omitempty"`
+
+	client *http.Client // Resolved when the config is validated.
+}
+
+func (sd *OutboxSinkDef) Validate() error {
+	var me *multierror.Error
+	switch sd.Type {
+	case "":
+		sd.Type = "webhook"
+	case "webhook":
+	default:
+		me = multierror.Append(me, fmt.Errorf("unrecognized sink type %q", sd.Type))
+	}
+	if sd.URL == "" {
+		me = multierror.Append(me, errors.New("url is empty"))
+	}
+	if sd.Timeout.Duration <= 0 {
+		sd.Timeout.Duration = 10 * time.Second
+	}
+	return errorOrNil(me)
+}
+
+// Deliver posts an event's payload to the webhook. The event ID is sent in
+// the X-Chisel-Event-Id header so that receivers can discard duplicates.
+func (sd *OutboxSinkDef) Deliver(ctx context.Context, id string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, sd.Timeout.Duration)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", sd.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	for k, v := range sd.Headers {
+		req.Header.Set(k, v)
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-Chisel-Event-Id", id)
+
+	client := sd.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error performing request: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// EmitDef appends events to an outbox from a step. Event is applied to the
+// step's output, after its mappings, with access to $context. If it returns
+// null, no event is appended; if it returns a list, each element is appended
+// as its own event.
+type EmitDef struct {
+	Outbox string `json:"outbox" yaml:"outbox"`
+	Event  *Expr  `json:"event" yaml:"event"`
+}
+
+func (ed *EmitDef) Validate() error {
+	var me *multierror.Error
+	if ed.Outbox == "" {
+		me = multierror.Append(me, errors.New("outbox is empty"))
+	}
+	if ed.Event == nil {
+		me = multierror.Append(me, errors.New("event is empty"))
+	}
+	return errorOrNil(me)
+}
+
+// Events evaluates the event expression and returns the JSON payloads of
+// the events to append.
+func (ed *EmitDef) Events(ctx context.Context, input, ctxVar interface{}) ([][]byte, error) {
+	out, err := ed.Event.Apply(ctx, input, ctxVar)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating event: %w", err)
+	}
+	var events []interface{}
+	switch out := out.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		events = out
+	default:
+		events = []interface{}{out}
+	}
+
+	payloads := make([][]byte, 0, len(events))
+	for i, ev := range events {
+		if ev == nil {
+			continue
+		}
+		p, err := json.Marshal(ev)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding event %d: %w", i, err)
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+// appendOutbox inserts events into an outbox table using t, the transaction
+// of the step that emitted them.
+func appendOutbox(ctx context.Context, t *transactionState, od *OutboxDef, payloads [][]byte) error {
+	query := rebind(t.db.options.BindType, "INSERT INTO "+od.Table+" (payload, created_at) VALUES (?, ?)")
+	now := time.Now().UTC()
+	for i, p := range payloads {
+		rows, err := t.QueryContext(t.Context(ctx), query, string(p), now)
+		if err != nil {
+			return fmt.Errorf("error appending event %d to outbox: %w", i, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// outboxDispatcher polls an outbox table and delivers undelivered events to
+// its sink in order.
+type outboxDispatcher struct {
+	name string
+	def  *OutboxDef
+	db   *Database
+}
+
+func (d *outboxDispatcher) Run(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("outbox", d.name).Logger()
+	ticker := time.NewTicker(d.def.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := d.dispatch(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warn().Err(err).Msg("Error dispatching outbox events.")
+				}
+				break
+			}
+			if n > 0 {
+				log.Debug().Int("events", n).Msg("Dispatched outbox events.")
+			}
+			if n < d.def.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type outboxEvent struct {
+	ID      int64  `db:"id"`
+	Payload string `db:"payload"`
+}
+
+// dispatch delivers a single batch of events and returns the number
+// delivered. Delivery stops at the first failed event so that events are
+// delivered in order.
+func (d *outboxDispatcher) dispatch(ctx context.Context) (int, error) {
+	bind := d.db.options.BindType
+	var events []outboxEvent
+	query := "SELECT id, payload FROM " + d.def.Table +
+		" WHERE delivered_at IS NULL ORDER BY id" + limitClause(bind, d.def.BatchSize)
+	if err := d.db.db.SelectContext(ctx, &events, query); err != nil {
+		return 0, fmt.Errorf("error reading outbox: %w", err)
+	}
+
+	mark := rebind(bind, "UPDATE "+d.def.Table+" SET delivered_at = ? WHERE id = ?")
+	for i, ev := range events {
+		id := d.name + "-" + strconv.FormatInt(ev.ID, 10)
+		if err := d.def.Sink.Deliver(ctx, id, []byte(ev.Payload)); err != nil {
+			return i, fmt.Errorf("error delivering event %s: %w", id, err)
+		}
+		if _, err := d.db.db.ExecContext(ctx, mark, time.Now().UTC(), ev.ID); err != nil {
+			return i, fmt.Errorf("error marking event %s delivered: %w", id, err)
+		}
+	}
+	return len(events), nil
+}
+
+// StartOutboxes starts dispatchers for the outboxes of the current config,
+// stopping any that are already running. Dispatchers stop when ctx ends.
+func (s *Server) StartOutboxes(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startOutboxes(ctx)
+}
+
+// startOutboxes is StartOutboxes for callers holding s.mu. Outboxes aren't
+// dispatched in standby, since the process a standby replaces still
+// dispatches them; they're started when it's promoted.
+func (s *Server) startOutboxes(ctx context.Context) {
+	s.stopOutboxes()
+	if len(s.conf.Outboxes) == 0 || s.standby != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for name, od := range s.conf.Outboxes {
+		d := &outboxDispatcher{name: name, def: od, db: s.dbs[od.DB]}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Run(ctx)
+		}()
+	}
+	s.outboxStop = func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// stopOutboxes stops running dispatchers and waits for them to exit. The
+// caller must hold s.mu.
+func (s *Server) stopOutboxes() {
+	if s.outboxStop != nil {
+		s.outboxStop()
+		s.outboxStop = nil
+	}
+}
@@ -0,0 +1,124 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// defaultPageParam is the query param holding a paginated endpoint's limit
+// if none is set.
+const defaultPageParam = "limit"
+
+// Headers reporting the limits applied to a paginated request.
+const (
+	pageLimitHeader    = "Page-Limit"
+	pageMaxLimitHeader = "Page-Max-Limit"
+)
+
+// PageDef enforces limits on the page size of a paginated endpoint, given by
+// the query param Param. Requests without the param use Default, and those
+// asking for more than Max are clamped to Max, or rejected with a 400 status
+// if Reject is set.
+type PageDef struct {
+	Param   string `json:"param,omitempty" yaml:"param,omitempty"`
+	Default int    `json:"default,omitempty" yaml:"default,omitempty"`
+	Max     int    `json:"max" yaml:"max"`
+	Reject  bool   `json:"reject,omitempty" yaml:"reject,omitempty"`
+}
+
+func (pd *PageDef) Validate() error {
+	var me *multierror.Error
+	if pd.Param == "" {
+		pd.Param = defaultPageParam
+	}
+	if pd.Max <= 0 {
+		me = multierror.Append(me, errors.New("max must be greater than 0"))
+	}
+	if pd.Default < 0 {
+		me = multierror.Append(me, errors.New("default must not be negative"))
+	} else if pd.Default == 0 {
+		pd.Default = pd.Max
+	} else if pd.Max > 0 && pd.Default > pd.Max {
+		me = multierror.Append(me, fmt.Errorf("default %d is greater than max %d", pd.Default, pd.Max))
+	}
+	return errorOrNil(me)
+}
+
+// PageInfo describes the limit applied to a paginated request. It's
+// available to expressions as $context.page.
+type PageInfo struct {
+	Limit     int  `json:"limit"`
+	Default   int  `json:"default"`
+	Max       int  `json:"max"`
+	Requested *int `json:"requested"` // The limit asked for, if any.
+	Clamped   bool `json:"clamped"`   // Whether the limit asked for was reduced to Max.
+}
+
+func (pi *PageInfo) Opaque() map[string]interface{} {
+	var requested interface{}
+	if pi.Requested != nil {
+		requested = *pi.Requested
+	}
+	return map[string]interface{}{
+		"limit":     pi.Limit,
+		"default":   pi.Default,
+		"max":       pi.Max,
+		"requested": requested,
+		"clamped":   pi.Clamped,
+	}
+}
+
+// WriteHeaders reports the applied limits in the response's headers. It does
+// nothing if pi is nil.
+func (pi *PageInfo) WriteHeaders(h http.Header) {
+	if pi == nil {
+		return
+	}
+	h.Set(pageLimitHeader, strconv.Itoa(pi.Limit))
+	h.Set(pageMaxLimitHeader, strconv.Itoa(pi.Max))
+}
+
+// Apply returns the limit to use for a request with the query q.
+func (pd *PageDef) Apply(q url.Values) (*PageInfo, error) {
+	pi := &PageInfo{Limit: pd.Default, Default: pd.Default, Max: pd.Max}
+	vs, ok := q[pd.Param]
+	if !ok || len(vs) == 0 || vs[len(vs)-1] == "" {
+		return pi, nil
+	}
+	n, err := strconv.Atoi(vs[len(vs)-1])
+	if err != nil {
+		return nil, errors.New("limit must be an integer")
+	}
+	pi.Requested = &n
+	switch {
+	case n < 1:
+		return nil, errors.New("limit must be at least 1")
+	case n > pd.Max && pd.Reject:
+		return nil, fmt.Errorf("limit must be at most %d", pd.Max)
+	case n > pd.Max:
+		pi.Limit, pi.Clamped = pd.Max, true
+	default:
+		pi.Limit = n
+	}
+	return pi, nil
+}
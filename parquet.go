@@ -0,0 +1,308 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+const parquetContentType = "application/vnd.apache.parquet"
+
+// parquetRowGroupRows is the maximum number of rows in each Parquet row group.
+const parquetRowGroupRows = 64 * 1024
+
+// Parquet thrift enum values used by encodeParquet.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// encodeParquet encodes out as an uncompressed Parquet file. Each column of
+// each row group is written as a single PLAIN-encoded data page.
+func encodeParquet(out interface{}) ([]byte, error) {
+	rows, err := tableRows(out)
+	if err != nil {
+		return nil, err
+	}
+	columns := tableColumns(rows)
+
+	var buf bytes.Buffer
+	buf.WriteString("PAR1")
+
+	meta := newThriftWriter()
+	meta.i32(1, 1) // version
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.begin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.end()
+	for _, col := range columns {
+		typ, converted := parquetType(col.Type)
+		meta.begin()
+		meta.i32(1, typ)
+		meta.i32(3, parquetOptional)
+		meta.binary(4, col.Name)
+		if converted >= 0 {
+			meta.i32(6, converted)
+		}
+		meta.end()
+	}
+	meta.i64(3, int64(len(rows)))
+
+	groups := (len(rows) + parquetRowGroupRows - 1) / parquetRowGroupRows
+	meta.list(4, thriftStruct, groups)
+	for lo := 0; lo < len(rows); lo += parquetRowGroupRows {
+		hi := lo + parquetRowGroupRows
+		if hi > len(rows) {
+			hi = len(rows)
+		}
+		n := int64(hi - lo)
+
+		meta.begin()
+		meta.list(1, thriftStruct, len(columns))
+		var total int64
+		for _, col := range columns {
+			offset := int64(buf.Len())
+			page := parquetPage(col, lo, hi)
+			header := newThriftWriter()
+			header.i32(1, parquetDataPage)
+			header.i32(2, int32(len(page)))
+			header.i32(3, int32(len(page)))
+			header.structField(5)
+			header.i32(1, int32(n))
+			header.i32(2, parquetPlain)
+			header.i32(3, parquetRLE)
+			header.i32(4, parquetRLE)
+			header.end()
+			header.end()
+			size := int64(header.Len() + len(page))
+			total += size
+			buf.Write(header.Bytes())
+			buf.Write(page)
+
+			typ, _ := parquetType(col.Type)
+			meta.begin()
+			meta.i64(2, offset) // file_offset
+			meta.structField(3)
+			meta.i32(1, typ)
+			meta.list(2, thriftI32, 2)
+			meta.zigzag(parquetPlain)
+			meta.zigzag(parquetRLE)
+			meta.list(3, thriftBinary, 1)
+			meta.str(col.Name)
+			meta.i32(4, parquetUncompressed)
+			meta.i64(5, n)
+			meta.i64(6, size)
+			meta.i64(7, size)
+			meta.i64(9, offset) // data_page_offset
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, total)
+		meta.i64(3, n)
+		meta.end()
+	}
+	meta.binary(6, "chisel")
+	meta.end()
+
+	buf.Write(meta.Bytes())
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(meta.Len()))
+	buf.Write(footer[:])
+	buf.WriteString("PAR1")
+	return buf.Bytes(), nil
+}
+
+// parquetType returns the physical and converted types of a column. The
+// converted type is -1 if the column has none.
+func parquetType(typ ColumnType) (physical, converted int32) {
+	switch typ {
+	case BoolColumn:
+		return parquetBoolean, -1
+	case Int64Column:
+		return parquetInt64, -1
+	case Float64Column:
+		return parquetDouble, -1
+	case BinaryColumn:
+		return parquetByteArray, -1
+	case TimestampColumn:
+		return parquetInt64, parquetTimestampMicros
+	default:
+		return parquetByteArray, parquetUTF8
+	}
+}
+
+// parquetPage returns the body of a data page holding rows lo through hi of
+// col: its definition levels followed by its non-null values.
+func parquetPage(col *column, lo, hi int) []byte {
+	values := col.Values[lo:hi]
+
+	// Definition levels are RLE runs of 0 (null) or 1, prefixed by their
+	// length.
+	var levels []byte
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && (values[j] == nil) == (values[i] == nil) {
+			j++
+		}
+		levels = appendUvarint(levels, uint64(j-i)<<1)
+		if values[i] == nil {
+			levels = append(levels, 0)
+		} else {
+			levels = append(levels, 1)
+		}
+		i = j
+	}
+	page := make([]byte, 4, 4+len(levels))
+	binary.LittleEndian.PutUint32(page, uint32(len(levels)))
+	page = append(page, levels...)
+
+	var b [8]byte
+	var bits, nbits int
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case bool:
+			if v {
+				bits |= 1 << nbits
+			}
+			if nbits++; nbits == 8 {
+				page = append(page, byte(bits))
+				bits, nbits = 0, 0
+			}
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			page = append(page, b[:]...)
+		case float64:
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			page = append(page, b[:]...)
+		default:
+			p := columnBytes(v)
+			binary.LittleEndian.PutUint32(b[:], uint32(len(p)))
+			page = append(append(page, b[:4]...), p...)
+		}
+	}
+	if nbits > 0 {
+		page = append(page, byte(bits))
+	}
+	return page
+}
+
+func appendUvarint(p []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(p, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes structs using the thrift compact protocol. Structs are
+// opened with begin or structField and closed with end.
+type thriftWriter struct {
+	bytes.Buffer
+	last []int16 // The last field ID written in each open struct.
+}
+
+// newThriftWriter returns a thriftWriter with a top-level struct open.
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (w *thriftWriter) begin() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) end() {
+	w.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		w.WriteByte(byte(d)<<4 | typ)
+	} else {
+		w.WriteByte(typ)
+		w.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) varint(v uint64) {
+	w.Write(appendUvarint(nil, v))
+}
+
+func (w *thriftWriter) zigzag(v int64) {
+	w.varint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (w *thriftWriter) str(s string) {
+	w.varint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.zigzag(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.zigzag(v)
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.str(s)
+}
+
+// list writes the header of a list of n elements. Struct elements are written
+// with begin and end.
+func (w *thriftWriter) list(id int16, elem byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	w.WriteByte(0xf0 | elem)
+	w.varint(uint64(n))
+}
+
+func (w *thriftWriter) structField(id int16) {
+	w.field(id, thriftStruct)
+	w.begin()
+}
@@ -0,0 +1,306 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeParquet(t *testing.T) {
+	got, err := encodeParquet(tableTestRows())
+	if err != nil {
+		t.Fatalf("encodeParquet() = %v", err)
+	}
+	checkGolden(t, "table.parquet", got)
+
+	file, err := readTestParquet(got)
+	if err != nil {
+		t.Fatalf("error reading parquet file: %v", err)
+	}
+	if file.rows != 3 {
+		t.Errorf("rows = %d; want 3", file.rows)
+	}
+	want := []testParquetColumn{
+		{"at", parquetInt64, parquetTimestampMicros, []interface{}{int64(1609556645000006), nil, int64(-1000000)}},
+		{"data", parquetByteArray, -1, []interface{}{[]byte{1, 2}, nil, []byte{}}},
+		{"id", parquetInt64, -1, []interface{}{int64(1), int64(2), int64(-3)}},
+		{"name", parquetByteArray, parquetUTF8, []interface{}{[]byte("a"), nil, []byte("ccc")}},
+		{"ok", parquetBoolean, -1, []interface{}{true, false, nil}},
+		{"score", parquetDouble, -1, []interface{}{1.5, nil, -2.25}},
+	}
+	if !reflect.DeepEqual(file.columns, want) {
+		t.Errorf("columns = %v; want %v", file.columns, want)
+	}
+}
+
+func TestEncodeParquetEmpty(t *testing.T) {
+	got, err := encodeParquet([]interface{}{})
+	if err != nil {
+		t.Fatalf("encodeParquet() = %v", err)
+	}
+	file, err := readTestParquet(got)
+	if err != nil {
+		t.Fatalf("error reading parquet file: %v", err)
+	}
+	if file.rows != 0 || len(file.columns) != 0 {
+		t.Errorf("file = %v; want no rows or columns", file)
+	}
+}
+
+type testParquetFile struct {
+	rows    int64
+	columns []testParquetColumn
+}
+
+type testParquetColumn struct {
+	Name      string
+	Type      int32
+	Converted int32
+	Values    []interface{}
+}
+
+// readTestParquet decodes a Parquet file written by encodeParquet. It reads
+// the file's thrift metadata independently of thriftWriter, and supports only
+// the parts of the format encodeParquet uses: flat optional columns of
+// uncompressed, PLAIN-encoded data pages with RLE definition levels.
+func readTestParquet(p []byte) (*testParquetFile, error) {
+	if len(p) < 12 || string(p[:4]) != "PAR1" || string(p[len(p)-4:]) != "PAR1" {
+		return nil, errors.New("missing PAR1 magic")
+	}
+	n := int(binary.LittleEndian.Uint32(p[len(p)-8:]))
+	if n > len(p)-12 {
+		return nil, fmt.Errorf("footer length %d is too large", n)
+	}
+	r := &testThriftReader{p: p[len(p)-8-n : len(p)-8]}
+	meta := r.structure()
+	if r.err != nil {
+		return nil, fmt.Errorf("error reading footer: %w", r.err)
+	}
+
+	file := &testParquetFile{rows: meta[3].(int64)}
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[5].(int64) != int64(len(schema)-1) {
+		return nil, fmt.Errorf("root has %d children, want %d", root[5], len(schema)-1)
+	}
+	for _, el := range schema[1:] {
+		el := el.(map[int16]interface{})
+		if el[3].(int64) != parquetOptional {
+			return nil, fmt.Errorf("column %s is not optional", el[4])
+		}
+		col := testParquetColumn{Name: string(el[4].([]byte)), Type: int32(el[1].(int64)), Converted: -1}
+		if c, ok := el[6]; ok {
+			col.Converted = int32(c.(int64))
+		}
+		file.columns = append(file.columns, col)
+	}
+
+	groups, _ := meta[4].([]interface{})
+	for _, g := range groups {
+		chunks := g.(map[int16]interface{})[1].([]interface{})
+		if len(chunks) != len(file.columns) {
+			return nil, fmt.Errorf("row group has %d columns, want %d", len(chunks), len(file.columns))
+		}
+		for i, chunk := range chunks {
+			cm := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			col := &file.columns[i]
+			if path := cm[3].([]interface{}); len(path) != 1 || string(path[0].([]byte)) != col.Name {
+				return nil, fmt.Errorf("column %d has path %q, want %q", i, path, col.Name)
+			}
+			if cm[4].(int64) != parquetUncompressed {
+				return nil, fmt.Errorf("column %s is compressed", col.Name)
+			}
+			values, err := readTestParquetPage(p, cm[9].(int64), col.Type, cm[5].(int64))
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			col.Values = append(col.Values, values...)
+		}
+	}
+	return file, nil
+}
+
+// readTestParquetPage reads the n values of the data page at offset.
+func readTestParquetPage(p []byte, offset int64, typ int32, n int64) ([]interface{}, error) {
+	r := &testThriftReader{p: p[offset:]}
+	header := r.structure()
+	if r.err != nil {
+		return nil, fmt.Errorf("error reading page header: %w", r.err)
+	}
+	if header[1].(int64) != parquetDataPage {
+		return nil, fmt.Errorf("page type is %d, want a data page", header[1])
+	}
+	dph := header[5].(map[int16]interface{})
+	if dph[1].(int64) != n || dph[2].(int64) != parquetPlain {
+		return nil, fmt.Errorf("page has %d values encoded as %d, want %d PLAIN values", dph[1], dph[2], n)
+	}
+	page := r.p[:header[3].(int64)]
+
+	// Definition levels, with a bit width of 1.
+	size := binary.LittleEndian.Uint32(page)
+	levels, rest := page[4:4+size], page[4+size:]
+	var defined []bool
+	for len(levels) > 0 {
+		run, k := binary.Uvarint(levels)
+		if run&1 != 0 {
+			return nil, errors.New("bit-packed definition levels are not supported")
+		}
+		for i := uint64(0); i < run>>1; i++ {
+			defined = append(defined, levels[k] == 1)
+		}
+		levels = levels[k+1:]
+	}
+	if int64(len(defined)) != n {
+		return nil, fmt.Errorf("page has %d definition levels, want %d", len(defined), n)
+	}
+
+	values := make([]interface{}, n)
+	bit := 0
+	for i, ok := range defined {
+		if !ok {
+			continue
+		}
+		switch typ {
+		case parquetBoolean:
+			values[i] = rest[bit/8]&(1<<(bit%8)) != 0
+			bit++
+		case parquetInt64:
+			values[i] = int64(binary.LittleEndian.Uint64(rest))
+			rest = rest[8:]
+		case parquetDouble:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(rest))
+			rest = rest[8:]
+		case parquetByteArray:
+			size := binary.LittleEndian.Uint32(rest)
+			values[i] = append([]byte{}, rest[4:4+size]...)
+			rest = rest[4+size:]
+		default:
+			return nil, fmt.Errorf("unsupported type %d", typ)
+		}
+	}
+	return values, nil
+}
+
+// testThriftReader reads thrift compact protocol structs as maps of field
+// IDs to values: int64s for integers, []bytes for binary, bools, lists as
+// []interface{}, and structs as maps.
+type testThriftReader struct {
+	p   []byte
+	err error
+}
+
+func (r *testThriftReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.p = nil
+}
+
+func (r *testThriftReader) byte() byte {
+	if len(r.p) == 0 {
+		r.fail(errors.New("unexpected end of data"))
+		return 0
+	}
+	b := r.p[0]
+	r.p = r.p[1:]
+	return b
+}
+
+func (r *testThriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.p)
+	if n <= 0 {
+		r.fail(errors.New("invalid varint"))
+		return 0
+	}
+	r.p = r.p[n:]
+	return v
+}
+
+func (r *testThriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *testThriftReader) structure() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var id int16
+	for r.err == nil {
+		b := r.byte()
+		if b == 0 {
+			break
+		}
+		if d := int16(b >> 4); d != 0 {
+			id += d
+		} else {
+			id = int16(r.zigzag())
+		}
+		switch typ := b & 0x0f; typ {
+		case 1, 2: // Booleans are held in the field's type.
+			fields[id] = typ == 1
+		default:
+			fields[id] = r.value(typ)
+		}
+	}
+	return fields
+}
+
+func (r *testThriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1, 2: // Booleans in lists are a byte each.
+		return r.byte() == 1
+	case 3:
+		return int64(int8(r.byte()))
+	case 4, 5, 6:
+		return r.zigzag()
+	case 7:
+		if len(r.p) < 8 {
+			r.fail(errors.New("unexpected end of data"))
+			return nil
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.p))
+		r.p = r.p[8:]
+		return v
+	case 8:
+		n := r.uvarint()
+		if n > uint64(len(r.p)) {
+			r.fail(errors.New("binary is longer than the data"))
+			return nil
+		}
+		v := r.p[:n]
+		r.p = r.p[n:]
+		return v
+	case 9, 10:
+		b := r.byte()
+		n := uint64(b >> 4)
+		if n == 15 {
+			n = r.uvarint()
+		}
+		list := []interface{}{}
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			list = append(list, r.value(b&0x0f))
+		}
+		return list
+	case 12:
+		return r.structure()
+	}
+	r.fail(fmt.Errorf("unsupported thrift type %d", typ))
+	return nil
+}
@@ -0,0 +1,114 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+)
+
+// PoolDef is a named worker pool that bounds the number of requests to its
+// endpoints handled at once. Requests arriving while all workers are busy
+// wait in the pool's queue, and are rejected with a 503 status if the queue
+// is full or they wait longer than QueueTimeout. Assigning expensive
+// endpoints to a pool keeps them from starving latency-sensitive ones.
+type PoolDef struct {
+	Workers      int      `json:"workers,omitempty" yaml:"workers,omitempty"`             // Defaults to GOMAXPROCS.
+	Queue        int      `json:"queue,omitempty" yaml:"queue,omitempty"`                 // Defaults to 100.
+	QueueTimeout Duration `json:"queue_timeout,omitempty" yaml:"queue_timeout,omitempty"` // If zero, requests wait until canceled.
+
+	once    sync.Once
+	workers chan struct{}
+	waiting int32
+}
+
+func (pd *PoolDef) Validate() error {
+	var me *multierror.Error
+	if pd.Workers < 0 {
+		me = multierror.Append(me, errors.New("workers must not be negative"))
+	} else if pd.Workers == 0 {
+		pd.Workers = runtime.GOMAXPROCS(0)
+	}
+	if pd.Queue < 0 {
+		me = multierror.Append(me, errors.New("queue must not be negative"))
+	} else if pd.Queue == 0 {
+		pd.Queue = 100
+	}
+	if pd.QueueTimeout.Duration < 0 {
+		me = multierror.Append(me, errors.New("queue_timeout must not be negative"))
+	}
+	return errorOrNil(me)
+}
+
+// acquire waits for a free worker and reports whether one was acquired. If
+// it returns true, the worker must be returned with release.
+func (pd *PoolDef) acquire(req *http.Request) bool {
+	pd.once.Do(func() {
+		pd.workers = make(chan struct{}, pd.Workers)
+	})
+	select {
+	case pd.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	if atomic.AddInt32(&pd.waiting, 1) > int32(pd.Queue) {
+		atomic.AddInt32(&pd.waiting, -1)
+		return false
+	}
+	defer atomic.AddInt32(&pd.waiting, -1)
+
+	var timeout <-chan time.Time
+	if d := pd.QueueTimeout.Duration; d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pd.workers <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (pd *PoolDef) release() {
+	<-pd.workers
+}
+
+// Wrap runs requests to next on the pool's workers.
+func (pd *PoolDef) Wrap(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !pd.acquire(req) {
+			log := *zerolog.Ctx(req.Context())
+			log.Warn().Str("pool", name).Msg("Worker pool is busy, rejecting request.")
+			w.Header().Set("Retry-After", "1")
+			writeError(log, w, http.StatusServiceUnavailable, &errorResponse{Error: "server busy"})
+			return
+		}
+		defer pd.release()
+		next.ServeHTTP(w, req)
+	})
+}
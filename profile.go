@@ -0,0 +1,329 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tailscale/hujson"
+	"gopkg.in/yaml.v3"
+)
+
+// profileEnv is the environment variable the config profile is read from
+// if -profile is not set.
+const profileEnv = "CHISEL_PROFILE"
+
+// validProfile returns an error if profile cannot be used in a file name.
+func validProfile(profile string) error {
+	if strings.ContainsAny(profile, `/\`) || profile == "." || profile == ".." {
+		return fmt.Errorf("invalid profile %q", profile)
+	}
+	return nil
+}
+
+// logProfileChanges logs the config keys changed by profile overlays. Only
+// keys are logged, since values may be secrets.
+func logProfileChanges(log zerolog.Logger, profile string, conf *Config) {
+	if profile == "" {
+		return
+	}
+	log.Info().
+		Str("profile", profile).
+		Strs("changed", conf.profileChanges).
+		Msg("Applied config profile overlays.")
+}
+
+// profileOverlayPath returns the path of the profile's overlay for the config
+// file at path, such as config.prod.yaml for config.yaml. The overlays of
+// encrypted files and templates are also encrypted or templates, as with
+// config.prod.yaml.age.
+func profileOverlayPath(path, profile string) string {
+	path, suffix := splitConfigSuffix(path)
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + profile + ext + suffix
+}
+
+// isProfileOverlay returns whether the file at path is the overlay of another
+// config file in paths, such as config.prod.yaml if config.yaml is in paths.
+// Overlays are only read along with the files they overlay.
+func isProfileOverlay(path string, paths map[string]bool) bool {
+	dir, name := filepath.Split(path)
+	name, suffix := splitConfigSuffix(name)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	i := strings.LastIndexByte(stem, '.')
+	return i > 0 && paths[dir+stem[:i]+ext+suffix]
+}
+
+// applyProfileOverlay deep-merges the profile's overlay for the config file
+// at path, if it has one, over data, the file's contents after environment
+// expansion. It returns the merged data and the config keys the overlay
+// changed. Mappings are merged key by key, while lists and other values in
+// the overlay replace those in data.
+func applyProfileOverlay(path, profile string, data []byte) ([]byte, []string, error) {
+	if profile == "" {
+		return data, nil, nil
+	}
+	opath := profileOverlayPath(path, profile)
+	odata, err := readConfigData(opath, profile)
+	if errors.Is(err, os.ErrNotExist) {
+		return data, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("error reading profile overlay: %w", err)
+	}
+	return mergeProfileOverlay(configExt(path), opath, data, odata)
+}
+
+// profilesKey is the key of the section of a config file that holds the
+// overlays of its profiles.
+const profilesKey = "profiles"
+
+// applyInlineProfile removes the profiles section from data, a config file
+// in the format of the file extension ext, and deep-merges the profile's
+// overlay from it, if it has one, over the rest of the file, as with
+// overlay files. It returns the data and the config keys the profile
+// changed. Data without a profiles section is returned as-is.
+func applyInlineProfile(ext, profile string, data []byte) ([]byte, []string, error) {
+	var changes []string
+	var err error
+	switch ext {
+	case ".yaml", ".yml":
+		var base yaml.Node
+		if err = yaml.Unmarshal(data, &base); err != nil || len(base.Content) == 0 {
+			// Errors are reported when the config is decoded.
+			return data, nil, nil
+		}
+		root := base.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return data, nil, nil
+		}
+		var profiles *yaml.Node
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == profilesKey {
+				profiles = root.Content[i+1]
+				root.Content = append(root.Content[:i:i], root.Content[i+2:]...)
+				break
+			}
+		}
+		if profiles == nil {
+			return data, nil, nil
+		}
+		if profiles.Kind != yaml.MappingNode {
+			return nil, nil, errors.New("profiles must be a mapping of profile names to overlays")
+		}
+		for i := 0; i+1 < len(profiles.Content); i += 2 {
+			name, overlay := profiles.Content[i].Value, profiles.Content[i+1]
+			if err := validInlineProfile(name, overlay.Kind == yaml.MappingNode, hasYAMLKey(overlay, profilesKey)); err != nil {
+				return nil, nil, err
+			}
+			if name == profile {
+				mergeYAMLOverlay(root, overlay, "", &changes)
+			}
+		}
+		data, err = yaml.Marshal(&base)
+	default:
+		var base interface{}
+		if err = decodeJSONTree(data, &base); err != nil {
+			return data, nil, nil
+		}
+		obj, ok := base.(map[string]interface{})
+		if !ok {
+			return data, nil, nil
+		}
+		section, ok := obj[profilesKey]
+		if !ok {
+			return data, nil, nil
+		}
+		delete(obj, profilesKey)
+		profiles, ok := section.(map[string]interface{})
+		if !ok {
+			return nil, nil, errors.New("profiles must be a mapping of profile names to overlays")
+		}
+		for name, overlay := range profiles {
+			om, isMap := overlay.(map[string]interface{})
+			_, nested := om[profilesKey]
+			if err := validInlineProfile(name, isMap, nested); err != nil {
+				return nil, nil, err
+			}
+			if name == profile {
+				mergeJSONOverlay(obj, om, "", &changes)
+			}
+		}
+		data, err = json.Marshal(obj)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error applying profile %q: %w", profile, err)
+	}
+	sort.Strings(changes)
+	return data, changes, nil
+}
+
+// validInlineProfile returns an error if the profile name of a config
+// file's profiles section is invalid or its overlay isn't a mapping or
+// defines profiles of its own.
+func validInlineProfile(name string, isMap, nested bool) error {
+	if err := validProfile(name); err != nil || name == "" {
+		return fmt.Errorf("invalid profile name %q in profiles", name)
+	}
+	if !isMap {
+		return fmt.Errorf("profile %q must be a mapping", name)
+	}
+	if nested {
+		return fmt.Errorf("profile %q cannot define profiles", name)
+	}
+	return nil
+}
+
+// hasYAMLKey returns whether the YAML mapping node has the key.
+func hasYAMLKey(node *yaml.Node, key string) bool {
+	if node.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeProfileOverlay deep-merges the overlay odata, read from opath, over
+// data. Both are in the format of the file extension ext.
+func mergeProfileOverlay(ext, opath string, data, odata []byte) ([]byte, []string, error) {
+	var changes []string
+	var err error
+	switch ext {
+	case ".yaml", ".yml":
+		odata, err = expandConfigEnvYAML(odata)
+		if err != nil {
+			break
+		}
+		var base, overlay yaml.Node
+		if err = yaml.Unmarshal(data, &base); err != nil {
+			break
+		}
+		if err = yaml.Unmarshal(odata, &overlay); err != nil {
+			err = fmt.Errorf("%s: %w", opath, err)
+			break
+		}
+		if len(overlay.Content) == 0 {
+			return data, nil, nil
+		}
+		if len(base.Content) == 0 {
+			base = overlay
+		} else {
+			mergeYAMLOverlay(base.Content[0], overlay.Content[0], "", &changes)
+		}
+		data, err = yaml.Marshal(&base)
+	default:
+		odata, err = expandConfigEnvJSON(odata)
+		if err != nil {
+			break
+		}
+		var base, overlay interface{}
+		if err = decodeJSONTree(data, &base); err != nil {
+			break
+		}
+		if err = decodeJSONTree(odata, &overlay); err != nil {
+			err = fmt.Errorf("%s: %w", opath, err)
+			break
+		}
+		base = mergeJSONOverlay(base, overlay, "", &changes)
+		data, err = json.Marshal(base)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error applying profile overlay: %w", err)
+	}
+	sort.Strings(changes)
+	return data, changes, nil
+}
+
+func decodeJSONTree(data []byte, tree *interface{}) error {
+	dec := hujson.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(tree)
+}
+
+// overlayKey returns the config key of the field name under prefix. Keys
+// are joined with dots, as in databases.main.url.
+func overlayKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// mergeYAMLOverlay merges overlay into base, recording the keys it changes
+// in changes.
+func mergeYAMLOverlay(base, overlay *yaml.Node, prefix string, changes *[]string) {
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		a, aerr := yaml.Marshal(base)
+		b, berr := yaml.Marshal(overlay)
+		if aerr != nil || berr != nil || !bytes.Equal(a, b) {
+			*changes = append(*changes, prefix)
+		}
+		*base = *overlay
+		return
+	}
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		name := overlayKey(prefix, key.Value)
+		found := false
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				mergeYAMLOverlay(base.Content[j+1], value, name, changes)
+				found = true
+				break
+			}
+		}
+		if !found {
+			base.Content = append(base.Content, key, value)
+			*changes = append(*changes, name)
+		}
+	}
+}
+
+// mergeJSONOverlay merges overlay into base and returns the result,
+// recording the keys it changes in changes.
+func mergeJSONOverlay(base, overlay interface{}, prefix string, changes *[]string) interface{} {
+	bm, bok := base.(map[string]interface{})
+	om, ook := overlay.(map[string]interface{})
+	if !bok || !ook {
+		if !reflect.DeepEqual(base, overlay) {
+			*changes = append(*changes, prefix)
+		}
+		return overlay
+	}
+	for k, v := range om {
+		name := overlayKey(prefix, k)
+		if bv, ok := bm[k]; ok {
+			bm[k] = mergeJSONOverlay(bv, v, name, changes)
+			continue
+		}
+		bm[k] = v
+		*changes = append(*changes, name)
+	}
+	return bm
+}
@@ -0,0 +1,346 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+type QuotaPeriod int
+
+const (
+	DailyQuotaPeriod   QuotaPeriod = iota // day - Default
+	MonthlyQuotaPeriod                    // month
+)
+
+func (p QuotaPeriod) MarshalText() ([]byte, error) {
+	period := "day"
+	switch p {
+	case DailyQuotaPeriod:
+	case MonthlyQuotaPeriod:
+		period = "month"
+	default:
+		return nil, fmt.Errorf("unrecognized quota period %d", p)
+	}
+	return []byte(period), nil
+}
+
+func (p *QuotaPeriod) UnmarshalText(src []byte) error {
+	switch src := string(src); src {
+	case "day":
+		*p = DailyQuotaPeriod
+	case "month":
+		*p = MonthlyQuotaPeriod
+	default:
+		return fmt.Errorf("unrecognized quota period %q", src)
+	}
+	return nil
+}
+
+// window returns the name of the period containing now and the time at
+// which it ends. Periods are in UTC.
+func (p QuotaPeriod) window(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	y, m, d := now.Date()
+	if p == MonthlyQuotaPeriod {
+		return now.Format("2006-01"), time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return now.Format("2006-01-02"), time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// defaultQuotaTable is the table quota counts are kept in if a quota
+// middleware's db is set without a table.
+const defaultQuotaTable = "chisel_quotas"
+
+// QuotaMiddleware limits the number of requests a client may make per day or
+// month. Counts are kept in Redis or a database table, if configured, so that
+// they're shared by all instances of chisel and survive restarts. Otherwise,
+// they're kept in memory.
+//
+// A quota table must have the columns quota_key and quota_window (text,
+// together its primary key), requests (an integer), and expires (an
+// integer, the Unix time at which the row's window ends).
+type QuotaMiddleware struct {
+	Limit  int64       `json:"limit" yaml:"limit"` // The limit of clients without their own.
+	Period QuotaPeriod `json:"period" yaml:"period"`
+	// Key is what requests are counted by: "ip" (default), "principal"
+	// (the authenticated user), or "header:NAME" (the value of the
+	// request header NAME, such as an API key).
+	Key string `json:"key" yaml:"key"`
+	// Redis is the URL of a Redis server, such as redis://localhost:6379/0.
+	Redis string `json:"redis,omitempty" yaml:"redis,omitempty"`
+	// DB names the database whose Table counts are kept in, if not in
+	// Redis.
+	DB     string `json:"db,omitempty" yaml:"db,omitempty"`
+	Table  string `json:"table,omitempty" yaml:"table,omitempty"`   // Defaults to chisel_quotas.
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"` // Prefix of Redis keys and table keys.
+	// Limits loads each client's limit from a database, from the column
+	// limit of its row.
+	Limits *LimitsDef `json:"limits,omitempty" yaml:"limits,omitempty"`
+
+	redisOpts *redis.Options
+	initOnce  sync.Once
+	client    *redis.Client
+	db        *Database // Set by bindLimits.
+
+	mu     sync.Mutex
+	counts map[string]int64
+	window string
+	pruned string // The window in which ended rows were last deleted from Table.
+}
+
+func (m *QuotaMiddleware) Validate() error {
+	var me *multierror.Error
+	if m.Limit <= 0 {
+		me = multierror.Append(me, errors.New("limit must be greater than zero"))
+	}
+	if m.Key == "" {
+		m.Key = "ip"
+	} else if !validRequestKey(m.Key) {
+		me = multierror.Append(me, fmt.Errorf("unrecognized key %q", m.Key))
+	}
+	if m.Limits != nil {
+		if err := m.Limits.Validate(); err != nil {
+			me = multierror.Append(me, fmt.Errorf("limits failed validation: %w", err))
+		}
+	}
+	if m.Prefix == "" {
+		m.Prefix = "chisel:quota:"
+	}
+	if m.Redis != "" {
+		opts, err := redis.ParseURL(m.Redis)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("invalid redis url: %w", redactURLError(err)))
+		}
+		m.redisOpts = opts
+	}
+	switch {
+	case m.DB == "" && m.Table != "":
+		me = multierror.Append(me, errors.New("table requires db"))
+	case m.DB == "":
+	case m.Redis != "":
+		me = multierror.Append(me, errors.New("redis and db are mutually exclusive"))
+	case m.Table == "":
+		m.Table = defaultQuotaTable
+	case !tableNamePattern.MatchString(m.Table):
+		me = multierror.Append(me, fmt.Errorf("invalid table name %q", m.Table))
+	}
+	return errorOrNil(me)
+}
+
+// Close closes the middleware's Redis client, if it has one.
+func (m *QuotaMiddleware) Close() error {
+	m.initOnce.Do(func() {})
+	if m.client == nil {
+		return nil
+	}
+	return m.client.Close()
+}
+
+func (m *QuotaMiddleware) redisClient() *redis.Client {
+	m.initOnce.Do(func() {
+		if m.redisOpts != nil {
+			m.client = redis.NewClient(m.redisOpts)
+		}
+	})
+	return m.client
+}
+
+// key returns the key a request is counted under and the value it's
+// limited by. It returns false if the request has no key.
+func (m *QuotaMiddleware) key(req *http.Request) (key, value string, ok bool) {
+	value, ok = requestKey(m.Key, req)
+	return limitedKey(m.Key, value), value, ok
+}
+
+// limit returns the limit of the client value.
+func (m *QuotaMiddleware) limit(ctx context.Context, log zerolog.Logger, value string) int64 {
+	if m.Limits == nil {
+		return m.Limit
+	}
+	row, err := m.Limits.Lookup(ctx, value)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to load quota limits. Using the default limit.")
+		return m.Limit
+	}
+	if row == nil {
+		return m.Limit
+	}
+	limit, ok := opaqueInt(row["limit"])
+	if !ok {
+		log.Warn().Interface("limit", row["limit"]).Msg("Quota limits row has an invalid limit. Using the default limit.")
+		return m.Limit
+	}
+	return limit
+}
+
+// take counts a request against key's quota for the current window and
+// returns the number of requests made in the window, including this one.
+func (m *QuotaMiddleware) take(ctx context.Context, key string, now time.Time) (int64, time.Time, error) {
+	window, reset := m.Period.window(now)
+
+	if client := m.redisClient(); client != nil {
+		rkey := m.Prefix + window + ":" + key
+		var incr *redis.IntCmd
+		_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incr = pipe.Incr(ctx, rkey)
+			pipe.ExpireAt(ctx, rkey, reset)
+			return nil
+		})
+		if err != nil {
+			return 0, reset, fmt.Errorf("error updating quota: %w", err)
+		}
+		return incr.Val(), reset, nil
+	}
+
+	if m.DB != "" {
+		used, err := m.takeDB(ctx, key, window, reset, now)
+		return used, reset, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil || m.window != window {
+		m.counts = map[string]int64{}
+		m.window = window
+	}
+	m.counts[key]++
+	return m.counts[key], reset, nil
+}
+
+// takeDB counts a request against key's quota for window in the quota
+// table. The first request an instance counts in a window also deletes the
+// rows of windows that have ended.
+func (m *QuotaMiddleware) takeDB(ctx context.Context, key, window string, reset, now time.Time) (int64, error) {
+	db := m.db
+	if db == nil {
+		return 0, fmt.Errorf("database %q is not open", m.DB)
+	}
+
+	m.mu.Lock()
+	prune := m.pruned != window
+	m.pruned = window
+	m.mu.Unlock()
+	if prune {
+		query := rebind(db.options.BindType, "DELETE FROM "+m.Table+" WHERE expires <= ?")
+		if _, err := db.db.ExecContext(ctx, query, now.Unix()); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Unable to delete ended quota windows.")
+		}
+	}
+
+	// If another request inserts the window's row first, the insert fails
+	// and is retried as an update.
+	used, err := m.countDB(ctx, db, m.Prefix+key, window, reset)
+	if err != nil {
+		used, err = m.countDB(ctx, db, m.Prefix+key, window, reset)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error updating quota: %w", err)
+	}
+	return used, nil
+}
+
+// countDB increments the count of key in window, inserting its row if it
+// has none, and returns the new count.
+func (m *QuotaMiddleware) countDB(ctx context.Context, db *Database, key, window string, reset time.Time) (int64, error) {
+	bind := db.options.BindType
+	tx, err := db.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		rebind(bind, "UPDATE "+m.Table+" SET requests = requests + 1 WHERE quota_key = ? AND quota_window = ?"),
+		key, window)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		_, err := tx.ExecContext(ctx,
+			rebind(bind, "INSERT INTO "+m.Table+" (quota_key, quota_window, requests, expires) VALUES (?, ?, 1, ?)"),
+			key, window, reset.Unix())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var used int64
+	err = tx.GetContext(ctx, &used,
+		rebind(bind, "SELECT requests FROM "+m.Table+" WHERE quota_key = ? AND quota_window = ?"),
+		key, window)
+	if err != nil {
+		return 0, err
+	}
+	return used, tx.Commit()
+}
+
+func (m *QuotaMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		log := *zerolog.Ctx(ctx)
+
+		key, value, ok := m.key(req)
+		if !ok {
+			writeError(log, w, http.StatusUnauthorized, &errorResponse{
+				Error: "unauthorized",
+			})
+			return
+		}
+
+		limit := m.limit(ctx, log, value)
+		now := time.Now()
+		used, reset, err := m.take(ctx, key, now)
+		if err != nil {
+			// Fail open: an unavailable quota store shouldn't take
+			// endpoints down with it.
+			log.Warn().Err(err).Msg("Unable to check request quota.")
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+		h.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+		if used > limit {
+			secs := int64(reset.Sub(now).Round(time.Second) / time.Second)
+			h.Set("Retry-After", strconv.FormatInt(secs, 10))
+			writeError(log, w, http.StatusTooManyRequests, &errorResponse{
+				Error: "quota exceeded",
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
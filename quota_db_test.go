@@ -0,0 +1,99 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo && !omit_sqlite
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestQuotaDB returns a quota middleware counting requests in a quota
+// table of a fresh SQLite database.
+func newTestQuotaDB(t *testing.T, period QuotaPeriod) (*QuotaMiddleware, *Database) {
+	t.Helper()
+	_, db := newTestRouter(t, "  []\n")
+	_, err := db.db.Exec(`CREATE TABLE chisel_quotas (
+		quota_key    TEXT NOT NULL,
+		quota_window TEXT NOT NULL,
+		requests     INTEGER NOT NULL,
+		expires      INTEGER NOT NULL,
+		PRIMARY KEY (quota_key, quota_window)
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &QuotaMiddleware{Limit: 10, Period: period, DB: "main"}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	m.db = db
+	return m, db
+}
+
+// countQuotaRows returns the number of rows in the quota table.
+func countQuotaRows(t *testing.T, db *Database) int {
+	t.Helper()
+	var n int
+	if err := db.db.Get(&n, `SELECT COUNT(*) FROM chisel_quotas`); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestQuotaDBRolloverDay(t *testing.T) {
+	m, db := newTestQuotaDB(t, DailyQuotaPeriod)
+	testQuotaRollover(t, m,
+		time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	// The first request of the new day deleted the old day's row.
+	if n := countQuotaRows(t, db); n != 1 {
+		t.Errorf("quota rows = %d; want 1", n)
+	}
+}
+
+func TestQuotaDBRolloverMonth(t *testing.T) {
+	m, db := newTestQuotaDB(t, MonthlyQuotaPeriod)
+	testQuotaRollover(t, m,
+		time.Date(2021, 1, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+	if n := countQuotaRows(t, db); n != 1 {
+		t.Errorf("quota rows = %d; want 1", n)
+	}
+}
+
+func TestQuotaDBShared(t *testing.T) {
+	// Instances sharing a table share counts, as after a restart.
+	m, db := newTestQuotaDB(t, DailyQuotaPeriod)
+	now := time.Date(2021, 3, 14, 12, 0, 0, 0, time.UTC)
+	if _, _, err := m.take(context.Background(), "client", now); err != nil {
+		t.Fatal(err)
+	}
+	other := &QuotaMiddleware{Limit: 10, DB: "main"}
+	if err := other.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	other.db = db
+	used, _, err := other.take(context.Background(), "client", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 2 {
+		t.Errorf("take() = %d; want 2", used)
+	}
+}
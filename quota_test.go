@@ -0,0 +1,112 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodWindow(t *testing.T) {
+	utc := func(y int, m time.Month, d, h, min, s int) time.Time {
+		return time.Date(y, m, d, h, min, s, 0, time.UTC)
+	}
+	cases := []struct {
+		period QuotaPeriod
+		now    time.Time
+		window string
+		reset  time.Time
+	}{
+		{DailyQuotaPeriod, utc(2021, 3, 14, 0, 0, 0), "2021-03-14", utc(2021, 3, 15, 0, 0, 0)},
+		{DailyQuotaPeriod, utc(2021, 3, 14, 23, 59, 59), "2021-03-14", utc(2021, 3, 15, 0, 0, 0)},
+		{DailyQuotaPeriod, utc(2021, 1, 31, 12, 0, 0), "2021-01-31", utc(2021, 2, 1, 0, 0, 0)},
+		{DailyQuotaPeriod, utc(2021, 12, 31, 12, 0, 0), "2021-12-31", utc(2022, 1, 1, 0, 0, 0)},
+		{DailyQuotaPeriod, utc(2020, 2, 28, 12, 0, 0), "2020-02-28", utc(2020, 2, 29, 0, 0, 0)},
+		// Windows are in UTC, whatever the time's location.
+		{DailyQuotaPeriod, time.Date(2021, 3, 14, 20, 0, 0, 0, time.FixedZone("", -5*3600)), "2021-03-15", utc(2021, 3, 16, 0, 0, 0)},
+		{MonthlyQuotaPeriod, utc(2021, 3, 1, 0, 0, 0), "2021-03", utc(2021, 4, 1, 0, 0, 0)},
+		{MonthlyQuotaPeriod, utc(2021, 1, 31, 23, 59, 59), "2021-01", utc(2021, 2, 1, 0, 0, 0)},
+		{MonthlyQuotaPeriod, utc(2021, 12, 31, 23, 59, 59), "2021-12", utc(2022, 1, 1, 0, 0, 0)},
+	}
+	for _, c := range cases {
+		window, reset := c.period.window(c.now)
+		if window != c.window || !reset.Equal(c.reset) {
+			t.Errorf("window(%v) = %q, %v; want %q, %v", c.now, window, reset, c.window, c.reset)
+		}
+	}
+}
+
+// testQuotaRollover counts requests against the same key across the end of
+// a window, and checks that the count restarts in the next window.
+func testQuotaRollover(t *testing.T, m *QuotaMiddleware, last, next time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	for i, now := range []time.Time{last, last, next, next} {
+		want := int64(i%2 + 1)
+		used, _, err := m.take(ctx, "client", now)
+		if err != nil {
+			t.Fatalf("take(%v) = %v", now, err)
+		}
+		if used != want {
+			t.Errorf("take(%v) = %d; want %d", now, used, want)
+		}
+	}
+}
+
+func TestQuotaRolloverDay(t *testing.T) {
+	m := &QuotaMiddleware{Limit: 10}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	testQuotaRollover(t, m,
+		time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func TestQuotaRolloverMonth(t *testing.T) {
+	m := &QuotaMiddleware{Limit: 10, Period: MonthlyQuotaPeriod}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	testQuotaRollover(t, m,
+		time.Date(2021, 1, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func TestQuotaValidateDB(t *testing.T) {
+	cases := []struct {
+		name string
+		m    *QuotaMiddleware
+	}{
+		{"table without db", &QuotaMiddleware{Limit: 1, Table: "quotas"}},
+		{"db and redis", &QuotaMiddleware{Limit: 1, DB: "main", Redis: "redis://localhost:6379/0"}},
+		{"invalid table", &QuotaMiddleware{Limit: 1, DB: "main", Table: "quotas; DROP TABLE users"}},
+	}
+	for _, c := range cases {
+		if err := c.m.Validate(); err == nil {
+			t.Errorf("%s: Validate() = nil; want an error", c.name)
+		}
+	}
+
+	m := QuotaMiddleware{Limit: 1, DB: "main"}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if m.Table != defaultQuotaTable {
+		t.Errorf("Table = %q; want %q", m.Table, defaultQuotaTable)
+	}
+}
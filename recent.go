@@ -0,0 +1,99 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// requestIDHeader is the request header that request IDs are read from.
+const requestIDHeader = "X-Request-Id"
+
+// recentRequestErrorsSize is the number of failed requests kept for the
+// admin API.
+const recentRequestErrorsSize = 100
+
+// recentRequestErrors records the most recent failed requests for the admin
+// API.
+var recentRequestErrors = &recentErrorLog{errs: make([]*RecentError, recentRequestErrorsSize)}
+
+// RecentError describes a request that failed while running its query.
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`           // The path template of the endpoint.
+	Step      *int      `json:"step,omitempty"` // The step that failed, if any.
+	Status    int       `json:"status"`
+	SQLState  string    `json:"sqlstate,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Error     string    `json:"error"`
+}
+
+// sqlState returns the SQLSTATE code of err, if its driver reports one.
+func sqlState(err error) string {
+	var se interface {
+		error
+		SQLState() string
+	}
+	if errors.As(err, &se) {
+		return se.SQLState()
+	}
+	return ""
+}
+
+// recentErrorLog is a ring buffer of the most recent failed requests.
+type recentErrorLog struct {
+	mu   sync.Mutex
+	errs []*RecentError
+	next int
+	full bool
+}
+
+func (l *recentErrorLog) Add(re *RecentError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs[l.next] = re
+	l.next++
+	if l.next == len(l.errs) {
+		l.next, l.full = 0, true
+	}
+}
+
+// List returns the recorded errors, newest first.
+func (l *recentErrorLog) List() []*RecentError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.errs)
+	}
+	list := make([]*RecentError, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, l.errs[(l.next-i+len(l.errs))%len(l.errs)])
+	}
+	return list
+}
+
+func adminGetRecentErrors(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log := *zerolog.Ctx(req.Context())
+	writeJSON(log, w, http.StatusOK, recentRequestErrors.List())
+}
@@ -0,0 +1,348 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+// redactedSecret replaces secrets in printed config and logs. It matches
+// the placeholder used by url.URL.Redacted.
+const redactedSecret = "xxxxx"
+
+// errUnredactedSecret is returned by redactJSON in strict mode when a value
+// that looks like a secret would be printed as-is.
+var errUnredactedSecret = errors.New("possible secret is not redacted")
+
+// sensitiveNames are substrings of map keys and URL query parameters whose
+// values are treated as secrets in strict mode. Names are compared in lower
+// case with dashes and underscores removed.
+var sensitiveNames = []string{
+	"password",
+	"secret",
+	"token",
+	"apikey",
+	"authorization",
+	"cookie",
+	"privatekey",
+}
+
+// redactInliner is implemented by config types whose JSON encoding holds
+// the fields of another value, such as MiddlewareDef, so that the other
+// value's sensitive fields are redacted.
+type redactInliner interface {
+	redactInline() interface{}
+}
+
+// redactJSON encodes v as JSON with its secrets redacted. String fields
+// tagged `sensitive:"true"` are replaced entirely, as are all values of
+// sensitive maps and lists, and the passwords of URLs are redacted wherever
+// they appear. If strict is set, redactJSON fails instead of encoding a
+// value that still looks like a secret: a value under a key with a name
+// like "password" or "authorization", or a URL with such a query parameter.
+func redactJSON(v interface{}, strict bool) ([]byte, error) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(blob, &tree); err != nil {
+		return nil, err
+	}
+
+	tree = redactFields(reflect.ValueOf(v), tree)
+	var me *multierror.Error
+	tree = redactURLs(tree, "", strict, &me)
+	if err := errorOrNil(me); err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// redactConfig encodes conf with its secrets redacted, as redactJSON does,
+// in format, either json or yaml.
+func redactConfig(conf *Config, format string) ([]byte, error) {
+	data, err := redactJSON(conf, conf.StrictSecrets)
+	if err != nil || format != "yaml" {
+		return data, err
+	}
+	// JSON is YAML, so decoding it as a node keeps numbers exactly as
+	// they were encoded. Only its flow and quoting styles are dropped.
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+// clearYAMLStyle resets the style of node and its children so that they're
+// encoded in block style, with strings quoted only where they must be.
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
+// validConfigFormat returns whether format is a format redactConfig can
+// encode configs in.
+func validConfigFormat(format string) bool {
+	return format == "json" || format == "yaml"
+}
+
+// redactFields redacts the values of tree, the JSON encoding of v, that
+// encode sensitive fields of v.
+func redactFields(v reflect.Value, tree interface{}) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return tree
+		}
+		if ri, ok := v.Interface().(redactInliner); ok {
+			v = reflect.ValueOf(ri.redactInline())
+			continue
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		obj, ok := tree.(map[string]interface{})
+		if !ok {
+			return tree
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // Unexported.
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" && f.Anonymous {
+				redactFields(v.Field(i), obj)
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			e, ok := obj[name]
+			if !ok {
+				continue
+			}
+			if f.Tag.Get("sensitive") == "true" {
+				obj[name] = redactAll(e)
+				continue
+			}
+			obj[name] = redactFields(v.Field(i), e)
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := tree.([]interface{})
+		if !ok || len(list) != v.Len() {
+			return tree
+		}
+		for i := range list {
+			list[i] = redactFields(v.Index(i), list[i])
+		}
+	case reflect.Map:
+		obj, ok := tree.(map[string]interface{})
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return tree
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			k := iter.Key().String()
+			if e, ok := obj[k]; ok {
+				obj[k] = redactFields(iter.Value(), e)
+			}
+		}
+	}
+	return tree
+}
+
+// redactAll replaces every non-empty value in tree with redactedSecret.
+func redactAll(tree interface{}) interface{} {
+	switch tree := tree.(type) {
+	case nil:
+		return nil
+	case string:
+		if tree == "" {
+			return tree
+		}
+	case map[string]interface{}:
+		for k, e := range tree {
+			tree[k] = redactAll(e)
+		}
+		return tree
+	case []interface{}:
+		for i, e := range tree {
+			tree[i] = redactAll(e)
+		}
+		return tree
+	}
+	return redactedSecret
+}
+
+// redactURLs redacts the passwords of URLs in tree. If strict is set, it
+// also appends an error to me for each value at or below path that looks
+// like a secret.
+func redactURLs(tree interface{}, path string, strict bool, me **multierror.Error) interface{} {
+	switch tree := tree.(type) {
+	case string:
+		s := redactURLCredentials(tree)
+		if strict && s != redactedSecret && s != "" {
+			if sensitiveName(path[strings.LastIndexByte(path, '.')+1:]) || sensitiveQuery(s) {
+				*me = multierror.Append(*me, fmt.Errorf("%s: %w", path, errUnredactedSecret))
+			}
+		}
+		return s
+	case map[string]interface{}:
+		keys := make([]string, 0, len(tree))
+		for k := range tree {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			tree[k] = redactURLs(tree[k], joinPath(path, k), strict, me)
+		}
+	case []interface{}:
+		for i, e := range tree {
+			tree[i] = redactURLs(e, joinPath(path, fmt.Sprint(i)), strict, me)
+		}
+	}
+	return tree
+}
+
+func joinPath(path, elem string) string {
+	if path == "" {
+		return elem
+	}
+	return path + "." + elem
+}
+
+// sensitiveName returns whether name looks like the name of a secret.
+func sensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	name = strings.NewReplacer("-", "", "_", "").Replace(name)
+	for _, s := range sensitiveNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitiveQuery returns whether s is a URL with a query parameter that
+// looks like a secret.
+func sensitiveQuery(s string) bool {
+	if !strings.Contains(s, "://") {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	for k, vs := range u.Query() {
+		if !sensitiveName(k) {
+			continue
+		}
+		for _, v := range vs {
+			if v != "" && v != redactedSecret {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactURLPassword returns s with its password redacted if it is a URL
+// with userinfo, and s unchanged otherwise.
+func redactURLPassword(s string) string {
+	if !strings.Contains(s, "@") || !strings.Contains(s, "://") {
+		return s
+	}
+	return redactURL(s)
+}
+
+// redactURLCredentials returns s with its password and the values of query
+// parameters that look like secrets, such as the password parameter of a
+// SQL Server URL, redacted if it is a URL, and s unchanged otherwise.
+func redactURLCredentials(s string) string {
+	if !sensitiveQuery(s) {
+		return redactURLPassword(s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactURLPassword(s)
+	}
+	return redactRequestURL(u, sensitiveName)
+}
+
+// redactRequestURL returns the URL of a request with its password and the
+// values of query parameters whose names are sensitive redacted.
+func redactRequestURL(reqURL *url.URL, sensitive func(name string) bool) string {
+	u := *reqURL
+	q := u.Query()
+	redacted := false
+	for k, vs := range q {
+		if !sensitive(k) {
+			continue
+		}
+		for i := range vs {
+			vs[i] = redactedSecret
+		}
+		redacted = true
+	}
+	if redacted {
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// redactURL returns the URL s with its password redacted, for logging. If s
+// cannot be parsed, any userinfo it may hold is redacted.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err == nil {
+		return u.Redacted()
+	}
+	scheme, rest, ok := strings.Cut(s, "://")
+	if i := strings.LastIndexByte(rest, '@'); ok && i != -1 {
+		return scheme + "://" + redactedSecret + rest[i:]
+	}
+	return s
+}
+
+// redactURLError returns err with the URL redacted if it is a *url.Error,
+// as returned by url.Parse, and err unchanged otherwise.
+func redactURLError(err error) error {
+	ue, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	return &url.Error{Op: ue.Op, URL: redactURL(ue.URL), Err: ue.Err}
+}
@@ -0,0 +1,129 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Registry holds the endpoints of a config compiled into handlers. Endpoints
+// are compiled once and shared by the routers of all bindings. A Registry is
+// immutable once built; reloads build a new one.
+type Registry struct {
+	conf      *Config
+	endpoints []*compiledEndpoint
+}
+
+// compiledEndpoint is an endpoint's handler, wrapped in its middleware.
+type compiledEndpoint struct {
+	def    *EndpointDef
+	method string
+	handle httprouter.Handle
+}
+
+// NewRegistry compiles the endpoints of conf using the databases dbs.
+func NewRegistry(conf *Config, dbs Databases) *Registry {
+	bindLimits(conf, dbs)
+	reg := &Registry{
+		conf:      conf,
+		endpoints: make([]*compiledEndpoint, 0, len(conf.Endpoints)),
+	}
+	for _, ed := range conf.Endpoints {
+		reg.endpoints = append(reg.endpoints, compileEndpoint(conf, dbs, ed))
+	}
+	return reg
+}
+
+func compileEndpoint(conf *Config, dbs Databases, ed *EndpointDef) *compiledEndpoint {
+	handler := &Handler{
+		EndpointDef: ed,
+		db:          dbs,
+		trace:       conf.Trace,
+		outboxes:    conf.Outboxes,
+		datasets:    conf.Datasets,
+		catalog:     conf.Catalog,
+		links:       conf.Links,
+		external:    conf.external,
+	}
+	if ed.Batch != nil {
+		handler.batcher = newBatcher(ed.Batch)
+	}
+	method := strings.ToUpper(ed.Method)
+	fn := handler.Get
+	if ed.Catalog != nil {
+		fn = handler.ServeCatalog
+	} else if method != "GET" {
+		fn = handler.Post
+	}
+	ce := &compiledEndpoint{def: ed, method: method}
+
+	// Every endpoint is wrapped at least to count its request and response
+	// sizes.
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fn(w, req, httprouter.ParamsFromContext(req.Context()))
+	})
+	if ed.Pool != "" {
+		h = conf.Pools[ed.Pool].Wrap(ed.Pool, h)
+	}
+	if len(ed.ContentTypes) > 0 {
+		// Reject bodies before they take up a worker.
+		h = ed.ContentTypes.Wrap(h)
+	}
+	if ed.ResponseLimit != nil {
+		h = ed.ResponseLimit.Wrap(h)
+	}
+	h = endpointSizes.Wrap(ed.Method, ed.Path, h)
+	if ed.Capture != nil {
+		// Capture responses before middleware encodes them.
+		h = ed.Capture.Wrap(ed.Path, h)
+	}
+	if len(ed.Headers) > 0 {
+		h = (&HeadersMiddleware{Set: ed.Headers}).Wrap(h)
+	}
+	h = ed.Middleware.Wrap(conf.Middleware, h)
+	if ed.SLO != nil {
+		// Measure latency including endpoint middleware.
+		h = ed.SLO.Wrap(h)
+	}
+	if ed.Deprecated != nil {
+		h = ed.Deprecated.Wrap(ed.Method, ed.Path, h)
+	}
+	ce.handle = inflightRequests.Wrap(ed, requestTaps.Wrap(ed.Method, ed.Path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		ctx := context.WithValue(req.Context(), httprouter.ParamsKey, ps)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	}))
+	return ce
+}
+
+// Router creates a router for all endpoints served on the binding bid,
+// wrapped in the binding's middleware.
+func (r *Registry) Router(bid int) http.Handler {
+	rt := r.conf.Bind[bid].newRouter(r.conf.StrictRouting)
+	for _, ce := range r.endpoints {
+		if len(ce.def.Bind) > 0 && !ce.def.Bind.Contains(bid) {
+			continue
+		}
+		rt.Handle(ce.method, ce.def.Path, ce.handle)
+	}
+	if r.conf.Discovery.servedOn(bid) {
+		rt.Handle("GET", r.conf.Discovery.Path, r.discoveryHandle(bid))
+	}
+	return r.conf.Bind[bid].Middleware.Wrap(r.conf.Middleware, rt)
+}
@@ -0,0 +1,235 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// configMapDataDir is the symlink Kubernetes swaps atomically when
+	// a ConfigMap volume is updated.
+	configMapDataDir = "..data"
+
+	configMapPollInterval = 5 * time.Second
+)
+
+// Server holds the currently loaded config and databases served by chisel's
+// bindings, and swaps them out on reload.
+type Server struct {
+	configPath string
+	profile    string
+	remote     *remoteConfig
+	bind       []*BindDef
+	admin      *BindDef
+	handlers   []*swapHandler
+	check      *queryCheck // Checks the queries of reloaded configs, if set.
+
+	adminHandler *swapHandler
+	promote      chan struct{}        // Receives promotions while in standby.
+	rollbacks    chan rollbackRequest // Receives rollbacks from the admin API.
+
+	mu      sync.Mutex
+	conf    *Config
+	dbs     Databases
+	standby *standbyDef    // Set while the server is in standby.
+	history *configHistory // Configs the server has loaded, for rollbacks.
+
+	outboxStop  func() // Stops outbox dispatchers, if any are running.
+	datasetStop func() // Stops dataset refreshes, if any are running.
+}
+
+// Reload loads the config from disk and, if it is valid, its databases can
+// be opened, its queries pass the server's check, if any, and its datasets
+// load, replaces the routers of all bindings with ones built from the new
+// config. Binding addresses and server options cannot be changed by a
+// reload. Pools of databases that are removed or changed are closed once
+// requests using them complete.
+func (s *Server) Reload(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conf, err := loadConfig(s.configPath, s.profile, s.remote)
+	if err != nil {
+		return err
+	}
+	logProfileChanges(*log, s.profile, conf)
+	logConfigMigrations(*log, conf)
+
+	if err := s.swap(ctx, conf); err != nil {
+		return err
+	}
+	s.history.Add(*log, conf, 0)
+
+	log.Info().Msg("Config reloaded.")
+	return nil
+}
+
+// swap replaces the server's config with conf, a validated config, as
+// Reload does. s.mu must be held.
+func (s *Server) swap(ctx context.Context, conf *Config) error {
+	log := zerolog.Ctx(ctx)
+
+	if !sameBindings(conf.Bind, s.bind) {
+		return errors.New("binding addresses and server options cannot be changed by a reload")
+	}
+	if !sameBindings([]*BindDef{conf.Admin}, []*BindDef{s.admin}) {
+		return errors.New("admin binding cannot be changed by a reload")
+	}
+	s.bind, s.admin = conf.Bind, conf.Admin
+
+	dbs, err := openDatabases(*log, conf, s.dbs)
+	if err != nil {
+		return err
+	}
+	if s.check != nil {
+		if err := s.check.Run(ctx, conf, dbs); err != nil {
+			dbs.closeNew(s.dbs)
+			return fmt.Errorf("config queries failed check: %w", err)
+		}
+	}
+	if err := loadDatasets(ctx, *log, conf, dbs); err != nil {
+		dbs.closeNew(s.dbs)
+		return fmt.Errorf("error loading datasets: %w", err)
+	}
+
+	reg := NewRegistry(conf, dbs)
+	for bid, h := range s.handlers {
+		h.Swap(reg.Router(bid))
+	}
+	if s.adminHandler != nil {
+		s.adminHandler.Swap(buildAdminRouter(s, conf))
+	}
+
+	s.stopOutboxes()
+	s.stopDatasets()
+	old, oldConf := s.dbs, s.conf
+	s.conf, s.dbs = conf, dbs
+	s.startOutboxes(ctx)
+	s.startDatasets(ctx)
+	old.Drain(*log, dbs)
+	if oldConf != nil {
+		closeMiddleware(*log, oldConf.Middleware)
+		closeHTTPClients(oldConf)
+	}
+	return nil
+}
+
+// Config returns the currently loaded config.
+func (s *Server) Config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conf
+}
+
+// Close closes all databases in use by the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopOutboxes()
+	s.stopDatasets()
+	s.dbs.Close()
+	s.dbs = nil
+	if s.conf != nil {
+		closeMiddleware(zerolog.Nop(), s.conf.Middleware)
+		closeHTTPClients(s.conf)
+	}
+}
+
+func sameBindings(a, b []*BindDef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		if a[i].Addr.String() != b[i].Addr.String() || a[i].ServerDef != b[i].ServerDef {
+			return false
+		}
+	}
+	return true
+}
+
+// swapHandler is an http.Handler whose underlying handler can be replaced
+// atomically while serving requests.
+type swapHandler struct {
+	handler atomic.Value // http.Handler
+}
+
+func newSwapHandler(h http.Handler) *swapHandler {
+	sh := &swapHandler{}
+	sh.Swap(h)
+	return sh
+}
+
+func (sh *swapHandler) Swap(h http.Handler) {
+	sh.handler.Store(&h)
+}
+
+func (sh *swapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h := *sh.handler.Load().(*http.Handler)
+	h.ServeHTTP(w, req)
+}
+
+// isConfigMapDir returns whether dir looks like a Kubernetes ConfigMap volume.
+func isConfigMapDir(dir string) bool {
+	fi, err := os.Lstat(filepath.Join(dir, configMapDataDir))
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// watchConfigMapDir polls the ..data symlink of a ConfigMap volume and calls
+// notify whenever its target changes. It returns when ctx is done.
+func watchConfigMapDir(ctx context.Context, dir string, interval time.Duration, notify func()) error {
+	link := filepath.Join(dir, configMapDataDir)
+	last, _ := os.Readlink(link)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		target, err := os.Readlink(link)
+		if err != nil || target == last {
+			continue
+		}
+		zerolog.Ctx(ctx).Info().
+			Str("dir", dir).
+			Str("target", target).
+			Msg("Config directory changed, reloading.")
+		last = target
+		notify()
+	}
+}
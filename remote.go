@@ -0,0 +1,385 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// remoteConfigTimeout limits how long fetching a remote config file
+	// may take.
+	remoteConfigTimeout = 30 * time.Second
+
+	// maxRemoteConfigSize is the largest remote config file that will be
+	// read.
+	maxRemoteConfigSize = 16 << 20
+
+	// signatureSuffix is appended to the URL of a remote config file to
+	// get the URL of its signature.
+	signatureSuffix = ".sig"
+)
+
+// remoteConfig holds the options for reading configs from https:// and s3://
+// URLs. Its zero value reads remote configs without verifying them.
+type remoteConfig struct {
+	// digest, if set, is the SHA-256 digest the config must have.
+	digest []byte
+	// publicKey, if set, is the Ed25519 key that must have signed the
+	// config and its profile overlay.
+	publicKey ed25519.PublicKey
+	// refresh, if set, is how often to check the config for changes.
+	refresh time.Duration
+
+	mu     sync.Mutex
+	loaded [sha256.Size]byte // Digest of the last config read.
+}
+
+// addRemoteConfigFlags adds the flags for reading remote configs to fs and
+// returns the options they set.
+func addRemoteConfigFlags(fs *flag.FlagSet) *remoteConfig {
+	rc := &remoteConfig{}
+	fs.Func("config-sha256", "The hex SHA-256 `digest` a remote config must have.", func(v string) error {
+		digest, err := hex.DecodeString(v)
+		if err == nil && len(digest) != sha256.Size {
+			err = errors.New("digest must be 32 bytes")
+		}
+		rc.digest = digest
+		return err
+	})
+	fs.Func("config-key", "The `path` of a PEM Ed25519 public key that must have signed remote configs.", func(v string) error {
+		key, err := readPublicKey(v)
+		rc.publicKey = key
+		return err
+	})
+	fs.DurationVar(&rc.refresh, "config-refresh", rc.refresh, "How often to check a remote config for changes. If 0, it is only read on start and reload.")
+	return rc
+}
+
+// readPublicKey reads a PEM-encoded Ed25519 public key from the file at
+// path.
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("public key is not a PEM PUBLIC KEY block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// isRemoteConfig returns whether the config path is a URL to fetch the
+// config from.
+func isRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "s3://")
+}
+
+// readRemoteConfig fetches and verifies the config file at the URL uri and
+// the profile's overlay for it, if it has one. Remote configs may not
+// include other files or read endpoint files.
+func readRemoteConfig(uri, profile string, rc *remoteConfig) (*Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config URL: %w", redactURLError(err))
+	}
+	source := configSourceName(u)
+	data, err := rc.fetch(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %s: %w", source, err)
+	}
+	if err := rc.verify(ctx, u, data, true); err != nil {
+		return nil, fmt.Errorf("error verifying config %s: %w", source, err)
+	}
+	// The digest and signature are of the file as stored, so that it can be
+	// verified without decrypting or rendering it.
+	digest := sha256.Sum256(data)
+	if data, err = decodeConfigData(u.Path, profile, data); err != nil {
+		return nil, fmt.Errorf("error decoding config %s: %w", source, err)
+	}
+
+	ext := configExt(u.Path)
+	conf, changes, err := decodeConfig(ext, profile, data, func(data []byte) ([]byte, []string, error) {
+		if profile == "" {
+			return data, nil, nil
+		}
+		ou := *u
+		ou.Path = profileOverlayPath(u.Path, profile)
+		ou.RawPath = ""
+		odata, err := rc.fetch(ctx, &ou)
+		if errors.Is(err, os.ErrNotExist) {
+			return data, nil, nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("error reading profile overlay: %w", err)
+		}
+		if err := rc.verify(ctx, &ou, odata, false); err != nil {
+			return nil, nil, fmt.Errorf("error verifying profile overlay: %w", err)
+		}
+		if odata, err = decodeConfigData(ou.Path, profile, odata); err != nil {
+			return nil, nil, fmt.Errorf("error decoding profile overlay: %w", err)
+		}
+		return mergeProfileOverlay(ext, configSourceName(&ou), data, odata)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if len(conf.Include) > 0 {
+		return nil, fmt.Errorf("%s: include is not supported by remote configs", source)
+	}
+	if hasEndpointFiles(conf.Endpoints) {
+		return nil, fmt.Errorf("%s: endpoint files are not supported by remote configs", source)
+	}
+
+	for _, key := range changes {
+		conf.profileChanges = append(conf.profileChanges, source+": "+key)
+	}
+	for i, note := range conf.migrations {
+		conf.migrations[i] = source + ": " + note
+	}
+	for _, ed := range conf.Endpoints {
+		if ed != nil {
+			ed.source = source
+		}
+	}
+
+	rc.mu.Lock()
+	rc.loaded = digest
+	rc.mu.Unlock()
+	return conf, nil
+}
+
+// configSourceName returns u without its query, which may hold credentials,
+// for use in logs and errors.
+func configSourceName(u *url.URL) string {
+	nu := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	return nu.String()
+}
+
+// verify checks data, read from u, against the config's expected digest, if
+// it's the config itself (rather than an overlay), and its signature, if a
+// public key is set.
+func (rc *remoteConfig) verify(ctx context.Context, u *url.URL, data []byte, isConfig bool) error {
+	if rc.digest != nil {
+		if !isConfig {
+			return errors.New("profile overlays cannot be verified by digest; use -config-key instead")
+		}
+		sum := sha256.Sum256(data)
+		if subtle.ConstantTimeCompare(sum[:], rc.digest) != 1 {
+			return fmt.Errorf("digest %x does not match the expected digest", sum)
+		}
+	}
+	if rc.publicKey == nil {
+		return nil
+	}
+
+	su := *u
+	su.Path += signatureSuffix
+	su.RawPath = ""
+	sig, err := rc.fetch(ctx, &su)
+	if err != nil {
+		return fmt.Errorf("error reading signature: %w", err)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		// Signatures may also be base64-encoded.
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil {
+			return errors.New("signature is neither a raw nor a base64 Ed25519 signature")
+		}
+		sig = decoded
+	}
+	if !ed25519.Verify(rc.publicKey, data, sig) {
+		return errors.New("signature is invalid")
+	}
+	return nil
+}
+
+// fetch reads the file at u, which must be an https:// or s3:// URL. If the
+// file doesn't exist, the error wraps os.ErrNotExist.
+func (rc *remoteConfig) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	var req *http.Request
+	var err error
+	switch u.Scheme {
+	case "https":
+		req, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	case "s3":
+		req, err = newS3Request(ctx, u)
+	default:
+		return nil, fmt.Errorf("unsupported config URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", configSourceName(u), redactURLError(err))
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", configSourceName(u), os.ErrNotExist)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s responded with status %d", configSourceName(u), resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", configSourceName(u), err)
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", configSourceName(u), maxRemoteConfigSize)
+	}
+	return data, nil
+}
+
+// newS3Request returns a signed request to get the object at the s3://
+// bucket/key URL u. The bucket's region is read from AWS_REGION (defaulting
+// to us-east-1) and credentials from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables.
+func newS3Request(ctx context.Context, u *url.URL) (*http.Request, error) {
+	creds := awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, errors.New("no aws credentials in environment")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("s3 URL %s must name a bucket and key", configSourceName(u))
+	}
+
+	// Path-style URLs are used so that buckets with dots in their names
+	// work with TLS.
+	endpoint := &url.URL{
+		Scheme: "https",
+		Host:   "s3." + region + ".amazonaws.com",
+		Path:   "/" + u.Host + u.Path,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	creds.signS3(req, region, time.Now())
+	return req, nil
+}
+
+// signS3 signs a bodiless S3 request with AWS Signature Version 4.
+func (c *awsCredentials) signS3(req *http.Request, region string, now time.Time) {
+	const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // SHA-256 of "".
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayload)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+	var headers strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(h + ":" + v + "\n")
+	}
+	canonical := req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n" + headers.String() + "\n" +
+		strings.Join(signed, ";") + "\n" + emptyPayload
+
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+
+		", Signature="+awsSignature(c.secretKey, region, "s3", amzDate, canonical))
+}
+
+// watchRemoteConfig fetches the remote config at uri every interval and
+// calls notify whenever it differs from the config last read. Its profile
+// overlay isn't checked. The new config is verified when it is reloaded.
+// It returns when ctx is done.
+func watchRemoteConfig(ctx context.Context, uri string, rc *remoteConfig, interval time.Duration, notify func()) error {
+	log := zerolog.Ctx(ctx)
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid config URL: %w", redactURLError(err))
+	}
+
+	var seen [sha256.Size]byte // Digest of the last change notified.
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		fctx, cancel := context.WithTimeout(ctx, remoteConfigTimeout)
+		data, err := rc.fetch(fctx, u)
+		cancel()
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to check remote config for changes.")
+			continue
+		}
+		sum := sha256.Sum256(data)
+		rc.mu.Lock()
+		changed := sum != rc.loaded && sum != seen
+		rc.mu.Unlock()
+		if !changed {
+			continue
+		}
+		// Only notify once per change, so that a config that fails to
+		// load isn't reloaded every interval.
+		seen = sum
+		log.Info().Str("config", configSourceName(u)).Msg("Remote config changed, reloading.")
+		notify()
+	}
+}
@@ -0,0 +1,449 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// scaffoldColumn is a column of an introspected table.
+type scaffoldColumn struct {
+	Name      string
+	Type      string
+	Primary   bool
+	Generated bool // Whether the database assigns the column a default.
+}
+
+type scaffoldTable struct {
+	Name    string
+	Columns []*scaffoldColumn
+}
+
+// primaryKey returns the table's primary key column, if it has exactly one.
+func (t *scaffoldTable) primaryKey() *scaffoldColumn {
+	var pk *scaffoldColumn
+	for _, c := range t.Columns {
+		if !c.Primary {
+			continue
+		}
+		if pk != nil {
+			return nil
+		}
+		pk = c
+	}
+	return pk
+}
+
+// Scaffold implements the scaffold subcommand, which introspects a database
+// and writes endpoint config for the CRUD operations of its tables.
+func Scaffold(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	var (
+		dbURL  string
+		dbName = "main"
+		tables string
+		format = "json"
+		output = "-"
+	)
+	fs.StringVar(&dbURL, "d", dbURL, "The database `url` to introspect.")
+	fs.StringVar(&dbName, "n", dbName, "The `name` of the database in the generated config.")
+	fs.StringVar(&tables, "t", tables, "A comma-separated `list` of tables to scaffold. Defaults to all tables.")
+	fs.StringVar(&format, "f", format, "The `format` of the generated config: json or yaml.")
+	fs.StringVar(&output, "o", output, "The `path` to write the generated config to. Defaults to standard output.")
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	} else if err != nil {
+		return 1
+	}
+
+	log := zerolog.New(fs.Output()).With().Timestamp().Logger()
+	if dbURL == "" {
+		log.Error().Msg("No database URL given (-d).")
+		return 2
+	}
+	if format != "json" && format != "yaml" {
+		log.Error().Str("format", format).Msg("Unrecognized config format.")
+		return 2
+	}
+
+	schema, ok := scaffoldSchema(ctx, log, dbURL, tables)
+	if !ok {
+		return 1
+	}
+
+	conf := scaffoldConfig(dbName, dbURL, schema)
+
+	// Check the generated config before writing it.
+	blob, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode config.")
+		return 1
+	}
+	var check Config
+	if err := unmarshalStrict(blob, &check); err != nil {
+		log.Error().Err(err).Msg("Generated config could not be parsed.")
+		return 1
+	}
+	if err := check.Validate(); err != nil {
+		log.Error().Err(err).Msg("Generated config is invalid.")
+		return 1
+	}
+
+	if format == "yaml" {
+		blob, err = yaml.Marshal(conf)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to encode config.")
+			return 1
+		}
+	} else {
+		blob = append(blob, '\n')
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create output file.")
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := w.Write(blob); err != nil {
+		log.Error().Err(err).Msg("Failed to write config.")
+		return 1
+	}
+	return 0
+}
+
+// scaffoldSchema introspects the database at dbURL and returns its tables,
+// or only those in tables, a comma-separated list, if it's not empty. Errors
+// are logged.
+func scaffoldSchema(ctx context.Context, log zerolog.Logger, dbURL, tables string) ([]*scaffoldTable, bool) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		log.Error().Err(redactURLError(err)).Msg("Failed to parse database URL.")
+		return nil, false
+	}
+	drv, dsn, _, err := dsnFromURL(u)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to construct database DSN.")
+		return nil, false
+	}
+	db, err := sqlx.Open(drv, dsn)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open database.")
+		return nil, false
+	}
+	defer db.Close()
+
+	schema, err := introspect(ctx, db, u.Scheme)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to introspect database.")
+		return nil, false
+	}
+	if tables != "" {
+		schema, err = selectTables(schema, strings.Split(tables, ","))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to select tables.")
+			return nil, false
+		}
+	}
+	return schema, true
+}
+
+func selectTables(schema []*scaffoldTable, names []string) ([]*scaffoldTable, error) {
+	byName := make(map[string]*scaffoldTable, len(schema))
+	for _, t := range schema {
+		byName[t.Name] = t
+	}
+	selected := make([]*scaffoldTable, 0, len(names))
+	for _, name := range names {
+		t, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("table %q not found", name)
+		}
+		selected = append(selected, t)
+	}
+	return selected, nil
+}
+
+// introspect reads the tables and columns of the database's current schema.
+func introspect(ctx context.Context, db *sqlx.DB, scheme string) ([]*scaffoldTable, error) {
+	switch scheme {
+	case "postgres", "postgresql", "pg":
+		return introspectInformationSchema(ctx, db, `
+			SELECT c.table_name, c.column_name, c.data_type,
+				EXISTS (
+					SELECT 1
+					FROM information_schema.table_constraints tc
+					JOIN information_schema.key_column_usage k
+						ON k.constraint_name = tc.constraint_name
+						AND k.table_schema = tc.table_schema
+					WHERE tc.constraint_type = 'PRIMARY KEY'
+						AND tc.table_schema = c.table_schema
+						AND tc.table_name = c.table_name
+						AND k.column_name = c.column_name
+				) AS is_primary,
+				c.column_default IS NOT NULL OR c.is_identity = 'YES' AS is_generated
+			FROM information_schema.columns c
+			JOIN information_schema.tables t
+				ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+			WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+			ORDER BY c.table_name, c.ordinal_position`)
+	case "mysql":
+		return introspectInformationSchema(ctx, db, `
+			SELECT c.table_name, c.column_name, c.column_type,
+				c.column_key = 'PRI',
+				c.column_default IS NOT NULL OR c.extra LIKE '%auto_increment%'
+			FROM information_schema.columns c
+			JOIN information_schema.tables t
+				ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+			WHERE c.table_schema = DATABASE() AND t.table_type = 'BASE TABLE'
+			ORDER BY c.table_name, c.ordinal_position`)
+	case "sqlite", "sqlite3":
+		return introspectSQLite(ctx, db)
+	default:
+		return nil, fmt.Errorf("introspection is not supported for %q databases", scheme)
+	}
+}
+
+func introspectInformationSchema(ctx context.Context, db *sqlx.DB, query string) ([]*scaffoldTable, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying columns: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []*scaffoldTable
+	for rows.Next() {
+		var table string
+		col := &scaffoldColumn{}
+		if err := rows.Scan(&table, &col.Name, &col.Type, &col.Primary, &col.Generated); err != nil {
+			return nil, fmt.Errorf("error scanning column: %w", err)
+		}
+		if len(tables) == 0 || tables[len(tables)-1].Name != table {
+			tables = append(tables, &scaffoldTable{Name: table})
+		}
+		t := tables[len(tables)-1]
+		t.Columns = append(t.Columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading columns: %w", err)
+	}
+	return tables, nil
+}
+
+func introspectSQLite(ctx context.Context, db *sqlx.DB) ([]*scaffoldTable, error) {
+	var names []string
+	err := db.SelectContext(ctx, &names,
+		`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying tables: %w", err)
+	}
+
+	tables := make([]*scaffoldTable, 0, len(names))
+	for _, name := range names {
+		var cols []struct {
+			CID     int     `db:"cid"`
+			Name    string  `db:"name"`
+			Type    string  `db:"type"`
+			NotNull bool    `db:"notnull"`
+			Default *string `db:"dflt_value"`
+			PK      int     `db:"pk"`
+		}
+		err := db.SelectContext(ctx, &cols, "SELECT * FROM pragma_table_info(?)", name)
+		if err != nil {
+			return nil, fmt.Errorf("error querying columns of %q: %w", name, err)
+		}
+		t := &scaffoldTable{Name: name}
+		for _, c := range cols {
+			t.Columns = append(t.Columns, &scaffoldColumn{
+				Name:    c.Name,
+				Type:    c.Type,
+				Primary: c.PK > 0,
+				// INTEGER PRIMARY KEY columns alias the rowid.
+				Generated: c.Default != nil || (c.PK > 0 && strings.EqualFold(c.Type, "integer")),
+			})
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// scaffoldArgType guesses the arg type of a SQL column type. It returns the
+// empty string if the type isn't recognized.
+func scaffoldArgType(sqlType string) string {
+	typ := strings.ToLower(sqlType)
+	if i := strings.IndexByte(typ, '('); i >= 0 {
+		typ = typ[:i]
+	}
+	typ = strings.TrimSpace(typ)
+	if at, ok := argTypeNames[typ]; ok {
+		return at.String()
+	}
+	switch {
+	case strings.Contains(typ, "timestamp"), strings.Contains(typ, "datetime"):
+		return TimestampArgType.String()
+	case strings.Contains(typ, "int"):
+		return IntArgType.String()
+	case strings.Contains(typ, "char"), strings.Contains(typ, "text"), strings.Contains(typ, "clob"):
+		return TextArgType.String()
+	case strings.Contains(typ, "double"), strings.Contains(typ, "float"), strings.Contains(typ, "real"):
+		return FloatArgType.String()
+	case strings.Contains(typ, "decimal"), strings.Contains(typ, "numeric"):
+		return NumericArgType.String()
+	case strings.Contains(typ, "bool"):
+		return BoolArgType.String()
+	case strings.Contains(typ, "blob"), strings.Contains(typ, "binary"):
+		return BytesArgType.String()
+	case strings.Contains(typ, "json"):
+		return JSONArgType.String()
+	case typ == "date":
+		return DateArgType.String()
+	}
+	return ""
+}
+
+// scaffoldArg returns an arg definition for the source src, with the column's
+// type, if known.
+func scaffoldArg(src map[string]interface{}, col *scaffoldColumn) map[string]interface{} {
+	if typ := scaffoldArgType(col.Type); typ != "" {
+		src["type"] = typ
+	}
+	return src
+}
+
+// scaffoldList returns the query and args of an endpoint listing the rows of
+// t a page at a time, with limit and offset query parameters.
+func scaffoldList(t *scaffoldTable) (string, []interface{}) {
+	query := "SELECT * FROM " + t.Name
+	if pk := t.primaryKey(); pk != nil {
+		query += " ORDER BY " + pk.Name
+	}
+	query += " LIMIT ? OFFSET ?"
+	return query, []interface{}{
+		map[string]interface{}{"expr": `(.params.query.limit[0] // "100") | tonumber`},
+		map[string]interface{}{"expr": `(.params.query.offset[0] // "0") | tonumber`},
+	}
+}
+
+// scaffoldConfig generates config for the list, get, create, update, and
+// delete endpoints of each table. Tables without a single-column primary key
+// only get list and create endpoints.
+func scaffoldConfig(dbName, dbURL string, schema []*scaffoldTable) map[string]interface{} {
+	sort.Slice(schema, func(i, j int) bool { return schema[i].Name < schema[j].Name })
+
+	transactions := []interface{}{map[string]interface{}{"db": dbName}}
+	endpoint := func(method, path, query string, args []interface{}, mapping ...string) map[string]interface{} {
+		step := map[string]interface{}{
+			"query": query,
+			"args":  args,
+		}
+		if len(mapping) > 0 {
+			step["map"] = mapping
+		}
+		return map[string]interface{}{
+			"method": method,
+			"path":   path,
+			"query": map[string]interface{}{
+				"transactions": transactions,
+				"steps":        []interface{}{step},
+			},
+		}
+	}
+
+	var endpoints []interface{}
+	for _, t := range schema {
+		pk := t.primaryKey()
+		base := "/" + t.Name
+
+		list, listArgs := scaffoldList(t)
+		endpoints = append(endpoints, endpoint("GET", base, list, listArgs))
+
+		var (
+			insertCols, updateSets []string
+			insertArgs, updateArgs []interface{}
+		)
+		for _, c := range t.Columns {
+			arg := func() map[string]interface{} {
+				return scaffoldArg(map[string]interface{}{"expr": ".body." + jqField(c.Name)}, c)
+			}
+			if !(c.Primary && c.Generated) {
+				insertCols = append(insertCols, c.Name)
+				insertArgs = append(insertArgs, arg())
+			}
+			if !c.Primary {
+				updateSets = append(updateSets, c.Name+" = ?")
+				updateArgs = append(updateArgs, arg())
+			}
+		}
+		if len(insertCols) > 0 {
+			insert := "INSERT INTO " + t.Name + " (" + strings.Join(insertCols, ", ") + ") VALUES (?" +
+				strings.Repeat(", ?", len(insertCols)-1) + ")"
+			endpoints = append(endpoints, endpoint("POST", base, insert, insertArgs,
+				`{__response: {status: 201}}`))
+		}
+
+		if pk == nil {
+			continue
+		}
+		item := base + "/:" + pk.Name
+		pkArg := scaffoldArg(map[string]interface{}{"path": pk.Name}, pk)
+		endpoints = append(endpoints,
+			endpoint("GET", item, "SELECT * FROM "+t.Name+" WHERE "+pk.Name+" = ?", []interface{}{pkArg},
+				`if length == 0 then {__response: {status: 404}, error: "not found"} else .[0] end`),
+			endpoint("DELETE", item, "DELETE FROM "+t.Name+" WHERE "+pk.Name+" = ?", []interface{}{pkArg}),
+		)
+		if len(updateSets) > 0 {
+			update := "UPDATE " + t.Name + " SET " + strings.Join(updateSets, ", ") + " WHERE " + pk.Name + " = ?"
+			endpoints = append(endpoints, endpoint("PUT", item, update, append(updateArgs, pkArg)))
+		}
+	}
+
+	return map[string]interface{}{
+		"version": currentConfigVersion,
+		"databases": map[string]interface{}{
+			dbName: map[string]interface{}{"url": dbURL},
+		},
+		"endpoints": endpoints,
+	}
+}
+
+// jqField returns a jq field accessor for name.
+func jqField(name string) string {
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			blob, _ := json.Marshal(name)
+			return "[" + string(blob) + "]"
+		}
+	}
+	return name
+}
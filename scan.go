@@ -0,0 +1,161 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.spiff.io/sql/vdb"
+)
+
+// timeFormatNames maps the time formats of query options to their names in
+// configs, so that rows scanned by a rowScanner format times as
+// vdb.ScanRows does.
+var timeFormatNames = func() map[vdb.TimeFormat]string {
+	names := map[vdb.TimeFormat]string{}
+	for _, name := range []string{"rfc3339", "fsec", "unixns", "unixus", "unixms", "unix", "layout"} {
+		var tf vdb.TimeFormat
+		if err := json.Unmarshal([]byte(`"`+name+`"`), &tf); err == nil {
+			names[tf] = name
+		}
+	}
+	return names
+}()
+
+// columnKind is how a rowScanner converts a column's values.
+type columnKind int
+
+const (
+	textColumn columnKind = iota
+	binaryColumn
+	jsonColumn
+)
+
+// rowScanner scans the rows of a result set one at a time, converting their
+// values for the query options of the database they came from. Rows are
+// objects of their columns, as they are in the results of vdb.ScanRows.
+type rowScanner struct {
+	opts    *QueryOptions
+	columns []string
+	kinds   []columnKind
+	numeric []string
+	dest    []interface{}
+	ptrs    []interface{}
+}
+
+func newRowScanner(rows *sql.Rows, opts *QueryOptions) (*rowScanner, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	rs := &rowScanner{
+		opts:    opts,
+		columns: make([]string, len(types)),
+		kinds:   make([]columnKind, len(types)),
+		dest:    make([]interface{}, len(types)),
+		ptrs:    make([]interface{}, len(types)),
+	}
+	for i, ct := range types {
+		rs.columns[i] = ct.Name()
+		rs.ptrs[i] = &rs.dest[i]
+		switch strings.ToUpper(ct.DatabaseTypeName()) {
+		case "JSON", "JSONB":
+			rs.kinds[i] = jsonColumn
+		case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BYTEA", "BINARY", "VARBINARY", "IMAGE", "RAW", "LONG RAW":
+			rs.kinds[i] = binaryColumn
+		}
+	}
+	if opts.Numeric == NumberNumericFormat {
+		rs.numeric = numericColumns(rows)
+	}
+	return rs, nil
+}
+
+// Scan scans the current row of rows. The row is a new object, so it may
+// be kept after the next row is scanned.
+func (rs *rowScanner) Scan(rows *sql.Rows) (map[string]interface{}, error) {
+	for i := range rs.dest {
+		rs.dest[i] = nil
+	}
+	if err := rows.Scan(rs.ptrs...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{}, len(rs.columns))
+	for i, name := range rs.columns {
+		row[name] = rs.value(rs.kinds[i], rs.dest[i])
+	}
+	if len(rs.numeric) > 0 {
+		convertNumerics([]interface{}{row}, rs.numeric)
+	}
+	return row, nil
+}
+
+// value converts v, a value scanned from a column of kind.
+func (rs *rowScanner) value(kind columnKind, v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		if kind == binaryColumn {
+			// Drivers may reuse the buffer of a scanned value.
+			return append([]byte(nil), v...)
+		}
+		return rs.text(kind, string(v))
+	case string:
+		return rs.text(kind, v)
+	case time.Time:
+		return rs.time(v)
+	}
+	return v
+}
+
+// text returns s, a value of a text or JSON column, parsed as JSON if the
+// query options call for it.
+func (rs *rowScanner) text(kind columnKind, s string) interface{} {
+	if rs.opts.SkipJSON || (kind != jsonColumn && !rs.opts.TryJSON) {
+		return s
+	}
+	if kind != jsonColumn {
+		if t := strings.TrimSpace(s); t == "" || (t[0] != '{' && t[0] != '[') {
+			return s
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+// time returns t in the time format of the query options.
+func (rs *rowScanner) time(t time.Time) interface{} {
+	switch timeFormatNames[rs.opts.TimeFormat] {
+	case "fsec":
+		return float64(t.UnixNano()) / float64(time.Second)
+	case "unixns":
+		return t.UnixNano()
+	case "unixus":
+		return t.UnixNano() / int64(time.Microsecond)
+	case "unixms":
+		return t.UnixNano() / int64(time.Millisecond)
+	case "unix":
+		return t.Unix()
+	case "layout":
+		return t.Format(rs.opts.TimeLayout)
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,281 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// secretScheme is the URL scheme used to refer to a secret by name in place
+// of a database URL, as in secret://name.
+const secretScheme = "secret://"
+
+// secretTimeout is how long a secret provider may take to return a secret.
+const secretTimeout = 10 * time.Second
+
+type SecretProvider string
+
+const (
+	FileSecretProvider  SecretProvider = "file"
+	EnvSecretProvider   SecretProvider = "env"
+	VaultSecretProvider SecretProvider = "vault"
+	AWSSecretProvider   SecretProvider = "aws"
+	AgeSecretProvider   SecretProvider = "age"
+)
+
+// SecretDef describes where to read a secret from. Secrets are read when
+// the databases referring to them are opened, including on reload, and are
+// never stored in the config.
+type SecretDef struct {
+	Provider SecretProvider `json:"provider" yaml:"provider"`
+
+	// Path is the file to read for file and age secrets, or the path of
+	// the secret for Vault secrets, such as secret/data/chisel.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// Value is the armored ciphertext of an age secret, for secrets kept
+	// in the config itself. It is used instead of Path.
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+
+	// Var is the environment variable to read for env secrets.
+	Var string `json:"var,omitempty" yaml:"var,omitempty"`
+
+	// Key selects a field of the secret for Vault secrets and for AWS
+	// secrets holding JSON objects.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+
+	// Address and TokenFile configure the Vault client. They default to
+	// the VAULT_ADDR and VAULT_TOKEN environment variables.
+	Address   string `json:"address,omitempty" yaml:"address,omitempty"`
+	TokenFile string `json:"token_file,omitempty" yaml:"token_file,omitempty"`
+
+	// SecretID and Region identify an AWS Secrets Manager secret.
+	// Credentials are read from the AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables.
+	SecretID string `json:"secret_id,omitempty" yaml:"secret_id,omitempty"`
+	Region   string `json:"region,omitempty" yaml:"region,omitempty"`
+}
+
+func (sd *SecretDef) Validate() error {
+	var me *multierror.Error
+	require := func(name, v string) {
+		if v == "" {
+			me = multierror.Append(me, fmt.Errorf("%s secrets require %s", sd.Provider, name))
+		}
+	}
+	switch sd.Provider {
+	case FileSecretProvider:
+		require("path", sd.Path)
+	case EnvSecretProvider:
+		require("var", sd.Var)
+	case VaultSecretProvider:
+		require("path", sd.Path)
+		require("key", sd.Key)
+		if sd.Address != "" {
+			if _, err := url.Parse(sd.Address); err != nil {
+				me = multierror.Append(me, fmt.Errorf("invalid address: %w", redactURLError(err)))
+			}
+		}
+	case AWSSecretProvider:
+		require("secret_id", sd.SecretID)
+		require("region", sd.Region)
+	case AgeSecretProvider:
+		if (sd.Path == "") == (sd.Value == "") {
+			me = multierror.Append(me, errors.New("age secrets require one of path or value"))
+		}
+	case "":
+		me = multierror.Append(me, errors.New("provider is required"))
+	default:
+		me = multierror.Append(me, fmt.Errorf("unrecognized provider %q", sd.Provider))
+	}
+	return errorOrNil(me)
+}
+
+// Read returns the secret's value.
+func (sd *SecretDef) Read(ctx context.Context) (string, error) {
+	switch sd.Provider {
+	case FileSecretProvider:
+		p, err := os.ReadFile(sd.Path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(p), "\r\n"), nil
+	case EnvSecretProvider:
+		v, ok := os.LookupEnv(sd.Var)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", sd.Var)
+		}
+		return v, nil
+	case VaultSecretProvider:
+		return sd.readVault(ctx)
+	case AWSSecretProvider:
+		return sd.readAWS(ctx)
+	case AgeSecretProvider:
+		return sd.readAge()
+	}
+	return "", fmt.Errorf("unrecognized provider %q", sd.Provider)
+}
+
+// readVault reads a secret from a Vault KV secrets engine. Both version 1
+// and version 2 engines are supported.
+func (sd *SecretDef) readVault(ctx context.Context) (string, error) {
+	addr := sd.Address
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", errors.New("no vault address in config or environment")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if sd.TokenFile != "" {
+		p, err := os.ReadFile(sd.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(p))
+	}
+	if token == "" {
+		return "", errors.New("no vault token in config or environment")
+	}
+
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	uri := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(sd.Path, "/")
+	err := warehouseCall(ctx, http.DefaultClient, "GET", uri, nil, &resp, func(req *http.Request, _ []byte) {
+		req.Header.Set("X-Vault-Token", token)
+	}, func(status int, _ []byte) error {
+		return fmt.Errorf("vault responded with status %d", status)
+	})
+	if err != nil {
+		return "", redactURLError(err)
+	}
+
+	fields := resp.Data
+	if inner, ok := fields["data"]; ok {
+		// KV version 2 nests the secret's fields under data.data.
+		var v2 map[string]json.RawMessage
+		if json.Unmarshal(inner, &v2) == nil {
+			fields = v2
+		}
+	}
+	return secretField(fields, sd.Key)
+}
+
+// readAWS reads a secret from AWS Secrets Manager.
+func (sd *SecretDef) readAWS(ctx context.Context) (string, error) {
+	creds := awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return "", errors.New("no aws credentials in environment")
+	}
+
+	var resp struct {
+		SecretString *string `json:"SecretString"`
+	}
+	in := map[string]string{"SecretId": sd.SecretID}
+	uri := "https://secretsmanager." + sd.Region + ".amazonaws.com/"
+	err := warehouseCall(ctx, http.DefaultClient, "POST", uri, in, &resp, func(req *http.Request, body []byte) {
+		creds.sign(req, "secretsmanager", sd.Region, "secretsmanager.GetSecretValue", body, time.Now())
+	}, func(status int, _ []byte) error {
+		return fmt.Errorf("secrets manager responded with status %d", status)
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.SecretString == nil {
+		return "", errors.New("secret has no string value")
+	}
+	if sd.Key == "" {
+		return *resp.SecretString, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*resp.SecretString), &fields); err != nil {
+		return "", errors.New("secret is not a JSON object")
+	}
+	return secretField(fields, sd.Key)
+}
+
+// readAge decrypts an age secret with the identities in the environment.
+func (sd *SecretDef) readAge() (string, error) {
+	data := []byte(sd.Value)
+	if sd.Path != "" {
+		var err error
+		if data, err = os.ReadFile(sd.Path); err != nil {
+			return "", err
+		}
+	}
+	p, err := decryptAge(data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(p), "\r\n"), nil
+}
+
+// secretField returns the string field key of a secret.
+func secretField(fields map[string]json.RawMessage, key string) (string, error) {
+	raw, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", fmt.Errorf("secret key %q is not a string", key)
+	}
+	return v, nil
+}
+
+// secretName returns the name of the secret referred to by s, a
+// secret://name URL, and whether s is one.
+func secretName(s string) (string, bool) {
+	if !strings.HasPrefix(s, secretScheme) {
+		return "", false
+	}
+	return s[len(secretScheme):], true
+}
+
+// resolveSecret returns s, or the value of the secret it refers to if it is
+// a secret://name URL.
+func (c *Config) resolveSecret(ctx context.Context, s string) (string, error) {
+	name, ok := secretName(s)
+	if !ok {
+		return s, nil
+	}
+	sd := c.Secrets[name]
+	if sd == nil {
+		return "", fmt.Errorf("undefined secret %q", name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, secretTimeout)
+	defer cancel()
+	v, err := sd.Read(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret %q: %w", name, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,223 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// shutdownCancelGrace is how long requests canceled at the end of the
+	// shutdown timeout have to respond before their connections are
+	// closed.
+	shutdownCancelGrace = time.Second
+	// shutdownReportLimit is the number of in-flight requests listed by
+	// each shutdown report, oldest first.
+	shutdownReportLimit = 20
+)
+
+// inflightRequests tracks the requests being served by endpoints, so that
+// shutdown can report what it's waiting on.
+var inflightRequests = &inflightLog{reqs: map[*inflightRequest]struct{}{}}
+
+// InflightRequest describes a request still being served.
+type InflightRequest struct {
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`           // The path template of the endpoint.
+	Name      string  `json:"name,omitempty"` // The name of the endpoint, if it has one.
+	AgeMS     float64 `json:"age_ms"`
+	RequestID string  `json:"request_id,omitempty"`
+}
+
+// inflightRequest is a request being served and the function canceling
+// its context.
+type inflightRequest struct {
+	InflightRequest
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+// inflightLog is the set of requests being served by endpoints.
+type inflightLog struct {
+	mu       sync.Mutex
+	reqs     map[*inflightRequest]struct{}
+	canceled bool // Requests are canceled as soon as they begin.
+}
+
+// Wrap returns handle, tracking its requests while they're served.
+func (l *inflightLog) Wrap(ed *EndpointDef, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		ir := &inflightRequest{
+			InflightRequest: InflightRequest{
+				Method:    ed.Method,
+				Path:      ed.Path,
+				Name:      ed.Name,
+				RequestID: req.Header.Get(requestIDHeader),
+			},
+			started: time.Now(),
+			cancel:  cancel,
+		}
+		l.mu.Lock()
+		if l.canceled {
+			cancel()
+		}
+		l.reqs[ir] = struct{}{}
+		l.mu.Unlock()
+		defer func() {
+			l.mu.Lock()
+			delete(l.reqs, ir)
+			l.mu.Unlock()
+		}()
+		handle(w, req.WithContext(ctx), ps)
+	}
+}
+
+// Snapshot returns the number of requests in flight and the oldest of
+// them, up to limit, oldest first.
+func (l *inflightLog) Snapshot(limit int) (int, []InflightRequest) {
+	now := time.Now()
+	l.mu.Lock()
+	reqs := make([]InflightRequest, 0, len(l.reqs))
+	for ir := range l.reqs {
+		r := ir.InflightRequest
+		r.AgeMS = float64(now.Sub(ir.started)) / float64(time.Millisecond)
+		reqs = append(reqs, r)
+	}
+	l.mu.Unlock()
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].AgeMS > reqs[j].AgeMS })
+	if len(reqs) > limit {
+		return len(reqs), reqs[:limit]
+	}
+	return len(reqs), reqs
+}
+
+// Len returns the number of requests in flight.
+func (l *inflightLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.reqs)
+}
+
+// Cancel cancels the contexts of every request in flight, and of those
+// that begin after it, and returns the number canceled. Calls after the
+// first return 0.
+func (l *inflightLog) Cancel() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.canceled {
+		return 0
+	}
+	l.canceled = true
+	for ir := range l.reqs {
+		ir.cancel()
+	}
+	return len(l.reqs)
+}
+
+// shutdownDef configures how servers drain their requests when chisel
+// exits.
+type shutdownDef struct {
+	// timeout is how long servers wait for requests in flight to finish
+	// before their connections are closed.
+	timeout time.Duration
+	// report is how often the requests still in flight are logged while
+	// waiting for them. If 0, they're only logged if the timeout passes.
+	report time.Duration
+	// cancel, if true, cancels the requests still in flight once the
+	// timeout passes, so that they can abort their queries and respond,
+	// before their connections are closed.
+	cancel bool
+}
+
+// Shutdown gracefully shuts down sv, forcing it closed if its requests
+// don't finish within the shutdown timeout.
+func (sd *shutdownDef) Shutdown(log zerolog.Logger, sv *http.Server) error {
+	closex, cancel := context.WithTimeout(context.Background(), sd.timeout)
+	defer cancel()
+	err := sv.Shutdown(closex)
+	if err == nil {
+		log.Info().Msg("Server closed.")
+		return nil
+	}
+	if sd.cancel {
+		// Every server calls Cancel, but only the first cancels requests.
+		if n := inflightRequests.Cancel(); n > 0 {
+			log.Warn().Int("canceled", n).Msg("Canceled requests still in flight after the shutdown timeout.")
+		}
+		gracex, cancel := context.WithTimeout(context.Background(), shutdownCancelGrace)
+		defer cancel()
+		if err = sv.Shutdown(gracex); err == nil {
+			log.Info().Msg("Server closed.")
+			return nil
+		}
+	}
+	log.Warn().Err(err).Msg("Error closing server gracefully, forcing shutdown.")
+	if err := sv.Close(); err != nil {
+		log.Error().Err(err).Msg("Error forcing server shutdown.")
+		return err
+	}
+	log.Info().Msg("Server forced closed.")
+	return nil
+}
+
+// Report logs the requests still in flight every report interval until
+// none are left or the shutdown timeout passes, at which point any left are
+// logged once more.
+func (sd *shutdownDef) Report(log zerolog.Logger) {
+	deadline := time.After(sd.timeout)
+	var tick <-chan time.Time
+	if sd.report > 0 {
+		ticker := time.NewTicker(sd.report)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// Poll for the last request to finish between reports.
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		select {
+		case <-deadline:
+			if n, reqs := inflightRequests.Snapshot(shutdownReportLimit); n > 0 {
+				log.Warn().
+					Int("in_flight", n).
+					Interface("requests", reqs).
+					Dur("timeout", sd.timeout).
+					Msg("Shutdown timeout passed with requests still in flight.")
+			}
+			return
+		case <-tick:
+			if n, reqs := inflightRequests.Snapshot(shutdownReportLimit); n > 0 {
+				log.Info().
+					Int("in_flight", n).
+					Interface("requests", reqs).
+					Msg("Waiting for requests in flight to finish.")
+			}
+		case <-poll.C:
+			if inflightRequests.Len() == 0 {
+				return
+			}
+		}
+	}
+}
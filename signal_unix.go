@@ -0,0 +1,45 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// runProgram runs the program with a context that ends when chisel is sent
+// SIGINT or SIGTERM, and returns its exit code.
+func runProgram(run func(ctx context.Context) int) int {
+	ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM)
+	defer cancel()
+	return run(ctx)
+}
+
+// notifyReload relays the signals that reload the config, SIGHUP, to c.
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, unix.SIGHUP)
+}
+
+// notifyDiagnostics relays the signals that write a diagnostic bundle,
+// SIGQUIT, to c.
+func notifyDiagnostics(c chan<- os.Signal) {
+	signal.Notify(c, unix.SIGQUIT)
+}
@@ -0,0 +1,89 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// runProgram runs the program and returns its exit code. If chisel was
+// started by the service control manager, it runs as a Windows service and
+// its context ends when the service is stopped or the system shuts down.
+// Otherwise, its context ends on Ctrl+C or when its console is closed.
+func runProgram(run func(ctx context.Context) int) int {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		return run(ctx)
+	}
+	s := &windowsService{run: run}
+	// The name is ignored by services that run in their own process.
+	if err := svc.Run("chisel", s); err != nil {
+		return 1
+	}
+	return s.code
+}
+
+// windowsService runs chisel under the service control manager.
+type windowsService struct {
+	run  func(ctx context.Context) int
+	code int
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan int, 1)
+	go func() { done <- s.run(ctx) }()
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case s.code = <-done:
+			status <- svc.Status{State: svc.StopPending}
+			// Nonzero codes are reported as service-specific exit codes.
+			return s.code != 0, uint32(s.code)
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// Servers shut down gracefully once ctx ends.
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// notifyReload does nothing, since Windows has no SIGHUP. On Windows,
+// configs are only reloaded when a watched remote config changes.
+func notifyReload(c chan<- os.Signal) {}
+
+// notifyDiagnostics does nothing, since Windows has no SIGQUIT.
+// Diagnostic bundles are written on Windows through the admin API.
+func notifyDiagnostics(c chan<- os.Signal) {}
@@ -0,0 +1,267 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// truncatedHeader is set on responses truncated by a response limit.
+const truncatedHeader = "X-Response-Truncated"
+
+// bodyHeaders are headers that describe the full body of a response, and
+// are removed from responses that are truncated.
+var bodyHeaders = []string{"ETag", "Repr-Digest", "Digest"}
+
+// ResponseLimitDef limits the size of an endpoint's response bodies. By
+// default, responses larger than MaxBytes are replaced with a 500 error. If
+// Truncate is set, they're cut off at MaxBytes instead. If the response's
+// length was known before it was written, the X-Response-Truncated header
+// is set and the ETag and digest headers of the full body are removed.
+type ResponseLimitDef struct {
+	MaxBytes int64 `json:"max_bytes" yaml:"max_bytes"`
+	Truncate bool  `json:"truncate,omitempty" yaml:"truncate,omitempty"`
+}
+
+func (ld *ResponseLimitDef) Validate() error {
+	var me *multierror.Error
+	if ld.MaxBytes <= 0 {
+		me = multierror.Append(me, errors.New("max_bytes must be greater than 0"))
+	}
+	return errorOrNil(me)
+}
+
+// Wrap limits the size of responses from next.
+func (ld *ResponseLimitDef) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := zerolog.Ctx(req.Context()).With().Int64("max_bytes", ld.MaxBytes).Logger()
+		lw := &limitWriter{ResponseWriter: w, def: ld, log: log}
+		next.ServeHTTP(lw, req)
+	})
+}
+
+// limitWriter enforces a response limit. Responses whose Content-Length is
+// known to exceed the limit are rejected or truncated before their headers
+// are written. Otherwise, the response is truncated once the limit is
+// reached or, if it should be rejected, aborted, since its status has
+// already been sent.
+type limitWriter struct {
+	http.ResponseWriter
+	def *ResponseLimitDef
+	log zerolog.Logger
+
+	wroteHeader bool
+	rejected    bool
+	truncated   bool
+	written     int64
+}
+
+func (lw *limitWriter) WriteHeader(status int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	h := lw.Header()
+	n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil || n <= lw.def.MaxBytes {
+		lw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if lw.def.Truncate {
+		lw.log.Warn().Int64("length", n).Msg("Truncating response larger than the endpoint's limit.")
+		h.Set("Content-Length", strconv.FormatInt(lw.def.MaxBytes, 10))
+		h.Set(truncatedHeader, "true")
+		for _, k := range bodyHeaders {
+			h.Del(k)
+		}
+		lw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	lw.log.Error().Int64("length", n).Msg("Rejecting response larger than the endpoint's limit.")
+	lw.rejected = true
+	for k := range h {
+		delete(h, k)
+	}
+	writeError(lw.log, lw.ResponseWriter, http.StatusInternalServerError, &errorResponse{Error: "response too large"})
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.rejected || lw.truncated {
+		return len(p), nil
+	}
+	if rem := lw.def.MaxBytes - lw.written; int64(len(p)) > rem {
+		if !lw.def.Truncate {
+			lw.log.Error().Msg("Aborting response larger than the endpoint's limit.")
+			panic(http.ErrAbortHandler)
+		}
+		n, err := lw.ResponseWriter.Write(p[:rem])
+		lw.written += int64(n)
+		lw.truncated = true
+		if err != nil {
+			return n, err
+		}
+		return len(p), nil
+	}
+	n, err := lw.ResponseWriter.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying response, if it supports flushing.
+func (lw *limitWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// endpointKey identifies an endpoint by method and path.
+type endpointKey struct {
+	Method string
+	Path   string
+}
+
+// endpointLabels returns the Prometheus labels of an endpoint's metrics. The
+// endpoint label is only set for named endpoints.
+func endpointLabels(method, path, name string) string {
+	labels := fmt.Sprintf("method=%q,path=%q", method, path)
+	if name != "" {
+		labels += fmt.Sprintf(",endpoint=%q", name)
+	}
+	return labels
+}
+
+// endpointSizes counts the bytes read from request bodies and written to
+// response bodies by each endpoint. Counts are kept across reloads.
+var endpointSizes = &sizeMetrics{counts: map[endpointKey]*sizeCounts{}}
+
+type sizeCounts struct {
+	requestBytes  int64
+	responseBytes int64
+}
+
+type sizeMetrics struct {
+	mu     sync.Mutex
+	counts map[endpointKey]*sizeCounts
+}
+
+func (sm *sizeMetrics) get(key endpointKey) *sizeCounts {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sc := sm.counts[key]
+	if sc == nil {
+		sc = &sizeCounts{}
+		sm.counts[key] = sc
+	}
+	return sc
+}
+
+// Wrap counts the request and response bytes of requests to next.
+func (sm *sizeMetrics) Wrap(method, path string, next http.Handler) http.Handler {
+	sc := sm.get(endpointKey{Method: method, Path: path})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &countingReader{ReadCloser: req.Body, n: &sc.requestBytes}
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { atomic.AddInt64(&sc.responseBytes, sw.written) }()
+		next.ServeHTTP(sw, req)
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// SizeSummary is the number of request and response bytes of an endpoint.
+type SizeSummary struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Name          string `json:"name,omitempty"`
+	RequestBytes  int64  `json:"request_bytes"`
+	ResponseBytes int64  `json:"response_bytes"`
+}
+
+// sizeSummaries returns the size summaries of all endpoints in conf.
+func sizeSummaries(conf *Config) []SizeSummary {
+	sums := make([]SizeSummary, 0, len(conf.Endpoints))
+	for _, ed := range conf.Endpoints {
+		sc := endpointSizes.get(endpointKey{Method: ed.Method, Path: ed.Path})
+		sums = append(sums, SizeSummary{
+			Method:        ed.Method,
+			Path:          ed.Path,
+			Name:          ed.Name,
+			RequestBytes:  atomic.LoadInt64(&sc.requestBytes),
+			ResponseBytes: atomic.LoadInt64(&sc.responseBytes),
+		})
+	}
+	return sums
+}
+
+func adminGetSizes(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		writeJSON(log, w, http.StatusOK, sizeSummaries(conf))
+	}
+}
+
+// adminGetSizeMetrics writes endpoint byte counts in the Prometheus text
+// format.
+func adminGetSizeMetrics(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		sums := sizeSummaries(conf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		writeSizeMetrics(w, sums)
+	}
+}
+
+func writeSizeMetrics(w io.Writer, sums []SizeSummary) {
+	metrics := []struct {
+		name, help string
+		value      func(SizeSummary) int64
+	}{
+		{"chisel_request_bytes_total", "Bytes read from request bodies.", func(s SizeSummary) int64 { return s.RequestBytes }},
+		{"chisel_response_bytes_total", "Bytes written to response bodies.", func(s SizeSummary) int64 { return s.ResponseBytes }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, "counter")
+		for _, s := range sums {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, endpointLabels(s.Method, s.Path, s.Name), strconv.FormatInt(m.value(s), 10))
+		}
+	}
+}
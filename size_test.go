@@ -0,0 +1,64 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseLimitTruncate(t *testing.T) {
+	ld := &ResponseLimitDef{MaxBytes: 4, Truncate: true}
+	h := ld.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveContent(w, req, []byte("0123456789"))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); body != "0123" {
+		t.Errorf("body = %q; want %q", body, "0123")
+	}
+	if got := w.Header().Get(truncatedHeader); got != "true" {
+		t.Errorf("%s = %q; want true", truncatedHeader, got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "4" {
+		t.Errorf("Content-Length = %q; want 4", got)
+	}
+	for _, k := range bodyHeaders {
+		if v, ok := w.Header()[k]; ok {
+			t.Errorf("%s = %q; want it removed", k, v)
+		}
+	}
+}
+
+func TestResponseLimitUnderLimit(t *testing.T) {
+	ld := &ResponseLimitDef{MaxBytes: 16, Truncate: true}
+	h := ld.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveContent(w, req, []byte("0123456789"))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); body != "0123456789" {
+		t.Errorf("body = %q; want %q", body, "0123456789")
+	}
+	for _, k := range bodyHeaders {
+		if w.Header().Get(k) == "" {
+			t.Errorf("%s is missing", k)
+		}
+	}
+}
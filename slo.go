@@ -0,0 +1,199 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// sloBuckets is the number of buckets an SLO window is divided into.
+const sloBuckets = 60
+
+// SLODef declares a latency objective for an endpoint: the fraction of
+// requests, measured over a rolling window, that must succeed within the
+// latency target. Requests that fail with a 5xx status count against the
+// objective regardless of their latency.
+type SLODef struct {
+	Latency   Duration `json:"latency" yaml:"latency"`
+	Objective float64  `json:"objective" yaml:"objective"` // Defaults to 0.99.
+	Window    Duration `json:"window" yaml:"window"`       // Defaults to 1h.
+
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket
+}
+
+type sloBucket struct {
+	index int64 // Index of the bucket's interval since the Unix epoch.
+	total int64
+	good  int64
+}
+
+func (sd *SLODef) Validate() error {
+	var me *multierror.Error
+	if sd.Latency.Duration <= 0 {
+		me = multierror.Append(me, errors.New("latency must be greater than zero"))
+	}
+	if sd.Objective == 0 {
+		sd.Objective = 0.99
+	}
+	if sd.Objective <= 0 || sd.Objective >= 1 {
+		me = multierror.Append(me, errors.New("objective must be between 0 and 1"))
+	}
+	if sd.Window.Duration <= 0 {
+		sd.Window.Duration = time.Hour
+	}
+	if sd.Window.Duration < sloBuckets*time.Second {
+		me = multierror.Append(me, fmt.Errorf("window must be at least %v", sloBuckets*time.Second))
+	}
+	return errorOrNil(me)
+}
+
+func (sd *SLODef) bucketIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(sd.Window.Duration/sloBuckets)
+}
+
+// Record records a request completed at now.
+func (sd *SLODef) Record(now time.Time, good bool) {
+	idx := sd.bucketIndex(now)
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	b := &sd.buckets[idx%sloBuckets]
+	if b.index != idx {
+		*b = sloBucket{index: idx}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// Wrap records the latency and status of requests to next.
+func (sd *SLODef) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		now := time.Now()
+		sd.Record(now, now.Sub(start) <= sd.Latency.Duration && sw.Status() < 500)
+	})
+}
+
+// SLOSummary is the state of an endpoint's SLO over its current window.
+type SLOSummary struct {
+	Method    string   `json:"method"`
+	Path      string   `json:"path"`
+	Name      string   `json:"name,omitempty"`
+	Latency   Duration `json:"latency"`
+	Objective float64  `json:"objective"`
+	Window    Duration `json:"window"`
+	Total     int64    `json:"total"`
+	Good      int64    `json:"good"`
+	// BurnRate is the rate the error budget is being spent at. At a
+	// burn rate of 1, the budget is spent exactly over the window.
+	BurnRate    float64 `json:"burn_rate"`
+	OutOfBudget bool    `json:"out_of_budget"`
+}
+
+// Summary returns the SLO's state for the window ending at now.
+func (sd *SLODef) Summary(now time.Time) SLOSummary {
+	idx := sd.bucketIndex(now)
+	s := SLOSummary{
+		Latency:   sd.Latency,
+		Objective: sd.Objective,
+		Window:    sd.Window,
+	}
+
+	sd.mu.Lock()
+	for _, b := range sd.buckets {
+		if b.index > idx-sloBuckets && b.index <= idx {
+			s.Total += b.total
+			s.Good += b.good
+		}
+	}
+	sd.mu.Unlock()
+
+	if s.Total > 0 {
+		errRate := float64(s.Total-s.Good) / float64(s.Total)
+		s.BurnRate = errRate / (1 - sd.Objective)
+		s.OutOfBudget = s.BurnRate > 1
+	}
+	return s
+}
+
+// sloSummaries returns the SLO summaries of all endpoints that have one.
+func sloSummaries(conf *Config, now time.Time) []SLOSummary {
+	var sums []SLOSummary
+	for _, ed := range conf.Endpoints {
+		if ed.SLO == nil {
+			continue
+		}
+		s := ed.SLO.Summary(now)
+		s.Method, s.Path, s.Name = ed.Method, ed.Path, ed.Name
+		sums = append(sums, s)
+	}
+	return sums
+}
+
+func adminGetSLOs(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		sums := sloSummaries(conf, time.Now())
+		if sums == nil {
+			sums = []SLOSummary{}
+		}
+		writeJSON(log, w, http.StatusOK, sums)
+	}
+}
+
+// adminGetSLOMetrics writes SLO summaries in the Prometheus text format.
+func adminGetSLOMetrics(conf *Config) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		sums := sloSummaries(conf, time.Now())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		writeSLOMetrics(w, sums)
+	}
+}
+
+func writeSLOMetrics(w io.Writer, sums []SLOSummary) {
+	metric := func(name, typ, help string, value func(SLOSummary) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range sums {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, endpointLabels(s.Method, s.Path, s.Name), value(s))
+		}
+	}
+	float := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	metric("chisel_slo_requests", "gauge", "Requests in the current SLO window.",
+		func(s SLOSummary) string { return strconv.FormatInt(s.Total, 10) })
+	metric("chisel_slo_good_requests", "gauge", "Requests meeting the SLO in the current SLO window.",
+		func(s SLOSummary) string { return strconv.FormatInt(s.Good, 10) })
+	metric("chisel_slo_objective", "gauge", "Fraction of requests that must meet the SLO.",
+		func(s SLOSummary) string { return float(s.Objective) })
+	metric("chisel_slo_latency_seconds", "gauge", "Latency target of the SLO.",
+		func(s SLOSummary) string { return float(s.Latency.Seconds()) })
+	metric("chisel_slo_burn_rate", "gauge", "Rate the SLO's error budget is being spent at.",
+		func(s SLOSummary) string { return float(s.BurnRate) })
+}
@@ -0,0 +1,108 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sqlCommentFields are the fields a SQL comment may hold, in the order
+// they're written.
+var sqlCommentFields = []string{"req", "endpoint", "method", "path", "step"}
+
+// defaultSQLCommentFields are the fields of SQL comments that don't list
+// their own.
+var defaultSQLCommentFields = []string{"req", "endpoint", "step"}
+
+// SQLCommentDef prepends a comment identifying the request to each
+// statement a database runs for an endpoint, such as
+// /* chisel req=abc endpoint=get_user step=0 */, so that queries seen by
+// the database, as in pg_stat_activity, can be traced back to endpoints
+// and requests.
+type SQLCommentDef struct {
+	Fields []string `json:"fields,omitempty" yaml:"fields,omitempty"` // Defaults to req, endpoint, and step.
+
+	fields map[string]bool
+}
+
+func (cd *SQLCommentDef) Validate() error {
+	if len(cd.Fields) == 0 {
+		cd.Fields = defaultSQLCommentFields
+	}
+	cd.fields = make(map[string]bool, len(cd.Fields))
+	for _, f := range cd.Fields {
+		known := false
+		for _, k := range sqlCommentFields {
+			known = known || f == k
+		}
+		if !known {
+			return fmt.Errorf("unrecognized comment field %q", f)
+		}
+		cd.fields[f] = true
+	}
+	return nil
+}
+
+// sqlCommentTags identify the request a statement is run for.
+type sqlCommentTags struct {
+	ReqID    string // The request's X-Request-Id, if it has one.
+	Endpoint string // The endpoint's name, or its method and path.
+	Method   string
+	Path     string
+}
+
+// commentTags returns the tags identifying req in SQL comments.
+func (h *Handler) commentTags(req *http.Request) *sqlCommentTags {
+	tags := &sqlCommentTags{
+		ReqID:    req.Header.Get(requestIDHeader),
+		Endpoint: h.Name,
+		Method:   h.Method,
+		Path:     h.Path,
+	}
+	if tags.Endpoint == "" {
+		tags.Endpoint = strings.ToUpper(h.Method) + " " + h.Path
+	}
+	return tags
+}
+
+// Prepend returns query with a comment of the tags and step prepended.
+// Values are query-escaped, so requests can't end the comment early. Empty
+// values are left out. If cd is nil, query is returned as-is.
+func (cd *SQLCommentDef) Prepend(query string, tags *sqlCommentTags, step string) string {
+	if cd == nil || tags == nil {
+		return query
+	}
+	values := map[string]string{
+		"req":      tags.ReqID,
+		"endpoint": tags.Endpoint,
+		"method":   tags.Method,
+		"path":     tags.Path,
+		"step":     step,
+	}
+	var sb strings.Builder
+	sb.WriteString("/* chisel")
+	for _, f := range sqlCommentFields {
+		if v := values[f]; v != "" && cd.fields[f] {
+			sb.WriteString(" " + f + "=" + url.QueryEscape(v))
+		}
+	}
+	sb.WriteString(" */ ")
+	sb.WriteString(query)
+	return sb.String()
+}
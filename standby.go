@@ -0,0 +1,172 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// standbyPollInterval is how often a promoted standby retries listening on
+// addresses still held by the process it replaces.
+const standbyPollInterval = time.Second
+
+// standbyDef configures a server started in standby, with its config
+// loaded, databases open, and routers built, but not listening on its
+// bindings until it's promoted. Only the admin API is served in standby.
+type standbyDef struct {
+	// auto, if true, promotes the server as soon as it can listen on
+	// every binding, such as when the process it replaces exits.
+	auto bool
+	// timeout is how long a promotion waits for binding addresses to be
+	// released before the server returns to standby. If auto is set,
+	// there is no timeout.
+	timeout time.Duration
+}
+
+// Promote ends the server's standby, if it's in standby, so that it
+// listens on its bindings. Promotion waits for their addresses to be
+// released, so it is not complete when Promote returns. Promote returns
+// false if the server isn't in standby.
+func (s *Server) Promote() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.standby == nil {
+		return false
+	}
+	select {
+	case s.promote <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Standby returns whether the server is in standby.
+func (s *Server) Standby() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.standby != nil
+}
+
+// awaitPromotion waits for the server to be promoted and returns listeners
+// for each of its bindings, in order. Once they're open, the server leaves
+// standby and starts its outboxes. If a promotion times out, the server
+// stays in standby until promoted again. An error is only returned if ctx
+// ends first.
+func (s *Server) awaitPromotion(ctx context.Context, log zerolog.Logger) ([]net.Listener, error) {
+	s.mu.Lock()
+	sd, binds := s.standby, s.bind
+	s.mu.Unlock()
+	for {
+		timeout := time.Duration(0)
+		if !sd.auto {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-s.promote:
+			}
+			log.Info().Msg("Promoting server from standby.")
+			timeout = sd.timeout
+		}
+
+		ls, err := listenBindings(ctx, binds, timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			log.Error().Err(err).Msg("Failed to promote server, staying in standby.")
+			continue
+		}
+
+		s.mu.Lock()
+		s.standby = nil
+		s.startOutboxes(ctx)
+		s.mu.Unlock()
+		return ls, nil
+	}
+}
+
+// listenBindings opens listeners for every binding in binds, retrying
+// until all of their addresses are free or timeout passes. If timeout is
+// 0, it retries until ctx ends.
+func listenBindings(ctx context.Context, binds []*BindDef, timeout time.Duration) ([]net.Listener, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		ls, err := listenAll(binds)
+		if err == nil {
+			return ls, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(standbyPollInterval):
+		}
+	}
+}
+
+// listenAll opens listeners for every binding in binds. If any can't be
+// opened, those already opened are closed.
+func listenAll(binds []*BindDef) ([]net.Listener, error) {
+	ls := make([]net.Listener, 0, len(binds))
+	for bid, bd := range binds {
+		l, err := listenBinding(bd)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("binding %d: %w", bid, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// StandbyStatus describes whether the server is in standby.
+type StandbyStatus struct {
+	Standby bool `json:"standby"`
+}
+
+// adminGetStandby returns whether srv is in standby.
+func adminGetStandby(srv *Server) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		writeJSON(log, w, http.StatusOK, &StandbyStatus{Standby: srv.Standby()})
+	}
+}
+
+// adminPromote promotes srv from standby. It responds once the promotion
+// has begun, since it waits for binding addresses to be released.
+func adminPromote(srv *Server) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log := *zerolog.Ctx(req.Context())
+		if !srv.Promote() {
+			writeError(log, w, http.StatusConflict, &errorResponse{Error: "server is not in standby"})
+			return
+		}
+		writeJSON(log, w, http.StatusAccepted, &StandbyStatus{Standby: true})
+	}
+}
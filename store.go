@@ -0,0 +1,221 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// kvStore is a key-value store with expiring entries.
+type kvStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX sets key only if it is not already set, and reports whether
+	// it was set.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	Del(ctx context.Context, key string) error
+	Close() error
+}
+
+// StoreDef configures the store used by middleware that keep state between
+// requests, such as cache and idempotency. Memory stores are local to a
+// single chisel process, while Redis stores are shared by every instance
+// using the same Redis server and prefix.
+type StoreDef struct {
+	Type       string `json:"type" yaml:"type"`                                   // memory (default) or redis.
+	URL        string `json:"url,omitempty" yaml:"url,omitempty"`                 // Redis URL, such as redis://localhost:6379/0.
+	Prefix     string `json:"prefix,omitempty" yaml:"prefix,omitempty"`           // Prefix of all keys.
+	MaxEntries int    `json:"max_entries,omitempty" yaml:"max_entries,omitempty"` // Memory stores only. Defaults to 10000.
+
+	redisOpts *redis.Options
+	once      sync.Once
+	store     kvStore
+}
+
+func (sd *StoreDef) Validate() error {
+	switch sd.Type {
+	case "":
+		sd.Type = "memory"
+		fallthrough
+	case "memory":
+		if sd.URL != "" {
+			return errors.New("url is only used by redis stores")
+		}
+		if sd.MaxEntries <= 0 {
+			sd.MaxEntries = 10000
+		}
+	case "redis":
+		opts, err := redis.ParseURL(sd.URL)
+		if err != nil {
+			return fmt.Errorf("invalid redis url: %w", redactURLError(err))
+		}
+		sd.redisOpts = opts
+	default:
+		return fmt.Errorf("unrecognized store type %q", sd.Type)
+	}
+	return nil
+}
+
+// open returns the store, creating it on first use.
+func (sd *StoreDef) open() kvStore {
+	sd.once.Do(func() {
+		if sd.redisOpts != nil {
+			sd.store = &redisStore{client: redis.NewClient(sd.redisOpts)}
+			return
+		}
+		sd.store = &memoryStore{max: sd.MaxEntries, entries: map[string]memoryEntry{}}
+	})
+	return sd.store
+}
+
+func (sd *StoreDef) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	return sd.open().Get(ctx, sd.Prefix+key)
+}
+
+func (sd *StoreDef) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return sd.open().Set(ctx, sd.Prefix+key, value, ttl)
+}
+
+func (sd *StoreDef) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return sd.open().SetNX(ctx, sd.Prefix+key, value, ttl)
+}
+
+func (sd *StoreDef) Del(ctx context.Context, key string) error {
+	return sd.open().Del(ctx, sd.Prefix+key)
+}
+
+// Close closes the store if it was opened.
+func (sd *StoreDef) Close() error {
+	sd.once.Do(func() {})
+	if sd.store == nil {
+		return nil
+	}
+	return sd.store.Close()
+}
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func (rs *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	p, err := rs.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return p, true, nil
+}
+
+func (rs *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rs.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (rs *redisStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return rs.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (rs *redisStore) Del(ctx context.Context, key string) error {
+	return rs.client.Del(ctx, key).Err()
+}
+
+func (rs *redisStore) Close() error {
+	return rs.client.Close()
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStore is an in-process kvStore. When full, it drops expired entries
+// and then arbitrary entries to make room.
+type memoryStore struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]memoryEntry
+}
+
+func (ms *memoryStore) get(key string, now time.Time) ([]byte, bool) {
+	e, ok := ms.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		delete(ms.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (ms *memoryStore) set(key string, value []byte, ttl time.Duration, now time.Time) {
+	if _, ok := ms.entries[key]; !ok && len(ms.entries) >= ms.max {
+		for k, e := range ms.entries {
+			if now.After(e.expires) {
+				delete(ms.entries, k)
+			}
+		}
+		for k := range ms.entries {
+			if len(ms.entries) < ms.max {
+				break
+			}
+			delete(ms.entries, k)
+		}
+	}
+	ms.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+}
+
+func (ms *memoryStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	p, ok := ms.get(key, time.Now())
+	return p, ok, nil
+}
+
+func (ms *memoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.set(key, value, ttl, time.Now())
+	return nil
+}
+
+func (ms *memoryStore) SetNX(_ context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	if _, ok := ms.get(key, now); ok {
+		return false, nil
+	}
+	ms.set(key, value, ttl, now)
+	return true, nil
+}
+
+func (ms *memoryStore) Del(_ context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.entries, key)
+	return nil
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,236 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	defaultStreamChunkSize = 500
+	// maxStreamLine is the longest NDJSON line a streamed body may have.
+	maxStreamLine = 16 << 20
+)
+
+var (
+	errStreamNoRows   = errors.New("request body has no rows")
+	errStreamTooLarge = errors.New("request body has too many rows")
+)
+
+// StreamDef configures how the rows of an ndjson or csv request body are
+// streamed into an endpoint's query. Rows are decoded as they're read and
+// passed to the query's steps ChunkSize rows at a time, so that the body
+// is never held in memory at once.
+type StreamDef struct {
+	ChunkSize int `json:"chunk_size,omitempty" yaml:"chunk_size,omitempty"` // Defaults to 500.
+	MaxRows   int `json:"max_rows,omitempty" yaml:"max_rows,omitempty"`     // If 0, there is no limit.
+}
+
+func (sd *StreamDef) Validate() error {
+	var me *multierror.Error
+	if sd.ChunkSize < 0 {
+		me = multierror.Append(me, errors.New("chunk_size must not be negative"))
+	} else if sd.ChunkSize == 0 {
+		sd.ChunkSize = defaultStreamChunkSize
+	}
+	if sd.MaxRows < 0 {
+		me = multierror.Append(me, errors.New("max_rows must not be negative"))
+	}
+	return errorOrNil(me)
+}
+
+// rowStream reads the rows of a streamed request body in chunks. It reads
+// one chunk ahead so that the steps run for a chunk know whether it is the
+// last.
+type rowStream struct {
+	def   *StreamDef
+	read  func() (interface{}, error) // Returns io.EOF after the last row.
+	bytes int64
+
+	rows    int
+	chunks  int
+	pending []interface{}
+	started bool
+}
+
+// newRowStream returns a rowStream reading rows from body, in the format of
+// the streaming body type bt.
+func newRowStream(body io.ReadCloser, bt BodyType, sd *StreamDef) *rowStream {
+	rs := &rowStream{def: sd}
+	r := &countingReader{ReadCloser: body, n: &rs.bytes}
+	switch bt {
+	case CSVBodyType:
+		rs.read = csvRows(r)
+	default:
+		rs.read = ndjsonRows(r)
+	}
+	return rs
+}
+
+// ndjsonRows returns a function reading one JSON value per line from r.
+// Blank lines are skipped.
+func ndjsonRows(r io.Reader) func() (interface{}, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxStreamLine)
+	line := 0
+	return func() (interface{}, error) {
+		for sc.Scan() {
+			line++
+			p := sc.Bytes()
+			if len(p) == 0 || len(p) == 1 && p[0] == '\r' {
+				continue
+			}
+			var row interface{}
+			if err := json.Unmarshal(p, &row); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			return row, nil
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line+1, err)
+		}
+		return nil, io.EOF
+	}
+}
+
+// csvRows returns a function reading records from r as objects keyed by the
+// names in the first record, the header. Values are strings.
+func csvRows(r io.Reader) func() (interface{}, error) {
+	cr := csv.NewReader(r)
+	var header []string
+	return func() (interface{}, error) {
+		if header == nil {
+			rec, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			seen := make(map[string]bool, len(rec))
+			for _, name := range rec {
+				if seen[name] {
+					return nil, fmt.Errorf("duplicate column %q in header", name)
+				}
+				seen[name] = true
+			}
+			header = rec
+		}
+		rec, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			row[name] = rec[i]
+		}
+		return row, nil
+	}
+}
+
+// readChunk reads up to a chunk of rows. It returns an empty chunk once the
+// body has been read.
+func (rs *rowStream) readChunk() ([]interface{}, error) {
+	chunk := make([]interface{}, 0, rs.def.ChunkSize)
+	for len(chunk) < rs.def.ChunkSize {
+		row, err := rs.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if rs.def.MaxRows > 0 && rs.rows+len(chunk) >= rs.def.MaxRows {
+			return nil, errStreamTooLarge
+		}
+		chunk = append(chunk, row)
+	}
+	rs.rows += len(chunk)
+	return chunk, nil
+}
+
+// Next returns the next chunk of rows and whether it is the last.
+func (rs *rowStream) Next() (chunk []interface{}, done bool, err error) {
+	if !rs.started {
+		rs.started = true
+		if rs.pending, err = rs.readChunk(); err != nil {
+			return nil, false, err
+		}
+		if len(rs.pending) == 0 {
+			return nil, false, errStreamNoRows
+		}
+	}
+	chunk = rs.pending
+	rs.chunks++
+	if rs.pending, err = rs.readChunk(); err != nil {
+		return nil, false, err
+	}
+	return chunk, len(rs.pending) == 0, nil
+}
+
+// progress describes the stream after its latest chunk for
+// $context.stream.
+func (rs *rowStream) progress(chunk []interface{}, done bool) map[string]interface{} {
+	return map[string]interface{}{
+		"chunk":      rs.chunks - 1,
+		"chunk_rows": len(chunk),
+		"rows":       rs.rows - len(rs.pending),
+		"bytes":      rs.bytes,
+		"done":       done,
+	}
+}
+
+// streamFailure returns the status and public message to fail a request
+// with when its body can't be streamed.
+func streamFailure(err error) (int, string) {
+	switch {
+	case errors.Is(err, errStreamTooLarge):
+		return http.StatusRequestEntityTooLarge, errStreamTooLarge.Error()
+	case errors.Is(err, errStreamNoRows):
+		return http.StatusBadRequest, errStreamNoRows.Error()
+	}
+	return http.StatusBadRequest, "error parsing request body"
+}
+
+// runStream runs the query's steps once for each chunk of rows in the
+// executor's stream, all in the same transactions. Each chunk is the body
+// of its run, and the result of the last run is the response.
+func (ex *executor) runStream(ctx context.Context) (interface{}, error) {
+	rs := ex.stream
+	for {
+		chunk, done, err := rs.Next()
+		if err != nil {
+			status, public := streamFailure(err)
+			return nil, fail(ex.log, status, public, "Error reading streamed request body.", err)
+		}
+		progress := rs.progress(chunk, done)
+		ex.argCtx.SetChunk(chunk, progress)
+		ex.log.Debug().
+			Interface("chunk", progress["chunk"]).
+			Interface("rows", progress["rows"]).
+			Interface("bytes", progress["bytes"]).
+			Msg("Running steps for streamed chunk.")
+		out, err := ex.runSteps(ctx)
+		if err != nil || done {
+			return out, err
+		}
+	}
+}
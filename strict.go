@@ -0,0 +1,142 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+// allowUnknownFields, if true, ignores unknown fields in configs instead of
+// rejecting them. It is set by the -no-strict flag, for configs written for
+// newer versions of chisel.
+var allowUnknownFields = false
+
+var yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// decodeNodeStrict decodes node into dest, rejecting unknown fields as the
+// config's decoder does. Node.Decode doesn't inherit the KnownFields option
+// of the decoder calling an UnmarshalYAML method, so those methods use this
+// instead.
+func decodeNodeStrict(node *yaml.Node, dest interface{}) error {
+	if err := node.Decode(dest); err != nil || allowUnknownFields {
+		return err
+	}
+	return checkKnownFields(node, reflect.TypeOf(dest))
+}
+
+// checkKnownFields returns an error for each key of a mapping in node that
+// has no field in the type t it is decoded into. Values whose types
+// implement yaml.Unmarshaler are left to check their own fields.
+func checkKnownFields(node *yaml.Node, t reflect.Type) error {
+	for node.Kind == yaml.DocumentNode && len(node.Content) == 1 {
+		node = node.Content[0]
+	}
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(yamlUnmarshalerType) {
+		return nil
+	}
+
+	var me *multierror.Error
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			break
+		}
+		fields, anyKey := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			ft, ok := fields[k.Value]
+			if !ok {
+				if !anyKey && k.Value != "<<" {
+					me = multierror.Append(me, fmt.Errorf("line %d: field %s not found in type %v", k.Line, k.Value, t))
+				}
+				continue
+			}
+			if err := checkKnownFields(v, ft); err != nil {
+				me = multierror.Append(me, err)
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			break
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := checkKnownFields(node.Content[i], t.Elem()); err != nil {
+				me = multierror.Append(me, err)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			break
+		}
+		for _, v := range node.Content {
+			if err := checkKnownFields(v, t.Elem()); err != nil {
+				me = multierror.Append(me, err)
+			}
+		}
+	}
+	return errorOrNil(me)
+}
+
+// yamlFields returns the types of the fields of the struct type t by their
+// YAML keys, following yaml.v3's rules for tags, and whether t has an
+// inline map accepting any key.
+func yamlFields(t reflect.Type) (fields map[string]reflect.Type, anyKey bool) {
+	fields = make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(","+opts+",", ",inline,") {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			switch ft.Kind() {
+			case reflect.Struct:
+				inner, innerAny := yamlFields(ft)
+				for k, v := range inner {
+					fields[k] = v
+				}
+				anyKey = anyKey || innerAny
+			case reflect.Map:
+				anyKey = true
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields, anyKey
+}
@@ -0,0 +1,141 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errUnknownQueryParam  = errors.New("unknown query parameter")
+	errRepeatedQueryParam = errors.New("query parameter may only be given once")
+)
+
+// StrictQueryDef rejects requests to an endpoint with query parameters it
+// doesn't use, or with more than one value for parameters that take one,
+// so that typos such as ?user_d=1 fail with a 400 status instead of being
+// ignored. It may be given as true to accept only the params the endpoint
+// is known to use.
+type StrictQueryDef struct {
+	// Allow lists params the endpoint accepts in addition to those it maps
+	// in query_params, refers to in args, or pages with, such as params
+	// only read by expressions.
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	// Repeat lists params that may be given more than once. Repeated
+	// params are accepted.
+	Repeat []string `json:"repeat,omitempty" yaml:"repeat,omitempty"`
+
+	off    bool            // Set by strict_query: false.
+	known  map[string]bool // Params the endpoint accepts.
+	repeat map[string]bool // Params that may be given more than once.
+}
+
+type strictQueryDef StrictQueryDef
+
+func (sq *StrictQueryDef) UnmarshalJSON(src []byte) error {
+	var on bool
+	if unmarshalStrict(src, &on) == nil {
+		*sq = StrictQueryDef{off: !on}
+		return nil
+	}
+	var def strictQueryDef
+	if err := unmarshalStrict(src, &def); err != nil {
+		return err
+	}
+	*sq = StrictQueryDef(def)
+	return nil
+}
+
+func (sq *StrictQueryDef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var on bool
+		if err := node.Decode(&on); err != nil {
+			return fmt.Errorf("strict_query must be a boolean or mapping: %w", err)
+		}
+		*sq = StrictQueryDef{off: !on}
+		return nil
+	}
+	var def strictQueryDef
+	if err := decodeNodeStrict(node, &def); err != nil {
+		return err
+	}
+	*sq = StrictQueryDef(def)
+	return nil
+}
+
+// Validate checks the def and collects the query params of ed, the
+// endpoint it belongs to, which must be validated first.
+func (sq *StrictQueryDef) Validate(ed *EndpointDef) error {
+	var me *multierror.Error
+	sq.known, sq.repeat = map[string]bool{}, map[string]bool{}
+	for _, name := range sq.Allow {
+		if name == "" {
+			me = multierror.Append(me, errors.New("allow must not contain empty names"))
+		}
+		sq.known[name] = true
+	}
+	for _, name := range sq.Repeat {
+		if name == "" {
+			me = multierror.Append(me, errors.New("repeat must not contain empty names"))
+		}
+		sq.known[name], sq.repeat[name] = true, true
+	}
+	for name := range ed.QueryParams {
+		sq.known[name] = true
+	}
+	if ed.Page != nil {
+		sq.known[ed.Page.Param] = true
+	}
+	if ed.Query != nil {
+		for _, sd := range ed.Query.Steps {
+			if sd != nil {
+				sd.Args.queryParams(sq.known)
+			}
+		}
+		for _, td := range ed.Query.Transactions {
+			if td != nil && td.Compensate != nil {
+				td.Compensate.Args.queryParams(sq.known)
+			}
+		}
+	}
+	return errorOrNil(me)
+}
+
+// Check returns an error for each param of query that the endpoint
+// doesn't accept or that has several values but may only be given once.
+func (sq *StrictQueryDef) Check(query url.Values) ParamErrors {
+	var perrs ParamErrors
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case !sq.known[name]:
+			perrs = append(perrs, &ParamError{In: "query", Name: name, Err: errUnknownQueryParam})
+		case len(query[name]) > 1 && !sq.repeat[name]:
+			perrs = append(perrs, &ParamError{In: "query", Name: name, Err: errRepeatedQueryParam})
+		}
+	}
+	return perrs
+}
@@ -0,0 +1,210 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accepts reports whether the request's Accept header lists mediaType with a
+// non-zero quality.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mt := range strings.Split(accept, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(mt))
+			if err != nil || mt != mediaType {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+var errNotTabular = errors.New("response is not a list of objects")
+
+// tableRows returns out as a list of rows. A single object is a single row.
+func tableRows(out interface{}) ([]map[string]interface{}, error) {
+	switch out := out.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{out}, nil
+	case []interface{}:
+		rows := make([]map[string]interface{}, len(out))
+		for i, v := range out {
+			row, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errNotTabular
+			}
+			rows[i] = row
+		}
+		return rows, nil
+	default:
+		return nil, errNotTabular
+	}
+}
+
+// tableColumnNames returns the names of every field of every row, sorted.
+func tableColumnNames(rows []map[string]interface{}) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, row := range rows {
+		for k := range row {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ColumnType is the type of a column of a tabular response, used by
+// columnar encodings.
+type ColumnType int
+
+const (
+	StringColumn    ColumnType = iota // Strings, and values that aren't any other type.
+	BoolColumn                        // Booleans.
+	Int64Column                       // Integers that fit in 64 bits.
+	Float64Column                     // Numbers, if any don't fit in an int64.
+	BinaryColumn                      // Byte slices.
+	TimestampColumn                   // Times, stored as microseconds since the Unix epoch in UTC.
+)
+
+// column is a column of a tabular response. Values holds one value per row,
+// converted to the column's type, or nil for nulls.
+type column struct {
+	Name   string
+	Type   ColumnType
+	Values []interface{}
+	Nulls  int
+}
+
+// tableColumns splits rows into typed columns. The type of each column is
+// derived from its non-null values.
+func tableColumns(rows []map[string]interface{}) []*column {
+	names := tableColumnNames(rows)
+	columns := make([]*column, len(names))
+	for i, name := range names {
+		values := make([]interface{}, len(rows))
+		for r, row := range rows {
+			values[r] = row[name]
+		}
+		columns[i] = newColumn(name, values)
+	}
+	return columns
+}
+
+func newColumn(name string, values []interface{}) *column {
+	col := &column{Name: name, Type: inferColumnType(values), Values: values}
+	for i, v := range values {
+		if v == nil {
+			col.Nulls++
+			continue
+		}
+		switch col.Type {
+		case Int64Column:
+			values[i], _ = columnInt64(v)
+		case Float64Column:
+			values[i] = columnFloat64(v)
+		case TimestampColumn:
+			values[i] = v.(time.Time).UTC().UnixMicro()
+		case StringColumn:
+			s, ok := v.(string)
+			if !ok {
+				s, _ = opaqueString(v)
+			}
+			values[i] = s
+		}
+	}
+	return col
+}
+
+// inferColumnType returns the narrowest type that can hold every value.
+// Columns of only nulls are strings.
+func inferColumnType(values []interface{}) ColumnType {
+	typ, seen := StringColumn, false
+	for _, v := range values {
+		var vt ColumnType
+		switch v := v.(type) {
+		case nil:
+			continue
+		case bool:
+			vt = BoolColumn
+		case int, int64, *big.Int:
+			vt = Float64Column
+			if _, ok := columnInt64(v); ok {
+				vt = Int64Column
+			}
+		case float64:
+			vt = Float64Column
+		case []byte:
+			vt = BinaryColumn
+		case time.Time:
+			vt = TimestampColumn
+		default:
+			return StringColumn
+		}
+		switch {
+		case !seen:
+			typ, seen = vt, true
+		case typ == vt:
+		case typ == Int64Column && vt == Float64Column, typ == Float64Column && vt == Int64Column:
+			typ = Float64Column
+		default:
+			return StringColumn
+		}
+	}
+	return typ
+}
+
+func columnInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case *big.Int:
+		return v.Int64(), v.IsInt64()
+	}
+	return 0, false
+}
+
+func columnFloat64(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f
+	}
+	if i, ok := columnInt64(v); ok {
+		return float64(i)
+	}
+	return math.NaN()
+}
@@ -0,0 +1,78 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// tableTestRows returns rows with a column of every column type, each with
+// a null, for tests of columnar encodings.
+func tableTestRows() interface{} {
+	return []interface{}{
+		map[string]interface{}{
+			"at":    time.Date(2021, 1, 2, 3, 4, 5, 6000, time.UTC),
+			"data":  []byte{1, 2},
+			"id":    int64(1),
+			"name":  "a",
+			"ok":    true,
+			"score": 1.5,
+		},
+		map[string]interface{}{
+			"at":    nil,
+			"data":  nil,
+			"id":    2,
+			"name":  nil,
+			"ok":    false,
+			"score": nil,
+		},
+		map[string]interface{}{
+			"at":    time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC),
+			"data":  []byte{},
+			"id":    int64(-3),
+			"name":  "ccc",
+			"ok":    nil,
+			"score": -2.25,
+		},
+	}
+}
+
+// checkGolden compares got to the golden file testdata/name, or rewrites
+// the file if -update is set.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s; run with -update if the change is intended\ngot:  %x\nwant: %x", path, got, want)
+	}
+}
@@ -0,0 +1,206 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// tapBuffer is the number of events buffered for each tap. Events are
+	// dropped for taps that fall behind.
+	tapBuffer = 256
+
+	// tapHeartbeat is how often a comment is sent to idle taps to keep
+	// their connections open.
+	tapHeartbeat = 15 * time.Second
+)
+
+// requestTaps publishes summaries of requests to endpoints to the admin
+// API's tap streams.
+var requestTaps = &tapHub{subs: map[*tap]struct{}{}}
+
+// TapEvent is a summary of a request sent to taps. It holds no headers or
+// bodies, and sensitive query parameters are redacted from its URL.
+type TapEvent struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"` // The path template of the endpoint.
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	ElapsedMS float64   `json:"elapsed_ms"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// tapFilter selects the events sent to a tap. Empty fields match all
+// events. Status may be a status code, such as 404, or a class, such as 5xx.
+type tapFilter struct {
+	Method string
+	Path   string
+	Status string
+}
+
+func (f *tapFilter) match(ev *TapEvent) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, ev.Method) {
+		return false
+	}
+	if f.Path != "" && f.Path != ev.Path {
+		return false
+	}
+	if f.Status == "" {
+		return true
+	}
+	code := strconv.Itoa(ev.Status)
+	if strings.HasSuffix(f.Status, "xx") {
+		return strings.HasPrefix(code, f.Status[:len(f.Status)-2])
+	}
+	return f.Status == code
+}
+
+type tap struct {
+	filter tapFilter
+	events chan *TapEvent
+}
+
+type tapHub struct {
+	active int32 // Number of taps, read without holding mu.
+
+	mu   sync.Mutex
+	subs map[*tap]struct{}
+}
+
+// Subscribe returns a new tap receiving events that match filter. The tap
+// must be removed with Unsubscribe.
+func (th *tapHub) Subscribe(filter tapFilter) *tap {
+	t := &tap{filter: filter, events: make(chan *TapEvent, tapBuffer)}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.subs[t] = struct{}{}
+	atomic.StoreInt32(&th.active, int32(len(th.subs)))
+	return t
+}
+
+func (th *tapHub) Unsubscribe(t *tap) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	delete(th.subs, t)
+	atomic.StoreInt32(&th.active, int32(len(th.subs)))
+}
+
+// Active reports whether there are any taps.
+func (th *tapHub) Active() bool {
+	return atomic.LoadInt32(&th.active) > 0
+}
+
+// Publish sends ev to all taps whose filters match it, dropping it for taps
+// whose buffers are full.
+func (th *tapHub) Publish(ev *TapEvent) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	for t := range th.subs {
+		if !t.filter.match(ev) {
+			continue
+		}
+		select {
+		case t.events <- ev:
+		default:
+		}
+	}
+}
+
+// Wrap publishes a summary of each request to the endpoint's handle while
+// any taps are open.
+func (th *tapHub) Wrap(method, path string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !th.Active() {
+			handle(w, req, ps)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		handle(sw, req, ps)
+		th.Publish(&TapEvent{
+			Time:      start.UTC(),
+			Method:    method,
+			Path:      path,
+			URL:       redactRequestURL(req.URL, sensitiveName),
+			Status:    sw.Status(),
+			ElapsedMS: float64(time.Since(start)) / float64(time.Millisecond),
+			RequestID: req.Header.Get(requestIDHeader),
+		})
+	}
+}
+
+// adminTap streams summaries of requests as server-sent events until the
+// client disconnects. Events may be filtered with the method, path, and
+// status query parameters.
+func adminTap(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log := *zerolog.Ctx(req.Context())
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(log, w, http.StatusInternalServerError, &errorResponse{Error: "streaming is not supported"})
+		return
+	}
+
+	q := req.URL.Query()
+	filter := tapFilter{
+		Method: q.Get("method"),
+		Path:   q.Get("path"),
+		Status: strings.ToLower(q.Get("status")),
+	}
+	t := requestTaps.Subscribe(filter)
+	defer requestTaps.Unsubscribe(t)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(tapHeartbeat)
+	defer heartbeat.Stop()
+	ctx := req.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case ev := <-t.events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to marshal tap event.")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: request\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,171 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// TemplateDef is a parameterized list of endpoints. Strings in the endpoints
+// (including mapping keys) are Go text/templates that are expanded with the
+// parameters of each GenerateDef that uses the template.
+type TemplateDef struct {
+	Params    []string      `json:"params" yaml:"params"`
+	Endpoints []interface{} `json:"endpoints" yaml:"endpoints"`
+
+	dir string // Directory of the config file the template was read from.
+}
+
+// GenerateDef expands a template once for each set of parameters in With.
+// If Override is set, it is expanded with the same parameters and merged
+// over each generated endpoint, so that rules can change parts of a
+// template without copying it. As with profile overlays, mappings are
+// merged key by key, while lists and other values replace the template's.
+type GenerateDef struct {
+	Template string                 `json:"template" yaml:"template"`
+	With     []map[string]string    `json:"with" yaml:"with"`
+	Override map[string]interface{} `json:"override,omitempty" yaml:"override,omitempty"`
+}
+
+// ExpandTemplates expands all generate rules and appends the resulting endpoints to
+// the config's endpoints. Templates and rules are cleared afterward so that
+// they are not expanded again.
+func (c *Config) ExpandTemplates() error {
+	var me *multierror.Error
+	for gi, gd := range c.Generate {
+		td, ok := c.Templates[gd.Template]
+		if !ok {
+			me = multierror.Append(me, fmt.Errorf("generate=%d refers to undefined template %q", gi, gd.Template))
+			continue
+		}
+		for wi, params := range gd.With {
+			eds, err := td.Expand(params, gd.Override)
+			if err != nil {
+				me = multierror.Append(me, fmt.Errorf("generate=%d with=%d failed: %w", gi, wi, err))
+				continue
+			}
+			resolveStepFiles(eds, td.dir)
+			c.Endpoints = append(c.Endpoints, eds...)
+		}
+	}
+	if err := errorOrNil(me); err != nil {
+		return err
+	}
+	c.Templates, c.Generate = nil, nil
+	return nil
+}
+
+// Expand returns the template's endpoints with params substituted and
+// override, if not nil, merged over each of them.
+func (td *TemplateDef) Expand(params map[string]string, override map[string]interface{}) (EndpointDefs, error) {
+	if td == nil {
+		return nil, errors.New("template definition is nil")
+	}
+	var missing []string
+	for _, p := range td.Params {
+		if _, ok := params[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing template parameter(s): %s", strings.Join(missing, ", "))
+	}
+
+	expanded, err := expandTemplateValue(td.Endpoints, params)
+	if err != nil {
+		return nil, err
+	}
+	if override != nil {
+		var changes []string // Unused.
+		endpoints := expanded.([]interface{})
+		for i, ed := range endpoints {
+			// Expand the override for each endpoint so that they don't
+			// share values.
+			ov, err := expandTemplateValue(override, params)
+			if err != nil {
+				return nil, fmt.Errorf("error expanding override: %w", err)
+			}
+			endpoints[i] = mergeJSONOverlay(ed, ov, "", &changes)
+		}
+	}
+	blob, err := json.Marshal(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding expanded endpoints: %w", err)
+	}
+	var eds EndpointDefs
+	if err := unmarshalStrict(blob, &eds); err != nil {
+		return nil, fmt.Errorf("error parsing expanded endpoints: %w", err)
+	}
+	return eds, nil
+}
+
+// expandTemplateValue expands templates in all strings in v, which must be
+// decoded JSON or YAML.
+func expandTemplateValue(v interface{}, params map[string]string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return expandTemplateString(v, params)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			ev, err := expandTemplateValue(e, params)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ev
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ek, err := expandTemplateString(k, params)
+			if err != nil {
+				return nil, err
+			}
+			ev, err := expandTemplateValue(e, params)
+			if err != nil {
+				return nil, err
+			}
+			out[ek] = ev
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func expandTemplateString(s string, params map[string]string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template %q: %w", s, err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, params); err != nil {
+		return "", fmt.Errorf("error expanding template %q: %w", s, err)
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,156 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// traceHeader is both the request header used to ask for a trace and the
+// response header the trace is returned in.
+const traceHeader = "X-Chisel-Trace"
+
+// TraceDef configures execution traces. Traces summarize the time spent on
+// each step and transaction of a request and are returned to the client in
+// the X-Chisel-Trace response header.
+type TraceDef struct {
+	// Enabled, if true, includes a trace in every response.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Token, if set, includes a trace in responses to requests whose
+	// X-Chisel-Trace header is equal to it.
+	Token string `json:"token,omitempty" yaml:"token,omitempty" sensitive:"true"`
+}
+
+func (td *TraceDef) Validate() error {
+	if !td.Enabled && td.Token == "" {
+		return errors.New("trace must be enabled or define a token")
+	}
+	return nil
+}
+
+// Start returns a new trace if the request should be traced, or nil
+// otherwise. A nil *TraceDef never traces requests.
+func (td *TraceDef) Start(req *http.Request) *requestTrace {
+	if td == nil {
+		return nil
+	}
+	if !td.Enabled {
+		got := req.Header.Get(traceHeader)
+		if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(td.Token)) != 1 {
+			return nil
+		}
+	}
+	return &requestTrace{start: time.Now()}
+}
+
+// requestTrace records timings for a single request. All methods are no-ops
+// on a nil *requestTrace.
+type requestTrace struct {
+	start time.Time
+
+	Total        traceDuration       `json:"total_ms"`
+	Steps        []*stepTrace        `json:"steps"`
+	Transactions []*transactionTrace `json:"transactions,omitempty"`
+}
+
+type stepTrace struct {
+	Step     int           `json:"step"`
+	Type     string        `json:"type"`
+	Duration traceDuration `json:"ms"`
+	Rows     *int          `json:"rows,omitempty"`
+}
+
+type transactionTrace struct {
+	Transaction int           `json:"transaction"`
+	Begin       traceDuration `json:"begin_ms"`
+	End         traceDuration `json:"end_ms"`
+	Committed   bool          `json:"committed"`
+}
+
+// traceDuration is a duration encoded as fractional milliseconds.
+type traceDuration time.Duration
+
+func (d traceDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(float64(d) / float64(time.Millisecond))
+}
+
+func (t *requestTrace) Begin(ti int, began time.Time) {
+	if t == nil {
+		return
+	}
+	t.Transactions = append(t.Transactions, &transactionTrace{
+		Transaction: ti,
+		Begin:       traceDuration(time.Since(began)),
+	})
+}
+
+func (t *requestTrace) End(ti int, ended time.Time, committed bool) {
+	if t == nil || ti >= len(t.Transactions) {
+		return
+	}
+	t.Transactions[ti].End = traceDuration(time.Since(ended))
+	t.Transactions[ti].Committed = committed
+}
+
+// reset discards the steps and transactions recorded so far, for requests
+// that are run again after a failed batch.
+func (t *requestTrace) reset() {
+	if t == nil {
+		return
+	}
+	t.Steps, t.Transactions = nil, nil
+}
+
+// Step records a completed step. If res is a result set, its row count is
+// included in the trace.
+func (t *requestTrace) Step(si int, sd *StepDef, began time.Time, res interface{}) {
+	if t == nil {
+		return
+	}
+	st := &stepTrace{
+		Step:     si,
+		Type:     "query",
+		Duration: traceDuration(time.Since(began)),
+	}
+	if sd.HTTP != nil {
+		st.Type = "http"
+	} else if sd.Dataset != nil {
+		st.Type = "dataset"
+	}
+	if rows, ok := res.([]interface{}); ok {
+		n := len(rows)
+		st.Rows = &n
+	}
+	t.Steps = append(t.Steps, st)
+}
+
+// Write sets the trace header on w. It must be called before the response
+// status is written.
+func (t *requestTrace) Write(w http.ResponseWriter) {
+	if t == nil {
+		return
+	}
+	t.Total = traceDuration(time.Since(t.start))
+	blob, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	w.Header().Set(traceHeader, string(blob))
+}
@@ -0,0 +1,193 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+)
+
+// ValidateConfig implements the validate subcommand, which loads the config
+// without serving it and reports every error in it. Loading the config
+// checks references between its parts and compiles its jq expressions.
+// Unless -offline is set, the databases are also opened and every SQL
+// statement is prepared, and with -explain EXPLAINed, against its database. It returns 1 if there are
+// any errors.
+func ValidateConfig(ctx context.Context, fs *flag.FlagSet, args []string) int {
+	var (
+		offline bool
+		explain bool
+		timeout = 30 * time.Second
+	)
+	cf := addConfigFlags(fs)
+	fs.BoolVar(&offline, "offline", offline, "Skip opening databases and preparing SQL statements.")
+	fs.BoolVar(&explain, "explain", explain, "Also EXPLAIN SQL statements on PostgreSQL and MySQL databases.")
+	fs.DurationVar(&timeout, "timeout", timeout, "How long to spend preparing SQL statements.")
+
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	out := fs.Output()
+	if err := cf.resolveProfile(); err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return 2
+	}
+
+	conf, err := cf.load()
+	if err != nil {
+		return reportErrors(out, err)
+	}
+	for _, note := range conf.migrations {
+		fmt.Fprintf(out, "warning: upgraded from an older config version: %s\n", note)
+	}
+	if !offline {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := prepareStatements(ctx, conf, explain); err != nil {
+			return reportErrors(out, err)
+		}
+	}
+
+	fmt.Fprintf(out, "%s: config is valid\n", cf.path)
+	return 0
+}
+
+// reportErrors writes each error in err to w on its own line and returns the
+// validate subcommand's exit code for them.
+func reportErrors(w io.Writer, err error) int {
+	errs := splitErrors(err)
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		fmt.Fprintf(w, "error: %s\n", msg)
+	}
+	fmt.Fprintf(w, "%d error(s) found\n", len(msgs))
+	return 1
+}
+
+// splitErrors returns the errors of err if it is a multierror, unwrapping
+// multierrors holding a single error, or err alone otherwise.
+func splitErrors(err error) []error {
+	var me *multierror.Error
+	for errors.As(err, &me) && len(me.Errors) > 0 {
+		if len(me.Errors) > 1 {
+			return me.Errors
+		}
+		err = me.Errors[0]
+	}
+	return []error{err}
+}
+
+// logQueryErrors logs each error in err from checking a config's queries.
+func logQueryErrors(log zerolog.Logger, err error) {
+	for _, err := range splitErrors(err) {
+		log.Error().Err(err).Msg("Query failed check.")
+	}
+}
+
+// prepareStatements opens the databases of conf and checks the SQL
+// statements of every step and catalog query against them, as checkQueries
+// does.
+func prepareStatements(ctx context.Context, conf *Config, explain bool) error {
+	dbs, err := openDatabases(zerolog.Nop(), conf, nil)
+	if err != nil {
+		return fmt.Errorf("error opening databases: %w", err)
+	}
+	defer dbs.Close()
+	return checkQueries(ctx, conf, dbs, explain)
+}
+
+// queryCheck checks the queries of a config before it is served, as set by
+// the serve subcommand's -check-queries and -explain flags.
+type queryCheck struct {
+	explain bool
+	timeout time.Duration
+}
+
+// Run checks the queries of conf against dbs, giving up after the check's
+// timeout.
+func (qc *queryCheck) Run(ctx context.Context, conf *Config, dbs Databases) error {
+	ctx, cancel := context.WithTimeout(ctx, qc.timeout)
+	defer cancel()
+	return checkQueries(ctx, conf, dbs, qc.explain)
+}
+
+// checkQueries prepares the SQL statements of every step and catalog query
+// of conf against their databases in dbs. If explain is true, statements on
+// PostgreSQL and MySQL databases are also EXPLAINed with a NULL for each
+// parameter, which catches errors some drivers only report once a statement
+// is planned. Statements are never executed.
+func checkQueries(ctx context.Context, conf *Config, dbs Databases, explain bool) error {
+	var me *multierror.Error
+	check := func(ident string, db *Database, query string, canExplain bool) {
+		if db == nil || query == "" {
+			return
+		}
+		stmt, err := db.db.PrepareContext(ctx, rebind(db.options.BindType, query))
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("%s: %w", ident, err))
+			return
+		}
+		_ = stmt.Close()
+		if !explain || !canExplain || !db.explainable() {
+			return
+		}
+		args := make([]interface{}, strings.Count(query, "?"))
+		rows, err := db.db.QueryContext(ctx, "EXPLAIN "+rebind(db.options.BindType, query), args...)
+		if err != nil {
+			me = multierror.Append(me, fmt.Errorf("%s: explain: %w", ident, err))
+			return
+		}
+		_ = rows.Close()
+	}
+
+	for edi, ed := range conf.Endpoints {
+		if ed.Query == nil {
+			continue
+		}
+		for si, sd := range ed.Query.Steps {
+			if sd == nil || sd.HTTP != nil || sd.Dataset != nil {
+				continue
+			}
+			td := ed.Query.Transactions[sd.Transaction.Index]
+			// Procedure calls can't be explained.
+			check(fmt.Sprintf("%s step=%d", ed.ident(edi), si), dbs[td.DB], sd.Query, sd.Call == nil)
+		}
+	}
+	names := make([]string, 0, len(conf.Catalog))
+	for name := range conf.Catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cq := conf.Catalog[name]
+		check(fmt.Sprintf("catalog query=%q", name), dbs[cq.DB], cq.Query, true)
+	}
+	return errorOrNil(me)
+}
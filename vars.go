@@ -0,0 +1,65 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// exprVariables are the variables expressions may refer to, in the order
+// their values are passed to gojq:
+//
+//   - $context holds the request, params, and step results.
+//   - $vars holds the config's vars.
+//   - $item is the item a filter is applied to, or null elsewhere.
+var exprVariables = []string{"$context", "$vars", "$item"}
+
+// unknownVariablePrefix prefixes the errors gojq returns when compiling a
+// query that refers to an undefined variable.
+const unknownVariablePrefix = "variable not defined: "
+
+// unknownVariableError rewrites gojq's undefined variable errors to list the
+// variables expressions may use. Other errors are returned as-is.
+func unknownVariableError(err error) error {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, unknownVariablePrefix) {
+		return err
+	}
+	name := strings.TrimPrefix(msg, unknownVariablePrefix)
+	return fmt.Errorf("unknown variable %s (expressions may use %s)", name, strings.Join(exprVariables, ", "))
+}
+
+// bindVars binds the config's vars to $vars in each of its expressions.
+// Vars are normalized through JSON so that expressions see the same types
+// whether the config was written in JSON or YAML.
+func (c *Config) bindVars() error {
+	vars := map[string]interface{}{}
+	if len(c.Vars) > 0 {
+		data, err := json.Marshal(c.Vars)
+		if err != nil {
+			return fmt.Errorf("vars are not valid JSON: %w", err)
+		}
+		if err := json.Unmarshal(data, &vars); err != nil {
+			return fmt.Errorf("vars are not valid JSON: %w", err)
+		}
+	}
+	walkExprs(c, func(e *Expr) {
+		e.vars = vars
+	})
+	return nil
+}
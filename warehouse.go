@@ -0,0 +1,302 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// warehouseClient runs queries against a cloud data warehouse, such as
+// BigQuery or Athena, through its HTTP API. Warehouse queries run as jobs
+// that may take a while to finish, and their results are read a page at a
+// time.
+type warehouseClient interface {
+	// Query runs query with the positional args and waits for it to
+	// finish. If ctx ends first, the job is cancelled.
+	Query(ctx context.Context, query string, args []driver.NamedValue) (warehouseResult, error)
+}
+
+// warehouseResult is the result of a finished warehouse query.
+type warehouseResult interface {
+	Columns() []warehouseColumn
+	// NextPage returns the next page of rows, or io.EOF if there are no
+	// more rows.
+	NextPage(ctx context.Context) ([][]driver.Value, error)
+	RowsAffected() int64
+}
+
+// warehouseColumn is a column of a warehouse query's result. Type is
+// reported as the column's database type name, so that JSON and numeric
+// columns are handled as they are for other databases.
+type warehouseColumn struct {
+	Name string
+	Type string
+}
+
+// warehouseDriver is a database/sql driver for a warehouseClient. Its DSN is
+// the database URL, parsed by open.
+type warehouseDriver struct {
+	open func(u *url.URL) (warehouseClient, error)
+}
+
+func (d *warehouseDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+func (d *warehouseDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	client, err := d.open(u)
+	if err != nil {
+		return nil, err
+	}
+	return &warehouseConnector{driver: d, client: client}, nil
+}
+
+// warehouseConnector shares a single client, and its credentials, between
+// all connections of a pool.
+type warehouseConnector struct {
+	driver *warehouseDriver
+	client warehouseClient
+}
+
+func (c *warehouseConnector) Connect(context.Context) (driver.Conn, error) {
+	return &warehouseConn{client: c.client}, nil
+}
+
+func (c *warehouseConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// warehouseConn is a connection to a warehouse. Warehouses don't support
+// transactions, so transactions are accepted but statements take effect as
+// they run and rollbacks do nothing.
+type warehouseConn struct {
+	client warehouseClient
+}
+
+func (c *warehouseConn) Prepare(query string) (driver.Stmt, error) {
+	return &warehouseStmt{conn: c, query: query}, nil
+}
+
+func (c *warehouseConn) Close() error {
+	return nil
+}
+
+func (c *warehouseConn) Begin() (driver.Tx, error) {
+	return warehouseTx{}, nil
+}
+
+func (c *warehouseConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return warehouseTx{}, nil
+}
+
+func (c *warehouseConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.client.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &warehouseRows{ctx: ctx, res: res, cols: res.Columns()}, nil
+}
+
+func (c *warehouseConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.client.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.RowsAffected()), nil
+}
+
+type warehouseTx struct{}
+
+func (warehouseTx) Commit() error   { return nil }
+func (warehouseTx) Rollback() error { return nil }
+
+type warehouseStmt struct {
+	conn  *warehouseConn
+	query string
+}
+
+func (s *warehouseStmt) Close() error {
+	return nil
+}
+
+func (s *warehouseStmt) NumInput() int {
+	return -1
+}
+
+func (s *warehouseStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *warehouseStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *warehouseStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *warehouseStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// warehouseRows reads a warehouse result, fetching pages as they're needed.
+type warehouseRows struct {
+	ctx  context.Context
+	res  warehouseResult
+	cols []warehouseColumn
+	page [][]driver.Value
+	err  error
+}
+
+func (r *warehouseRows) Columns() []string {
+	names := make([]string, len(r.cols))
+	for i, c := range r.cols {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func (r *warehouseRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.cols[i].Type
+}
+
+func (r *warehouseRows) Close() error {
+	r.page, r.err = nil, io.EOF
+	return nil
+}
+
+func (r *warehouseRows) Next(dest []driver.Value) error {
+	for len(r.page) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+		r.page, r.err = r.res.NextPage(r.ctx)
+	}
+	copy(dest, r.page[0])
+	r.page = r.page[1:]
+	return nil
+}
+
+// warehouseMaxBytes parses the max_bytes option of a warehouse URL, which
+// limits the bytes a query may scan. Zero means no limit.
+func warehouseMaxBytes(q url.Values) (int64, error) {
+	s := q.Get("max_bytes")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max_bytes %q", s)
+	}
+	return n, nil
+}
+
+// warehouseDuration parses a duration option of a warehouse URL, returning
+// def if it's not set.
+func warehouseDuration(q url.Values, name string, def time.Duration) (time.Duration, error) {
+	s := q.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return d, nil
+}
+
+// warehouseCall sends a JSON request to a warehouse API and decodes its JSON
+// response into out. If sign isn't nil, it's called with the request and its
+// body before the request is sent. If the response isn't successful, its
+// body is passed to apiErr to produce an error.
+func warehouseCall(ctx context.Context, client *http.Client, method, uri string, body, out interface{},
+	sign func(req *http.Request, body []byte), apiErr func(status int, body []byte) error) error {
+	var p []byte
+	if body != nil {
+		var err error
+		if p, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("error encoding request: %w", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(p))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if sign != nil {
+		sign(req, p)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if p, err = io.ReadAll(resp.Body); err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiErr(resp.StatusCode, p)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(p, out); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
+
+// errMaxBytes is returned when a query would scan more than a warehouse's
+// max_bytes.
+var errMaxBytes = errors.New("query exceeds max_bytes")
+
+// cancelJob calls cancel with a short-lived context after the query's own
+// context has ended, so that abandoned jobs don't keep running (and
+// billing).
+func cancelJob(cancel func(ctx context.Context) error) {
+	ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+	_ = cancel(ctx)
+}
@@ -0,0 +1,174 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// watchDebounce is how long the config watcher waits after a change
+	// for further changes before reloading, so that editors saving several
+	// files, or writing a file in steps, cause a single reload.
+	watchDebounce = 250 * time.Millisecond
+	// watchResyncInterval is how often the config watcher updates the
+	// directories it watches to match the loaded config, such as after a
+	// reload adds an include.
+	watchResyncInterval = time.Second
+)
+
+// configWatcher watches the files the config of a server was read from,
+// for -watch.
+type configWatcher struct {
+	fsw     *fsnotify.Watcher
+	srv     *Server
+	watched map[string]bool // Directories being watched.
+}
+
+func newConfigWatcher(srv *Server) (*configWatcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating file watcher: %w", err)
+	}
+	return &configWatcher{fsw: fsw, srv: srv, watched: map[string]bool{}}, nil
+}
+
+// Run calls notify whenever a file the server's config was read from is
+// written, created, removed, or renamed. It returns when ctx is done.
+func (cw *configWatcher) Run(ctx context.Context, notify func()) error {
+	defer cw.fsw.Close()
+	log := zerolog.Ctx(ctx)
+
+	sources := cw.resync(*log)
+	ticker := time.NewTicker(watchResyncInterval)
+	defer ticker.Stop()
+	var debounce <-chan time.Time
+	var changed string
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			sources = cw.resync(*log)
+		case err := <-cw.fsw.Errors:
+			log.Warn().Err(err).Msg("Error watching config files.")
+		case ev := <-cw.fsw.Events:
+			if ev.Op == fsnotify.Chmod || !matchesConfigSource(sources, ev.Name) {
+				continue
+			}
+			changed = ev.Name
+			debounce = time.After(watchDebounce)
+		case <-debounce:
+			debounce = nil
+			log.Info().Str("path", changed).Msg("Config file changed, reloading.")
+			notify()
+		}
+	}
+}
+
+// resync watches the directories of the files and globs the server's
+// config was read from, and stops watching those it no longer uses. It
+// returns the files and globs.
+func (cw *configWatcher) resync(log zerolog.Logger) []string {
+	sources := configSources(cw.srv.Config())
+	dirs := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		dir := filepath.Dir(src)
+		if !hasGlobMeta(dir) {
+			dirs[dir] = true
+			continue
+		}
+		matches, _ := filepath.Glob(dir)
+		for _, m := range matches {
+			dirs[m] = true
+		}
+	}
+	for dir := range dirs {
+		if cw.watched[dir] {
+			continue
+		}
+		if err := cw.fsw.Add(dir); err != nil {
+			// The directory may not exist yet. It's retried on the next
+			// resync.
+			log.Debug().Err(err).Str("dir", dir).Msg("Failed to watch config directory.")
+			continue
+		}
+		cw.watched[dir] = true
+	}
+	for dir := range cw.watched {
+		if !dirs[dir] {
+			_ = cw.fsw.Remove(dir)
+			delete(cw.watched, dir)
+		}
+	}
+	return sources
+}
+
+// configSources returns the files and globs conf was read from: its config
+// files, includes, profile overlays, endpoint files, query files, and the
+// values file of config templates. Relative paths are made absolute so
+// that they match the paths of file events.
+func configSources(conf *Config) []string {
+	if conf == nil {
+		return nil
+	}
+	sources := append([]string(nil), conf.sources...)
+	for _, ed := range conf.Endpoints {
+		if ed == nil || ed.Query == nil {
+			continue
+		}
+		for _, sd := range ed.Query.Steps {
+			if sd != nil && sd.QueryFile != "" {
+				sources = append(sources, sd.QueryFile)
+			}
+		}
+	}
+	if configValuesPath != "" {
+		sources = append(sources, configValuesPath)
+	}
+	for i, src := range sources {
+		if abs, err := filepath.Abs(src); err == nil {
+			sources[i] = abs
+		}
+	}
+	return sources
+}
+
+// matchesConfigSource returns whether path is one of sources or matches one
+// of their globs.
+func matchesConfigSource(sources []string, path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, src := range sources {
+		if src == path {
+			return true
+		}
+		if hasGlobMeta(src) {
+			if ok, _ := filepath.Match(src, path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+// chisel - A tool to fetch, transform, and serve data.
+// Copyright 2021 Noel Cower
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// XlsxDef configures how an endpoint's response is encoded as an Excel
+// workbook. Responses are encoded as xlsx if Default is set or the request's
+// Accept header asks for xlsx.
+type XlsxDef struct {
+	Sheet string `json:"sheet,omitempty" yaml:"sheet,omitempty"` // Defaults to Sheet1.
+	// Columns gives the columns of the sheet in order. If empty, every
+	// field of every row is a column, sorted by name.
+	Columns  []string `json:"columns,omitempty" yaml:"columns,omitempty"`
+	Filename string   `json:"filename,omitempty" yaml:"filename,omitempty"` // Sent in Content-Disposition.
+	Default  bool     `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+func (xd *XlsxDef) Validate() error {
+	if xd.Sheet == "" {
+		xd.Sheet = "Sheet1"
+	}
+	if len(xd.Sheet) > 31 || strings.ContainsAny(xd.Sheet, "[]:*?/\\") || strings.HasPrefix(xd.Sheet, "'") {
+		return fmt.Errorf("invalid sheet name %q", xd.Sheet)
+	}
+	seen := map[string]bool{}
+	for _, c := range xd.Columns {
+		if seen[c] {
+			return fmt.Errorf("column %q is listed more than once", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// Encode encodes out as a workbook with a single sheet. The first row of the
+// sheet holds column headers.
+func (xd *XlsxDef) Encode(out interface{}) ([]byte, error) {
+	rows, err := tableRows(out)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := xd.Columns
+	if len(columns) == 0 {
+		columns = tableColumnNames(rows)
+	}
+
+	var sheet bytes.Buffer
+	sheet.WriteString(xml.Header)
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	sheet.WriteString(`<row r="1">`)
+	for i, c := range columns {
+		writeXlsxCell(&sheet, i, 1, c, 1)
+	}
+	sheet.WriteString(`</row>`)
+	for r, row := range rows {
+		fmt.Fprintf(&sheet, `<row r="%d">`, r+2)
+		for i, c := range columns {
+			writeXlsxCell(&sheet, i, r+2, row[c], 0)
+		}
+		sheet.WriteString(`</row>`)
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct {
+		name string
+		data string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, xmlEscape(xd.sheetName()))},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+		{"xl/worksheets/sheet1.xml", sheet.String()},
+	}
+	for _, part := range parts {
+		fw, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(fw, part.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (xd *XlsxDef) sheetName() string {
+	if xd.Sheet == "" {
+		return "Sheet1"
+	}
+	return xd.Sheet
+}
+
+// xlsxColumn returns the letters naming the zero-based column i.
+func xlsxColumn(i int) string {
+	var name []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = append([]byte{byte('A' + (i-1)%26)}, name...)
+	}
+	return string(name)
+}
+
+func xmlEscape(s string) string {
+	var sb strings.Builder
+	_ = xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+// writeXlsxCell writes a cell holding v. Numbers and booleans are written as
+// typed cells, and objects and lists as JSON text.
+func writeXlsxCell(w *bytes.Buffer, col, row int, v interface{}, style int) {
+	ref := xlsxColumn(col) + strconv.Itoa(row)
+	var typ, val string
+	switch v := v.(type) {
+	case nil:
+		return
+	case bool:
+		typ, val = "b", "0"
+		if v {
+			val = "1"
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			writeXlsxCell(w, col, row, strconv.FormatFloat(v, 'g', -1, 64), style)
+			return
+		}
+		typ, val = "n", strconv.FormatFloat(v, 'g', -1, 64)
+	case int64:
+		typ, val = "n", strconv.FormatInt(v, 10)
+	case int:
+		typ, val = "n", strconv.Itoa(v)
+	case *big.Int:
+		typ, val = "n", v.String()
+	case json.Number:
+		typ, val = "n", v.String()
+	case string:
+		fmt.Fprintf(w, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, xmlEscape(v))
+		return
+	default:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		writeXlsxCell(w, col, row, string(js), style)
+		return
+	}
+	fmt.Fprintf(w, `<c r="%s" s="%d" t="%s"><v>%s</v></c>`, ref, style, typ, val)
+}
+
+const xlsxContentTypes = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+	`</Types>`
+
+const xlsxRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxWorkbook = xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>` +
+	`</workbook>`
+
+const xlsxWorkbookRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`
+
+// xlsxStyles defines two cell styles: 0 is the default and 1 is bold, for
+// headers.
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+	`</styleSheet>`